@@ -0,0 +1,330 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"docker-app/internal/models"
+	"docker-app/internal/pubsub"
+	"docker-app/internal/worker"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxLeaseWait caps how long a lease request is held open
+const maxLeaseWait = 60 * time.Second
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(c *fiber.Ctx) string {
+	return strings.TrimSpace(strings.TrimPrefix(c.Get("Authorization"), "Bearer "))
+}
+
+// hashAgentToken returns the hex sha256 under which an agent token is stored
+func hashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RegisterAgent registers an agent presenting the agent token the server was
+// started with, and issues the token the agent uses from then on
+func (h *Handler) RegisterAgent(c *fiber.Ctx) error {
+	if h.AgentToken == "" {
+		return c.Status(403).JSON(fiber.Map{"error": "agents are disabled, start the server with --agent-token"})
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(h.AgentToken)) != 1 {
+		return c.Status(401).JSON(fiber.Map{"error": "invalid agent token"})
+	}
+	var req struct {
+		Name   string   `json:"name"`
+		Labels []string `json:"labels"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+	}
+	if err := models.ValidateLabels(req.Labels); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "labels: " + err.Error()})
+	}
+	labels, err := models.LabelsJSON(req.Labels)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	token := hex.EncodeToString(secret)
+	result, err := h.DB.Exec("INSERT INTO agents (name, token_hash, labels, last_seen_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)", req.Name, hashAgentToken(token), labels)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, _ := result.LastInsertId()
+	return c.Status(201).JSON(fiber.Map{"id": id, "name": req.Name, "labels": req.Labels, "token": token})
+}
+
+// AgentAuth authenticates agents by the token issued when they registered
+func (h *Handler) AgentAuth(c *fiber.Ctx) error {
+	token := bearerToken(c)
+	if token == "" {
+		return c.Status(401).JSON(fiber.Map{"error": "missing agent token"})
+	}
+	var agent models.Agent
+	err := h.DB.Get(&agent, "SELECT * FROM agents WHERE token_hash = ?", hashAgentToken(token))
+	if err == sql.ErrNoRows {
+		return c.Status(401).JSON(fiber.Map{"error": "invalid agent token"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	h.DB.Exec("UPDATE agents SET last_seen_at = CURRENT_TIMESTAMP WHERE id = ?", agent.ID)
+	c.Locals("agent", agent)
+	return c.Next()
+}
+
+// GetAgents lists the registered agents
+func (h *Handler) GetAgents(c *fiber.Ctx) error {
+	agents := []models.Agent{}
+	err := h.DB.Select(&agents, "SELECT * FROM agents ORDER BY id")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(agents)
+}
+
+// LeaseAgentJob hands the oldest pending job the agent has the labels for to
+// it, waiting up to ?wait= seconds for one. It responds 204 when none came up.
+func (h *Handler) LeaseAgentJob(c *fiber.Ctx) error {
+	agent := c.Locals("agent").(models.Agent)
+	wait := 30 * time.Second
+	if s := c.Query("wait"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid wait"})
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait > maxLeaseWait {
+		wait = maxLeaseWait
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		lease, err := h.Worker.LeaseJob(agent)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if lease != nil {
+			return c.JSON(lease)
+		}
+		if !time.Now().Before(deadline) {
+			return c.SendStatus(204)
+		}
+		select {
+		case <-c.Context().Done():
+			return nil
+		case <-time.After(h.Worker.Config.PollInterval):
+		}
+	}
+}
+
+// AgentHeartbeat renews the agent's lease on a job and tells it whether the
+// job was cancelled
+func (h *Handler) AgentHeartbeat(c *fiber.Ctx) error {
+	agent := c.Locals("agent").(models.Agent)
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	cancelled, err := h.Worker.RenewLease(agent.ID, id)
+	if errors.Is(err, worker.ErrLeaseLost) {
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"cancelled": cancelled})
+}
+
+// agentStep returns a step of a running job leased to the agent
+func (h *Handler) agentStep(c *fiber.Ctx) (models.Step, int, error) {
+	agent := c.Locals("agent").(models.Agent)
+	var step models.Step
+	jobID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return step, 400, errors.New("invalid id")
+	}
+	stepID, err := strconv.Atoi(c.Params("step_id"))
+	if err != nil {
+		return step, 400, errors.New("invalid step id")
+	}
+	err = h.DB.Get(&step, "SELECT * FROM steps WHERE id = ? AND job_id = ?", stepID, jobID)
+	if err == sql.ErrNoRows {
+		return step, 404, errors.New("step not found")
+	}
+	if err != nil {
+		return step, 500, err
+	}
+	var held int
+	err = h.DB.Get(&held, "SELECT COUNT(*) FROM jobs WHERE id = ? AND agent_id = ? AND status = 'running'", jobID, agent.ID)
+	if err != nil {
+		return step, 500, err
+	}
+	if held == 0 {
+		return step, 409, worker.ErrLeaseLost
+	}
+	return step, 0, nil
+}
+
+// AgentStepOutput stores the lines an agent read from a step and appends
+// them to its output, with the job's secrets masked. A plain text body, as
+// older agents send, is stdout.
+func (h *Handler) AgentStepOutput(c *fiber.Ctx) error {
+	step, status, err := h.agentStep(c)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+	}
+	var batch models.AgentLogLines
+	now := time.Now().UTC()
+	if c.Is("json") {
+		if err := c.BodyParser(&batch); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	} else if body := strings.TrimSuffix(string(c.Body()), "\n"); body != "" {
+		for _, line := range strings.Split(body, "\n") {
+			batch.Lines = append(batch.Lines, models.LogLine{Attempt: step.Attempts, Stream: models.LogStreamStdout, Line: line})
+		}
+	}
+
+	masker, err := h.Worker.JobMasker(step.JobID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	var output strings.Builder
+	for i, line := range batch.Lines {
+		switch line.Stream {
+		case models.LogStreamStdout, models.LogStreamStderr, models.LogStreamSystem:
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "invalid stream"})
+		}
+		if line.Attempt < 1 {
+			batch.Lines[i].Attempt = 1
+		}
+		if line.Timestamp.IsZero() {
+			batch.Lines[i].Timestamp = now
+		}
+		batch.Lines[i].Line = masker.Mask(line.Line)
+		output.WriteString(batch.Lines[i].Line + "\n")
+	}
+	if err := worker.AppendLogLines(h.DB, step.JobID, step.ID, batch.Lines); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	for _, line := range batch.Lines {
+		h.Worker.Events.Publish(step.JobID, pubsub.TypeLine, line)
+	}
+	_, err = h.DB.Exec("UPDATE steps SET output = COALESCE(output, '') || ? WHERE id = ?", output.String(), step.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.SendStatus(204)
+}
+
+// AgentUpdateStep records the status of a step run by the agent
+func (h *Handler) AgentUpdateStep(c *fiber.Ctx) error {
+	step, status, err := h.agentStep(c)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+	}
+	var update models.AgentStepUpdate
+	if err := c.BodyParser(&update); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	switch update.Status {
+	case "running", "success", "failed", "timed_out", "skipped", "cancelled":
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "invalid status"})
+	}
+	var outputs *string
+	if len(update.Outputs) > 0 {
+		data, err := json.Marshal(update.Outputs)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		encoded := string(data)
+		outputs = &encoded
+	}
+	_, err = h.DB.Exec("UPDATE steps SET status = ?, status_reason = ?, attempts = MAX(attempts, ?), outputs = COALESCE(?, outputs) WHERE id = ?",
+		update.Status, update.StatusReason, update.Attempts, outputs, step.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	h.Worker.PublishStep(step.ID)
+	return c.SendStatus(204)
+}
+
+// AgentFinishJob records the result of a job and ends the agent's lease
+func (h *Handler) AgentFinishJob(c *fiber.Ctx) error {
+	agent := c.Locals("agent").(models.Agent)
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var result models.AgentJobResult
+	if err := c.BodyParser(&result); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	switch result.Status {
+	case "success", "failed", "cancelled", "interrupted":
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "invalid status"})
+	}
+
+	var job models.Job
+	err = h.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "job not found"})
+	}
+	if job.AgentID == nil || *job.AgentID != agent.ID || (job.Status != "running" && !job.Cancelled) {
+		return c.Status(409).JSON(fiber.Map{"error": worker.ErrLeaseLost.Error()})
+	}
+	if job.Cancelled {
+		// Cancelling the job already recorded its status
+		h.DB.Exec("UPDATE jobs SET lease_expires_at = NULL WHERE id = ?", id)
+		return c.JSON(fiber.Map{"message": "job cancelled"})
+	}
+
+	_, err = h.DB.Exec("UPDATE jobs SET status = ?, status_reason = ?, lease_expires_at = NULL, finished_at = CURRENT_TIMESTAMP WHERE id = ?",
+		result.Status, result.StatusReason, id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	stepStatus := result.StepStatus
+	if stepStatus == "" && result.Status != "success" {
+		stepStatus = "failed"
+	}
+	if stepStatus != "" {
+		h.DB.Exec("UPDATE steps SET status = ? WHERE job_id = ? AND status = 'running'", stepStatus, id)
+	}
+	if result.Status == "cancelled" || result.Status == "interrupted" {
+		h.DB.Exec("UPDATE steps SET status = ? WHERE job_id = ? AND status = 'pending'", result.Status, id)
+	} else if result.Status == "failed" {
+		reason := "the job failed"
+		if result.StatusReason != nil {
+			reason = *result.StatusReason
+		}
+		h.Worker.SkipPendingSteps(id, reason)
+	}
+	h.Worker.PublishSteps(id)
+	h.Worker.PublishJob(id)
+	return c.JSON(fiber.Map{"message": "job finished"})
+}
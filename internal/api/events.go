@@ -0,0 +1,273 @@
+package api
+
+import (
+	"bufio"
+	"docker-app/internal/models"
+	"docker-app/internal/pubsub"
+	"docker-app/internal/websocket"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+)
+
+// eventKeepalive is how often an idle event stream shows the client it is
+// still there
+const eventKeepalive = 15 * time.Second
+
+// eventReset tells a client that gave an event id the broker doesn't know,
+// from before a restart or too old to be kept, to drop what it has: the job
+// is sent again from the start
+const eventReset = "reset"
+
+// eventMessage is an event sent over a WebSocket
+type eventMessage struct {
+	ID   string      `json:"id,omitempty"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// StreamJobEvents pushes the lines and the status changes of a job as
+// Server-Sent Events until it finishes. Clients resume after the event in the
+// Last-Event-ID header or ?last_event_id=, which EventSource sends on its own
+// when it reconnects.
+func (h *Handler) StreamJobEvents(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var job models.Job
+	err = h.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "job not found"})
+	}
+	if h.Worker == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "worker not available"})
+	}
+	// The request is reused once the handler returned, keep a copy
+	lastEventID := strings.Clone(c.Get("Last-Event-ID", c.Query("last_event_id")))
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	// The writer runs once the handler returned, it may not use c
+	db, broker := h.DB, h.Worker.Events
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		send := func(event pubsub.Event) error {
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				return err
+			}
+			if event.ID != "" {
+				fmt.Fprintf(w, "id: %s\n", event.ID)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			return w.Flush()
+		}
+		keepalive := func() error {
+			w.WriteString(": keepalive\n\n")
+			return w.Flush()
+		}
+		// Flushing fails once the client went away, which ends the stream
+		followJob(db, broker, id, lastEventID, nil, send, keepalive)
+	})
+	return nil
+}
+
+// JobEventsSocket pushes the same events as StreamJobEvents over a WebSocket,
+// each message a JSON object with the id, type and data of an event. Clients
+// resume after the event of ?last_event_id=. Browsers may only connect from
+// the server's own pages or those of h.AllowedOrigins.
+func (h *Handler) JobEventsSocket(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var job models.Job
+	err = h.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "job not found"})
+	}
+	if h.Worker == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "worker not available"})
+	}
+	lastEventID := strings.Clone(c.Query("last_event_id"))
+
+	db, broker := h.DB, h.Worker.Events
+	return websocket.Upgrade(c, h.AllowedOrigins, func(conn *websocket.Conn) {
+		send := func(event pubsub.Event) error {
+			data, err := json.Marshal(eventMessage{ID: event.ID, Type: event.Type, Data: event.Data})
+			if err != nil {
+				return err
+			}
+			return conn.WriteText(data)
+		}
+		err := followJob(db, broker, id, lastEventID, conn.Done(), send, conn.Ping)
+		if err != nil && !errors.Is(err, websocket.ErrClosed) {
+			conn.Close(websocket.CloseInternalError, err.Error())
+		}
+	})
+}
+
+// followJob sends the events of a job to a client until the job finishes,
+// done is closed or sending fails. A client that resumes from lastEventID
+// gets the events it missed. Any other client gets the lines and statuses
+// stored so far, after a reset when it gave an id, then the events that
+// follow. keepalive is called while no event comes.
+func followJob(db *sqlx.DB, broker *pubsub.Broker, jobID int, lastEventID string, done <-chan struct{}, send func(pubsub.Event) error, keepalive func() error) error {
+	sub, backlog, resumed := broker.Subscribe(jobID, lastEventID)
+	defer sub.Close()
+
+	// Lines read from the database may be in the backlog or published again
+	// before the client sees them, only the first of each is sent
+	sent := make(map[int]int)
+	emit := func(event pubsub.Event) error {
+		if line, ok := event.Data.(models.LogLine); ok {
+			if line.Seq <= sent[line.StepID] {
+				return nil
+			}
+			sent[line.StepID] = line.Seq
+		}
+		return send(event)
+	}
+
+	if resumed {
+		for _, event := range backlog {
+			if err := emit(event); err != nil {
+				return err
+			}
+		}
+		// The job may have finished before its last status was published
+		if finished, err := sendFinishedJob(db, jobID, send); finished || err != nil {
+			return err
+		}
+	} else {
+		if lastEventID != "" {
+			if err := send(pubsub.Event{Type: eventReset, JobID: jobID, Data: fiber.Map{"job_id": jobID}}); err != nil {
+				return err
+			}
+		}
+		status, err := sendJobSnapshot(db, jobID, emit)
+		if err != nil {
+			return err
+		}
+		// The statuses read from the database are newer than those of the
+		// backlog, only the lines not stored yet are missing
+		for _, event := range backlog {
+			if event.Type != pubsub.TypeLine {
+				continue
+			}
+			if err := emit(event); err != nil {
+				return err
+			}
+		}
+		if !jobActive(status) {
+			return nil
+		}
+	}
+
+	ticker := time.NewTicker(eventKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Dropped for falling behind or the job started over, the
+				// client resumes when it reconnects
+				return nil
+			}
+			if err := emit(event); err != nil {
+				return err
+			}
+			if status, ok := event.Data.(pubsub.JobStatus); ok && !jobActive(status.Status) {
+				return nil
+			}
+		case <-ticker.C:
+			if err := keepalive(); err != nil {
+				return err
+			}
+			if finished, err := sendFinishedJob(db, jobID, send); finished || err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// sendJobSnapshot sends the lines of a job stored so far, then the statuses
+// of its steps and its own, and returns the status of the job. Lines are
+// stored before the statuses change, so a finished job has all of them sent.
+func sendJobSnapshot(db *sqlx.DB, jobID int, send func(pubsub.Event) error) (string, error) {
+	after := 0
+	for {
+		var lines []models.LogLine
+		err := db.Select(&lines, "SELECT * FROM log_lines WHERE job_id = ? AND id > ? ORDER BY id LIMIT ?", jobID, after, defaultLogLimit)
+		if err != nil {
+			return "", err
+		}
+		for _, line := range lines {
+			if err := send(pubsub.Event{Type: pubsub.TypeLine, JobID: jobID, Data: line}); err != nil {
+				return "", err
+			}
+			after = line.ID
+		}
+		if len(lines) < defaultLogLimit {
+			break
+		}
+	}
+
+	var steps []models.Step
+	err := db.Select(&steps, "SELECT * FROM steps WHERE job_id = ? ORDER BY order_num", jobID)
+	if err != nil {
+		return "", err
+	}
+	for _, step := range steps {
+		status := pubsub.StepStatus{
+			JobID:        step.JobID,
+			StepID:       step.ID,
+			OrderNum:     step.OrderNum,
+			Status:       step.Status,
+			StatusReason: step.StatusReason,
+		}
+		if err := send(pubsub.Event{Type: pubsub.TypeStep, JobID: jobID, Data: status}); err != nil {
+			return "", err
+		}
+	}
+
+	var job models.Job
+	if err := db.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID); err != nil {
+		return "", err
+	}
+	return job.Status, send(jobEvent(job))
+}
+
+// sendFinishedJob sends the status of a job read from the database once it
+// finished, and reports whether it did
+func sendFinishedJob(db *sqlx.DB, jobID int, send func(pubsub.Event) error) (bool, error) {
+	var job models.Job
+	if err := db.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID); err != nil {
+		return false, err
+	}
+	if jobActive(job.Status) {
+		return false, nil
+	}
+	return true, send(jobEvent(job))
+}
+
+func jobEvent(job models.Job) pubsub.Event {
+	return pubsub.Event{
+		Type:  pubsub.TypeJob,
+		JobID: job.ID,
+		Data:  pubsub.JobStatus{JobID: job.ID, Status: job.Status, StatusReason: job.StatusReason},
+	}
+}
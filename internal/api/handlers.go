@@ -1,14 +1,15 @@
 package api
 
 import (
+	"bufio"
 	"docker-app/internal/models"
+	"docker-app/internal/secrets"
 	"docker-app/internal/worker"
 	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jmoiron/sqlx"
@@ -85,6 +86,17 @@ func unmarshalConfig(configStr string, config *models.PipelineConfig) error {
 type Handler struct {
 	DB     *sqlx.DB
 	Worker *worker.Worker
+	// AgentToken is the token agents register with; agents can't register
+	// when it is empty
+	AgentToken string
+	// Secrets encrypts the values of stored secrets
+	Secrets *secrets.Cipher
+	// AllowedOrigins are the pages other than the server's own that may open
+	// WebSockets, as scheme://host[:port]
+	AllowedOrigins []string
+	// AllowPrivateSubscriptions lets subscriptions point at loopback,
+	// link-local and private addresses
+	AllowPrivateSubscriptions bool
 }
 
 func NewHandler(db *sqlx.DB, w *worker.Worker) *Handler {
@@ -96,21 +108,29 @@ func (h *Handler) CreatePipeline(c *fiber.Ctx) error {
 	if err := c.BodyParser(&config); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
+	if err := config.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid config: " + err.Error()})
+	}
 	// Convert config to YAML
 	configYAML, err := yaml.Marshal(config)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "failed to marshal config"})
 	}
-	query := `INSERT INTO pipelines (name, config) VALUES (?, ?)`
-	result, err := h.DB.Exec(query, config.Name, string(configYAML))
+	retention, err := config.RetentionJSON()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	query := `INSERT INTO pipelines (name, config, retention) VALUES (?, ?, ?)`
+	result, err := h.DB.Exec(query, config.Name, string(configYAML), retention)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	id, _ := result.LastInsertId()
 	pipeline := models.Pipeline{
-		ID:     int(id),
-		Name:   config.Name,
-		Config: string(configYAML),
+		ID:        int(id),
+		Name:      config.Name,
+		Config:    string(configYAML),
+		Retention: retention,
 	}
 	return c.Status(201).JSON(pipeline)
 }
@@ -130,6 +150,7 @@ func (h *Handler) GetPipelines(c *fiber.Ctx) error {
 			log.Printf("Failed to unmarshal config for pipeline %d: %v", pipeline.ID, err)
 			continue
 		}
+		config.RedactCredentials()
 		configBytes, err := json.Marshal(config)
 		if err != nil {
 			log.Printf("Failed to marshal config to JSON for pipeline %d: %v", pipeline.ID, err)
@@ -160,6 +181,7 @@ func (h *Handler) GetPipeline(c *fiber.Ctx) error {
 			"config_format_error": err.Error(),
 		})
 	}
+	config.RedactCredentials()
 	configBytes, err := json.Marshal(config)
 	if err != nil {
 		log.Printf("Failed to marshal config to JSON for pipeline %d: %v", pipeline.ID, err)
@@ -174,6 +196,20 @@ func (h *Handler) GetPipeline(c *fiber.Ctx) error {
 	return c.JSON(pipeline)
 }
 
+// redactPipelineConfig masks the credentials of a stored pipeline config that
+// don't refer to a secret, keeping its format
+func redactPipelineConfig(configStr string) string {
+	var config models.PipelineConfig
+	if err := unmarshalConfig(configStr, &config); err != nil || !config.RedactCredentials() {
+		return configStr
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return configStr
+	}
+	return string(data)
+}
+
 func (h *Handler) GetPipelineJobs(c *fiber.Ctx) error {
 	pipelineID := c.Params("id")
 	var jobs []models.Job
@@ -210,94 +246,88 @@ func (h *Handler) CreateJob(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "invalid config: " + err.Error()})
 	}
-	// Create job
-	job := models.Job{
-		PipelineID: pipelineID,
-		Status:     "pending",
-	}
-	if config.Branch != "" {
-		job.Branch = &config.Branch
-	}
-	if config.RepoName != "" {
-		job.RepoName = &config.RepoName
+	// Secrets can be added after the pipeline, the ones it refers to have to
+	// exist by the time it runs
+	secretNames, err := SecretNames(h.DB, pipelineID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
-	if config.Language != "" {
-		job.Language = &config.Language
+	if err := config.ValidateSecrets(secretNames); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid config: " + err.Error()})
 	}
-	if config.Version != "" {
-		job.Version = &config.Version
+	// Optional trigger information for step conditions
+	var req struct {
+		Trigger string `json:"trigger"`
+		Tag     string `json:"tag"`
 	}
-	if config.Folder != "" {
-		job.Folder = &config.Folder
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid body: " + err.Error()})
+		}
 	}
-	if config.ExposePorts {
-		job.ExposePorts = &config.ExposePorts
+	if req.Trigger == "" {
+		req.Trigger = models.TriggerAPI
 	}
-	query := `INSERT INTO jobs (pipeline_id, status, branch, repo_name, language, version, folder, expose_ports) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	result, err := h.DB.Exec(query, job.PipelineID, job.Status, job.Branch, job.RepoName, job.Language, job.Version, job.Folder, job.ExposePorts)
+
+	run, jobs, err := CreateJobs(h.DB, pipelineID, config, req.Trigger, req.Tag)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
-	id, _ := result.LastInsertId()
-	job.ID = int(id)
-	// Create steps
-	for i, step := range config.Steps {
-		result, err := h.DB.Exec(`INSERT INTO steps (job_id, order_num, type, content, status) VALUES (?, ?, ?, ?, ?)`, job.ID, i+1, step.Type, step.Content, "pending")
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-		}
-		stepID, _ := result.LastInsertId()
-		// Insert files
-		for name, content := range step.Files {
-			_, err = h.DB.Exec(`INSERT INTO files (step_id, name, content) VALUES (?, ?, ?)`, stepID, name, content)
-			if err != nil {
-				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-			}
+	if h.Worker != nil {
+		for _, job := range jobs {
+			h.Worker.PublishJob(job.ID)
 		}
 	}
-	// For env
-	for k, v := range config.Env {
-		_, err = h.DB.Exec(`INSERT INTO environments (job_id, key, value) VALUES (?, ?, ?)`, job.ID, k, v)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-		}
+	if run == nil {
+		return c.Status(201).JSON(jobs[0])
 	}
+	summary, err := matrixRunSummary(h.DB, *run)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(summary)
+}
 
-	// Create runnables
-	for _, runnable := range config.Runnables {
-		if !runnable.Enabled {
-			continue // Skip disabled runnables
-		}
-
-		configJSON, err := json.Marshal(runnable)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-		}
+// GetMatrixRun returns a matrix run with its child jobs and their combined status
+func (h *Handler) GetMatrixRun(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var run models.MatrixRun
+	err = h.DB.Get(&run, "SELECT * FROM matrix_runs WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "matrix run not found"})
+	}
+	summary, err := matrixRunSummary(h.DB, run)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(summary)
+}
 
-		result, err := h.DB.Exec(`INSERT INTO runnables (job_id, name, type, config, status) VALUES (?, ?, ?, ?, ?)`,
-			job.ID, runnable.Name, runnable.Type, string(configJSON), "pending")
+// GetPipelineMatrixRuns returns the matrix runs of a pipeline, newest first
+func (h *Handler) GetPipelineMatrixRuns(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var runs []models.MatrixRun
+	err = h.DB.Select(&runs, "SELECT * FROM matrix_runs WHERE pipeline_id = ? ORDER BY id DESC", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	summaries := make([]models.MatrixRunWithJobs, 0, len(runs))
+	for _, run := range runs {
+		summary, err := matrixRunSummary(h.DB, run)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
-
-		runnableID, _ := result.LastInsertId()
-
-		// Create deployments for this runnable
-		for _, output := range runnable.Outputs {
-			outputConfigJSON, err := json.Marshal(output.Config)
-			if err != nil {
-				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-			}
-
-			_, err = h.DB.Exec(`INSERT INTO deployments (runnable_id, output_type, config, status) VALUES (?, ?, ?, ?)`,
-				runnableID, output.Type, string(outputConfigJSON), "pending")
-			if err != nil {
-				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-			}
-		}
+		summaries = append(summaries, summary)
 	}
-
-	return c.Status(201).JSON(job)
+	return c.JSON(summaries)
 }
 
 func (h *Handler) GetJob(c *fiber.Ctx) error {
@@ -342,6 +372,196 @@ func (h *Handler) GetStep(c *fiber.Ctx) error {
 	return c.JSON(step)
 }
 
+// GetStepAttempts returns every attempt of a step with its own output and exit code
+func (h *Handler) GetStepAttempts(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var count int
+	err = h.DB.Get(&count, "SELECT COUNT(*) FROM steps WHERE id = ?", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if count == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "step not found"})
+	}
+	attempts := []models.StepAttempt{}
+	err = h.DB.Select(&attempts, "SELECT * FROM step_attempts WHERE step_id = ? ORDER BY attempt", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(attempts)
+}
+
+// GetJobCaches returns whether each cache of a job was restored and saved
+func (h *Handler) GetJobCaches(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	caches := []models.JobCache{}
+	err = h.DB.Select(&caches, "SELECT * FROM job_caches WHERE job_id = ? ORDER BY id", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(caches)
+}
+
+// GetPipelineCaches returns the saved caches of a pipeline, most recently used first
+func (h *Handler) GetPipelineCaches(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	caches := []models.Cache{}
+	err = h.DB.Select(&caches, "SELECT * FROM caches WHERE pipeline_id = ? ORDER BY last_used_at DESC", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(caches)
+}
+
+// DeleteCache removes a saved cache, so the next job saves it again
+func (h *Handler) DeleteCache(c *fiber.Ctx) error {
+	if h.Worker == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "worker not available"})
+	}
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var count int
+	err = h.DB.Get(&count, "SELECT COUNT(*) FROM caches WHERE id = ?", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if count == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "cache not found"})
+	}
+	if err := h.Worker.DeleteCache(id); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "cache deleted"})
+}
+
+// GetJobArtifacts returns the artifacts built by a job
+func (h *Handler) GetJobArtifacts(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	artifacts := []models.Artifact{}
+	err = h.DB.Select(&artifacts, "SELECT * FROM artifacts WHERE job_id = ? ORDER BY id", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(artifacts)
+}
+
+// DownloadArtifact streams an artifact from the artifact store
+func (h *Handler) DownloadArtifact(c *fiber.Ctx) error {
+	if h.Worker == nil || h.Worker.Artifacts == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "worker not available"})
+	}
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var artifact models.Artifact
+	err = h.DB.Get(&artifact, "SELECT * FROM artifacts WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "artifact not found"})
+	}
+	if artifact.Store != h.Worker.Artifacts.GetType() {
+		return c.Status(410).JSON(fiber.Map{"error": "artifact is kept in the " + artifact.Store + " store, which is not in use"})
+	}
+	content, err := h.Worker.Artifacts.Open(c.Context(), artifact.Digest)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	c.Set("Content-Type", "application/octet-stream")
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", artifact.Name))
+	c.Set("ETag", fmt.Sprintf("%q", artifact.Digest))
+	return c.SendStream(content, int(artifact.Size))
+}
+
+// registryCredentialRequest is the body of CreateRegistryCredential
+type registryCredentialRequest struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CreateRegistryCredential stores the login the registry provider uses for a
+// registry host, replacing the one stored before. The password is encrypted
+// with the master key.
+func (h *Handler) CreateRegistryCredential(c *fiber.Ctx) error {
+	if h.Secrets == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "registry credentials are disabled, the server has no master key"})
+	}
+	var req registryCredentialRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	req.Registry = strings.TrimSpace(req.Registry)
+	if req.Registry == "" || req.Username == "" || req.Password == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "registry, username and password are required"})
+	}
+	if strings.Contains(req.Registry, "/") {
+		return c.Status(400).JSON(fiber.Map{"error": "registry must be a host such as ghcr.io or localhost:5000"})
+	}
+	password, err := h.Secrets.Encrypt(req.Registry, req.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	_, err = h.DB.Exec(`INSERT INTO registry_credentials (registry, username, password) VALUES (?, ?, ?)
+		ON CONFLICT(registry) DO UPDATE SET username = excluded.username, password = excluded.password`,
+		req.Registry, req.Username, password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	var credential models.RegistryCredential
+	err = h.DB.Get(&credential, "SELECT * FROM registry_credentials WHERE registry = ?", req.Registry)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(credential)
+}
+
+// GetRegistryCredentials lists the stored registry logins without passwords
+func (h *Handler) GetRegistryCredentials(c *fiber.Ctx) error {
+	credentials := []models.RegistryCredential{}
+	err := h.DB.Select(&credentials, "SELECT * FROM registry_credentials ORDER BY registry")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(credentials)
+}
+
+// DeleteRegistryCredential removes a stored registry login
+func (h *Handler) DeleteRegistryCredential(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	result, err := h.DB.Exec("DELETE FROM registry_credentials WHERE id = ?", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "registry credential not found"})
+	}
+	return c.JSON(fiber.Map{"message": "registry credential deleted"})
+}
+
 // GetJobDetails returns detailed job information with all related data
 func (h *Handler) GetJobDetails(c *fiber.Ctx) error {
 	idStr := c.Params("id")
@@ -408,6 +628,14 @@ func (h *Handler) GetJobDetails(c *fiber.Ctx) error {
 		}
 	}
 
+	pipeline.Config = redactPipelineConfig(pipeline.Config)
+	for i := range runnables {
+		runnables[i].Config = models.RedactCredentialsJSON(runnables[i].Config)
+	}
+	for i := range deployments {
+		deployments[i].Config = models.RedactCredentialsJSON(deployments[i].Config)
+	}
+
 	details := models.JobWithDetails{
 		Job:          job,
 		Pipeline:     pipeline,
@@ -436,7 +664,7 @@ func (h *Handler) CancelJob(c *fiber.Ctx) error {
 	}
 
 	// Check if job is in a cancellable state
-	if job.Status != "running" && job.Status != "pending" {
+	if job.Status != "running" && job.Status != "pending" && job.Status != "waiting" && job.Status != "queued" {
 		return c.Status(400).JSON(fiber.Map{"error": "job cannot be cancelled", "status": job.Status})
 	}
 
@@ -447,7 +675,7 @@ func (h *Handler) CancelJob(c *fiber.Ctx) error {
 	}
 
 	// Try to cancel the running job if it's currently running
-	if job.Status == "running" && h.Worker != nil {
+	if (job.Status == "running" || job.Status == "queued") && h.Worker != nil {
 		err = h.Worker.CancelJob(id)
 		if err != nil {
 			// Job might not be running anymore, which is fine
@@ -466,6 +694,10 @@ func (h *Handler) CancelJob(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
+	if h.Worker != nil {
+		h.Worker.PublishSteps(id)
+		h.Worker.PublishJob(id)
+	}
 
 	return c.JSON(fiber.Map{"message": "job cancelled successfully"})
 }
@@ -486,13 +718,13 @@ func (h *Handler) RetryJob(c *fiber.Ctx) error {
 	}
 
 	// Only allow retrying completed jobs
-	if originalJob.Status == "running" || originalJob.Status == "pending" {
+	if originalJob.Status == "running" || originalJob.Status == "pending" || originalJob.Status == "waiting" || originalJob.Status == "queued" {
 		return c.Status(400).JSON(fiber.Map{"error": "cannot retry running or pending job"})
 	}
 
 	// Create new job with same parameters
-	query := `INSERT INTO jobs (pipeline_id, status, branch, repo_name, language, version, folder, expose_ports) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	result, err := h.DB.Exec(query, originalJob.PipelineID, "pending", originalJob.Branch, originalJob.RepoName, originalJob.Language, originalJob.Version, originalJob.Folder, originalJob.ExposePorts)
+	query := `INSERT INTO jobs (pipeline_id, status, branch, repo_name, language, version, folder, expose_ports, restart_policy, resources, timeout, max_parallel, trigger, tag, matrix_run_id, matrix_values, services, network, cache, executor, runs_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := h.DB.Exec(query, originalJob.PipelineID, "pending", originalJob.Branch, originalJob.RepoName, originalJob.Language, originalJob.Version, originalJob.Folder, originalJob.ExposePorts, originalJob.RestartPolicy, originalJob.Resources, originalJob.Timeout, originalJob.MaxParallel, models.TriggerRetry, originalJob.Tag, originalJob.MatrixRunID, originalJob.MatrixValues, originalJob.Services, originalJob.Network, originalJob.Cache, originalJob.Executor, originalJob.RunsOn)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -507,7 +739,7 @@ func (h *Handler) RetryJob(c *fiber.Ctx) error {
 	}
 
 	for _, step := range originalSteps {
-		result, err := h.DB.Exec(`INSERT INTO steps (job_id, order_num, type, content, status) VALUES (?, ?, ?, ?, ?)`, newJobID, step.OrderNum, step.Type, step.Content, "pending")
+		result, err := h.DB.Exec(`INSERT INTO steps (job_id, order_num, type, content, status, config, step_key, depends_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, newJobID, step.OrderNum, step.Type, step.Content, "pending", step.Config, step.StepKey, step.DependsOn)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -522,7 +754,7 @@ func (h *Handler) RetryJob(c *fiber.Ctx) error {
 		}
 
 		for _, file := range files {
-			_, err = h.DB.Exec(`INSERT INTO files (step_id, name, content) VALUES (?, ?, ?)`, newStepID, file.Name, file.Content)
+			_, err = h.DB.Exec(`INSERT INTO files (step_id, name, content, encoding, mode, owner) VALUES (?, ?, ?, ?, ?, ?)`, newStepID, file.Name, file.Content, file.Encoding, file.Mode, file.Owner)
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 			}
@@ -549,6 +781,9 @@ func (h *Handler) RetryJob(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
+	if h.Worker != nil {
+		h.Worker.PublishJob(newJob.ID)
+	}
 
 	return c.Status(201).JSON(newJob)
 }
@@ -624,7 +859,10 @@ func (h *Handler) GetStepLogs(c *fiber.Ctx) error {
 	})
 }
 
-// StreamJobLogs streams the logs for a job (useful for real-time monitoring)
+// StreamJobLogs streams the lines of a job as plain text. With ?follow=true
+// the connection stays open and lines are sent as they are stored until the
+// job finishes. ?after= resumes after the line with that id and ?since= skips
+// the steps up to that step id.
 func (h *Handler) StreamJobLogs(c *fiber.Ctx) error {
 	idStr := c.Params("id")
 	id, err := strconv.Atoi(idStr)
@@ -639,91 +877,38 @@ func (h *Handler) StreamJobLogs(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "job not found"})
 	}
 
+	// Get query parameters
+	follow := c.Query("follow", "false") == "true"
+	since, _ := strconv.Atoi(c.Query("since"))
+	after := 0
+	if afterStr := c.Query("after"); afterStr != "" {
+		if after, err = strconv.Atoi(afterStr); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid after"})
+		}
+	}
+
 	// Set headers for streaming
 	c.Set("Content-Type", "text/plain")
 	c.Set("Cache-Control", "no-cache")
 	c.Set("Connection", "keep-alive")
 	c.Set("Access-Control-Allow-Origin", "*")
 
-	// Get query parameters
-	follow := c.Query("follow", "false") == "true"
-	sinceStr := c.Query("since")
-	var since *int
-	if sinceStr != "" {
-		if sinceInt, err := strconv.Atoi(sinceStr); err == nil {
-			since = &sinceInt
-		}
-	}
-
-	// Build query based on parameters
-	query := "SELECT * FROM steps WHERE job_id = ?"
-	args := []interface{}{id}
+	// The writer runs once the handler returned, it may not use c
+	db := h.DB
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		streamJobLines(db, id, since, after, follow, w)
+	})
+	return nil
+}
 
-	if since != nil {
-		query += " AND id > ?"
-		args = append(args, *since)
+// GetWorkerStatus returns the utilisation of the worker pool
+func (h *Handler) GetWorkerStatus(c *fiber.Ctx) error {
+	if h.Worker == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "worker not available"})
 	}
-
-	query += " ORDER BY order_num, id"
-
-	// Get initial logs
-	var steps []models.Step
-	err = h.DB.Select(&steps, query, args...)
+	status, err := h.Worker.PoolStatus()
 	if err != nil {
-		return c.Status(500).SendString("Error retrieving logs: " + err.Error())
-	}
-
-	// Send initial logs
-	for _, step := range steps {
-		if step.Output != nil && *step.Output != "" {
-			c.WriteString(fmt.Sprintf("=== Step %d (%s) ===\n", step.OrderNum, step.Type))
-			c.WriteString(*step.Output)
-			c.WriteString("\n")
-		}
-	}
-
-	// If follow is requested and job is still running, keep polling
-	if follow && (job.Status == "running" || job.Status == "pending") {
-		ticker := time.NewTicker(2 * time.Second)
-		defer ticker.Stop()
-
-		lastStepID := 0
-		if len(steps) > 0 {
-			lastStepID = steps[len(steps)-1].ID
-		}
-
-		for {
-			select {
-			case <-ticker.C:
-				// Check if job is still running
-				err = h.DB.Get(&job, "SELECT status FROM jobs WHERE id = ?", id)
-				if err != nil || (job.Status != "running" && job.Status != "pending") {
-					c.WriteString("\n=== Build completed ===\n")
-					return nil
-				}
-
-				// Get new logs since last check
-				var newSteps []models.Step
-				err = h.DB.Select(&newSteps, "SELECT * FROM steps WHERE job_id = ? AND id > ? ORDER BY order_num, id", id, lastStepID)
-				if err != nil {
-					continue
-				}
-
-				// Send new logs
-				for _, step := range newSteps {
-					if step.Output != nil && *step.Output != "" {
-						c.WriteString(fmt.Sprintf("=== Step %d (%s) ===\n", step.OrderNum, step.Type))
-						c.WriteString(*step.Output)
-						c.WriteString("\n")
-						lastStepID = step.ID
-					}
-				}
-
-			case <-c.Context().Done():
-				return nil
-			}
-		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	return nil
+	return c.JSON(status)
 }
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"docker-app/internal/models"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CreateJobs creates the jobs for one run of a pipeline, together with their
+// steps, environment, runnables and deployments. A pipeline with a matrix gets
+// one child job per combination, grouped under the returned matrix run; the
+// matrix run is nil otherwise.
+func CreateJobs(db *sqlx.DB, pipelineID int, config models.PipelineConfig, trigger, tag string) (*models.MatrixRun, []models.Job, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if config.Matrix == nil {
+		job, err := createJob(tx, pipelineID, config, trigger, tag, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, []models.Job{job}, tx.Commit()
+	}
+
+	result, err := tx.Exec(`INSERT INTO matrix_runs (pipeline_id) VALUES (?)`, pipelineID)
+	if err != nil {
+		return nil, nil, err
+	}
+	runID, _ := result.LastInsertId()
+	var run models.MatrixRun
+	err = tx.Get(&run, "SELECT * FROM matrix_runs WHERE id = ?", runID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var jobs []models.Job
+	for _, values := range config.Matrix.Combinations() {
+		valuesJSON, err := json.Marshal(values)
+		if err != nil {
+			return nil, nil, err
+		}
+		matrixValues := string(valuesJSON)
+		job, err := createJob(tx, pipelineID, config.ForMatrix(values), trigger, tag, &run.ID, &matrixValues)
+		if err != nil {
+			return nil, nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return &run, jobs, tx.Commit()
+}
+
+// createJob inserts a single job and everything it runs
+func createJob(tx *sqlx.Tx, pipelineID int, config models.PipelineConfig, trigger, tag string, matrixRunID *int, matrixValues *string) (models.Job, error) {
+	job := models.Job{
+		PipelineID:   pipelineID,
+		Status:       "pending",
+		Trigger:      &trigger,
+		MatrixRunID:  matrixRunID,
+		MatrixValues: matrixValues,
+	}
+	if tag != "" {
+		job.Tag = &tag
+	}
+	if config.Branch != "" {
+		job.Branch = &config.Branch
+	}
+	if config.RepoName != "" {
+		job.RepoName = &config.RepoName
+	}
+	if config.RepoURL != "" {
+		job.RepoURL = &config.RepoURL
+	}
+	if config.Language != "" {
+		job.Language = &config.Language
+	}
+	if config.Version != "" {
+		job.Version = &config.Version
+	}
+	if config.Folder != "" {
+		job.Folder = &config.Folder
+	}
+	if config.ExposePorts {
+		job.ExposePorts = &config.ExposePorts
+	}
+	if config.Temporary {
+		job.Temporary = &config.Temporary
+	}
+	if config.RestartPolicy != "" {
+		job.RestartPolicy = &config.RestartPolicy
+	}
+	if config.Resources != nil {
+		resourcesJSON, err := json.Marshal(config.Resources)
+		if err != nil {
+			return job, err
+		}
+		resources := string(resourcesJSON)
+		job.Resources = &resources
+	}
+	if config.Timeout != "" {
+		job.Timeout = &config.Timeout
+	}
+	if config.MaxParallel > 0 {
+		job.MaxParallel = &config.MaxParallel
+	}
+	if len(config.Services) > 0 {
+		servicesJSON, err := json.Marshal(config.Services)
+		if err != nil {
+			return job, err
+		}
+		services := string(servicesJSON)
+		job.Services = &services
+	}
+	if config.Network != "" {
+		job.Network = &config.Network
+	}
+	if len(config.Cache) > 0 {
+		cacheJSON, err := json.Marshal(config.Cache)
+		if err != nil {
+			return job, err
+		}
+		cache := string(cacheJSON)
+		job.Cache = &cache
+	}
+	if config.Executor != nil {
+		executorJSON, err := json.Marshal(config.Executor)
+		if err != nil {
+			return job, err
+		}
+		executor := string(executorJSON)
+		job.Executor = &executor
+	}
+	runsOn, err := models.LabelsJSON(config.RunsOn)
+	if err != nil {
+		return job, err
+	}
+	job.RunsOn = runsOn
+	query := `INSERT INTO jobs (pipeline_id, status, branch, repo_name, repo_url, language, version, folder, expose_ports, temporary, restart_policy, resources, timeout, max_parallel, trigger, tag, matrix_run_id, matrix_values, services, network, cache, executor, runs_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, job.PipelineID, job.Status, job.Branch, job.RepoName, job.RepoURL, job.Language, job.Version, job.Folder, job.ExposePorts, job.Temporary, job.RestartPolicy, job.Resources, job.Timeout, job.MaxParallel, job.Trigger, job.Tag, job.MatrixRunID, job.MatrixValues, job.Services, job.Network, job.Cache, job.Executor, job.RunsOn)
+	if err != nil {
+		return job, err
+	}
+	id, _ := result.LastInsertId()
+	job.ID = int(id)
+
+	// Create steps
+	dependencies := config.StepDependencies()
+	for i, step := range config.Steps {
+		stepConfigJSON, err := json.Marshal(step)
+		if err != nil {
+			return job, err
+		}
+		dependsOnJSON, err := json.Marshal(dependencies[i])
+		if err != nil {
+			return job, err
+		}
+		result, err := tx.Exec(`INSERT INTO steps (job_id, order_num, type, content, status, config, step_key, depends_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, job.ID, i+1, step.Type, step.Content, "pending", string(stepConfigJSON), config.StepKey(i), string(dependsOnJSON))
+		if err != nil {
+			return job, err
+		}
+		stepID, _ := result.LastInsertId()
+		// Insert files
+		for name, file := range step.Files {
+			_, err = tx.Exec(`INSERT INTO files (step_id, name, content, encoding, mode, owner) VALUES (?, ?, ?, ?, ?, ?)`, stepID, name, file.Content, file.Encoding, file.Mode, file.Owner)
+			if err != nil {
+				return job, err
+			}
+		}
+	}
+
+	// Create env
+	for k, v := range config.Env {
+		_, err = tx.Exec(`INSERT INTO environments (job_id, key, value) VALUES (?, ?, ?)`, job.ID, k, v)
+		if err != nil {
+			return job, err
+		}
+	}
+
+	// Create runnables
+	for _, runnable := range config.Runnables {
+		if !runnable.Enabled {
+			continue // Skip disabled runnables
+		}
+
+		configJSON, err := json.Marshal(runnable)
+		if err != nil {
+			return job, err
+		}
+
+		result, err := tx.Exec(`INSERT INTO runnables (job_id, name, type, config, status) VALUES (?, ?, ?, ?, ?)`,
+			job.ID, runnable.Name, runnable.Type, string(configJSON), "pending")
+		if err != nil {
+			return job, err
+		}
+
+		runnableID, _ := result.LastInsertId()
+
+		// Create deployments for this runnable
+		for _, output := range runnable.Outputs {
+			outputConfigJSON, err := json.Marshal(output.Config)
+			if err != nil {
+				return job, err
+			}
+
+			_, err = tx.Exec(`INSERT INTO deployments (runnable_id, output_type, config, status) VALUES (?, ?, ?, ?)`,
+				runnableID, output.Type, string(outputConfigJSON), "pending")
+			if err != nil {
+				return job, err
+			}
+		}
+	}
+
+	return job, nil
+}
+
+// matrixRunSummary loads a matrix run with the latest job of every
+// combination, so that retried children replace the jobs they retried
+func matrixRunSummary(db *sqlx.DB, run models.MatrixRun) (models.MatrixRunWithJobs, error) {
+	summary := models.MatrixRunWithJobs{
+		MatrixRun: run,
+		Counts:    make(map[string]int),
+		Jobs:      []models.Job{},
+	}
+	err := db.Select(&summary.Jobs, `SELECT * FROM jobs WHERE id IN (SELECT MAX(id) FROM jobs WHERE matrix_run_id = ? GROUP BY matrix_values) ORDER BY id`, run.ID)
+	if err != nil {
+		return summary, err
+	}
+	statuses := make([]string, len(summary.Jobs))
+	for i, job := range summary.Jobs {
+		statuses[i] = job.Status
+		summary.Counts[job.Status]++
+	}
+	summary.Status = models.MatrixStatus(statuses)
+	return summary, nil
+}
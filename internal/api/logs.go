@@ -0,0 +1,230 @@
+package api
+
+import (
+	"bufio"
+	"docker-app/internal/models"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// defaultLogLimit and maxLogLimit bound the lines of a page of a log
+	defaultLogLimit = 1000
+	maxLogLimit     = 10000
+	// logPollInterval is how often a followed log looks for new lines
+	logPollInterval = time.Second
+)
+
+// logPage is the part of a log a request asks for: the lines after the
+// cursor After, or the last Tail lines, at most Limit of them and only those
+// of Stream when it is set
+type logPage struct {
+	After  int
+	Tail   int
+	Limit  int
+	Stream string
+}
+
+// parseLogPage reads ?after=, ?tail=, ?limit= and ?stream=
+func parseLogPage(c *fiber.Ctx) (logPage, error) {
+	page := logPage{Limit: defaultLogLimit, Stream: c.Query("stream")}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"after", &page.After}, {"tail", &page.Tail}, {"limit", &page.Limit}} {
+		s := c.Query(param.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return page, fmt.Errorf("invalid %s", param.name)
+		}
+		*param.value = n
+	}
+	if page.Limit == 0 || page.Limit > maxLogLimit {
+		page.Limit = maxLogLimit
+	}
+	if page.Tail > page.Limit {
+		page.Tail = page.Limit
+	}
+	switch page.Stream {
+	case "", models.LogStreamStdout, models.LogStreamStderr, models.LogStreamSystem:
+	default:
+		return page, fmt.Errorf("invalid stream, expected stdout, stderr or system")
+	}
+	return page, nil
+}
+
+// selectLogLines reads a page of the lines matching filter, ordered by the
+// cursor column, and reports whether more lines follow the page
+func selectLogLines(db *sqlx.DB, page logPage, cursor, filter string, args ...interface{}) ([]models.LogLine, bool, error) {
+	query := "SELECT * FROM log_lines WHERE " + filter
+	if page.Stream != "" {
+		query += " AND stream = ?"
+		args = append(args, page.Stream)
+	}
+	lines := []models.LogLine{}
+	if page.Tail > 0 {
+		err := db.Select(&lines, query+" ORDER BY "+cursor+" DESC LIMIT ?", append(args, page.Tail)...)
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+		return lines, false, err
+	}
+	query += " AND " + cursor + " > ? ORDER BY " + cursor + " LIMIT ?"
+	err := db.Select(&lines, query, append(args, page.After, page.Limit+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(lines) > page.Limit {
+		return lines[:page.Limit], true, nil
+	}
+	return lines, false, nil
+}
+
+// GetStepLines returns a page of the lines of a step. The cursor is the seq
+// of a line: pass the returned next as ?after= to read on.
+func (h *Handler) GetStepLines(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid step id"})
+	}
+	page, err := parseLogPage(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	var step models.Step
+	err = h.DB.Get(&step, "SELECT * FROM steps WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "step not found"})
+	}
+
+	lines, more, err := selectLogLines(h.DB, page, "seq", "step_id = ?", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	next := page.After
+	if len(lines) > 0 {
+		next = lines[len(lines)-1].Seq
+	}
+	return c.JSON(fiber.Map{
+		"step_id": step.ID,
+		"status":  step.Status,
+		"lines":   lines,
+		"next":    next,
+		"more":    more,
+	})
+}
+
+// GetJobLines returns a page of the lines of all the steps of a job, or of
+// one with ?step_id=. The cursor is the id of a line.
+func (h *Handler) GetJobLines(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	page, err := parseLogPage(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	filter := "job_id = ?"
+	args := []interface{}{id}
+	if stepID := c.Query("step_id"); stepID != "" {
+		n, err := strconv.Atoi(stepID)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid step_id"})
+		}
+		filter += " AND step_id = ?"
+		args = append(args, n)
+	}
+	var job models.Job
+	err = h.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "job not found"})
+	}
+
+	lines, more, err := selectLogLines(h.DB, page, "id", filter, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	next := page.After
+	if len(lines) > 0 {
+		next = lines[len(lines)-1].ID
+	}
+	return c.JSON(fiber.Map{
+		"job_id": job.ID,
+		"status": job.Status,
+		"lines":  lines,
+		"next":   next,
+		"more":   more,
+	})
+}
+
+// jobActive reports whether a job with status may still print lines
+func jobActive(status string) bool {
+	return status == "running" || status == "pending" || status == "waiting" || status == "queued"
+}
+
+// streamJobLines writes the lines of a job after the line with id after,
+// of the steps after the step with id since, each step under a header. While
+// follow is set it keeps polling for new lines until the job finishes or the
+// client goes away.
+func streamJobLines(db *sqlx.DB, jobID, since, after int, follow bool, w *bufio.Writer) {
+	steps := make(map[int]models.Step)
+	lastStep := 0
+	for {
+		// Lines are stored before the status changes, so once a finished
+		// status is read every line can be
+		var status string
+		if err := db.Get(&status, "SELECT status FROM jobs WHERE id = ?", jobID); err != nil {
+			fmt.Fprintf(w, "Error retrieving logs: %v\n", err)
+			w.Flush()
+			return
+		}
+		for {
+			var lines []models.LogLine
+			err := db.Select(&lines, "SELECT * FROM log_lines WHERE job_id = ? AND step_id > ? AND id > ? ORDER BY id LIMIT ?", jobID, since, after, defaultLogLimit)
+			if err != nil {
+				fmt.Fprintf(w, "Error retrieving logs: %v\n", err)
+				w.Flush()
+				return
+			}
+			for _, line := range lines {
+				if line.StepID != lastStep {
+					step, ok := steps[line.StepID]
+					if !ok {
+						db.Get(&step, "SELECT * FROM steps WHERE id = ?", line.StepID)
+						steps[line.StepID] = step
+					}
+					fmt.Fprintf(w, "=== Step %d (%s) ===\n", step.OrderNum, step.Type)
+					lastStep = line.StepID
+				}
+				w.WriteString(line.Line + "\n")
+				after = line.ID
+			}
+			if len(lines) < defaultLogLimit {
+				break
+			}
+		}
+
+		if !follow || !jobActive(status) {
+			if follow {
+				w.WriteString("\n=== Build completed ===\n")
+			}
+			w.Flush()
+			return
+		}
+		// Flushing fails once the client went away
+		if err := w.Flush(); err != nil {
+			return
+		}
+		time.Sleep(logPollInterval)
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"database/sql"
+	"docker-app/internal/models"
+	"docker-app/internal/secrets"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+)
+
+type secretRequest struct {
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+	PipelineID *int   `json:"pipeline_id"`
+}
+
+// CreateSecret stores a secret encrypted with the master key, global or for
+// one pipeline, replacing the one of the same name in that scope
+func (h *Handler) CreateSecret(c *fiber.Ctx) error {
+	if h.Secrets == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "secrets are disabled, the server has no master key"})
+	}
+	var req secretRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if err := secrets.ValidateName(req.Name); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.Value == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "value is required"})
+	}
+	if req.PipelineID != nil {
+		var count int
+		err := h.DB.Get(&count, "SELECT COUNT(*) FROM pipelines WHERE id = ?", *req.PipelineID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if count == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "pipeline not found"})
+		}
+	}
+	encrypted, err := h.Secrets.Encrypt(req.Name, req.Value)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback()
+	var secret models.Secret
+	err = tx.Get(&secret, "SELECT * FROM secrets WHERE COALESCE(pipeline_id, 0) = COALESCE(?, 0) AND name = ?", req.PipelineID, req.Name)
+	if err == sql.ErrNoRows {
+		result, err := tx.Exec("INSERT INTO secrets (pipeline_id, name, value) VALUES (?, ?, ?)", req.PipelineID, req.Name, encrypted)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		id, _ := result.LastInsertId()
+		secret.ID = int(id)
+	} else if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	} else {
+		_, err = tx.Exec("UPDATE secrets SET value = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", encrypted, secret.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if err := tx.Get(&secret, "SELECT * FROM secrets WHERE id = ?", secret.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(secret)
+}
+
+// GetSecrets lists secrets without their values, those of one pipeline with
+// ?pipeline_id= and the global ones with ?pipeline_id=global
+func (h *Handler) GetSecrets(c *fiber.Ctx) error {
+	list := []models.Secret{}
+	var err error
+	switch pipelineID := c.Query("pipeline_id"); pipelineID {
+	case "":
+		err = h.DB.Select(&list, "SELECT * FROM secrets ORDER BY pipeline_id, name")
+	case "global":
+		err = h.DB.Select(&list, "SELECT * FROM secrets WHERE pipeline_id IS NULL ORDER BY name")
+	default:
+		id, convErr := strconv.Atoi(pipelineID)
+		if convErr != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid pipeline_id"})
+		}
+		err = h.DB.Select(&list, "SELECT * FROM secrets WHERE pipeline_id = ? ORDER BY name", id)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(list)
+}
+
+// UpdateSecret replaces the value of a secret
+func (h *Handler) UpdateSecret(c *fiber.Ctx) error {
+	if h.Secrets == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "secrets are disabled, the server has no master key"})
+	}
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var req secretRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.Value == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "value is required"})
+	}
+	var secret models.Secret
+	err = h.DB.Get(&secret, "SELECT * FROM secrets WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "secret not found"})
+	}
+	encrypted, err := h.Secrets.Encrypt(secret.Name, req.Value)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	_, err = h.DB.Exec("UPDATE secrets SET value = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", encrypted, id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.DB.Get(&secret, "SELECT * FROM secrets WHERE id = ?", id); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(secret)
+}
+
+// DeleteSecret removes a secret
+func (h *Handler) DeleteSecret(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	result, err := h.DB.Exec("DELETE FROM secrets WHERE id = ?", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "secret not found"})
+	}
+	return c.JSON(fiber.Map{"message": "secret deleted"})
+}
+
+// SecretNames returns the names of the secrets the jobs of a pipeline can
+// refer to, its own and the global ones
+func SecretNames(db *sqlx.DB, pipelineID int) ([]string, error) {
+	names := []string{}
+	err := db.Select(&names, "SELECT DISTINCT name FROM secrets WHERE pipeline_id IS NULL OR pipeline_id = ?", pipelineID)
+	return names, err
+}
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"crypto/rand"
+	"docker-app/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// defaultEventLimit and maxEventLimit bound the events and deliveries
+	// listed at once
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+type subscriptionRequest struct {
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`
+	PipelineID *int     `json:"pipeline_id"`
+	Secret     string   `json:"secret"`
+	Active     *bool    `json:"active"`
+}
+
+// CreateSubscription registers an HTTP endpoint for the chosen events, of
+// every pipeline or of one. The payloads are signed with the secret of the
+// request, or with one generated and returned only this once.
+func (h *Handler) CreateSubscription(c *fiber.Ctx) error {
+	var req subscriptionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if err := models.ValidateSubscription(req.URL, req.Events, h.AllowPrivateSubscriptions); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.PipelineID != nil {
+		var count int
+		err := h.DB.Get(&count, "SELECT COUNT(*) FROM pipelines WHERE id = ?", *req.PipelineID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if count == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "pipeline not found"})
+		}
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+	active := req.Active == nil || *req.Active
+	events, err := models.EventsJSON(req.Events)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result, err := h.DB.Exec("INSERT INTO event_subscriptions (url, events, pipeline_id, secret, active) VALUES (?, ?, ?, ?, ?)",
+		req.URL, events, req.PipelineID, req.Secret, active)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	id, _ := result.LastInsertId()
+	return c.Status(201).JSON(fiber.Map{
+		"id":          id,
+		"url":         req.URL,
+		"events":      req.Events,
+		"pipeline_id": req.PipelineID,
+		"active":      active,
+		"secret":      req.Secret,
+	})
+}
+
+// GetSubscriptions lists subscriptions without their secrets
+func (h *Handler) GetSubscriptions(c *fiber.Ctx) error {
+	subscriptions := []models.EventSubscription{}
+	err := h.DB.Select(&subscriptions, "SELECT * FROM event_subscriptions ORDER BY id")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(subscriptions)
+}
+
+// GetSubscription returns a subscription without its secret
+func (h *Handler) GetSubscription(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var subscription models.EventSubscription
+	err = h.DB.Get(&subscription, "SELECT * FROM event_subscriptions WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "subscription not found"})
+	}
+	return c.JSON(subscription)
+}
+
+// UpdateSubscription changes the URL, events, secret or active flag of a
+// subscription; what the request leaves out is kept. An inactive subscription
+// gets no deliveries and those still pending fail.
+func (h *Handler) UpdateSubscription(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var req subscriptionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	var subscription models.EventSubscription
+	err = h.DB.Get(&subscription, "SELECT * FROM event_subscriptions WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "subscription not found"})
+	}
+
+	if req.URL != "" {
+		subscription.URL = strings.TrimSpace(req.URL)
+	}
+	events := req.Events
+	if events == nil {
+		json.Unmarshal([]byte(subscription.Events), &events)
+	}
+	if err := models.ValidateSubscription(subscription.URL, events, h.AllowPrivateSubscriptions); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	subscription.Events, err = models.EventsJSON(events)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if req.Secret != "" {
+		subscription.Secret = req.Secret
+	}
+	if req.Active != nil {
+		subscription.Active = *req.Active
+	}
+
+	_, err = h.DB.Exec("UPDATE event_subscriptions SET url = ?, events = ?, secret = ?, active = ? WHERE id = ?",
+		subscription.URL, subscription.Events, subscription.Secret, subscription.Active, id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(subscription)
+}
+
+// DeleteSubscription removes a subscription and its deliveries
+func (h *Handler) DeleteSubscription(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM event_deliveries WHERE subscription_id = ?", id); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	result, err := tx.Exec("DELETE FROM event_subscriptions WHERE id = ?", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "subscription not found"})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "subscription deleted"})
+}
+
+// GetSubscriptionDeliveries lists the deliveries of a subscription, newest
+// first, only those with a status with ?status=
+func (h *Handler) GetSubscriptionDeliveries(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	limit, err := eventLimit(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM event_subscriptions WHERE id = ?", id); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if count == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "subscription not found"})
+	}
+
+	query := "SELECT * FROM event_deliveries WHERE subscription_id = ?"
+	args := []interface{}{id}
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case models.DeliveryPending, models.DeliverySuccess, models.DeliveryFailed:
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "invalid status, expected pending, success or failed"})
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	deliveries := []models.EventDelivery{}
+	err = h.DB.Select(&deliveries, query+" ORDER BY id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(deliveries)
+}
+
+// GetDelivery returns a delivery with the payload of its event
+func (h *Handler) GetDelivery(c *fiber.Ctx) error {
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var delivery models.EventDelivery
+	err = h.DB.Get(&delivery, "SELECT * FROM event_deliveries WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "delivery not found"})
+	}
+	var event models.Event
+	err = h.DB.Get(&event, "SELECT * FROM events WHERE id = ?", delivery.EventID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"delivery": delivery,
+		"payload":  event.Payload(),
+	})
+}
+
+// RedeliverDelivery sends the event of a delivery to its subscription again,
+// as a new delivery
+func (h *Handler) RedeliverDelivery(c *fiber.Ctx) error {
+	if h.Worker == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "worker not available"})
+	}
+	idStr := c.Params("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid id"})
+	}
+	var delivery models.EventDelivery
+	err = h.DB.Get(&delivery, "SELECT * FROM event_deliveries WHERE id = ?", id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "delivery not found"})
+	}
+	redelivery, err := h.Worker.Redeliver(delivery)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(redelivery)
+}
+
+// GetEvents lists the recorded events, newest first, those of a job with
+// ?job_id= and of a type with ?type=
+func (h *Handler) GetEvents(c *fiber.Ctx) error {
+	limit, err := eventLimit(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	query := "SELECT * FROM events WHERE 1 = 1"
+	var args []interface{}
+	if jobID := c.Query("job_id"); jobID != "" {
+		id, err := strconv.Atoi(jobID)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid job_id"})
+		}
+		query += " AND job_id = ?"
+		args = append(args, id)
+	}
+	if eventType := c.Query("type"); eventType != "" {
+		query += " AND type = ?"
+		args = append(args, eventType)
+	}
+	var events []models.Event
+	err = h.DB.Select(&events, query+" ORDER BY id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	payloads := []models.EventPayload{}
+	for _, event := range events {
+		payloads = append(payloads, event.Payload())
+	}
+	return c.JSON(payloads)
+}
+
+// eventLimit reads ?limit=, defaultEventLimit by default
+func eventLimit(c *fiber.Ctx) (int, error) {
+	limit := defaultEventLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid limit")
+		}
+		limit = n
+	}
+	if limit > maxEventLimit {
+		limit = maxEventLimit
+	}
+	return limit, nil
+}
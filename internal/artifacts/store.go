@@ -0,0 +1,118 @@
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store keeps artifact contents addressed by their sha256 digest, so that an
+// artifact built twice is stored once.
+//
+// To add a backend, implement Store and set it as worker.Config.ArtifactStore.
+type Store interface {
+	// Put stores the content of r and returns its digest ("sha256:<hex>") and size
+	Put(ctx context.Context, r io.Reader) (digest string, size int64, err error)
+
+	// Open returns the content stored under digest
+	Open(ctx context.Context, digest string) (io.ReadCloser, error)
+
+	// Delete removes the content stored under digest
+	Delete(ctx context.Context, digest string) error
+
+	// GetType returns the unique identifier of the backend, recorded with
+	// every artifact
+	GetType() string
+}
+
+// LocalStore stores artifacts on the local filesystem as
+// <dir>/sha256/<first two hex digits>/<hex>
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore creates a local store in dir
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact store: %v", err)
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+func (s *LocalStore) GetType() string {
+	return "local"
+}
+
+// Put writes r to a temporary file while hashing it and moves the file into
+// place once the digest is known
+func (s *LocalStore) Put(ctx context.Context, r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(s.dir, "upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	path := s.path(sum)
+	if _, err := os.Stat(path); err == nil {
+		// Already stored
+		return "sha256:" + sum, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return "sha256:" + sum, size, nil
+}
+
+func (s *LocalStore) Open(ctx context.Context, digest string) (io.ReadCloser, error) {
+	sum, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(s.path(sum))
+}
+
+func (s *LocalStore) Delete(ctx context.Context, digest string) error {
+	sum, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(s.path(sum))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStore) path(sum string) string {
+	return filepath.Join(s.dir, "sha256", sum[:2], sum)
+}
+
+// parseDigest returns the hex part of a sha256 digest
+func parseDigest(digest string) (string, error) {
+	sum := strings.TrimPrefix(digest, "sha256:")
+	if len(sum) != sha256.Size*2 || sum == digest {
+		return "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	return sum, nil
+}
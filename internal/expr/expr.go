@@ -0,0 +1,251 @@
+// Package expr implements the small expression language used by step `if:`
+// conditions. Expressions can only read the variables they are given and call
+// a fixed set of functions, so evaluating untrusted input is safe.
+//
+//	branch == 'main' && env.DEPLOY != ''
+//	failure() || steps.test.status == 'failed'
+//	startsWith(tag, 'v')
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Value is the result of evaluating an expression: a string or a bool
+type Value interface{}
+
+// Context holds what an expression is evaluated against. Vars may nest
+// map[string]string and map[string]interface{} values, which are reached
+// with dotted paths such as env.NAME.
+type Context struct {
+	Vars map[string]interface{}
+	// Failed reports whether an earlier step failed, for success() and failure()
+	Failed bool
+}
+
+// Expression is a parsed expression
+type Expression struct {
+	source string
+	root   node
+}
+
+// Parse parses an expression
+func Parse(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", p.peek(), p.peek().pos)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Variables returns the dotted paths of every variable the expression reads
+func (e *Expression) Variables() [][]string {
+	var paths [][]string
+	walk(e.root, func(n node) {
+		if v, ok := n.(*variableNode); ok {
+			paths = append(paths, v.path)
+		}
+	})
+	return paths
+}
+
+// UsesStatus reports whether the expression calls success(), failure() or
+// always(). Conditions that don't are only evaluated when no step has failed.
+func (e *Expression) UsesStatus() bool {
+	uses := false
+	walk(e.root, func(n node) {
+		if c, ok := n.(*callNode); ok {
+			switch c.name {
+			case "success", "failure", "always":
+				uses = true
+			}
+		}
+	})
+	return uses
+}
+
+// Eval evaluates the expression and returns its truth value
+func (e *Expression) Eval(ctx Context) (bool, error) {
+	v, err := e.root.eval(ctx)
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+// truthy converts a value to a bool: non-empty strings are true
+func truthy(v Value) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return false
+}
+
+// toString converts a value to a string for comparisons
+func toString(v Value) string {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case string:
+		return v
+	}
+	return ""
+}
+
+type node interface {
+	eval(ctx Context) (Value, error)
+	children() []node
+}
+
+func walk(n node, fn func(node)) {
+	fn(n)
+	for _, child := range n.children() {
+		walk(child, fn)
+	}
+}
+
+type literalNode struct {
+	value Value
+}
+
+func (n *literalNode) eval(ctx Context) (Value, error) { return n.value, nil }
+func (n *literalNode) children() []node                { return nil }
+
+type variableNode struct {
+	path []string
+}
+
+func (n *variableNode) eval(ctx Context) (Value, error) {
+	var current interface{} = ctx.Vars
+	for _, key := range n.path {
+		switch m := current.(type) {
+		case map[string]interface{}:
+			current = m[key]
+		case map[string]string:
+			current = m[key]
+		default:
+			// Missing variables read as an empty string
+			return "", nil
+		}
+	}
+	switch v := current.(type) {
+	case string, bool:
+		return v, nil
+	}
+	return "", nil
+}
+
+func (n *variableNode) children() []node { return nil }
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(ctx Context) (Value, error) {
+	v, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+func (n *notNode) children() []node { return []node{n.operand} }
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(ctx Context) (Value, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short-circuit
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return toString(left) == toString(right), nil
+	case "!=":
+		return toString(left) != toString(right), nil
+	}
+	return truthy(right), nil
+}
+
+func (n *binaryNode) children() []node { return []node{n.left, n.right} }
+
+type callNode struct {
+	name string
+	args []node
+}
+
+// functions maps every callable function to its number of arguments
+var functions = map[string]int{
+	"success":    0,
+	"failure":    0,
+	"always":     0,
+	"contains":   2,
+	"startsWith": 2,
+	"endsWith":   2,
+}
+
+func (n *callNode) eval(ctx Context) (Value, error) {
+	args := make([]string, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = toString(v)
+	}
+	switch n.name {
+	case "success":
+		return !ctx.Failed, nil
+	case "failure":
+		return ctx.Failed, nil
+	case "always":
+		return true, nil
+	case "contains":
+		return strings.Contains(args[0], args[1]), nil
+	case "startsWith":
+		return strings.HasPrefix(args[0], args[1]), nil
+	case "endsWith":
+		return strings.HasSuffix(args[0], args[1]), nil
+	}
+	return nil, fmt.Errorf("unknown function %s()", n.name)
+}
+
+func (n *callNode) children() []node { return n.args }
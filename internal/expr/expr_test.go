@@ -0,0 +1,159 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testVars = map[string]interface{}{
+	"branch": "main",
+	"tag":    "v1.2.0",
+	"empty":  "",
+	"env":    map[string]string{"DEPLOY": "yes"},
+	"steps": map[string]interface{}{
+		"test":    map[string]interface{}{"status": "failed"},
+		"build-2": map[string]interface{}{"status": "success"},
+	},
+}
+
+func eval(t *testing.T, source string, failed bool) bool {
+	t.Helper()
+	e, err := Parse(source)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", source, err)
+	}
+	result, err := e.Eval(Context{Vars: testVars, Failed: failed})
+	if err != nil {
+		t.Fatalf("Eval(%q): %v", source, err)
+	}
+	return result
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		// && binds tighter than ||
+		{"true || false && false", true},
+		{"false && false || true", true},
+		{"(true || false) && false", false},
+		{"false && (false || true)", false},
+		// ! applies to the comparison that follows it
+		{"!branch == 'main'", false},
+		{"!branch == 'dev'", true},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"!!true", true},
+		// Comparisons bind tighter than && and ||
+		{"branch == 'main' && tag != ''", true},
+		{"branch == 'dev' || env.DEPLOY == 'yes'", true},
+		{"branch == 'dev' || env.DEPLOY == 'no' && true", false},
+	}
+	for _, tt := range tests {
+		if got := eval(t, tt.source, false); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		source string
+		failed bool
+		want   bool
+	}{
+		{"branch", false, true},
+		{"empty", false, false},
+		{"missing", false, false},
+		{"missing.deeper.still", false, false},
+		{"missing == ''", false, true},
+		{"env.DEPLOY == 'yes'", false, true},
+		{"steps.test.status == 'failed'", false, true},
+		{"steps.build-2.status == \"success\"", false, true},
+		{"'it''s' == \"it's\"", false, true},
+		{"true == 'true'", false, true},
+		{"1 == '1'", false, true},
+		{"startsWith(tag, 'v')", false, true},
+		{"endsWith(tag, '.0')", false, true},
+		{"contains(branch, 'ai')", false, true},
+		{"contains(branch, 'dev')", false, false},
+		{"success()", false, true},
+		{"success()", true, false},
+		{"failure()", true, true},
+		{"failure() || steps.test.status == 'failed'", false, true},
+		{"always()", true, true},
+	}
+	for _, tt := range tests {
+		if got := eval(t, tt.source, tt.failed); got != tt.want {
+			t.Errorf("%s (failed %v) = %v, want %v", tt.source, tt.failed, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", "unexpected end of expression"},
+		{"branch ==", "unexpected end of expression"},
+		{"== 'main'", `unexpected "=="`},
+		{"'unterminated", "unterminated string at position 0"},
+		{"branch = 'main'", "unexpected character '='"},
+		{"branch == 'main' tag", `unexpected "tag" at position 17`},
+		{"(branch == 'main'", `expected ")" but found end of expression`},
+		{"branch)", `unexpected ")"`},
+		{"env.", "expected a name after '.'"},
+		{"exec('rm -rf /')", "unknown function exec()"},
+		{"contains('a')", "contains() takes 2 arguments but got 1"},
+		{"success(true)", "success() takes 0 arguments but got 1"},
+		{"startsWith(tag 'v')", `expected ")"`},
+		{"a == b == c", `unexpected "=="`},
+		{"branch & tag", "unexpected character '&'"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.source)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", tt.source)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %q, want it to contain %q", tt.source, err, tt.want)
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	e, err := Parse("branch == 'main' && startsWith(steps.test.outputs.version, env.PREFIX) || !failure()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"branch"}, {"steps", "test", "outputs", "version"}, {"env", "PREFIX"}}
+	if got := e.Variables(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Variables() = %v, want %v", got, want)
+	}
+}
+
+func TestUsesStatus(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"branch == 'main'", false},
+		{"contains(branch, 'failure')", false},
+		{"always()", true},
+		{"branch == 'main' && !success()", true},
+		{"contains(branch, 'x') || failure()", true},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.UsesStatus(); got != tt.want {
+			t.Errorf("UsesStatus(%q) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return fmt.Sprintf("string '%s'", t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+// tokenize splits an expression into tokens. Strings use single or double
+// quotes; a quote is escaped by doubling it.
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			quote := r
+			start := i
+			var value strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if runes[i] == quote {
+					if i+1 < len(runes) && runes[i+1] == quote {
+						value.WriteRune(quote)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value.String(), pos: start})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: string(runes[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: string(runes[start:i]), pos: start})
+		default:
+			if i+1 < len(runes) {
+				switch op := string(runes[i : i+2]); op {
+				case "==", "!=", "&&", "||":
+					tokens = append(tokens, token{kind: tokenOperator, value: op, pos: i})
+					i += 2
+					continue
+				}
+			}
+			switch r {
+			case '!', '(', ')', ',', '.':
+				tokens = append(tokens, token{kind: tokenOperator, value: string(r), pos: i})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+// parser is a recursive descent parser for the grammar
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | compare
+//	compare = primary [ ( "==" | "!=" ) primary ]
+//	primary = "(" or ")" | string | number | "true" | "false"
+//	        | ident "(" [ or { "," or } ] ")" | ident { "." ident }
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOperator(value string) bool {
+	t := p.peek()
+	return t.kind == tokenOperator && t.value == value
+}
+
+func (p *parser) expect(value string) error {
+	if !p.isOperator(value) {
+		return fmt.Errorf("expected %q but found %s at position %d", value, p.peek(), p.peek().pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOperator("!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOperator("==") || p.isOperator("!=") {
+		op := p.next().value
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString, tokenNumber:
+		return &literalNode{value: t.value}, nil
+	case tokenIdent:
+		switch t.value {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		}
+		if p.isOperator("(") {
+			return p.parseCall(t)
+		}
+		path := []string{t.value}
+		for p.isOperator(".") {
+			p.next()
+			part := p.next()
+			if part.kind != tokenIdent && part.kind != tokenNumber {
+				return nil, fmt.Errorf("expected a name after '.' at position %d", part.pos)
+			}
+			path = append(path, part.value)
+		}
+		return &variableNode{path: path}, nil
+	case tokenOperator:
+		if t.value == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	arity, ok := functions[name.value]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s() at position %d", name.value, name.pos)
+	}
+	p.next() // (
+
+	var args []node
+	if !p.isOperator(")") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.isOperator(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(args) != arity {
+		return nil, fmt.Errorf("%s() takes %d arguments but got %d", name.value, arity, len(args))
+	}
+	return &callNode{name: name.value, args: args}, nil
+}
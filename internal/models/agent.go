@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// Agent is a remote machine that leases jobs from the server and runs them.
+// Agents authenticate with the token they got when they registered, of which
+// only the sha256 is stored. Labels are what the agent offers to runs_on.
+type Agent struct {
+	ID         int        `db:"id" json:"id"`
+	Name       string     `db:"name" json:"name"`
+	TokenHash  string     `db:"token_hash" json:"-"`
+	Labels     *string    `db:"labels" json:"labels"`
+	LastSeenAt *time.Time `db:"last_seen_at" json:"last_seen_at"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+}
+
+// Lease is a job handed to an agent, with everything it needs to run it,
+// including the decrypted values of the secrets it may refer to. The agent
+// keeps the lease by sending a heartbeat every LeaseSeconds/3 seconds; once
+// ExpiresAt passes without one, the job is re-queued.
+type Lease struct {
+	Job          Job               `json:"job"`
+	PipelineName string            `json:"pipeline_name"`
+	Steps        []Step            `json:"steps"`
+	Files        []File            `json:"files"`
+	Env          []Environment     `json:"env"`
+	Secrets      map[string]string `json:"secrets"`
+	LeaseSeconds int               `json:"lease_seconds"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+}
+
+// AgentStepUpdate is what an agent reports when a step starts or finishes,
+// with the outputs it set once it finished
+type AgentStepUpdate struct {
+	Status       string            `json:"status"`
+	StatusReason *string           `json:"status_reason"`
+	Attempts     int               `json:"attempts"`
+	Outputs      map[string]string `json:"outputs,omitempty"`
+}
+
+// AgentLogLines is the output of a step an agent sends as it runs. The
+// server numbers the lines, only their attempt, stream, text and time are
+// read.
+type AgentLogLines struct {
+	Lines []LogLine `json:"lines"`
+}
+
+// AgentJobResult is what an agent reports when a job finishes. StepStatus
+// is recorded on the steps that were still running, such as timed_out when
+// the job timed out.
+type AgentJobResult struct {
+	Status       string  `json:"status"`
+	StatusReason *string `json:"status_reason"`
+	StepStatus   string  `json:"step_status"`
+}
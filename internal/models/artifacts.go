@@ -0,0 +1,131 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DefaultArtifactsSource is the container path an artifacts runnable packages
+// when it doesn't set a source
+const DefaultArtifactsSource = "/workspace"
+
+// ArtifactsConfig selects the files an artifacts or serverless runnable
+// packages. Patterns are matched against paths relative to Source: a pattern
+// without a slash matches a name at any depth, a pattern with one matches from
+// the source root, ** matches any number of directories and a pattern that
+// matches a directory matches everything below it. Without Include every file
+// is included; Exclude wins over Include.
+type ArtifactsConfig struct {
+	Source  string   `yaml:"source,omitempty" json:"source,omitempty"`
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+}
+
+// Artifacts decodes the artifacts options from a runnable's config
+func (r RunnableConfig) Artifacts() (ArtifactsConfig, error) {
+	var a ArtifactsConfig
+	if len(r.Config) == 0 {
+		return a, nil
+	}
+	data, err := json.Marshal(r.Config)
+	if err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(data, &a); err != nil {
+		return a, fmt.Errorf("invalid artifacts config: %v", err)
+	}
+	return a, nil
+}
+
+// SourcePath returns the absolute container path to package. A relative
+// source is taken from /workspace.
+func (a ArtifactsConfig) SourcePath() string {
+	if a.Source == "" {
+		return DefaultArtifactsSource
+	}
+	if path.IsAbs(a.Source) {
+		return path.Clean(a.Source)
+	}
+	return path.Join(DefaultArtifactsSource, a.Source)
+}
+
+// Selects reports whether the file at rel, a slash separated path relative to
+// the source, belongs in the artifacts
+func (a ArtifactsConfig) Selects(rel string) bool {
+	included := len(a.Include) == 0
+	for _, pattern := range a.Include {
+		if matchArtifactPattern(pattern, rel) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range a.Exclude {
+		if matchArtifactPattern(pattern, rel) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks the syntax of the patterns
+func (a ArtifactsConfig) validate() error {
+	for _, patterns := range [][]string{a.Include, a.Exclude} {
+		for _, pattern := range patterns {
+			if pattern == "" || path.IsAbs(pattern) {
+				return fmt.Errorf("pattern %q must be a relative path", pattern)
+			}
+			for _, segment := range strings.Split(pattern, "/") {
+				if segment == ".." {
+					return fmt.Errorf("pattern %q must not contain ..", pattern)
+				}
+				if _, err := path.Match(segment, ""); err != nil {
+					return fmt.Errorf("pattern %q: %v", pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchArtifactPattern reports whether pattern matches rel or one of the
+// directories it is in
+func matchArtifactPattern(pattern, rel string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	patternParts := strings.Split(pattern, "/")
+	relParts := strings.Split(rel, "/")
+	for n := 1; n <= len(relParts); n++ {
+		if matchSegments(patternParts, relParts[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments, where **
+// matches zero or more segments
+func matchSegments(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], parts[0])
+	return err == nil && ok && matchSegments(pattern[1:], parts[1:])
+}
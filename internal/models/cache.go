@@ -0,0 +1,65 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/docker/go-units"
+)
+
+// CacheConfig saves paths of the build container after a job or step succeeds
+// and restores them before the next one with the same key runs. Key is a
+// template such as `go-{{ hashFiles "go.sum" }}`; Paths are absolute or start
+// with "~/".
+type CacheConfig struct {
+	Key     string   `yaml:"key" json:"key"`
+	Paths   []string `yaml:"paths" json:"paths"`
+	MaxSize string   `yaml:"max_size,omitempty" json:"max_size,omitempty"`
+}
+
+// CacheKeyData holds the values a cache key template can use besides hashFiles
+type CacheKeyData struct {
+	Language string
+	Version  string
+	Branch   string
+	Env      map[string]string
+}
+
+// ParseCacheKey parses a cache key template. hashFiles hashes the workspace
+// files matching the given glob patterns.
+func ParseCacheKey(key string, hashFiles func(patterns ...string) (string, error)) (*template.Template, error) {
+	return template.New("key").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"hashFiles": hashFiles}).
+		Parse(key)
+}
+
+// validate checks a cache's key template, paths and size limit
+func (c CacheConfig) validate() error {
+	if strings.TrimSpace(c.Key) == "" {
+		return fmt.Errorf("key is required")
+	}
+	_, err := ParseCacheKey(c.Key, func(patterns ...string) (string, error) { return "", nil })
+	if err != nil {
+		return fmt.Errorf("key: %v", err)
+	}
+	if len(c.Paths) == 0 {
+		return fmt.Errorf("paths are required")
+	}
+	for _, p := range c.Paths {
+		if !path.IsAbs(p) && !strings.HasPrefix(p, "~/") {
+			return fmt.Errorf("path %q must be absolute or start with ~/", p)
+		}
+		if path.Clean(p) == "/" {
+			return fmt.Errorf("path %q can't be cached", p)
+		}
+	}
+	if c.MaxSize != "" {
+		if _, err := units.RAMInBytes(c.MaxSize); err != nil {
+			return fmt.Errorf("max_size: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"docker-app/internal/secrets"
+	"docker-app/internal/vars"
+	"encoding/json"
+	"fmt"
+)
+
+// credentialKeys are the keys of runnable and output configs that hold
+// credentials, such as the secret_access_key of s3 outputs, the nginx_pm_pass
+// of vps outputs and the SMTP password of email outputs. Their values must
+// come from secrets, so that pipeline configs don't store them.
+var credentialKeys = map[string]bool{
+	"secret_access_key": true,
+	"nginx_pm_pass":     true,
+	"password":          true,
+	"api_key":           true,
+}
+
+// refersToSecret reports whether a credential value is taken from a secret,
+// as ${{ secrets.NAME }} or as ${NAME}, which runnables look up in the env,
+// the exported variables and then the secrets
+func refersToSecret(value interface{}) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	refs, err := vars.References(s, true)
+	if err != nil {
+		return false
+	}
+	for _, ref := range refs {
+		if ref.Short || ref.Namespace() == vars.Secrets {
+			return true
+		}
+	}
+	return false
+}
+
+// literalCredentials calls fn with every credential key of a config, or of the
+// maps and lists below it, whose value doesn't come from a secret. Where is
+// the dotted path of the key.
+func literalCredentials(where string, value interface{}, fn func(where string, parent map[string]interface{}, key string)) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			if credentialKeys[key] && v[key] != nil && v[key] != "" && !refersToSecret(v[key]) {
+				fn(where+key, v, key)
+				continue
+			}
+			literalCredentials(where+key+".", v[key], fn)
+		}
+	case []interface{}:
+		for i, item := range v {
+			literalCredentials(fmt.Sprintf("%s%d.", where, i), item, fn)
+		}
+	}
+}
+
+// runnableConfigs calls fn with the config of every runnable and output
+func (c *PipelineConfig) runnableConfigs(fn func(where string, config map[string]interface{})) {
+	for _, runnable := range c.Runnables {
+		fn("runnable "+runnable.Name, runnable.Config)
+		for i, output := range runnable.Outputs {
+			fn(fmt.Sprintf("runnable %s: output %d", runnable.Name, i+1), output.Config)
+		}
+	}
+}
+
+// validateCredentials rejects credentials written into the config instead of
+// referring to a secret
+func (c *PipelineConfig) validateCredentials() error {
+	var err error
+	c.runnableConfigs(func(where string, config map[string]interface{}) {
+		literalCredentials("", config, func(key string, _ map[string]interface{}, _ string) {
+			if err == nil {
+				err = fmt.Errorf("%s: %s must refer to a secret, as ${{ secrets.NAME }}", where, key)
+			}
+		})
+	})
+	return err
+}
+
+// RedactCredentials masks the credentials of the config that don't refer to
+// a secret, which pipelines created before secrets existed may still hold. It
+// reports whether any were masked.
+func (c *PipelineConfig) RedactCredentials() bool {
+	redacted := false
+	c.runnableConfigs(func(_ string, config map[string]interface{}) {
+		literalCredentials("", config, func(_ string, parent map[string]interface{}, key string) {
+			parent[key] = secrets.Masked
+			redacted = true
+		})
+	})
+	return redacted
+}
+
+// RedactCredentialsJSON masks the credentials that don't refer to a secret in
+// the config of a runnable or deployment record
+func RedactCredentialsJSON(config string) string {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(config), &decoded); err != nil {
+		return config
+	}
+	redacted := false
+	literalCredentials("", decoded, func(_ string, parent map[string]interface{}, key string) {
+		parent[key] = secrets.Masked
+		redacted = true
+	})
+	if !redacted {
+		return config
+	}
+	data, err := json.Marshal(decoded)
+	if err != nil {
+		return config
+	}
+	return string(data)
+}
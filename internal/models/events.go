@@ -0,0 +1,260 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Types of the lifecycle events of jobs, their steps and their deployments
+const (
+	EventJobQueued           = "job.queued"
+	EventJobWaiting          = "job.waiting"
+	EventJobStarted          = "job.started"
+	EventJobSucceeded        = "job.succeeded"
+	EventJobFailed           = "job.failed"
+	EventJobCancelled        = "job.cancelled"
+	EventJobInterrupted      = "job.interrupted"
+	EventStepStarted         = "step.started"
+	EventStepFinished        = "step.finished"
+	EventDeploymentSucceeded = "deployment.succeeded"
+	EventDeploymentFailed    = "deployment.failed"
+)
+
+// EventAll subscribes to every event type
+const EventAll = "*"
+
+// EventTypes lists every event type
+var EventTypes = []string{
+	EventJobQueued, EventJobWaiting, EventJobStarted, EventJobSucceeded, EventJobFailed, EventJobCancelled, EventJobInterrupted,
+	EventStepStarted, EventStepFinished,
+	EventDeploymentSucceeded, EventDeploymentFailed,
+}
+
+// JobEvent returns the event of a job entering status, "" when entering it
+// is not an event, such as queued which only means a worker slot claimed it
+func JobEvent(status string) string {
+	switch status {
+	case "pending":
+		return EventJobQueued
+	case "waiting":
+		return EventJobWaiting
+	case "running":
+		return EventJobStarted
+	case "success":
+		return EventJobSucceeded
+	case "failed":
+		return EventJobFailed
+	case "cancelled":
+		return EventJobCancelled
+	case "interrupted":
+		return EventJobInterrupted
+	}
+	return ""
+}
+
+// StepEvent returns the event of a step entering status, "" for pending
+func StepEvent(status string) string {
+	switch status {
+	case "pending":
+		return ""
+	case "running":
+		return EventStepStarted
+	}
+	return EventStepFinished
+}
+
+// DeploymentEvent returns the event of a deployment entering status, "" when
+// it has not finished
+func DeploymentEvent(status string) string {
+	switch status {
+	case "success":
+		return EventDeploymentSucceeded
+	case "failed":
+		return EventDeploymentFailed
+	}
+	return ""
+}
+
+// Event is something that happened to a job, one of its steps or one of its
+// deployments. Data is the JSON of the job, step or deployment at the time.
+// Restart is the restart_count of the job, so that a job re-queued by crash
+// recovery reports its lifecycle again.
+type Event struct {
+	ID           int       `db:"id" json:"id"`
+	Type         string    `db:"type" json:"type"`
+	PipelineID   int       `db:"pipeline_id" json:"pipeline_id"`
+	JobID        int       `db:"job_id" json:"job_id"`
+	StepID       *int      `db:"step_id" json:"step_id"`
+	DeploymentID *int      `db:"deployment_id" json:"deployment_id"`
+	Restart      int       `db:"restart" json:"restart"`
+	Data         string    `db:"data" json:"-"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+}
+
+// EventPayload is the body POSTed to subscriptions, and how the API returns
+// an event
+type EventPayload struct {
+	ID         int             `json:"id"`
+	Type       string          `json:"type"`
+	PipelineID int             `json:"pipeline_id"`
+	JobID      int             `json:"job_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Payload returns the payload of an event
+func (e Event) Payload() EventPayload {
+	return EventPayload{
+		ID:         e.ID,
+		Type:       e.Type,
+		PipelineID: e.PipelineID,
+		JobID:      e.JobID,
+		CreatedAt:  e.CreatedAt,
+		Data:       json.RawMessage(e.Data),
+	}
+}
+
+// EventJobData is the data of job events
+type EventJobData struct {
+	Job Job `json:"job"`
+}
+
+// EventStepData is the data of step events. The output of the step is left
+// out, it is read from the API.
+type EventStepData struct {
+	Job  Job  `json:"job"`
+	Step Step `json:"step"`
+}
+
+// EventDeploymentData is the data of deployment events
+type EventDeploymentData struct {
+	Job        Job        `json:"job"`
+	Deployment Deployment `json:"deployment"`
+}
+
+// EventSubscription is an HTTP endpoint events of the chosen types are
+// POSTed to, those of one pipeline when PipelineID is set. Events is the
+// JSON list of the types. Payloads are signed with Secret, which is only
+// returned when the subscription is created.
+type EventSubscription struct {
+	ID         int       `db:"id" json:"id"`
+	URL        string    `db:"url" json:"url"`
+	Events     string    `db:"events" json:"events"`
+	PipelineID *int      `db:"pipeline_id" json:"pipeline_id"`
+	Secret     string    `db:"secret" json:"-"`
+	Active     bool      `db:"active" json:"active"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+// EventsJSON encodes the event types of a subscription
+func EventsJSON(events []string) (string, error) {
+	data, err := json.Marshal(events)
+	return string(data), err
+}
+
+// Wants reports whether the subscription takes events of eventType
+func (s EventSubscription) Wants(eventType string) bool {
+	var events []string
+	if err := json.Unmarshal([]byte(s.Events), &events); err != nil {
+		return false
+	}
+	for _, event := range events {
+		if event == eventType || event == EventAll {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionLookupTimeout bounds resolving the host of a subscription
+const subscriptionLookupTimeout = 5 * time.Second
+
+// ValidateSubscription checks the URL and event types of a subscription.
+// Unless allowPrivate, the host of the URL must only resolve to addresses
+// ForbiddenAddress lets through, so that subscriptions can't reach the
+// server itself or its network.
+func ValidateSubscription(endpoint string, events []string, allowPrivate bool) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if !allowPrivate {
+		if err := checkSubscriptionHost(parsed.Hostname()); err != nil {
+			return err
+		}
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("events is required, use %q for every event", EventAll)
+	}
+	for _, event := range events {
+		if event == EventAll {
+			continue
+		}
+		known := false
+		for _, eventType := range EventTypes {
+			if event == eventType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// checkSubscriptionHost resolves the host of a subscription and rejects it
+// when any of its addresses is forbidden
+func checkSubscriptionHost(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), subscriptionLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("url host %s can't be resolved", host)
+	}
+	for _, addr := range addrs {
+		if ForbiddenAddress(addr.IP) {
+			return fmt.Errorf("url host %s is a loopback, link-local or private address", host)
+		}
+	}
+	return nil
+}
+
+// ForbiddenAddress reports whether ip is a loopback, link-local, private,
+// multicast or unspecified address, which subscriptions may not reach
+func ForbiddenAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// Statuses of deliveries. A pending delivery is sent again at NextAttemptAt
+// until it succeeds or runs out of attempts and fails.
+const (
+	DeliveryPending = "pending"
+	DeliverySuccess = "success"
+	DeliveryFailed  = "failed"
+)
+
+// EventDelivery is the sending of an event to a subscription, with the
+// response or error of its last attempt. ResponseBody is only kept when the
+// server is configured to. Redelivering an event adds a delivery.
+type EventDelivery struct {
+	ID             int        `db:"id" json:"id"`
+	SubscriptionID int        `db:"subscription_id" json:"subscription_id"`
+	EventID        int        `db:"event_id" json:"event_id"`
+	EventType      string     `db:"event_type" json:"event_type"`
+	Status         string     `db:"status" json:"status"`
+	Attempts       int        `db:"attempts" json:"attempts"`
+	NextAttemptAt  *time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	ResponseStatus *int       `db:"response_status" json:"response_status"`
+	ResponseBody   *string    `db:"response_body" json:"response_body"`
+	Error          *string    `db:"error" json:"error"`
+	DurationMs     *int       `db:"duration_ms" json:"duration_ms"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	LastAttemptAt  *time.Time `db:"last_attempt_at" json:"last_attempt_at"`
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Executors a pipeline can run its jobs with. Docker runs the steps in a
+// container on the worker's Docker daemon, local runs them as shell commands
+// on the worker itself and ssh runs them in a container on a remote Docker
+// daemon reached over SSH.
+const (
+	ExecutorDocker = "docker"
+	ExecutorLocal  = "local"
+	ExecutorSSH    = "ssh"
+)
+
+// ExecutorConfig chooses the executor of a pipeline's jobs. The ssh executor
+// takes the connection settings of the vps deployment in Config: host,
+// ssh_user, ssh_key_path, ssh_port and docker_host.
+type ExecutorConfig struct {
+	Type   string                 `yaml:"type" json:"type"`
+	Config map[string]interface{} `yaml:"config,omitempty" json:"config,omitempty"`
+}
+
+// ExecutorType returns the executor a job runs with, docker when the pipeline
+// doesn't choose one
+func ExecutorType(executor *ExecutorConfig) string {
+	if executor == nil || executor.Type == "" {
+		return ExecutorDocker
+	}
+	return executor.Type
+}
+
+// ParseExecutor decodes the executor stored with a job. Jobs created before
+// executors could be chosen have none.
+func ParseExecutor(executor *string) (*ExecutorConfig, error) {
+	if executor == nil || *executor == "" {
+		return nil, nil
+	}
+	var config ExecutorConfig
+	if err := json.Unmarshal([]byte(*executor), &config); err != nil {
+		return nil, fmt.Errorf("invalid executor: %v", err)
+	}
+	return &config, nil
+}
+
+// DecodeConfig decodes the executor options into v
+func (e *ExecutorConfig) DecodeConfig(v interface{}) error {
+	data, err := json.Marshal(e.Config)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// validateExecutor checks the executor and that the pipeline only uses what
+// it supports. Services, network policies and resource limits need a
+// container; images are built and kept on the worker's Docker daemon.
+func (c *PipelineConfig) validateExecutor() error {
+	executor := ExecutorType(c.Executor)
+	switch executor {
+	case ExecutorDocker:
+		return nil
+	case ExecutorLocal:
+		if len(c.Services) > 0 {
+			return fmt.Errorf("the local executor doesn't support services")
+		}
+		if c.Resources != nil {
+			return fmt.Errorf("the local executor doesn't support resources")
+		}
+		if c.ExposePorts {
+			return fmt.Errorf("the local executor doesn't support expose_ports")
+		}
+		if c.Network != "" && c.Network != NetworkDefault {
+			return fmt.Errorf("the local executor doesn't support network policies")
+		}
+		for i, step := range c.Steps {
+			if step.Network != "" && step.Network != NetworkDefault {
+				return fmt.Errorf("step %d: the local executor doesn't support network policies", i+1)
+			}
+		}
+	case ExecutorSSH:
+		var config struct {
+			Host       string `json:"host"`
+			SSHUser    string `json:"ssh_user"`
+			SSHKeyPath string `json:"ssh_key_path"`
+		}
+		if err := c.Executor.DecodeConfig(&config); err != nil {
+			return fmt.Errorf("invalid ssh executor config: %v", err)
+		}
+		if config.Host == "" || config.SSHUser == "" || config.SSHKeyPath == "" {
+			return fmt.Errorf("the ssh executor needs host, ssh_user and ssh_key_path")
+		}
+	default:
+		return fmt.Errorf("executor must be %s, %s or %s", ExecutorDocker, ExecutorLocal, ExecutorSSH)
+	}
+
+	if c.Temporary {
+		return fmt.Errorf("temporary jobs need the %s executor", ExecutorDocker)
+	}
+	for _, runnable := range c.Runnables {
+		if runnable.Type == "docker_image" || runnable.Type == "docker_container" {
+			return fmt.Errorf("runnable %s: %s runnables need the %s executor", runnable.Name, runnable.Type, ExecutorDocker)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Encodings of the content of step files. Base64 content is decoded when the
+// file is written, so binary files can be part of a pipeline.
+const (
+	FileEncodingText   = ""
+	FileEncodingBase64 = "base64"
+)
+
+// Modes step files and directories get unless they set one
+const (
+	DefaultFileMode = 0644
+	DefaultDirMode  = 0755
+)
+
+// ownerPattern matches the owner of a step file: a user and optionally a
+// group, by name or id, as chown takes them
+var ownerPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`)
+
+// StepFile is a file a step creates in the workspace before it runs. It is
+// written as either its content alone:
+//
+//	files:
+//	  config.json: '{"debug": true}'
+//	  logo.png: !!binary iVBORw0KGgo...
+//
+// or with its options:
+//
+//	files:
+//	  deploy.sh:
+//	    content: ./release.sh
+//	    mode: "0755"
+//	    owner: app:app
+//	  keystore.jks:
+//	    content: ${{ secrets.KEYSTORE }}
+//	    encoding: base64
+//	  cache/: {}
+//
+// Names ending with a slash are directories, which have no content. Mode is
+// octal and Owner is given to chown.
+type StepFile struct {
+	Content  string `yaml:"content,omitempty" json:"content,omitempty"`
+	Encoding string `yaml:"encoding,omitempty" json:"encoding,omitempty"`
+	Mode     string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Owner    string `yaml:"owner,omitempty" json:"owner,omitempty"`
+}
+
+// UnmarshalYAML takes either the content of the file or its options. Content
+// tagged !!binary is base64.
+func (f *StepFile) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*f = StepFile{}
+		if value.Tag != "!!null" {
+			f.Content = value.Value
+		}
+		if value.Tag == "!!binary" {
+			f.Encoding = FileEncodingBase64
+		}
+		return nil
+	}
+	type options StepFile
+	var decoded options
+	if err := value.Decode(&decoded); err != nil {
+		return err
+	}
+	*f = StepFile(decoded)
+	// Decoding a !!binary scalar into a string decodes it, keep the base64
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if value.Content[i].Value == "content" && value.Content[i+1].Tag == "!!binary" {
+			f.Content = value.Content[i+1].Value
+			f.Encoding = FileEncodingBase64
+		}
+	}
+	return nil
+}
+
+// MarshalYAML writes a file with no options as its content alone
+func (f StepFile) MarshalYAML() (interface{}, error) {
+	if f.Encoding == FileEncodingText && f.Mode == "" && f.Owner == "" {
+		return f.Content, nil
+	}
+	type options StepFile
+	return options(f), nil
+}
+
+// UnmarshalJSON takes either the content of the file or its options
+func (f *StepFile) UnmarshalJSON(data []byte) error {
+	var content string
+	if err := json.Unmarshal(data, &content); err == nil {
+		*f = StepFile{Content: content}
+		return nil
+	}
+	type options StepFile
+	var decoded options
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*f = StepFile(decoded)
+	return nil
+}
+
+// IsStepDir reports whether a step file name is a directory
+func IsStepDir(name string) bool {
+	return strings.HasSuffix(name, "/")
+}
+
+// CleanFilePath returns the path of a step file relative to the workspace. It
+// fails for paths that are absolute or leave the workspace.
+func CleanFilePath(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("invalid path %q", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("path %q must be relative to the workspace and stay in it", name)
+	}
+	return clean, nil
+}
+
+// ParseFileMode parses the octal mode of a step file, def when it has none
+func ParseFileMode(mode string, def int64) (int64, error) {
+	if mode == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseInt(mode, 8, 64)
+	if err != nil || parsed < 0 || parsed > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal such as 0644", mode)
+	}
+	return parsed, nil
+}
+
+// DecodeFileContent returns the bytes a step file holds
+func DecodeFileContent(content, encoding string) ([]byte, error) {
+	switch encoding {
+	case FileEncodingText:
+		return []byte(content), nil
+	case FileEncodingBase64:
+		// Long base64 is often wrapped over several lines
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(content), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 content: %v", err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q, expected base64", encoding)
+}
+
+// validate checks a step file named name. Base64 content that refers to
+// variables is only decoded once they are expanded.
+func (f StepFile) validate(name string) error {
+	if _, err := CleanFilePath(name); err != nil {
+		return err
+	}
+	def := int64(DefaultFileMode)
+	if IsStepDir(name) {
+		if f.Content != "" || f.Encoding != FileEncodingText {
+			return fmt.Errorf("directories have no content")
+		}
+		def = DefaultDirMode
+	}
+	if _, err := ParseFileMode(f.Mode, def); err != nil {
+		return err
+	}
+	if f.Owner != "" && !ownerPattern.MatchString(f.Owner) {
+		return fmt.Errorf("invalid owner %q, expected user or user:group", f.Owner)
+	}
+	if f.Encoding == FileEncodingBase64 && strings.Contains(f.Content, "${{") {
+		return nil
+	}
+	_, err := DecodeFileContent(f.Content, f.Encoding)
+	return err
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StepRefs are the ids of the steps a step depends on. A step without
+// depends_on has none, while `depends_on: []` puts it in a graph with no
+// dependencies, so storing a config keeps an empty list and only leaves out a
+// missing one.
+type StepRefs []string
+
+// IsZero makes omitempty leave out only a missing list
+func (r StepRefs) IsZero() bool {
+	return r == nil
+}
+
+// StepKey returns the id of the step at index i. Steps without an id are named
+// after their position, e.g. "step-2".
+func (c *PipelineConfig) StepKey(i int) string {
+	if c.Steps[i].ID != "" {
+		return c.Steps[i].ID
+	}
+	return fmt.Sprintf("step-%d", i+1)
+}
+
+// UsesStepGraph reports whether any step declares depends_on. Pipelines that
+// don't keep running their steps one after another.
+func (c *PipelineConfig) UsesStepGraph() bool {
+	for _, step := range c.Steps {
+		if step.DependsOn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// StepDependencies returns the keys every step waits for before it may start
+func (c *PipelineConfig) StepDependencies() [][]string {
+	deps := make([][]string, len(c.Steps))
+	graph := c.UsesStepGraph()
+	for i, step := range c.Steps {
+		deps[i] = []string{}
+		if graph {
+			deps[i] = append(deps[i], step.DependsOn...)
+		} else if i > 0 {
+			deps[i] = append(deps[i], c.StepKey(i-1))
+		}
+	}
+	return deps
+}
+
+// validateStepGraph rejects duplicate step ids, dependencies on steps that
+// don't exist and dependency cycles
+func (c *PipelineConfig) validateStepGraph() error {
+	index := make(map[string]int, len(c.Steps))
+	for i := range c.Steps {
+		key := c.StepKey(i)
+		if j, ok := index[key]; ok {
+			return fmt.Errorf("step %d: id %q is already used by step %d", i+1, key, j+1)
+		}
+		index[key] = i
+	}
+
+	deps := c.StepDependencies()
+	for i, stepDeps := range deps {
+		for _, dep := range stepDeps {
+			if _, ok := index[dep]; !ok {
+				return fmt.Errorf("step %d: depends_on unknown step %q", i+1, dep)
+			}
+			if dep == c.StepKey(i) {
+				return fmt.Errorf("step %d: depends on itself", i+1)
+			}
+		}
+	}
+
+	// Depth-first search, a step reached again while still on the path closes a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(c.Steps))
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			start := 0
+			for j, key := range path {
+				if key == c.StepKey(i) {
+					start = j
+				}
+			}
+			cycle := append(append([]string{}, path[start:]...), c.StepKey(i))
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		path = append(path, c.StepKey(i))
+		for _, dep := range deps[i] {
+			if err := visit(index[dep]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range c.Steps {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dependsOn reports whether the step at index i waits for the step named key,
+// either directly or through other steps
+func (c *PipelineConfig) dependsOn(i int, key string) bool {
+	index := make(map[string]int, len(c.Steps))
+	for j := range c.Steps {
+		index[c.StepKey(j)] = j
+	}
+	deps := c.StepDependencies()
+
+	seen := make(map[int]bool)
+	queue := []int{i}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, dep := range deps[current] {
+			if dep == key {
+				return true
+			}
+			j, ok := index[dep]
+			if ok && !seen[j] {
+				seen[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+	return false
+}
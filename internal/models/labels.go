@@ -0,0 +1,61 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// labelPattern matches runner labels such as "arm64", "docker" or "disk.large"
+var labelPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// ValidateLabels checks the labels of a runner or the runs_on of a pipeline
+func ValidateLabels(labels []string) error {
+	for _, label := range labels {
+		if !labelPattern.MatchString(label) {
+			return fmt.Errorf("%q is not a valid label", label)
+		}
+	}
+	return nil
+}
+
+// LabelsJSON encodes labels stored with a job or an agent, nil when there are
+// none
+func LabelsJSON(labels []string) (*string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	encoded := string(data)
+	return &encoded, nil
+}
+
+// ParseLabels decodes labels stored with a job or an agent
+func ParseLabels(labels *string) ([]string, error) {
+	if labels == nil || *labels == "" {
+		return nil, nil
+	}
+	var decoded []string
+	if err := json.Unmarshal([]byte(*labels), &decoded); err != nil {
+		return nil, fmt.Errorf("invalid labels: %v", err)
+	}
+	return decoded, nil
+}
+
+// HasLabels reports whether a runner with labels may run a job that runs on
+// runsOn, that is whether labels has every label of runsOn
+func HasLabels(labels, runsOn []string) bool {
+	have := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		have[label] = true
+	}
+	for _, label := range runsOn {
+		if !have[label] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Streams of log lines. System lines are written by the runner rather than
+// the step, such as the banner of a retried attempt on an agent.
+const (
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+	LogStreamSystem = "system"
+)
+
+// LogLine is a line a step printed, stored as soon as it is read. Seq orders
+// the lines of a step across its attempts and ID those of a job; they are the
+// cursors of /steps/:id/lines and /jobs/:id/lines.
+type LogLine struct {
+	ID        int       `db:"id" json:"id"`
+	JobID     int       `db:"job_id" json:"job_id"`
+	StepID    int       `db:"step_id" json:"step_id"`
+	Attempt   int       `db:"attempt" json:"attempt"`
+	Seq       int       `db:"seq" json:"seq"`
+	Stream    string    `db:"stream" json:"stream"`
+	Line      string    `db:"line" json:"line"`
+	Timestamp time.Time `db:"timestamp" json:"timestamp"`
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxMatrixJobs caps how many child jobs a matrix may expand to
+const MaxMatrixJobs = 64
+
+// MatrixConfig expands a pipeline into one job per combination of axis values.
+// The language and version axes set the job's language and version, every
+// other axis becomes an environment variable.
+type MatrixConfig struct {
+	Axes    map[string][]string `yaml:"axes" json:"axes"`
+	Include []map[string]string `yaml:"include,omitempty" json:"include,omitempty"`
+	Exclude []map[string]string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+}
+
+// Combinations returns every combination of axis values, in axis order, minus
+// the excluded ones, followed by the included combinations that aren't
+// already present
+func (m *MatrixConfig) Combinations() []map[string]string {
+	names := make([]string, 0, len(m.Axes))
+	for name := range m.Axes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var combinations []map[string]string
+	if len(names) > 0 {
+		combinations = []map[string]string{{}}
+		for _, name := range names {
+			var next []map[string]string
+			for _, combination := range combinations {
+				for _, value := range m.Axes[name] {
+					expanded := make(map[string]string, len(combination)+1)
+					for k, v := range combination {
+						expanded[k] = v
+					}
+					expanded[name] = value
+					next = append(next, expanded)
+				}
+			}
+			combinations = next
+		}
+	}
+
+	seen := make(map[string]bool)
+	var result []map[string]string
+	for _, combination := range combinations {
+		if m.excluded(combination) {
+			continue
+		}
+		seen[MatrixKey(combination)] = true
+		result = append(result, combination)
+	}
+	for _, include := range m.Include {
+		if seen[MatrixKey(include)] {
+			continue
+		}
+		seen[MatrixKey(include)] = true
+		result = append(result, include)
+	}
+	return result
+}
+
+// excluded reports whether a combination matches any exclude rule. A rule
+// matches when every value it lists matches.
+func (m *MatrixConfig) excluded(combination map[string]string) bool {
+	for _, rule := range m.Exclude {
+		matches := true
+		for k, v := range rule {
+			if combination[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the matrix for empty axes, unknown exclude keys and the
+// number of combinations
+func (m *MatrixConfig) validate() error {
+	if len(m.Axes) == 0 && len(m.Include) == 0 {
+		return fmt.Errorf("needs at least one axis or include")
+	}
+	for name, values := range m.Axes {
+		if len(values) == 0 {
+			return fmt.Errorf("axis %s has no values", name)
+		}
+	}
+	for i, rule := range m.Exclude {
+		if len(rule) == 0 {
+			return fmt.Errorf("exclude %d is empty", i+1)
+		}
+		for k := range rule {
+			if _, ok := m.Axes[k]; !ok {
+				return fmt.Errorf("exclude %d: unknown axis %s", i+1, k)
+			}
+		}
+	}
+	for i, include := range m.Include {
+		if len(include) == 0 {
+			return fmt.Errorf("include %d is empty", i+1)
+		}
+	}
+
+	// The axes are multiplied out before anything is built, so a matrix too
+	// big to expand is refused without expanding it. Excludes only remove
+	// combinations from those the axes allow.
+	product := 1
+	for _, values := range m.Axes {
+		product *= len(values)
+		if product > MaxMatrixJobs {
+			return fmt.Errorf("axes expand to more than %d jobs", MaxMatrixJobs)
+		}
+	}
+
+	count := len(m.Combinations())
+	if count == 0 {
+		return fmt.Errorf("every combination is excluded")
+	}
+	if count > MaxMatrixJobs {
+		return fmt.Errorf("expands to %d jobs, at most %d are allowed", count, MaxMatrixJobs)
+	}
+	return nil
+}
+
+// MatrixKey returns a stable string for a combination, e.g. "CGO_ENABLED=0,version=1.22"
+func MatrixKey(values map[string]string) string {
+	pairs := make([]string, 0, len(values))
+	for k, v := range values {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// ForMatrix returns the configuration of the child job for one combination
+func (c PipelineConfig) ForMatrix(values map[string]string) PipelineConfig {
+	env := make(map[string]string, len(c.Env)+len(values))
+	for k, v := range c.Env {
+		env[k] = v
+	}
+	for k, v := range values {
+		switch k {
+		case "language":
+			c.Language = v
+		case "version":
+			c.Version = v
+		default:
+			env[k] = v
+		}
+	}
+	c.Env = env
+	return c
+}
+
+// MatrixStatus sums up the statuses of a matrix run's jobs: running while any
+// job hasn't finished, then failed if any failed, cancelled if any was stopped
+// and success otherwise
+func MatrixStatus(statuses []string) string {
+	status := "success"
+	pending := 0
+	for _, s := range statuses {
+		switch s {
+		case "pending", "waiting":
+			pending++
+		case "queued", "running":
+			return "running"
+		case "failed":
+			status = "failed"
+		case "cancelled", "interrupted", "stopped":
+			if status == "success" {
+				status = "cancelled"
+			}
+		}
+	}
+	if pending == len(statuses) {
+		return "pending"
+	}
+	if pending > 0 {
+		return "running"
+	}
+	return status
+}
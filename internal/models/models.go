@@ -1,6 +1,8 @@
 package models
 
 import (
+	"encoding/json"
+	"path"
 	"time"
 )
 
@@ -8,37 +10,99 @@ type Pipeline struct {
 	ID        int       `db:"id" json:"id"`
 	Name      string    `db:"name" json:"name"`
 	Config    string    `db:"config" json:"config"`
+	Retention *string   `db:"retention" json:"retention"`
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 }
 
 type Job struct {
-	ID          int        `db:"id" json:"id"`
-	PipelineID  int        `db:"pipeline_id" json:"pipeline_id"`
-	Status      string     `db:"status" json:"status"`
-	Branch      *string    `db:"branch" json:"branch"`
-	RepoName    *string    `db:"repo_name" json:"repo_name"`
-	RepoURL     *string    `db:"repo_url" json:"repo_url"`
-	Language    *string    `db:"language" json:"language"`
-	Version     *string    `db:"version" json:"version"`
-	Folder      *string    `db:"folder" json:"folder"`
-	ExposePorts *bool      `db:"expose_ports" json:"expose_ports"`
-	Temporary   *bool      `db:"temporary" json:"temporary"`
-	TempDir     *string    `db:"temp_dir" json:"temp_dir"`
-	Cancelled   bool       `db:"cancelled" json:"cancelled"`
-	ContainerID *string    `db:"container_id" json:"container_id"`
-	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
-	StartedAt   *time.Time `db:"started_at" json:"started_at"`
-	FinishedAt  *time.Time `db:"finished_at" json:"finished_at"`
+	ID            int        `db:"id" json:"id"`
+	PipelineID    int        `db:"pipeline_id" json:"pipeline_id"`
+	Status        string     `db:"status" json:"status"`
+	Branch        *string    `db:"branch" json:"branch"`
+	RepoName      *string    `db:"repo_name" json:"repo_name"`
+	RepoURL       *string    `db:"repo_url" json:"repo_url"`
+	Language      *string    `db:"language" json:"language"`
+	Version       *string    `db:"version" json:"version"`
+	Folder        *string    `db:"folder" json:"folder"`
+	ExposePorts   *bool      `db:"expose_ports" json:"expose_ports"`
+	Temporary     *bool      `db:"temporary" json:"temporary"`
+	TempDir       *string    `db:"temp_dir" json:"temp_dir"`
+	Cancelled     bool       `db:"cancelled" json:"cancelled"`
+	ContainerID   *string    `db:"container_id" json:"container_id"`
+	RestartPolicy *string    `db:"restart_policy" json:"restart_policy"`
+	Resources     *string    `db:"resources" json:"resources"`
+	Timeout       *string    `db:"timeout" json:"timeout"`
+	MaxParallel   *int       `db:"max_parallel" json:"max_parallel"`
+	Trigger       *string    `db:"trigger" json:"trigger"`
+	Tag           *string    `db:"tag" json:"tag"`
+	MatrixRunID   *int       `db:"matrix_run_id" json:"matrix_run_id"`
+	MatrixValues  *string    `db:"matrix_values" json:"matrix_values"`
+	Services      *string    `db:"services" json:"services"`
+	Network       *string    `db:"network" json:"network"`
+	Cache         *string    `db:"cache" json:"cache"`
+	CommitSHA     *string    `db:"commit_sha" json:"commit_sha"`
+	Executor      *string    `db:"executor" json:"executor"`
+	RunsOn        *string    `db:"runs_on" json:"runs_on"`
+	AgentID       *int       `db:"agent_id" json:"agent_id"`
+	LeaseExpires  *time.Time `db:"lease_expires_at" json:"lease_expires_at"`
+	RestartCount  int        `db:"restart_count" json:"restart_count"`
+	StatusReason  *string    `db:"status_reason" json:"status_reason"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	StartedAt     *time.Time `db:"started_at" json:"started_at"`
+	FinishedAt    *time.Time `db:"finished_at" json:"finished_at"`
 }
 
 type Step struct {
+	ID           int       `db:"id" json:"id"`
+	JobID        int       `db:"job_id" json:"job_id"`
+	OrderNum     int       `db:"order_num" json:"order_num"`
+	Type         string    `db:"type" json:"type"`
+	Content      string    `db:"content" json:"content"`
+	Status       string    `db:"status" json:"status"`
+	Output       *string   `db:"output" json:"output"`
+	Outputs      *string   `db:"outputs" json:"outputs"`
+	StatusReason *string   `db:"status_reason" json:"status_reason"`
+	Config       *string   `db:"config" json:"config"`
+	StepKey      *string   `db:"step_key" json:"step_key"`
+	DependsOn    *string   `db:"depends_on" json:"depends_on"`
+	Attempts     int       `db:"attempts" json:"attempts"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+}
+
+type StepAttempt struct {
+	ID           int        `db:"id" json:"id"`
+	StepID       int        `db:"step_id" json:"step_id"`
+	Attempt      int        `db:"attempt" json:"attempt"`
+	Status       string     `db:"status" json:"status"`
+	ExitCode     *int       `db:"exit_code" json:"exit_code"`
+	Output       *string    `db:"output" json:"output"`
+	StatusReason *string    `db:"status_reason" json:"status_reason"`
+	StartedAt    time.Time  `db:"started_at" json:"started_at"`
+	FinishedAt   *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// Cache is a saved set of cached paths, shared by the jobs of a pipeline
+type Cache struct {
+	ID         int       `db:"id" json:"id"`
+	PipelineID int       `db:"pipeline_id" json:"pipeline_id"`
+	Key        string    `db:"key" json:"key"`
+	Paths      string    `db:"paths" json:"paths"`
+	Size       int64     `db:"size" json:"size"`
+	Hits       int       `db:"hits" json:"hits"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	LastUsedAt time.Time `db:"last_used_at" json:"last_used_at"`
+}
+
+// JobCache records whether a job found a cache and whether it saved one
+type JobCache struct {
 	ID        int       `db:"id" json:"id"`
 	JobID     int       `db:"job_id" json:"job_id"`
-	OrderNum  int       `db:"order_num" json:"order_num"`
-	Type      string    `db:"type" json:"type"`
-	Content   string    `db:"content" json:"content"`
-	Status    string    `db:"status" json:"status"`
-	Output    *string   `db:"output" json:"output"`
+	StepID    *int      `db:"step_id" json:"step_id"`
+	Key       string    `db:"key" json:"key"`
+	Hit       bool      `db:"hit" json:"hit"`
+	Saved     bool      `db:"saved" json:"saved"`
+	Size      int64     `db:"size" json:"size"`
+	Reason    *string   `db:"reason" json:"reason"`
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 }
 
@@ -49,34 +113,92 @@ type Environment struct {
 	Value string `db:"value" json:"value"`
 }
 
+// File is a file of a step, see StepFile. Names ending with a slash are
+// directories.
 type File struct {
-	ID      int    `db:"id" json:"id"`
-	StepID  int    `db:"step_id" json:"step_id"`
-	Name    string `db:"name" json:"name"`
-	Content string `db:"content" json:"content"`
+	ID       int    `db:"id" json:"id"`
+	StepID   int    `db:"step_id" json:"step_id"`
+	Name     string `db:"name" json:"name"`
+	Content  string `db:"content" json:"content"`
+	Encoding string `db:"encoding" json:"encoding,omitempty"`
+	Mode     string `db:"mode" json:"mode,omitempty"`
+	Owner    string `db:"owner" json:"owner,omitempty"`
 }
 
 type PipelineConfig struct {
-	Name        string            `yaml:"name"`
-	Language    string            `yaml:"language,omitempty"`
-	Version     string            `yaml:"version,omitempty"`
-	Branch      string            `yaml:"branch,omitempty"`
-	RepoName    string            `yaml:"repo_name,omitempty"`
-	RepoURL     string            `yaml:"repo_url,omitempty"`
-	Folder      string            `yaml:"folder,omitempty"`
-	ExposePorts bool              `yaml:"expose_ports,omitempty"`
-	Temporary   bool              `yaml:"temporary,omitempty"`
-	Env         map[string]string `yaml:"env"`
-	Steps       []StepConfig      `yaml:"steps"`
-	Runnables   []RunnableConfig  `yaml:"runnables,omitempty"`
+	Name          string            `yaml:"name"`
+	Language      string            `yaml:"language,omitempty"`
+	Version       string            `yaml:"version,omitempty"`
+	Branch        string            `yaml:"branch,omitempty"`
+	RepoName      string            `yaml:"repo_name,omitempty"`
+	RepoURL       string            `yaml:"repo_url,omitempty"`
+	Folder        string            `yaml:"folder,omitempty"`
+	ExposePorts   bool              `yaml:"expose_ports,omitempty"`
+	Temporary     bool              `yaml:"temporary,omitempty"`
+	RestartPolicy string            `yaml:"restart_policy,omitempty" json:"restart_policy,omitempty"`
+	Resources     *ResourceConfig   `yaml:"resources,omitempty" json:"resources,omitempty"`
+	Timeout       string            `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	MaxParallel   int               `yaml:"max_parallel,omitempty" json:"max_parallel,omitempty"`
+	Matrix        *MatrixConfig     `yaml:"matrix,omitempty" json:"matrix,omitempty"`
+	Services      []ServiceConfig   `yaml:"services,omitempty" json:"services,omitempty"`
+	Network       string            `yaml:"network,omitempty" json:"network,omitempty"`
+	Cache         []CacheConfig     `yaml:"cache,omitempty" json:"cache,omitempty"`
+	Retention     *RetentionConfig  `yaml:"retention,omitempty" json:"retention,omitempty"`
+	Executor      *ExecutorConfig   `yaml:"executor,omitempty" json:"executor,omitempty"`
+	RunsOn        []string          `yaml:"runs_on,omitempty" json:"runs_on,omitempty"`
+	Env           map[string]string `yaml:"env"`
+	Steps         []StepConfig      `yaml:"steps"`
+	Runnables     []RunnableConfig  `yaml:"runnables,omitempty"`
 }
 
+// Triggers recorded on jobs, available to step conditions as `trigger`
+const (
+	TriggerAPI   = "api"
+	TriggerCLI   = "cli"
+	TriggerRetry = "retry"
+)
+
+// Network policies for the steps of a job. Default steps reach the internet
+// and the job's services, restricted steps only the services and steps with
+// none have no network at all.
+const (
+	NetworkDefault    = "default"
+	NetworkRestricted = "restricted"
+	NetworkNone       = "none"
+)
+
+// Restart policies for jobs interrupted by a server restart
+const (
+	RestartPolicyFail    = "fail"
+	RestartPolicyRequeue = "requeue"
+)
+
 type StepConfig struct {
-	Type    string            `yaml:"type"`
-	Content string            `yaml:"content"`
-	Files   map[string]string `yaml:"files"`
+	ID              string              `yaml:"id,omitempty" json:"id,omitempty"`
+	If              string              `yaml:"if,omitempty" json:"if,omitempty"`
+	Type            string              `yaml:"type"`
+	Content         string              `yaml:"content"`
+	Files           map[string]StepFile `yaml:"files"`
+	Timeout         string              `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	DependsOn       StepRefs            `yaml:"depends_on,omitempty" json:"depends_on"`
+	Retry           *RetryConfig        `yaml:"retry,omitempty" json:"retry,omitempty"`
+	ContinueOnError bool                `yaml:"continue_on_error,omitempty" json:"continue_on_error,omitempty"`
+	Network         string              `yaml:"network,omitempty" json:"network,omitempty"`
+	Cache           []CacheConfig       `yaml:"cache,omitempty" json:"cache,omitempty"`
+}
+
+// RetryConfig re-runs a failed step. Backoff is the delay before the second
+// attempt and doubles for every attempt after that. Without OnExitCodes every
+// failure, including a timeout, is retried.
+type RetryConfig struct {
+	MaxAttempts int    `yaml:"max_attempts" json:"max_attempts"`
+	Backoff     string `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+	OnExitCodes []int  `yaml:"on_exit_codes,omitempty" json:"on_exit_codes,omitempty"`
 }
 
+// MaxStepAttempts caps retry.max_attempts
+const MaxStepAttempts = 10
+
 type RunnableConfig struct {
 	Type          string                 `yaml:"type"`
 	Name          string                 `yaml:"name"`
@@ -84,12 +206,69 @@ type RunnableConfig struct {
 	Config        map[string]interface{} `yaml:"config"`
 	Outputs       []OutputConfig         `yaml:"outputs"`
 	Dockerfile    string                 `yaml:"dockerfile"`
+	Context       string                 `yaml:"context" json:"context"`
+	BuildArgs     map[string]string      `yaml:"build_args" json:"build_args"`
+	Target        string                 `yaml:"target" json:"target"`
 	Entrypoint    []string               `yaml:"entrypoint"`
 	Ports         []string               `yaml:"ports"`
 	Environment   map[string]string      `yaml:"environment"`
 	ContainerName string                 `yaml:"container_name"`
 	ImageName     string                 `yaml:"image_name"`
 	WorkingDir    string                 `yaml:"working_dir"`
+	Resources     *ResourceConfig        `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+// BuildContextPath returns the container path of the directory an image is
+// built from. A relative context is taken from /workspace.
+func (r RunnableConfig) BuildContextPath() string {
+	if r.Context == "" {
+		return "/workspace"
+	}
+	if path.IsAbs(r.Context) {
+		return path.Clean(r.Context)
+	}
+	return path.Join("/workspace", r.Context)
+}
+
+// ResourceConfig limits the resources a container may use. Sizes use Docker
+// notation such as "512m" or "2g". Disk limits the writable layer of the
+// container, which needs a storage driver with quotas such as overlay2 on xfs
+// with pquota.
+type ResourceConfig struct {
+	CPUs       float64                 `yaml:"cpus,omitempty" json:"cpus,omitempty"`
+	Memory     string                  `yaml:"memory,omitempty" json:"memory,omitempty"`
+	MemorySwap string                  `yaml:"memory_swap,omitempty" json:"memory_swap,omitempty"`
+	PidsLimit  int64                   `yaml:"pids_limit,omitempty" json:"pids_limit,omitempty"`
+	ShmSize    string                  `yaml:"shm_size,omitempty" json:"shm_size,omitempty"`
+	Disk       string                  `yaml:"disk,omitempty" json:"disk,omitempty"`
+	Ulimits    map[string]UlimitConfig `yaml:"ulimits,omitempty" json:"ulimits,omitempty"`
+}
+
+type UlimitConfig struct {
+	Soft int64 `yaml:"soft" json:"soft"`
+	Hard int64 `yaml:"hard" json:"hard"`
+}
+
+// ServiceConfig is a container started next to the build container, such as
+// a database, reachable from the steps by its name and aliases
+type ServiceConfig struct {
+	Name        string             `yaml:"name" json:"name"`
+	Image       string             `yaml:"image" json:"image"`
+	Aliases     []string           `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	Env         map[string]string  `yaml:"env,omitempty" json:"env,omitempty"`
+	Command     []string           `yaml:"command,omitempty" json:"command,omitempty"`
+	HealthCheck *HealthCheckConfig `yaml:"healthcheck,omitempty" json:"healthcheck,omitempty"`
+	Resources   *ResourceConfig    `yaml:"resources,omitempty" json:"resources,omitempty"`
+}
+
+// HealthCheckConfig overrides the health check of a service image. Test is a
+// shell command; durations use the same notation as timeouts.
+type HealthCheckConfig struct {
+	Test        string `yaml:"test" json:"test"`
+	Interval    string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Timeout     string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Retries     int    `yaml:"retries,omitempty" json:"retries,omitempty"`
+	StartPeriod string `yaml:"start_period,omitempty" json:"start_period,omitempty"`
 }
 
 type OutputConfig struct {
@@ -106,9 +285,69 @@ type Runnable struct {
 	Status      string    `db:"status" json:"status"`
 	Output      *string   `db:"output" json:"output"`
 	ArtifactURL *string   `db:"artifact_url" json:"artifact_url"`
+	ImageDigest *string   `db:"image_digest" json:"image_digest"`
 	CreatedAt   time.Time `db:"created_at" json:"created_at"`
 }
 
+// Artifact is a file built by a runnable, kept in the artifact store under its
+// sha256 digest
+type Artifact struct {
+	ID         int       `db:"id" json:"id"`
+	JobID      int       `db:"job_id" json:"job_id"`
+	RunnableID int       `db:"runnable_id" json:"runnable_id"`
+	PipelineID int       `db:"pipeline_id" json:"pipeline_id"`
+	Name       string    `db:"name" json:"name"`
+	Digest     string    `db:"digest" json:"digest"`
+	Size       int64     `db:"size" json:"size"`
+	Store      string    `db:"store" json:"store"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+// RegistryCredential is the login the registry provider uses to push to a
+// registry host. The password is encrypted with the master key and never
+// returned by the API.
+type RegistryCredential struct {
+	ID        int       `db:"id" json:"id"`
+	Registry  string    `db:"registry" json:"registry"`
+	Username  string    `db:"username" json:"username"`
+	Password  string    `db:"password" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Secret is a value steps, runnables and deployments refer to as
+// ${{ secrets.NAME }}, global or scoped to a pipeline. Value holds the
+// encrypted value and is never returned by the API.
+type Secret struct {
+	ID         int       `db:"id" json:"id"`
+	PipelineID *int      `db:"pipeline_id" json:"pipeline_id"`
+	Name       string    `db:"name" json:"name"`
+	Value      string    `db:"value" json:"-"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// RetentionConfig limits how long the artifacts of a pipeline are kept.
+// Artifacts older than MaxAge are deleted, as are those of all but the
+// KeepLast most recent jobs that built any.
+type RetentionConfig struct {
+	MaxAge   string `yaml:"max_age,omitempty" json:"max_age,omitempty"`
+	KeepLast int    `yaml:"keep_last,omitempty" json:"keep_last,omitempty"`
+}
+
+// RetentionJSON encodes the retention rules stored with a pipeline, nil when
+// it has none
+func (c PipelineConfig) RetentionJSON() (*string, error) {
+	if c.Retention == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(c.Retention)
+	if err != nil {
+		return nil, err
+	}
+	retention := string(data)
+	return &retention, nil
+}
+
 type Deployment struct {
 	ID         int       `db:"id" json:"id"`
 	RunnableID int       `db:"runnable_id" json:"runnable_id"`
@@ -120,6 +359,19 @@ type Deployment struct {
 	CreatedAt  time.Time `db:"created_at" json:"created_at"`
 }
 
+type MatrixRun struct {
+	ID         int       `db:"id" json:"id"`
+	PipelineID int       `db:"pipeline_id" json:"pipeline_id"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+type MatrixRunWithJobs struct {
+	MatrixRun MatrixRun      `json:"matrix_run"`
+	Status    string         `json:"status"`
+	Counts    map[string]int `json:"counts"`
+	Jobs      []Job          `json:"jobs"`
+}
+
 type JobWithDetails struct {
 	Job          Job           `json:"job"`
 	Pipeline     Pipeline      `json:"pipeline"`
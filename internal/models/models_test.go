@@ -0,0 +1,137 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPipelineConfigJSON(t *testing.T) {
+	body := `{
+		"name": "api",
+		"restart_policy": "requeue",
+		"max_parallel": 2,
+		"runs_on": ["linux"],
+		"resources": {"memory": "512m"},
+		"steps": [
+			{"id": "deps", "type": "shell", "content": "make deps", "depends_on": []},
+			{"id": "test", "type": "shell", "content": "make test", "depends_on": ["deps"], "continue_on_error": true}
+		],
+		"runnables": [{"type": "docker", "name": "app", "context": "web", "build_args": {"A": "1"}}]
+	}`
+	var config PipelineConfig
+	if err := json.Unmarshal([]byte(body), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.RestartPolicy != RestartPolicyRequeue || config.MaxParallel != 2 || !reflect.DeepEqual(config.RunsOn, []string{"linux"}) {
+		t.Errorf("pipeline fields lost: %+v", config)
+	}
+	if config.Resources == nil || config.Resources.Memory != "512m" {
+		t.Errorf("resources lost: %+v", config.Resources)
+	}
+	deps, test := config.Steps[0], config.Steps[1]
+	if deps.DependsOn == nil || len(deps.DependsOn) != 0 {
+		t.Errorf("depends_on [] decoded as %#v", deps.DependsOn)
+	}
+	if !reflect.DeepEqual(test.DependsOn, StepRefs{"deps"}) || !test.ContinueOnError {
+		t.Errorf("step fields lost: %+v", test)
+	}
+	if r := config.Runnables[0]; r.Context != "web" || r.BuildArgs["A"] != "1" {
+		t.Errorf("runnable fields lost: %+v", r)
+	}
+}
+
+func TestDependsOnSurvivesYAML(t *testing.T) {
+	config := PipelineConfig{Name: "api", Steps: []StepConfig{
+		{Type: "shell", Content: "a"},
+		{ID: "b", Type: "shell", Content: "b", DependsOn: StepRefs{}},
+	}}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored PipelineConfig
+	if err := yaml.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Steps[0].DependsOn != nil {
+		t.Errorf("a step without depends_on was stored with %#v", stored.Steps[0].DependsOn)
+	}
+	if stored.Steps[1].DependsOn == nil {
+		t.Errorf("depends_on: [] was dropped from\n%s", data)
+	}
+	if !stored.UsesStepGraph() {
+		t.Errorf("the stored pipeline no longer uses a step graph")
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	step := []StepConfig{{Type: "shell", Content: "true"}}
+	tests := []struct {
+		name   string
+		config PipelineConfig
+		want   string
+	}{
+		{"memory", PipelineConfig{Resources: &ResourceConfig{Memory: "lots"}}, "resources: memory: invalid size"},
+		{"cpus", PipelineConfig{Resources: &ResourceConfig{CPUs: -1}}, "resources: cpus must not be negative"},
+		{"pids_limit", PipelineConfig{Resources: &ResourceConfig{PidsLimit: -5}}, "resources: pids_limit must not be negative"},
+		{"memory_swap", PipelineConfig{Resources: &ResourceConfig{Memory: "1g", MemorySwap: "-2g"}}, "resources: memory_swap: invalid size"},
+		{"shm_size", PipelineConfig{Resources: &ResourceConfig{ShmSize: "64q"}}, "resources: shm_size:"},
+		{"ulimit name", PipelineConfig{Resources: &ResourceConfig{Ulimits: map[string]UlimitConfig{"files": {Soft: 1, Hard: 2}}}}, "resources: ulimits: invalid ulimit type: files"},
+		{"ulimit order", PipelineConfig{Resources: &ResourceConfig{Ulimits: map[string]UlimitConfig{"nofile": {Soft: 2, Hard: 1}}}}, "resources: ulimits: ulimit soft limit must be less than or equal to hard limit"},
+		{"service", PipelineConfig{Services: []ServiceConfig{{Name: "db", Image: "postgres", Resources: &ResourceConfig{Disk: "big"}}}}, "service 1: resources: disk:"},
+		{"runnable", PipelineConfig{Runnables: []RunnableConfig{{Type: "docker_container", Name: "app", Resources: &ResourceConfig{CPUs: -0.5}}}}, "runnable app: resources: cpus"},
+	}
+	for _, tt := range tests {
+		tt.config.Name = "api"
+		tt.config.Steps = step
+		err := tt.config.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Validate() = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	valid := PipelineConfig{Name: "api", Steps: step, Resources: &ResourceConfig{
+		CPUs: 1.5, Memory: "512m", MemorySwap: "-1", PidsLimit: 100, ShmSize: "64m", Disk: "10g",
+		Ulimits: map[string]UlimitConfig{"nofile": {Soft: 1024, Hard: 4096}},
+	}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("valid resources: %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	config := PipelineConfig{Name: "api", Steps: []StepConfig{{Type: "shell", Content: "true"}}, Runnables: []RunnableConfig{{
+		Type: "artifacts", Name: "site", Enabled: true,
+		Outputs: []OutputConfig{
+			{Type: "s3", Config: map[string]interface{}{"bucket": "b", "secret_access_key": "${{ secrets.AWS_SECRET }}", "password": "${AWS_PASSWORD}"}},
+			{Type: "email", Config: map[string]interface{}{"smtp": map[string]interface{}{"password": "hunter2"}, "api_key": ""}},
+		},
+	}}}
+	err := config.validateCredentials()
+	if err == nil || !strings.Contains(err.Error(), "runnable site: output 2: smtp.password must refer to a secret") {
+		t.Errorf("validateCredentials() = %v, want the literal SMTP password rejected", err)
+	}
+
+	if !config.RedactCredentials() {
+		t.Fatalf("RedactCredentials masked nothing")
+	}
+	if got := config.Runnables[0].Outputs[1].Config["smtp"].(map[string]interface{})["password"]; got != "***" {
+		t.Errorf("password = %v, want it masked", got)
+	}
+	if got := config.Runnables[0].Outputs[0].Config; got["secret_access_key"] != "${{ secrets.AWS_SECRET }}" || got["password"] != "${AWS_PASSWORD}" {
+		t.Errorf("a reference was masked: %v", got)
+	}
+
+	stored := `{"bucket":"b","nginx_pm_pass":"admin","outputs":[{"config":{"password":"${{ secrets.SMTP }}"}}]}`
+	want := `{"bucket":"b","nginx_pm_pass":"***","outputs":[{"config":{"password":"${{ secrets.SMTP }}"}}]}`
+	if got := RedactCredentialsJSON(stored); got != want {
+		t.Errorf("RedactCredentialsJSON = %s, want %s", got, want)
+	}
+	if clean := `{"bucket": "b"}`; RedactCredentialsJSON(clean) != clean {
+		t.Errorf("a config without credentials was rewritten")
+	}
+}
@@ -0,0 +1,329 @@
+package models
+
+import (
+	"docker-app/internal/expr"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// ParseDuration parses a non-negative Go duration such as "90s", "15m" or
+// "1h30m", or a plain number of seconds. An empty string is 0, which for
+// timeouts means none.
+func ParseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("duration must not be negative: %s", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %v", value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration must not be negative: %s", value)
+	}
+	return d, nil
+}
+
+// Validate checks a pipeline configuration for errors that would otherwise
+// only show up when a job runs
+func (c *PipelineConfig) Validate() error {
+	if _, err := ParseDuration(c.Timeout); err != nil {
+		return fmt.Errorf("timeout: %v", err)
+	}
+	for i, step := range c.Steps {
+		if _, err := ParseDuration(step.Timeout); err != nil {
+			return fmt.Errorf("step %d: timeout: %v", i+1, err)
+		}
+		if err := step.Retry.validate(); err != nil {
+			return fmt.Errorf("step %d: retry: %v", i+1, err)
+		}
+		if err := validateNetwork(step.Network); err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+		for j, cache := range step.Cache {
+			if err := cache.validate(); err != nil {
+				return fmt.Errorf("step %d: cache %d: %v", i+1, j+1, err)
+			}
+		}
+		for _, name := range sortedKeys(step.Files) {
+			if err := step.Files[name].validate(name); err != nil {
+				return fmt.Errorf("step %d: file %s: %v", i+1, name, err)
+			}
+		}
+	}
+	if err := validateNetwork(c.Network); err != nil {
+		return err
+	}
+	if err := validateRestartPolicy(c.RestartPolicy); err != nil {
+		return err
+	}
+	if err := c.Resources.validate(); err != nil {
+		return fmt.Errorf("resources: %v", err)
+	}
+	if err := c.validateExecutor(); err != nil {
+		return err
+	}
+	if err := ValidateLabels(c.RunsOn); err != nil {
+		return fmt.Errorf("runs_on: %v", err)
+	}
+	for i, cache := range c.Cache {
+		if err := cache.validate(); err != nil {
+			return fmt.Errorf("cache %d: %v", i+1, err)
+		}
+	}
+	if c.Matrix != nil {
+		if err := c.Matrix.validate(); err != nil {
+			return fmt.Errorf("matrix: %v", err)
+		}
+	}
+	services := make(map[string]bool)
+	for i, service := range c.Services {
+		if err := service.validate(); err != nil {
+			return fmt.Errorf("service %d: %v", i+1, err)
+		}
+		if err := service.Resources.validate(); err != nil {
+			return fmt.Errorf("service %d: resources: %v", i+1, err)
+		}
+		for _, name := range append([]string{service.Name}, service.Aliases...) {
+			if services[name] {
+				return fmt.Errorf("service %d: name %q is already used", i+1, name)
+			}
+			services[name] = true
+		}
+	}
+	for _, runnable := range c.Runnables {
+		if err := runnable.validateBuild(); err != nil {
+			return fmt.Errorf("runnable %s: %v", runnable.Name, err)
+		}
+		if err := runnable.Resources.validate(); err != nil {
+			return fmt.Errorf("runnable %s: resources: %v", runnable.Name, err)
+		}
+		for _, output := range runnable.Outputs {
+			if output.Type != "registry" {
+				continue
+			}
+			if runnable.Type != "docker_image" && runnable.Type != "docker_container" {
+				return fmt.Errorf("runnable %s: registry outputs need a docker_image or docker_container runnable", runnable.Name)
+			}
+			if image, _ := output.Config["image"].(string); image == "" {
+				return fmt.Errorf("runnable %s: registry output: image is required", runnable.Name)
+			}
+		}
+		if runnable.Type != "artifacts" && runnable.Type != "serverless" {
+			continue
+		}
+		artifacts, err := runnable.Artifacts()
+		if err == nil {
+			err = artifacts.validate()
+		}
+		if err != nil {
+			return fmt.Errorf("runnable %s: %v", runnable.Name, err)
+		}
+	}
+	if err := c.validateCredentials(); err != nil {
+		return err
+	}
+	if c.Retention != nil {
+		if _, err := ParseDuration(c.Retention.MaxAge); err != nil {
+			return fmt.Errorf("retention: max_age: %v", err)
+		}
+		if c.Retention.KeepLast < 0 {
+			return fmt.Errorf("retention: keep_last must not be negative")
+		}
+	}
+	if c.MaxParallel < 0 {
+		return fmt.Errorf("max_parallel must not be negative")
+	}
+	if err := c.validateStepGraph(); err != nil {
+		return err
+	}
+	for i, step := range c.Steps {
+		if step.If == "" {
+			continue
+		}
+		if err := c.validateCondition(i); err != nil {
+			return fmt.Errorf("step %d: if: %v", i+1, err)
+		}
+	}
+	return c.validateVariables()
+}
+
+// validate checks a retry policy; a nil policy is valid
+func (r *RetryConfig) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.MaxAttempts < 0 || r.MaxAttempts > MaxStepAttempts {
+		return fmt.Errorf("max_attempts must be between 1 and %d", MaxStepAttempts)
+	}
+	if _, err := ParseDuration(r.Backoff); err != nil {
+		return fmt.Errorf("backoff: %v", err)
+	}
+	for _, code := range r.OnExitCodes {
+		if code <= 0 || code > 255 {
+			return fmt.Errorf("on_exit_codes: %d is not a failing exit code", code)
+		}
+	}
+	return nil
+}
+
+// validate checks the sizes and counts of resource limits; nil limits are
+// valid. Whether they fit the server's maximums is only known when a job runs.
+func (r *ResourceConfig) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.CPUs < 0 || math.IsNaN(r.CPUs) || math.IsInf(r.CPUs, 0) {
+		return fmt.Errorf("cpus must not be negative")
+	}
+	if r.PidsLimit < 0 {
+		return fmt.Errorf("pids_limit must not be negative")
+	}
+	sizes := []struct {
+		name  string
+		value string
+	}{
+		{"memory", r.Memory},
+		{"memory_swap", r.MemorySwap},
+		{"shm_size", r.ShmSize},
+		{"disk", r.Disk},
+	}
+	for _, size := range sizes {
+		if size.value == "" || (size.name == "memory_swap" && size.value == "-1") {
+			continue
+		}
+		if _, err := units.RAMInBytes(size.value); err != nil {
+			return fmt.Errorf("%s: %v", size.name, err)
+		}
+	}
+	for _, name := range sortedKeys(r.Ulimits) {
+		limit := r.Ulimits[name]
+		if _, err := units.ParseUlimit(fmt.Sprintf("%s=%d:%d", name, limit.Soft, limit.Hard)); err != nil {
+			return fmt.Errorf("ulimits: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateNetwork checks a network policy; empty means the default
+func validateNetwork(network string) error {
+	switch network {
+	case "", NetworkDefault, NetworkRestricted, NetworkNone:
+		return nil
+	}
+	return fmt.Errorf("network must be %s, %s or %s", NetworkDefault, NetworkRestricted, NetworkNone)
+}
+
+// validateRestartPolicy checks a restart policy; empty means fail
+func validateRestartPolicy(policy string) error {
+	switch policy {
+	case "", RestartPolicyFail, RestartPolicyRequeue:
+		return nil
+	}
+	return fmt.Errorf("restart_policy must be %s or %s", RestartPolicyFail, RestartPolicyRequeue)
+}
+
+// validateBuild checks the Dockerfile build options of a runnable. The
+// Dockerfile is a path inside the build context.
+func (r RunnableConfig) validateBuild() error {
+	if r.Dockerfile == "" {
+		if r.Context != "" || len(r.BuildArgs) > 0 || r.Target != "" {
+			return fmt.Errorf("context, build_args and target require a dockerfile")
+		}
+		return nil
+	}
+	if r.Type != "docker_image" && r.Type != "docker_container" {
+		return fmt.Errorf("dockerfile is only supported by docker_image and docker_container runnables")
+	}
+	dockerfile := path.Clean(r.Dockerfile)
+	if path.IsAbs(dockerfile) || dockerfile == ".." || strings.HasPrefix(dockerfile, "../") {
+		return fmt.Errorf("dockerfile %q must be a path inside the build context", r.Dockerfile)
+	}
+	if !path.IsAbs(r.Context) && strings.HasPrefix(path.Clean(r.Context)+"/", "../") {
+		return fmt.Errorf("context %q must be inside /workspace", r.Context)
+	}
+	for key := range r.BuildArgs {
+		if key == "" || strings.ContainsAny(key, "= ") {
+			return fmt.Errorf("build_args: %q is not a valid argument name", key)
+		}
+	}
+	return nil
+}
+
+// hostnamePattern matches the names services are reachable by
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// validate checks a service's name, image and health check
+func (s ServiceConfig) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Image == "" {
+		return fmt.Errorf("image is required")
+	}
+	for _, name := range append([]string{s.Name}, s.Aliases...) {
+		if !hostnamePattern.MatchString(name) {
+			return fmt.Errorf("%q is not a valid host name", name)
+		}
+	}
+	if s.HealthCheck != nil {
+		if s.HealthCheck.Test == "" {
+			return fmt.Errorf("healthcheck: test is required")
+		}
+		for _, d := range []string{s.HealthCheck.Interval, s.HealthCheck.Timeout, s.HealthCheck.StartPeriod} {
+			if _, err := ParseDuration(d); err != nil {
+				return fmt.Errorf("healthcheck: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// conditionVariables lists the variables a step condition can read, with the
+// number of dotted parts each takes (env.NAME, steps.ID.status); the outputs
+// of steps take one more (steps.ID.outputs.NAME)
+var conditionVariables = map[string]int{
+	"branch":  1,
+	"tag":     1,
+	"trigger": 1,
+	"env":     2,
+	"steps":   3,
+}
+
+// validateCondition parses the if: condition of the step at index i and checks
+// that it only reads known variables and the status and outputs of steps it
+// depends on
+func (c *PipelineConfig) validateCondition(i int) error {
+	condition, err := expr.Parse(c.Steps[i].If)
+	if err != nil {
+		return err
+	}
+	for _, path := range condition.Variables() {
+		name := strings.Join(path, ".")
+		parts, ok := conditionVariables[path[0]]
+		if ok && path[0] == "steps" {
+			ok = (len(path) == parts && path[2] == "status") || (len(path) == parts+1 && path[2] == "outputs")
+		} else if ok {
+			ok = len(path) == parts
+		}
+		if !ok {
+			return fmt.Errorf("unknown variable %s", name)
+		}
+		if path[0] == "steps" && !c.dependsOn(i, path[1]) {
+			return fmt.Errorf("%s: step %q is not a dependency of this step", name, path[1])
+		}
+	}
+	return nil
+}
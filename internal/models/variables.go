@@ -0,0 +1,188 @@
+package models
+
+import (
+	"docker-app/internal/vars"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// variableSite is a part of a pipeline that can refer to variables, with the
+// namespaces it may read. Step is the index of the step it belongs to, or -1.
+type variableSite struct {
+	where      string
+	refs       []vars.Reference
+	namespaces []string
+	step       int
+}
+
+// variableSites parses the references of every part of the pipeline that is
+// expanded when its jobs run
+func (c *PipelineConfig) variableSites() ([]variableSite, error) {
+	var sites []variableSite
+	add := func(where string, value string, step int, namespaces ...string) error {
+		refs, err := vars.References(value, false)
+		if err != nil {
+			return fmt.Errorf("%s: %v", where, err)
+		}
+		sites = append(sites, variableSite{where: where, refs: refs, namespaces: namespaces, step: step})
+		return nil
+	}
+
+	for _, key := range sortedKeys(c.Env) {
+		// The env can't refer to itself, it is expanded before any of it is known
+		if err := add("env "+key, c.Env[key], -1, vars.Secrets, vars.Job, vars.Pipeline); err != nil {
+			return nil, err
+		}
+	}
+	for _, service := range c.Services {
+		for _, key := range sortedKeys(service.Env) {
+			where := fmt.Sprintf("service %s: env %s", service.Name, key)
+			if err := add(where, service.Env[key], -1, vars.Env, vars.Secrets, vars.Job, vars.Pipeline); err != nil {
+				return nil, err
+			}
+		}
+	}
+	all := []string{vars.Env, vars.Secrets, vars.Job, vars.Pipeline, vars.Steps}
+	for i, step := range c.Steps {
+		if err := add(fmt.Sprintf("step %d", i+1), step.Content, i, all...); err != nil {
+			return nil, err
+		}
+		for _, name := range sortedKeys(step.Files) {
+			if err := add(fmt.Sprintf("step %d: file %s", i+1, name), step.Files[name].Content, i, all...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Runnables and their outputs are stored and expanded as JSON, ${NAME}
+	// included
+	for _, runnable := range c.Runnables {
+		if !runnable.Enabled {
+			continue
+		}
+		where := "runnable " + runnable.Name
+		data, err := json.Marshal(runnable)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", where, err)
+		}
+		refs, err := vars.JSONReferences(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", where, err)
+		}
+		sites = append(sites, variableSite{where: where, refs: refs, namespaces: all, step: -1})
+	}
+	return sites, nil
+}
+
+// validateVariables checks that the references of a pipeline are well formed,
+// that they only read the env it defines and that steps only read the
+// outputs of steps they depend on. Secrets are checked by ValidateSecrets.
+func (c *PipelineConfig) validateVariables() error {
+	sites, err := c.variableSites()
+	if err != nil {
+		return err
+	}
+	env := c.envNames()
+	steps := make(map[string]bool, len(c.Steps))
+	for i := range c.Steps {
+		steps[c.StepKey(i)] = true
+	}
+
+	for _, site := range sites {
+		for _, ref := range site.refs {
+			if ref.Short {
+				continue
+			}
+			if err := ref.Check(); err != nil {
+				return fmt.Errorf("%s: %v", site.where, err)
+			}
+			namespace := ref.Namespace()
+			allowed := false
+			for _, n := range site.namespaces {
+				allowed = allowed || n == namespace
+			}
+			if !allowed {
+				return fmt.Errorf("%s: %s can't be used here", site.where, ref)
+			}
+			switch namespace {
+			case vars.Env:
+				if !env[ref.Path[1]] {
+					return fmt.Errorf("%s: %s is not defined", site.where, ref)
+				}
+			case vars.Steps:
+				if !steps[ref.Path[1]] {
+					return fmt.Errorf("%s: %s: unknown step %q", site.where, ref, ref.Path[1])
+				}
+				if site.step >= 0 && !c.dependsOn(site.step, ref.Path[1]) {
+					return fmt.Errorf("%s: %s: step %q is not a dependency of this step", site.where, ref, ref.Path[1])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateSecrets checks that the secrets a pipeline refers to are among
+// those defined, and that every ${NAME} is a variable of the job or a secret.
+// It is checked when jobs are created, as secrets may be added after the
+// pipeline.
+func (c *PipelineConfig) ValidateSecrets(defined []string) error {
+	sites, err := c.variableSites()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(defined))
+	for _, name := range defined {
+		known[name] = true
+	}
+	env := c.envNames()
+	for _, name := range vars.ExportedNames {
+		env[name] = true
+	}
+
+	for _, site := range sites {
+		for _, ref := range site.refs {
+			switch {
+			case ref.Short && !env[ref.Path[0]] && !known[ref.Path[0]]:
+				return fmt.Errorf("%s: ${%s} is neither a variable of the job nor a secret", site.where, ref)
+			case ref.Namespace() == vars.Secrets && !known[ref.Path[1]]:
+				return fmt.Errorf("%s: secret %s is not defined", site.where, ref.Path[1])
+			}
+		}
+	}
+	return nil
+}
+
+// envNames returns the names of the env of the pipeline's jobs, including the
+// matrix axes that become env
+func (c *PipelineConfig) envNames() map[string]bool {
+	names := make(map[string]bool, len(c.Env))
+	for name := range c.Env {
+		names[name] = true
+	}
+	if c.Matrix != nil {
+		combinations := append([]map[string]string{}, c.Matrix.Include...)
+		for axis := range c.Matrix.Axes {
+			combinations = append(combinations, map[string]string{axis: ""})
+		}
+		for _, combination := range combinations {
+			for name := range combination {
+				if name != "language" && name != "version" {
+					names[name] = true
+				}
+			}
+		}
+	}
+	return names
+}
+
+// sortedKeys returns the keys of m in order, so that errors are reported the
+// same way every time
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
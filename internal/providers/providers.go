@@ -2,12 +2,11 @@ package providers
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
 	"docker-app/internal/models"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -31,6 +30,13 @@ type Provider interface {
 	GetType() string
 }
 
+// JobDeployer is implemented by providers that need the job being deployed,
+// such as its branch and commit, and that report where the deployment was
+// published. The returned URL is recorded in deployments.url.
+type JobDeployer interface {
+	DeployJob(ctx context.Context, job models.Job, runnable models.Runnable, deployment models.Deployment, artifactPath string) (string, error)
+}
+
 // EmailProvider handles deployment via email
 // WebhookProvider handles deployment via webhook
 
@@ -39,14 +45,16 @@ type Provider interface {
 //
 // Usage:
 //
-//	pm := NewProviderManager()
+//	pm := NewProviderManager(dockerClient, credentials)
 //	pm.RegisterProvider(NewMyCustomProvider())
 //	provider, err := pm.GetProvider("my-custom-type")
 type ProviderManager struct {
 	providers map[string]Provider
 }
 
-func NewProviderManager() *ProviderManager {
+// NewProviderManager registers the built-in providers. The registry provider
+// pushes images with dockerClient and logs in with credentials.
+func NewProviderManager(dockerClient *client.Client, credentials RegistryCredentials) *ProviderManager {
 	pm := &ProviderManager{
 		providers: make(map[string]Provider),
 	}
@@ -58,6 +66,7 @@ func NewProviderManager() *ProviderManager {
 	pm.RegisterProvider(NewLocalProvider())
 	pm.RegisterProvider(NewVPSProvider())
 	pm.RegisterProvider(NewNginxProvider())
+	pm.RegisterProvider(NewRegistryProvider(dockerClient, credentials))
 
 	return pm
 }
@@ -105,12 +114,29 @@ func CreateZipArchive(sourceDir, zipPath string) error {
 			return err
 		}
 
-		// Create zip entry
-		writer, err := archive.Create(relPath)
+		// Create zip entry, keeping the file mode
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		header.Method = zip.Deflate
+		writer, err := archive.CreateHeader(header)
 		if err != nil {
 			return err
 		}
 
+		// Store symlinks as links rather than following them, they may point
+		// outside sourceDir
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, err = writer.Write([]byte(target))
+			return err
+		}
+
 		// Copy file content
 		file, err := os.Open(path)
 		if err != nil {
@@ -149,26 +175,101 @@ func SaveDockerImage(dockerClient *client.Client, imageID, imagePath string) err
 	return nil
 }
 
-func BuildDockerImage(dockerClient *client.Client, buildContext io.Reader, dockerfile, tag string) (string, error) {
-	ctx := context.Background()
+// BuildOptions describes an image build from a Dockerfile
+type BuildOptions struct {
+	Dockerfile string
+	Tag        string
+	BuildArgs  map[string]string
+	Target     string
+	Labels     map[string]string
+}
+
+// dockerMessage is one line of the JSON stream the Docker daemon sends while it
+// builds or pushes an image
+type dockerMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Error string           `json:"error"`
+	Aux   *json.RawMessage `json:"aux"`
+}
+
+// readDockerMessages calls fn for every message of a Docker JSON stream and
+// fails with the first error the daemon reports
+func readDockerMessages(r io.Reader, fn func(dockerMessage) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var message dockerMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if message.ErrorDetail != nil && message.ErrorDetail.Message != "" {
+			return fmt.Errorf("%s", message.ErrorDetail.Message)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("%s", message.Error)
+		}
+		if err := fn(message); err != nil {
+			return err
+		}
+	}
+}
+
+// BuildDockerImage builds an image from buildContext, a tar archive with the
+// Dockerfile inside, writes the build log to output as it is produced and
+// returns the ID of the built image
+func BuildDockerImage(ctx context.Context, dockerClient *client.Client, buildContext io.Reader, options BuildOptions, output io.Writer) (string, error) {
+	buildArgs := make(map[string]*string, len(options.BuildArgs))
+	for key, value := range options.BuildArgs {
+		value := value
+		buildArgs[key] = &value
+	}
 
 	buildResponse, err := dockerClient.ImageBuild(ctx, buildContext, dockertypes.ImageBuildOptions{
-		Tags:       []string{tag},
-		Dockerfile: dockerfile,
-		Remove:     true,
+		Tags:        []string{options.Tag},
+		Dockerfile:  options.Dockerfile,
+		BuildArgs:   buildArgs,
+		Target:      options.Target,
+		Labels:      options.Labels,
+		Remove:      true,
+		ForceRemove: true,
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to build Docker image: %v", err)
 	}
 	defer buildResponse.Body.Close()
 
-	// Read build output
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, buildResponse.Body)
+	var imageID string
+	err = readDockerMessages(buildResponse.Body, func(message dockerMessage) error {
+		if message.Aux != nil {
+			var result dockertypes.BuildResult
+			if err := json.Unmarshal(*message.Aux, &result); err == nil && result.ID != "" {
+				imageID = result.ID
+			}
+		}
+		if message.Stream != "" {
+			io.WriteString(output, message.Stream)
+		} else if message.Status != "" {
+			io.WriteString(output, message.Status+"\n")
+		}
+		return nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to read build output: %v", err)
+		return "", fmt.Errorf("failed to build Docker image: %v", err)
 	}
 
-	log.Printf("Docker build output: %s", buf.String())
-	return tag, nil
+	if imageID == "" {
+		// Older daemons don't report the ID, look the tag up instead
+		inspect, _, err := dockerClient.ImageInspectWithRaw(ctx, options.Tag)
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect built image: %v", err)
+		}
+		imageID = inspect.ID
+	}
+	return imageID, nil
 }
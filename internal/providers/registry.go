@@ -0,0 +1,233 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"docker-app/internal/models"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+)
+
+// defaultRegistry is the registry of image names without a registry host
+const defaultRegistry = "docker.io"
+
+// RegistryProvider pushes the image built by a docker_image or
+// docker_container runnable to a Docker/OCI registry
+type RegistryProvider struct {
+	docker      *client.Client
+	credentials RegistryCredentials
+}
+
+// RegistryCredentials looks up the stored login for a registry host, such as
+// "ghcr.io", "localhost:5000" or "docker.io". It returns empty strings when
+// no login is stored, and the image is pushed anonymously.
+type RegistryCredentials interface {
+	Lookup(registry string) (username, password string, err error)
+}
+
+type RegistryConfig struct {
+	// Image is the repository to push to, such as "localhost:5000/my-app"
+	Image string `json:"image"`
+	// Tags are text/template strings rendered with RegistryTagData, "latest"
+	// when empty
+	Tags []string `json:"tags"`
+}
+
+// RegistryTagData is what registry tag templates can use, for example
+// "{{ .Branch }}-{{ .ShortCommit }}" or "build-{{ .JobID }}"
+type RegistryTagData struct {
+	JobID       int
+	Branch      string
+	Commit      string
+	ShortCommit string
+	Tag         string
+}
+
+// tagPattern matches valid image tags
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+func NewRegistryProvider(dockerClient *client.Client, credentials RegistryCredentials) *RegistryProvider {
+	return &RegistryProvider{docker: dockerClient, credentials: credentials}
+}
+
+func (p *RegistryProvider) GetType() string {
+	return "registry"
+}
+
+func (p *RegistryProvider) Deploy(ctx context.Context, runnable models.Runnable, deployment models.Deployment, artifactPath string) error {
+	_, err := p.DeployJob(ctx, models.Job{ID: runnable.JobID}, runnable, deployment, artifactPath)
+	return err
+}
+
+// DeployJob tags the runnable's image with every configured tag, pushes the
+// tags and returns the pushed image by digest, such as
+// "localhost:5000/my-app@sha256:..."
+func (p *RegistryProvider) DeployJob(ctx context.Context, job models.Job, runnable models.Runnable, deployment models.Deployment, artifactPath string) (string, error) {
+	var config RegistryConfig
+	if err := json.Unmarshal([]byte(deployment.Config), &config); err != nil {
+		return "", fmt.Errorf("invalid registry config: %v", err)
+	}
+	if config.Image == "" {
+		return "", fmt.Errorf("invalid registry config: image is required")
+	}
+	if strings.ContainsAny(config.Image, "@") || strings.Contains(config.Image[strings.LastIndex(config.Image, "/")+1:], ":") {
+		return "", fmt.Errorf("invalid registry config: image %q must not have a tag or digest, use tags", config.Image)
+	}
+	if runnable.ImageDigest == nil || *runnable.ImageDigest == "" {
+		return "", fmt.Errorf("runnable %s did not build an image", runnable.Name)
+	}
+	if p.docker == nil {
+		return "", fmt.Errorf("registry provider has no Docker client")
+	}
+
+	tags, err := RenderRegistryTags(config.Tags, registryTagData(job))
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := p.registryAuth(RegistryHost(config.Image))
+	if err != nil {
+		return "", err
+	}
+
+	var digest string
+	for _, tag := range tags {
+		ref := config.Image + ":" + tag
+		if err := p.docker.ImageTag(ctx, *runnable.ImageDigest, ref); err != nil {
+			return "", fmt.Errorf("failed to tag image as %s: %v", ref, err)
+		}
+		pushed, err := p.push(ctx, ref, auth)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("Pushed %s (%s)", ref, pushed)
+		if digest == "" {
+			digest = pushed
+		}
+	}
+	return config.Image + "@" + digest, nil
+}
+
+// registryAuth encodes the stored login for host as the X-Registry-Auth
+// header expects it
+func (p *RegistryProvider) registryAuth(host string) (string, error) {
+	var auth registry.AuthConfig
+	if p.credentials != nil {
+		username, password, err := p.credentials.Lookup(host)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up credentials for %s: %v", host, err)
+		}
+		auth = registry.AuthConfig{Username: username, Password: password, ServerAddress: host}
+	}
+	return registry.EncodeAuthConfig(auth)
+}
+
+// push pushes ref and returns the digest the registry reports for it
+func (p *RegistryProvider) push(ctx context.Context, ref, auth string) (string, error) {
+	body, err := p.docker.ImagePush(ctx, ref, dockertypes.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s: %v", ref, err)
+	}
+	defer body.Close()
+
+	var digest string
+	err = readDockerMessages(body, func(message dockerMessage) error {
+		if message.Aux == nil {
+			return nil
+		}
+		var result dockertypes.PushResult
+		if err := json.Unmarshal(*message.Aux, &result); err == nil && result.Digest != "" {
+			digest = result.Digest
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to push %s: %v", ref, err)
+	}
+	if digest == "" {
+		return "", fmt.Errorf("failed to push %s: the registry did not report a digest", ref)
+	}
+	return digest, nil
+}
+
+// RegistryHost returns the registry an image name is pushed to. Like Docker,
+// the first part of the name is a host when it has a dot or a port or is
+// localhost.
+func RegistryHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return defaultRegistry
+	}
+	host := image[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return defaultRegistry
+}
+
+// RenderRegistryTags renders tag templates. Characters that aren't allowed in
+// a tag, such as the slash of "feature/login", are replaced with dashes.
+func RenderRegistryTags(templates []string, data RegistryTagData) ([]string, error) {
+	if len(templates) == 0 {
+		templates = []string{"latest"}
+	}
+	var tags []string
+	seen := make(map[string]bool)
+	for _, text := range templates {
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %v", text, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %v", text, err)
+		}
+		tag := sanitizeTag(buf.String())
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q renders to %q, which is not a valid tag", text, tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// sanitizeTag replaces the characters a tag can't have with dashes
+func sanitizeTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(tag))
+}
+
+func registryTagData(job models.Job) RegistryTagData {
+	data := RegistryTagData{JobID: job.ID}
+	if job.Branch != nil {
+		data.Branch = *job.Branch
+	}
+	if job.CommitSHA != nil {
+		data.Commit = *job.CommitSHA
+		data.ShortCommit = data.Commit
+		if len(data.ShortCommit) > 7 {
+			data.ShortCommit = data.ShortCommit[:7]
+		}
+	}
+	if job.Tag != nil {
+		data.Tag = *job.Tag
+	}
+	return data
+}
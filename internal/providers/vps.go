@@ -64,6 +64,11 @@ func (p *VPSProvider) Deploy(ctx context.Context, runnable models.Runnable, depl
 
 // SSH helper methods for VPSProvider
 func (p *VPSProvider) connectSSH(host, user, keyPath, sshPort string) (*ssh.Client, error) {
+	return ConnectSSH(host, user, keyPath, sshPort)
+}
+
+// ConnectSSH opens an SSH connection authenticated with a private key
+func ConnectSSH(host, user, keyPath, sshPort string) (*ssh.Client, error) {
 	// Read private key
 	key, err := os.ReadFile(keyPath)
 	if err != nil {
@@ -0,0 +1,226 @@
+// Package pubsub passes what happens to jobs while they run, the lines their
+// steps print and the statuses they go through, from the worker to the
+// clients following them. The broker keeps a bounded history of every job so
+// that a client that lost its connection can resume after the last event it
+// got instead of starting over.
+package pubsub
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events. Line events carry a models.LogLine, step events a
+// StepStatus and job events a JobStatus.
+const (
+	TypeLine = "line"
+	TypeStep = "step"
+	TypeJob  = "job"
+)
+
+const (
+	// historySize caps the events kept per job for clients to resume from
+	historySize = 10000
+	// historyRetention is how long the history of a job no one follows is
+	// kept after its last event
+	historyRetention = 10 * time.Minute
+	// subscriptionBuffer is how many events a subscriber may fall behind
+	// before it is dropped
+	subscriptionBuffer = 1024
+)
+
+// Event is something that happened to a job. ID is unique to the broker and
+// what clients resume from; events read from the database have none.
+type Event struct {
+	ID    string
+	Type  string
+	JobID int
+	Data  interface{}
+
+	seq int64
+}
+
+// StepStatus is the data of a step event
+type StepStatus struct {
+	JobID        int     `json:"job_id"`
+	StepID       int     `json:"step_id"`
+	OrderNum     int     `json:"order_num"`
+	Status       string  `json:"status"`
+	StatusReason *string `json:"status_reason"`
+}
+
+// JobStatus is the data of a job event
+type JobStatus struct {
+	JobID        int     `json:"job_id"`
+	Status       string  `json:"status"`
+	StatusReason *string `json:"status_reason"`
+}
+
+// Broker hands the events published for a job to its subscribers. A nil
+// Broker drops everything, for workers that no one follows.
+type Broker struct {
+	// epoch tells the ids of this broker from those of a previous process
+	epoch string
+
+	mutex  sync.Mutex
+	seq    int64
+	topics map[int]*topic
+	pruned time.Time
+}
+
+// topic holds the history and the subscribers of a job
+type topic struct {
+	history     []Event
+	subscribers map[*Subscription]bool
+	updated     time.Time
+}
+
+// NewBroker creates an empty broker
+func NewBroker() *Broker {
+	return &Broker{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		topics: make(map[int]*topic),
+	}
+}
+
+// Publish sends an event to the subscribers of a job. Subscribers that fell
+// too far behind are dropped, they resume from the history when they come
+// back.
+func (b *Broker) Publish(jobID int, eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.seq++
+	event := Event{
+		ID:    b.epoch + "-" + strconv.FormatInt(b.seq, 10),
+		Type:  eventType,
+		JobID: jobID,
+		Data:  data,
+		seq:   b.seq,
+	}
+	t := b.topic(jobID)
+	t.history = append(t.history, event)
+	if len(t.history) > historySize {
+		t.history = append([]Event(nil), t.history[len(t.history)-historySize/2:]...)
+	}
+	t.updated = time.Now()
+	for sub := range t.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			delete(t.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	b.prune()
+}
+
+// Subscribe follows the events of a job. The backlog holds the events of the
+// history after lastEventID and resumed is set when that id was found, so
+// that nothing was missed since. Otherwise the backlog holds the whole
+// history, which may not go back to the start of the job.
+func (b *Broker) Subscribe(jobID int, lastEventID string) (sub *Subscription, backlog []Event, resumed bool) {
+	sub = &Subscription{broker: b, jobID: jobID, events: make(chan Event, subscriptionBuffer)}
+	if b == nil {
+		return sub, nil, false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	t := b.topic(jobID)
+	t.subscribers[sub] = true
+	backlog = append([]Event(nil), t.history...)
+	if seq, ok := b.parseID(lastEventID); ok {
+		for i, event := range backlog {
+			if event.seq == seq {
+				return sub, backlog[i+1:], true
+			}
+		}
+		// Nothing happened since the last event the client got
+		if len(backlog) > 0 && seq > backlog[len(backlog)-1].seq {
+			return sub, nil, true
+		}
+	}
+	return sub, backlog, false
+}
+
+// Forget drops the history of a job that starts over and closes its
+// subscriptions, so that their clients come back and read it from the start
+func (b *Broker) Forget(jobID int) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if t, ok := b.topics[jobID]; ok {
+		for sub := range t.subscribers {
+			close(sub.events)
+		}
+		delete(b.topics, jobID)
+	}
+}
+
+// topic returns the topic of a job, creating it when needed. b.mutex is held.
+func (b *Broker) topic(jobID int) *topic {
+	t, ok := b.topics[jobID]
+	if !ok {
+		t = &topic{subscribers: make(map[*Subscription]bool), updated: time.Now()}
+		b.topics[jobID] = t
+	}
+	return t
+}
+
+// prune drops the topics no one follows that had no event for
+// historyRetention, at most once a minute. b.mutex is held.
+func (b *Broker) prune() {
+	if time.Since(b.pruned) < time.Minute {
+		return
+	}
+	b.pruned = time.Now()
+	for jobID, t := range b.topics {
+		if len(t.subscribers) == 0 && time.Since(t.updated) > historyRetention {
+			delete(b.topics, jobID)
+		}
+	}
+}
+
+// parseID returns the sequence number of an id of this broker
+func (b *Broker) parseID(id string) (int64, bool) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found || epoch != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	return n, err == nil
+}
+
+// Subscription receives the events of a job
+type Subscription struct {
+	broker *Broker
+	jobID  int
+	events chan Event
+}
+
+// Events returns the channel events arrive on. It is closed when the
+// subscriber fell too far behind or the job started over.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	if s.broker == nil {
+		return
+	}
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+	if t, ok := s.broker.topics[s.jobID]; ok && t.subscribers[s] {
+		delete(t.subscribers, s)
+		close(s.events)
+	}
+}
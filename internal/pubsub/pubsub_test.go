@@ -0,0 +1,210 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+// drain returns the events waiting on a subscription and whether it is still
+// open
+func drain(sub *Subscription) ([]Event, bool) {
+	var events []Event
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return events, false
+			}
+			events = append(events, event)
+		default:
+			return events, true
+		}
+	}
+}
+
+func dataOf(events []Event) []interface{} {
+	data := make([]interface{}, len(events))
+	for i, event := range events {
+		data[i] = event.Data
+	}
+	return data
+}
+
+func equalData(got []Event, want ...interface{}) bool {
+	data := dataOf(got)
+	if len(data) != len(want) {
+		return false
+	}
+	for i := range data {
+		if data[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSubscribeReceivesPublished(t *testing.T) {
+	b := NewBroker()
+	sub, backlog, resumed := b.Subscribe(1, "")
+	defer sub.Close()
+	if len(backlog) != 0 || resumed {
+		t.Fatalf("new subscription: backlog %v, resumed %v", backlog, resumed)
+	}
+
+	b.Publish(1, TypeLine, "a")
+	b.Publish(2, TypeLine, "other job")
+	b.Publish(1, TypeStep, "b")
+	events, open := drain(sub)
+	if !open || !equalData(events, "a", "b") {
+		t.Fatalf("got %v (open %v), want a and b", dataOf(events), open)
+	}
+	if events[0].ID == "" || events[0].ID == events[1].ID {
+		t.Errorf("events need distinct ids, got %q and %q", events[0].ID, events[1].ID)
+	}
+	if events[1].Type != TypeStep || events[1].JobID != 1 {
+		t.Errorf("second event is %+v", events[1])
+	}
+}
+
+func TestResume(t *testing.T) {
+	b := NewBroker()
+	for _, data := range []string{"a", "b", "c"} {
+		b.Publish(1, TypeLine, data)
+	}
+	first, history, _ := b.Subscribe(1, "")
+	first.Close()
+	if !equalData(history, "a", "b", "c") {
+		t.Fatalf("history = %v", dataOf(history))
+	}
+
+	sub, backlog, resumed := b.Subscribe(1, history[0].ID)
+	sub.Close()
+	if !resumed || !equalData(backlog, "b", "c") {
+		t.Errorf("resuming after a: backlog %v, resumed %v", dataOf(backlog), resumed)
+	}
+
+	sub, backlog, resumed = b.Subscribe(1, history[2].ID)
+	sub.Close()
+	if !resumed || len(backlog) != 0 {
+		t.Errorf("resuming after the last event: backlog %v, resumed %v", dataOf(backlog), resumed)
+	}
+}
+
+func TestResumeUnknownID(t *testing.T) {
+	b := NewBroker()
+	b.Publish(1, TypeLine, "a")
+	b.Publish(1, TypeLine, "b")
+
+	for _, id := range []string{"not-an-id", "otherepoch-1", "garbage"} {
+		sub, backlog, resumed := b.Subscribe(1, id)
+		sub.Close()
+		if resumed || !equalData(backlog, "a", "b") {
+			t.Errorf("id %q: backlog %v, resumed %v, want the whole history", id, dataOf(backlog), resumed)
+		}
+	}
+
+	// An id of a previous broker, as after a restart
+	previous := NewBroker()
+	previous.epoch = "previous"
+	previous.Publish(1, TypeLine, "old")
+	old, history, _ := previous.Subscribe(1, "")
+	old.Close()
+	sub, backlog, resumed := b.Subscribe(1, history[0].ID)
+	sub.Close()
+	if resumed || len(backlog) != 2 {
+		t.Errorf("id of another broker: backlog %v, resumed %v", dataOf(backlog), resumed)
+	}
+}
+
+func TestResumeAfterHistoryTrimmed(t *testing.T) {
+	b := NewBroker()
+	b.Publish(1, TypeLine, 0)
+	first, history, _ := b.Subscribe(1, "")
+	first.Close()
+	for i := 1; i <= historySize; i++ {
+		b.Publish(1, TypeLine, i)
+	}
+
+	sub, backlog, resumed := b.Subscribe(1, history[0].ID)
+	sub.Close()
+	if resumed {
+		t.Errorf("resumed from an event no longer kept")
+	}
+	if len(backlog) == 0 || len(backlog) > historySize {
+		t.Errorf("backlog holds %d events, want the kept history", len(backlog))
+	}
+	if last := backlog[len(backlog)-1].Data; last != historySize {
+		t.Errorf("last event of the backlog is %v, want %d", last, historySize)
+	}
+}
+
+func TestOverflowDropsSubscriber(t *testing.T) {
+	b := NewBroker()
+	slow, _, _ := b.Subscribe(1, "")
+	for i := 0; i <= subscriptionBuffer; i++ {
+		b.Publish(1, TypeLine, i)
+	}
+	events, open := drain(slow)
+	if open {
+		t.Fatalf("a subscriber %d events behind is still open", subscriptionBuffer+1)
+	}
+	if len(events) != subscriptionBuffer {
+		t.Errorf("got %d events before the drop, want %d", len(events), subscriptionBuffer)
+	}
+	// Closing a dropped subscription is harmless
+	slow.Close()
+
+	// The dropped subscriber resumes from the history
+	sub, backlog, resumed := b.Subscribe(1, events[len(events)-1].ID)
+	defer sub.Close()
+	if !resumed || !equalData(backlog, subscriptionBuffer) {
+		t.Errorf("resuming after the drop: backlog %v, resumed %v", dataOf(backlog), resumed)
+	}
+}
+
+func TestForget(t *testing.T) {
+	b := NewBroker()
+	b.Publish(1, TypeLine, "a")
+	sub, history, _ := b.Subscribe(1, "")
+	other, _, _ := b.Subscribe(2, "")
+	defer other.Close()
+
+	b.Forget(1)
+	if _, open := drain(sub); open {
+		t.Errorf("subscription of a forgotten job is still open")
+	}
+	sub.Close()
+	if _, open := drain(other); !open {
+		t.Errorf("subscription of another job was closed")
+	}
+
+	// The job starts over: old ids are unknown and the history is new
+	b.Publish(1, TypeLine, "b")
+	again, backlog, resumed := b.Subscribe(1, history[0].ID)
+	defer again.Close()
+	if resumed || !equalData(backlog, "b") {
+		t.Errorf("after Forget: backlog %v, resumed %v", dataOf(backlog), resumed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	b := NewBroker()
+	sub, _, _ := b.Subscribe(1, "")
+	sub.Close()
+	sub.Close()
+	if _, open := drain(sub); open {
+		t.Errorf("closed subscription is still open")
+	}
+	// Publishing no longer reaches it
+	b.Publish(1, TypeLine, "a")
+}
+
+func TestNilBroker(t *testing.T) {
+	var b *Broker
+	b.Publish(1, TypeLine, "a")
+	b.Forget(1)
+	sub, backlog, resumed := b.Subscribe(1, "")
+	if backlog != nil || resumed {
+		t.Errorf("nil broker: backlog %v, resumed %v", backlog, resumed)
+	}
+	sub.Close()
+}
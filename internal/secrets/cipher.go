@@ -0,0 +1,105 @@
+// Package secrets keeps the secrets of pipelines encrypted at rest and masks
+// their values in output. Pipelines refer to them as ${{ secrets.NAME }},
+// which package vars expands.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the size of the master key, an AES-256 key
+const KeySize = 32
+
+// Cipher encrypts secret values with the server's master key using AES-GCM
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a cipher for a master key of KeySize bytes
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("the master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns the base64 nonce and ciphertext of a secret's value. The
+// name is authenticated with it, so a value can't be moved to another secret.
+func (c *Cipher) Encrypt(name, value string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the value of a secret encrypted by Encrypt
+func (c *Cipher) Decrypt(name, encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", name, err)
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("secret %s: ciphertext too short", name)
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	value, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %s can't be decrypted, was the master key changed?", name)
+	}
+	return string(value), nil
+}
+
+// ParseKey decodes a base64 master key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %v", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("the master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// LoadKey reads the base64 master key from path. When the file doesn't exist
+// a new key is generated and written to it, readable only by its owner.
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ParseKey(string(data))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
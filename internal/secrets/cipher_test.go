@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCipher(t *testing.T, fill byte) *Cipher {
+	t.Helper()
+	c, err := NewCipher(bytes.Repeat([]byte{fill}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	c := testCipher(t, 1)
+	for _, value := range []string{"", "s3cret", "multi\nline\nvalue", strings.Repeat("x", 4096), "ünïcödé"} {
+		encrypted, err := c.Encrypt("TOKEN", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "" && strings.Contains(encrypted, value) {
+			t.Errorf("the encrypted value holds the plaintext %q", value)
+		}
+		decrypted, err := c.Decrypt("TOKEN", encrypted)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		}
+		if decrypted != value {
+			t.Errorf("round trip of %q gave %q", value, decrypted)
+		}
+	}
+
+	// Every encryption takes a new nonce
+	a, _ := c.Encrypt("TOKEN", "same")
+	b, _ := c.Encrypt("TOKEN", "same")
+	if a == b {
+		t.Errorf("encrypting a value twice gave the same ciphertext")
+	}
+}
+
+func TestDecryptFails(t *testing.T) {
+	c := testCipher(t, 1)
+	encrypted, err := c.Encrypt("TOKEN", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(encrypted)
+	sealed[len(sealed)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name      string
+		cipher    *Cipher
+		secret    string
+		encrypted string
+		want      string
+	}{
+		{"another name", c, "OTHER", encrypted, "secret OTHER can't be decrypted"},
+		{"another key", testCipher(t, 2), "TOKEN", encrypted, "secret TOKEN can't be decrypted"},
+		{"tampered", c, "TOKEN", tampered, "can't be decrypted"},
+		{"not base64", c, "TOKEN", "not base64!", "secret TOKEN: illegal base64"},
+		{"too short", c, "TOKEN", base64.StdEncoding.EncodeToString([]byte("short")), "ciphertext too short"},
+	}
+	for _, tt := range tests {
+		value, err := tt.cipher.Decrypt(tt.secret, tt.encrypted)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Decrypt = %q, %v, want an error containing %q", tt.name, value, err, tt.want)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	if _, err := NewCipher(make([]byte, 16)); err == nil {
+		t.Errorf("NewCipher took a 16 byte key")
+	}
+	key := bytes.Repeat([]byte{7}, KeySize)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	if got, err := ParseKey(" " + encoded + "\n"); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("ParseKey = %v, %v", got, err)
+	}
+	if _, err := ParseKey(base64.StdEncoding.EncodeToString(key[:31])); err == nil {
+		t.Errorf("ParseKey took a 31 byte key")
+	}
+	if _, err := ParseKey("%%%"); err == nil {
+		t.Errorf("ParseKey took invalid base64")
+	}
+
+	path := filepath.Join(t.TempDir(), "keys", "secret.key")
+	generated, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("generated key file: %v, %v", info, err)
+	}
+	loaded, err := LoadKey(path)
+	if err != nil || !bytes.Equal(loaded, generated) {
+		t.Errorf("loading the generated key gave %v, %v", loaded, err)
+	}
+}
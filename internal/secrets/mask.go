@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"sort"
+	"strings"
+)
+
+// Masked replaces secret values in masked output
+const Masked = "***"
+
+// minMaskLength is the length below which values aren't masked, as masking
+// them would garble the output without hiding anything
+const minMaskLength = 3
+
+// Masker hides the values of secrets in output and errors. A nil Masker
+// masks nothing.
+type Masker struct {
+	replacer *strings.Replacer
+}
+
+// NewMasker returns a masker for the values of secrets. The lines of values
+// spanning several lines are masked on their own too, as output is often
+// handled line by line.
+func NewMasker(values map[string]string) *Masker {
+	seen := make(map[string]bool)
+	var masked []string
+	add := func(s string) {
+		s = strings.TrimSpace(s)
+		if len(s) >= minMaskLength && !seen[s] {
+			seen[s] = true
+			masked = append(masked, s)
+		}
+	}
+	for _, value := range values {
+		add(value)
+		if strings.Contains(value, "\n") {
+			for _, line := range strings.Split(value, "\n") {
+				add(line)
+			}
+		}
+	}
+	if len(masked) == 0 {
+		return nil
+	}
+
+	// Longer values first, so that a value containing another is masked whole
+	sort.Slice(masked, func(i, j int) bool {
+		return len(masked[i]) > len(masked[j])
+	})
+	pairs := make([]string, 0, 2*len(masked))
+	for _, s := range masked {
+		pairs = append(pairs, s, Masked)
+	}
+	return &Masker{replacer: strings.NewReplacer(pairs...)}
+}
+
+// Mask returns s with every secret value replaced by Masked
+func (m *Masker) Mask(s string) string {
+	if m == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
@@ -0,0 +1,36 @@
+package secrets
+
+import "testing"
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		in     string
+		want   string
+	}{
+		{"value", map[string]string{"TOKEN": "s3cret"}, "token=s3cret; again s3cret", "token=***; again ***"},
+		{"contained value", map[string]string{"A": "pass", "B": "password123"}, "password123 and pass", "*** and ***"},
+		{"overlapping values", map[string]string{"A": "abcdef", "B": "defghi"}, "xabcdefghix", "x***ghix"},
+		{"surrounding spaces", map[string]string{"A": "  s3cret\n"}, "[s3cret]", "[***]"},
+		{"short value", map[string]string{"A": "ab", "B": ""}, "ab cd", "ab cd"},
+		{"multi-line value whole", map[string]string{"KEY": "-----BEGIN KEY-----\nMIIEow\n-----END KEY-----"}, "-----BEGIN KEY-----\nMIIEow\n-----END KEY-----", "***"},
+		{"multi-line value by line", map[string]string{"KEY": "-----BEGIN KEY-----\nMIIEow\n-----END KEY-----"}, "line: MIIEow", "line: ***"},
+		{"no secrets", nil, "s3cret", "s3cret"},
+	}
+	for _, tt := range tests {
+		if got := NewMasker(tt.values).Mask(tt.in); got != tt.want {
+			t.Errorf("%s: Mask(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNilMasker(t *testing.T) {
+	if m := NewMasker(map[string]string{"A": "ab"}); m != nil {
+		t.Errorf("a masker with nothing to mask is not nil")
+	}
+	var m *Masker
+	if got := m.Mask("s3cret"); got != "s3cret" {
+		t.Errorf("nil Masker changed the output to %q", got)
+	}
+}
@@ -0,0 +1,17 @@
+package secrets
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// namePattern matches secret names, which are valid environment variable names
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateName checks the name of a secret
+func ValidateName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("%q is not a valid secret name, use letters, digits and underscores", name)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package secrets
+
+import "testing"
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"TOKEN", true},
+		{"aws_secret_key", true},
+		{"_PRIVATE", true},
+		{"KEY2", true},
+		{"", false},
+		{"2KEY", false},
+		{"MY-KEY", false},
+		{"MY KEY", false},
+		{"secrets.KEY", false},
+		{"KEY}}", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateName(tt.name); (err == nil) != tt.valid {
+			t.Errorf("ValidateName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Package vars expands the variables pipelines refer to in their steps,
+// environment, services, runnables and deployment outputs:
+//
+//	${{ env.NAME }}                 a variable of the pipeline's env
+//	${{ secrets.NAME }}             a stored secret
+//	${{ job.id }}                   id, branch, tag, trigger, commit_sha, short_sha
+//	${{ pipeline.name }}            id, name
+//	${{ steps.ID.outputs.NAME }}    an output set by an earlier step
+//
+// Where no shell would read them, in runnables and deployment outputs,
+// ${NAME} is expanded too, to what a step's shell would see as $NAME or else
+// to the secret NAME. Expansion is strict: a variable that isn't defined is
+// an error rather than an empty string. $${{ and $${ escape a reference,
+// leaving ${{ and ${ in its place.
+package vars
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Namespaces of ${{ }} references
+const (
+	Env      = "env"
+	Secrets  = "secrets"
+	Job      = "job"
+	Pipeline = "pipeline"
+	Steps    = "steps"
+)
+
+// JobFields and PipelineFields are what the job and pipeline namespaces hold
+var (
+	JobFields      = []string{"id", "branch", "tag", "trigger", "commit_sha", "short_sha"}
+	PipelineFields = []string{"id", "name"}
+)
+
+// ExportedNames are the variables jobs set for their steps besides their env.
+// BRANCH is only set when the job has a branch and COMMIT_SHA once the
+// commit being built is known.
+var ExportedNames = []string{"JOB_ID", "PIPELINE_NAME", "BRANCH", "COMMIT_SHA"}
+
+var (
+	// segmentPattern matches the dotted parts of a reference; step ids may
+	// contain dashes, as in step-2
+	segmentPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// namePattern matches the names of ${NAME}, environment variable names
+	namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Reference is a variable a string refers to. Path holds the dotted parts of
+// a ${{ }} reference, such as [env NAME]; a ${NAME} reference is Short and
+// has the single part NAME.
+type Reference struct {
+	Path  []string
+	Short bool
+}
+
+func (r Reference) String() string {
+	return strings.Join(r.Path, ".")
+}
+
+// Namespace returns the namespace of a ${{ }} reference
+func (r Reference) Namespace() string {
+	if r.Short {
+		return ""
+	}
+	return r.Path[0]
+}
+
+// Check reports whether a ${{ }} reference has the shape its namespace
+// expects, without looking at any values
+func (r Reference) Check() error {
+	if r.Short {
+		return nil
+	}
+	switch r.Path[0] {
+	case Env, Secrets:
+		if len(r.Path) == 2 && namePattern.MatchString(r.Path[1]) {
+			return nil
+		}
+	case Job:
+		if len(r.Path) == 2 && contains(JobFields, r.Path[1]) {
+			return nil
+		}
+	case Pipeline:
+		if len(r.Path) == 2 && contains(PipelineFields, r.Path[1]) {
+			return nil
+		}
+	case Steps:
+		if len(r.Path) == 4 && r.Path[2] == "outputs" {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown variable %s", r)
+}
+
+// part is either literal text or a reference
+type part struct {
+	text string
+	ref  *Reference
+}
+
+// parse splits s into literal text and references. short enables ${NAME}.
+func parse(s string, short bool) ([]part, error) {
+	var parts []part
+	var text strings.Builder
+	for i := 0; i < len(s); {
+		j := strings.IndexByte(s[i:], '$')
+		if j < 0 {
+			text.WriteString(s[i:])
+			break
+		}
+		text.WriteString(s[i : i+j])
+		i += j
+		rest := s[i:]
+		switch {
+		case strings.HasPrefix(rest, "$${{"):
+			text.WriteString("${{")
+			i += 4
+		case strings.HasPrefix(rest, "${{"):
+			end := strings.Index(rest, "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ${{ at position %d", i)
+			}
+			source := strings.TrimSpace(rest[3:end])
+			path := strings.Split(source, ".")
+			for _, segment := range path {
+				if !segmentPattern.MatchString(segment) {
+					return nil, fmt.Errorf("invalid reference ${{ %s }}", source)
+				}
+			}
+			parts = append(parts, part{text: text.String()}, part{ref: &Reference{Path: path}})
+			text.Reset()
+			i += end + 2
+		case short && strings.HasPrefix(rest, "$${"):
+			text.WriteString("${")
+			i += 3
+		case short && strings.HasPrefix(rest, "${"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ${ at position %d", i)
+			}
+			name := rest[2:end]
+			if !namePattern.MatchString(name) {
+				return nil, fmt.Errorf("invalid reference ${%s}, write $${ for a literal ${", name)
+			}
+			parts = append(parts, part{text: text.String()}, part{ref: &Reference{Path: []string{name}, Short: true}})
+			text.Reset()
+			i += end + 1
+		default:
+			text.WriteByte('$')
+			i++
+		}
+	}
+	return append(parts, part{text: text.String()}), nil
+}
+
+// References returns the ${{ }} references of s, and its ${NAME} references
+// when short is set
+func References(s string, short bool) ([]Reference, error) {
+	parts, err := parse(s, short)
+	if err != nil {
+		return nil, err
+	}
+	var refs []Reference
+	for _, p := range parts {
+		if p.ref != nil {
+			refs = append(refs, *p.ref)
+		}
+	}
+	return refs, nil
+}
+
+// JSONReferences returns the references of the strings of a JSON document,
+// both ${{ }} and ${NAME}
+func JSONReferences(doc string) ([]Reference, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return nil, err
+	}
+	var refs []Reference
+	err := walkStrings(v, func(s string) (string, error) {
+		found, err := References(s, true)
+		refs = append(refs, found...)
+		return s, err
+	})
+	return refs, err
+}
+
+// Scope holds the values references are expanded to. Exported holds the
+// variables the job sets for its steps besides its env, such as JOB_ID,
+// which ${NAME} can refer to.
+type Scope struct {
+	Env      map[string]string
+	Exported map[string]string
+	Secrets  map[string]string
+	Job      map[string]string
+	Pipeline map[string]string
+	// Steps holds the outputs of the steps that finished, by step id
+	Steps map[string]map[string]string
+}
+
+// Lookup returns the value of a reference
+func (s *Scope) Lookup(ref Reference) (string, error) {
+	if err := ref.Check(); err != nil {
+		return "", err
+	}
+	var value string
+	var ok bool
+	switch {
+	case ref.Short:
+		name := ref.Path[0]
+		if value, ok = s.Env[name]; !ok {
+			if value, ok = s.Exported[name]; !ok {
+				value, ok = s.Secrets[name]
+			}
+		}
+	case ref.Path[0] == Env:
+		value, ok = s.Env[ref.Path[1]]
+	case ref.Path[0] == Secrets:
+		value, ok = s.Secrets[ref.Path[1]]
+	case ref.Path[0] == Job:
+		value, ok = s.Job[ref.Path[1]]
+	case ref.Path[0] == Pipeline:
+		value, ok = s.Pipeline[ref.Path[1]]
+	case ref.Path[0] == Steps:
+		value, ok = s.Steps[ref.Path[1]][ref.Path[3]]
+	}
+	if !ok && ref.Short {
+		return "", fmt.Errorf("${%s} is not defined", ref)
+	}
+	if !ok {
+		return "", fmt.Errorf("%s is not defined", ref)
+	}
+	return value, nil
+}
+
+// Expand replaces the ${{ }} references of s with their values. Strings a
+// shell reads, such as step commands, use it so that ${NAME} stays for the
+// shell to expand.
+func (s *Scope) Expand(str string) (string, error) {
+	return s.expand(str, false)
+}
+
+// ExpandAll replaces both the ${{ }} and the ${NAME} references of s
+func (s *Scope) ExpandAll(str string) (string, error) {
+	return s.expand(str, true)
+}
+
+func (s *Scope) expand(str string, short bool) (string, error) {
+	parts, err := parse(str, short)
+	if err != nil {
+		return "", err
+	}
+	var expanded strings.Builder
+	for _, p := range parts {
+		if p.ref == nil {
+			expanded.WriteString(p.text)
+			continue
+		}
+		value, err := s.Lookup(*p.ref)
+		if err != nil {
+			return "", err
+		}
+		expanded.WriteString(value)
+	}
+	return expanded.String(), nil
+}
+
+// ExpandJSON expands the strings of a JSON document with ExpandAll, so that
+// values with quotes or newlines keep it valid
+func (s *Scope) ExpandJSON(doc string) (string, error) {
+	if !strings.Contains(doc, "${") {
+		return doc, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return "", err
+	}
+	v, err := walkValue(v, s.ExpandAll)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Snapshot returns a copy of the scope with the step outputs known so far,
+// so that a step running alongside others keeps seeing those that finished
+// before it started
+func (s *Scope) Snapshot() *Scope {
+	scope := *s
+	scope.Steps = make(map[string]map[string]string, len(s.Steps))
+	for id, outputs := range s.Steps {
+		scope.Steps[id] = outputs
+	}
+	return &scope
+}
+
+// walkStrings calls f with every string of a decoded JSON value
+func walkStrings(v interface{}, f func(string) (string, error)) error {
+	_, err := walkValue(v, f)
+	return err
+}
+
+// walkValue replaces every string of a decoded JSON value with what f
+// returns for it
+func walkValue(v interface{}, f func(string) (string, error)) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		return f(value)
+	case map[string]interface{}:
+		for k, item := range value {
+			replaced, err := walkValue(item, f)
+			if err != nil {
+				return nil, err
+			}
+			value[k] = replaced
+		}
+	case []interface{}:
+		for i, item := range value {
+			replaced, err := walkValue(item, f)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = replaced
+		}
+	}
+	return v, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOutputName reports whether name can be referred to as a step output
+func IsOutputName(name string) bool {
+	return segmentPattern.MatchString(name)
+}
@@ -0,0 +1,193 @@
+package vars
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testScope() *Scope {
+	return &Scope{
+		Env:      map[string]string{"GREETING": "hello", "QUOTED": "say \"hi\"\nbye"},
+		Exported: map[string]string{"JOB_ID": "17"},
+		Secrets:  map[string]string{"TOKEN": "s3cret", "GREETING": "not this one"},
+		Job:      map[string]string{"id": "17", "branch": "main"},
+		Pipeline: map[string]string{"name": "api"},
+		Steps:    map[string]map[string]string{"build": {"version": "1.4.2"}},
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"no references", "no references"},
+		{"${{ env.GREETING }} world", "hello world"},
+		{"${{env.GREETING}}", "hello"},
+		{"${{ secrets.TOKEN }}", "s3cret"},
+		{"job ${{ job.id }} of ${{ pipeline.name }} on ${{ job.branch }}", "job 17 of api on main"},
+		{"v${{ steps.build.outputs.version }}", "v1.4.2"},
+		// ${NAME} is left for the shell
+		{"echo ${GREETING} $HOME", "echo ${GREETING} $HOME"},
+		{"cost: $5 and $", "cost: $5 and $"},
+		// $${{ escapes a reference
+		{"$${{ env.GREETING }}", "${{ env.GREETING }}"},
+		{"$${{ env.GREETING }} is ${{ env.GREETING }}", "${{ env.GREETING }} is hello"},
+		{"$$${{ env.GREETING }}", "$${{ env.GREETING }}"},
+	}
+	scope := testScope()
+	for _, tt := range tests {
+		got, err := scope.Expand(tt.in)
+		if err != nil {
+			t.Errorf("Expand(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpandAll(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"${GREETING} ${{ env.GREETING }}", "hello hello"},
+		// The env comes first, then the exported variables, then secrets
+		{"${GREETING}", "hello"},
+		{"${JOB_ID}", "17"},
+		{"Bearer ${TOKEN}", "Bearer s3cret"},
+		// $${ escapes a ${NAME} reference
+		{"$${GREETING}", "${GREETING}"},
+		{"$${GREETING} is ${GREETING}", "${GREETING} is hello"},
+		{"$${{ env.GREETING }}", "${{ env.GREETING }}"},
+		{"$GREETING", "$GREETING"},
+	}
+	scope := testScope()
+	for _, tt := range tests {
+		got, err := scope.ExpandAll(tt.in)
+		if err != nil {
+			t.Errorf("ExpandAll(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ExpandAll(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpandStrict(t *testing.T) {
+	tests := []struct {
+		in    string
+		short bool
+		want  string
+	}{
+		{"${{ env.MISSING }}", false, "env.MISSING is not defined"},
+		{"${{ secrets.MISSING }}", false, "secrets.MISSING is not defined"},
+		{"${{ steps.build.outputs.missing }}", false, "steps.build.outputs.missing is not defined"},
+		{"${{ steps.deploy.outputs.url }}", false, "steps.deploy.outputs.url is not defined"},
+		{"${{ job.nope }}", false, "unknown variable job.nope"},
+		{"${{ other.NAME }}", false, "unknown variable other.NAME"},
+		{"${{ env }}", false, "unknown variable env"},
+		{"${{ env.GREETING", false, "unterminated ${{ at position 0"},
+		{"${{ env.GREE TING }}", false, "invalid reference ${{ env.GREE TING }}"},
+		{"${{ env..X }}", false, "invalid reference"},
+		{"${MISSING}", true, "${MISSING} is not defined"},
+		{"${GREETING", true, "unterminated ${ at position 0"},
+		{"${HOME:-/root}", true, "invalid reference ${HOME:-/root}, write $${ for a literal ${"},
+	}
+	scope := testScope()
+	for _, tt := range tests {
+		var err error
+		if tt.short {
+			_, err = scope.ExpandAll(tt.in)
+		} else {
+			_, err = scope.Expand(tt.in)
+		}
+		if err == nil {
+			t.Errorf("expanding %q succeeded, want an error", tt.in)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("expanding %q: error %q, want it to contain %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestExpandJSON(t *testing.T) {
+	scope := testScope()
+	doc := `{"name": "${{ pipeline.name }}", "env": {"MESSAGE": "${QUOTED}"}, "args": ["${GREETING}", "$${GREETING}", 3, true, null], "plain": "x"}`
+	expanded, err := scope.ExpandJSON(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(expanded), &got); err != nil {
+		t.Fatalf("ExpandJSON returned invalid JSON %s: %v", expanded, err)
+	}
+	want := map[string]interface{}{
+		"name":  "api",
+		"env":   map[string]interface{}{"MESSAGE": "say \"hi\"\nbye"},
+		"args":  []interface{}{"hello", "${GREETING}", float64(3), true, nil},
+		"plain": "x",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExpandJSON = %v, want %v", got, want)
+	}
+
+	// Documents without references are returned as they are
+	plain := `{"b": 1,  "a": "$5"}`
+	if got, err := scope.ExpandJSON(plain); err != nil || got != plain {
+		t.Errorf("ExpandJSON(%s) = %s, %v", plain, got, err)
+	}
+
+	if _, err := scope.ExpandJSON(`{"a": "${MISSING}"}`); err == nil {
+		t.Errorf("ExpandJSON with an undefined variable succeeded")
+	}
+	if _, err := scope.ExpandJSON(`{"a": "${`); err == nil {
+		t.Errorf("ExpandJSON of invalid JSON succeeded")
+	}
+}
+
+func TestReferences(t *testing.T) {
+	refs, err := References("${{ env.A }} ${B} $${{ env.C }} ${{ secrets.D }}", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Reference{{Path: []string{"env", "A"}}, {Path: []string{"secrets", "D"}}}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("References = %v, want %v", refs, want)
+	}
+
+	refs, err = JSONReferences(`{"url": "https://${HOST}/${{ job.id }}", "list": ["$${ESCAPED}", "${{ steps.x.outputs.y }}"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, ref := range refs {
+		found[ref.String()] = true
+	}
+	for _, name := range []string{"HOST", "job.id", "steps.x.outputs.y"} {
+		if !found[name] {
+			t.Errorf("JSONReferences misses %s, found %v", name, refs)
+		}
+	}
+	if len(refs) != 3 {
+		t.Errorf("JSONReferences found %d references, want 3: %v", len(refs), refs)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	scope := testScope()
+	snapshot := scope.Snapshot()
+	scope.Steps["later"] = map[string]string{"out": "x"}
+	if _, err := snapshot.Expand("${{ steps.later.outputs.out }}"); err == nil {
+		t.Errorf("a snapshot sees outputs of steps that finished after it was taken")
+	}
+	if got, err := snapshot.Expand("${{ steps.build.outputs.version }}"); err != nil || got != "1.4.2" {
+		t.Errorf("snapshot lost earlier outputs: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,309 @@
+// Package websocket serves the server side of the WebSocket protocol (RFC
+// 6455) on fiber routes. It covers what pushing events to clients takes:
+// connections send text messages and pings, and the read side answers pings
+// and close frames while discarding the messages clients send.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Close codes
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseMessageTooBig = 1009
+	CloseInternalError = 1011
+	// closeNoStatus is received when the client gave no code
+	closeNoStatus = 1005
+)
+
+const (
+	// acceptGUID is hashed with the key of the client to accept the upgrade
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// maxControlPayload is the largest payload of close, ping and pong frames
+	maxControlPayload = 125
+	// maxClientMessage bounds what a client may send, it is discarded anyway
+	maxClientMessage = 64 * 1024
+	// writeTimeout is how long a frame may take to be written
+	writeTimeout = 10 * time.Second
+	// closeHandshakeLimit is how long the client has to answer a close frame
+	closeHandshakeLimit = time.Second
+)
+
+// Opcodes of frames
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// ErrClosed is returned by writes once the connection is closing
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Conn is an upgraded connection. Writes may be called from any goroutine.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	mutex   sync.Mutex
+	closing bool
+	done    chan struct{}
+}
+
+// IsUpgrade reports whether a request asks for a WebSocket connection
+func IsUpgrade(c *fiber.Ctx) bool {
+	return c.Context().Request.Header.ConnectionUpgrade() && strings.EqualFold(c.Get(fiber.HeaderUpgrade), "websocket")
+}
+
+// Upgrade answers the handshake of a WebSocket request and runs handler on
+// the connection once the response was sent. The connection is closed when
+// handler returns. handler runs after the fiber handler returned, it may not
+// use c.
+//
+// Browsers open WebSockets from any page without asking the server first, so
+// requests with an Origin are refused unless it is the server itself or one
+// of allowedOrigins, given as scheme://host[:port], or "*" for any.
+func Upgrade(c *fiber.Ctx, allowedOrigins []string, handler func(*Conn)) error {
+	if !IsUpgrade(c) {
+		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{"error": "expected a websocket upgrade"})
+	}
+	if origin := c.Get(fiber.HeaderOrigin); !originAllowed(origin, c.Hostname(), allowedOrigins) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "origin not allowed"})
+	}
+	if c.Get("Sec-WebSocket-Version") != "13" {
+		c.Set("Sec-WebSocket-Version", "13")
+		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{"error": "unsupported websocket version"})
+	}
+	key := c.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "missing Sec-WebSocket-Key"})
+	}
+
+	c.Set(fiber.HeaderUpgrade, "websocket")
+	c.Set(fiber.HeaderConnection, "Upgrade")
+	c.Set("Sec-WebSocket-Accept", acceptKey(key))
+	c.Status(fiber.StatusSwitchingProtocols)
+	c.Context().Hijack(func(netConn net.Conn) {
+		conn := &Conn{
+			conn:   netConn,
+			reader: bufio.NewReader(netConn),
+			done:   make(chan struct{}),
+		}
+		go conn.read()
+		handler(conn)
+		conn.Close(CloseNormal, "")
+		// Give the client a moment to answer the close frame
+		select {
+		case <-conn.done:
+		case <-time.After(closeHandshakeLimit):
+		}
+		netConn.Close()
+	})
+	return nil
+}
+
+// originAllowed reports whether a page of origin may connect to host. Clients
+// other than browsers send no origin.
+func originAllowed(origin, host string, allowedOrigins []string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, host)
+}
+
+// acceptKey returns the Sec-WebSocket-Accept of a Sec-WebSocket-Key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Done is closed once the client closed the connection or it broke
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// WriteText sends a text message
+func (c *Conn) WriteText(data []byte) error {
+	return c.write(opText, data)
+}
+
+// Ping sends a ping, which the client answers to keep the connection alive
+func (c *Conn) Ping() error {
+	return c.write(opPing, nil)
+}
+
+// Close starts closing the connection with a close code and a reason. Only
+// the first call sends a close frame.
+func (c *Conn) Close(code int, reason string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.writeFrame(opClose, append(payload, reason...))
+}
+
+func (c *Conn) write(opcode byte, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closing {
+		return ErrClosed
+	}
+	return c.writeFrame(opcode, data)
+}
+
+// writeFrame writes a whole message in one frame. Server frames are not
+// masked. c.mutex is held.
+func (c *Conn) writeFrame(opcode byte, data []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+	case len(data) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(data)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(data)))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// read answers the control frames of the client until it closes the
+// connection or the connection breaks
+func (c *Conn) read() {
+	defer close(c.done)
+	messageSize := 0
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			var protocolErr closeError
+			if errors.As(err, &protocolErr) {
+				c.Close(int(protocolErr), err.Error())
+			}
+			return
+		}
+		switch opcode {
+		case opClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == closeNoStatus {
+				code = CloseNormal
+			}
+			c.Close(code, "")
+			return
+		case opPing:
+			c.write(opPong, payload)
+		case opPong:
+		case opText, opBinary, opContinuation:
+			// Messages of clients are not read, only their size is bounded
+			if opcode != opContinuation {
+				messageSize = 0
+			}
+			messageSize += len(payload)
+			if messageSize > maxClientMessage {
+				c.Close(CloseMessageTooBig, "message too big")
+				return
+			}
+		default:
+			c.Close(CloseProtocolError, "unknown opcode")
+			return
+		}
+	}
+}
+
+// closeError is a violation of the protocol by the client, closing the
+// connection with its code
+type closeError int
+
+func (e closeError) Error() string {
+	if e == CloseMessageTooBig {
+		return "frame too big"
+	}
+	return "protocol error"
+}
+
+// readFrame reads a frame of the client and unmasks its payload
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	if !masked || header[0]&0x70 != 0 {
+		return 0, nil, closeError(CloseProtocolError)
+	}
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= opClose && (length > maxControlPayload || header[0]&0x80 == 0) {
+		return 0, nil, closeError(CloseProtocolError)
+	}
+	if length > maxClientMessage {
+		return 0, nil, closeError(CloseMessageTooBig)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
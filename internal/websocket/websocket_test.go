@@ -0,0 +1,218 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientFrame builds a frame as a client sends it, masked
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func readerConn(data []byte) *Conn {
+	return &Conn{reader: bufio.NewReader(bytes.NewReader(data))}
+}
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("acceptKey = %q", got)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 300)
+	tests := []struct {
+		name    string
+		frame   []byte
+		opcode  byte
+		payload []byte
+	}{
+		{"text", clientFrame(true, opText, []byte("hello")), opText, []byte("hello")},
+		{"empty ping", clientFrame(true, opPing, nil), opPing, []byte{}},
+		{"16-bit length", clientFrame(true, opBinary, long), opBinary, long},
+		{"continuation", clientFrame(false, opText, []byte("part")), opText, []byte("part")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opcode, payload, err := readerConn(tt.frame).readFrame()
+			if err != nil {
+				t.Fatalf("readFrame: %v", err)
+			}
+			if opcode != tt.opcode || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("readFrame = %#x %q, want %#x %q", opcode, payload, tt.opcode, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	unmasked := clientFrame(true, opText, []byte("hi"))
+	unmasked[1] &^= 0x80
+	reserved := clientFrame(true, opText, []byte("hi"))
+	reserved[0] |= 0x40
+	tooBig := []byte{0x80 | opBinary, 0x80 | 127}
+	tooBig = binary.BigEndian.AppendUint64(tooBig, maxClientMessage+1)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"unmasked", unmasked, closeError(CloseProtocolError)},
+		{"reserved bits", reserved, closeError(CloseProtocolError)},
+		{"control payload too long", clientFrame(true, opPing, bytes.Repeat([]byte("x"), maxControlPayload+1)), closeError(CloseProtocolError)},
+		{"fragmented control frame", clientFrame(false, opPing, nil), closeError(CloseProtocolError)},
+		{"message too big", tooBig, closeError(CloseMessageTooBig)},
+		{"truncated header", []byte{0x81}, io.ErrUnexpectedEOF},
+		{"truncated payload", clientFrame(true, opText, []byte("hello"))[:8], io.ErrUnexpectedEOF},
+		{"nothing", nil, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readerConn(tt.frame).readFrame()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("readFrame error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// pipeConn returns a connection read by its own goroutine, and the client end
+// of it
+func pipeConn(t *testing.T) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	conn := &Conn{conn: server, reader: bufio.NewReader(server), done: make(chan struct{})}
+	go conn.read()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, client
+}
+
+// readServerFrame reads an unmasked frame the server sent
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if header[1]&0x80 != 0 || header[1]&0x7f >= 126 {
+		t.Fatalf("unexpected frame header %#x", header)
+	}
+	payload := make([]byte, header[1])
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestPingIsAnswered(t *testing.T) {
+	_, client := pipeConn(t)
+	if _, err := client.Write(clientFrame(true, opPing, []byte("are you there"))); err != nil {
+		t.Fatal(err)
+	}
+	opcode, payload := readServerFrame(t, client)
+	if opcode != opPong || string(payload) != "are you there" {
+		t.Errorf("got %#x %q, want a pong with the ping's payload", opcode, payload)
+	}
+}
+
+func TestCloseIsEchoed(t *testing.T) {
+	conn, client := pipeConn(t)
+	payload := binary.BigEndian.AppendUint16(nil, CloseGoingAway)
+	if _, err := client.Write(clientFrame(true, opClose, payload)); err != nil {
+		t.Fatal(err)
+	}
+	opcode, echoed := readServerFrame(t, client)
+	if opcode != opClose || binary.BigEndian.Uint16(echoed) != CloseGoingAway {
+		t.Errorf("got %#x %v, want a close frame with code %d", opcode, echoed, CloseGoingAway)
+	}
+	<-conn.Done()
+	if err := conn.WriteText([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteText after close = %v, want ErrClosed", err)
+	}
+}
+
+func TestProtocolErrorCloses(t *testing.T) {
+	conn, client := pipeConn(t)
+	frame := clientFrame(true, opText, []byte("hi"))
+	frame[1] &^= 0x80
+	if _, err := client.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	opcode, payload := readServerFrame(t, client)
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != CloseProtocolError {
+		t.Errorf("got %#x %v, want a close frame with code %d", opcode, payload, CloseProtocolError)
+	}
+	<-conn.Done()
+}
+
+func TestFragmentedMessageTooBig(t *testing.T) {
+	conn, client := pipeConn(t)
+	half := bytes.Repeat([]byte("x"), maxClientMessage/2+1)
+	go func() {
+		client.Write(clientFrame(false, opText, half))
+		client.Write(clientFrame(true, opContinuation, half))
+	}()
+	opcode, payload := readServerFrame(t, client)
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != CloseMessageTooBig {
+		t.Errorf("got %#x %v, want a close frame with code %d", opcode, payload, CloseMessageTooBig)
+	}
+	<-conn.Done()
+}
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://ci.example.com", "http://localhost:5173/"}
+	tests := []struct {
+		origin  string
+		host    string
+		allowed []string
+		want    bool
+	}{
+		{"", "localhost:3000", nil, true},
+		{"http://localhost:3000", "localhost:3000", nil, true},
+		{"http://LOCALHOST:3000", "localhost:3000", nil, true},
+		{"http://localhost:3001", "localhost:3000", nil, false},
+		{"https://evil.example", "localhost:3000", nil, false},
+		{"https://ci.example.com", "localhost:3000", allowed, true},
+		{"http://localhost:5173", "localhost:3000", allowed, true},
+		{"http://ci.example.com", "localhost:3000", allowed, false},
+		{"null", "localhost:3000", allowed, false},
+		{"https://evil.example", "localhost:3000", []string{"*"}, true},
+	}
+	for _, tt := range tests {
+		if got := originAllowed(tt.origin, tt.host, tt.allowed); got != tt.want {
+			t.Errorf("originAllowed(%q, %q, %v) = %v, want %v", tt.origin, tt.host, tt.allowed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package worker
+
+import (
+	"context"
+	"docker-app/internal/expr"
+	"docker-app/internal/models"
+	"docker-app/internal/secrets"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+const (
+	// agentLeaseWait is how long the server holds a lease request while it
+	// has no job for the agent
+	agentLeaseWait = 30 * time.Second
+	// agentRetryDelay is how long an agent waits after the server failed
+	agentRetryDelay = 5 * time.Second
+	// agentOutputInterval is how often an agent sends the lines of a running
+	// step
+	agentOutputInterval = time.Second
+	// agentReportTimeout bounds every report an agent sends
+	agentReportTimeout = 30 * time.Second
+)
+
+// AgentConfig holds the settings of an agent
+type AgentConfig struct {
+	// ServerURL is the address of the server, such as "http://ci.internal:3000"
+	ServerURL string
+	// Token is the agent token the server was started with
+	Token string
+	// Name identifies the agent on the server
+	Name string
+	// AllowLocalExecutor lets the agent run jobs with the local executor
+	AllowLocalExecutor bool
+	// Labels are what the agent offers to runs_on; it is only handed jobs
+	// whose runs_on labels it all has
+	Labels []string
+}
+
+// Agent runs jobs leased from a server on the machine it runs on. The server
+// stays the only one using the database: the agent gets everything a job
+// needs with the lease and reports step output, step statuses and the result
+// over HTTP. It runs one job at a time and its steps one after another.
+type Agent struct {
+	Config AgentConfig
+	Docker *client.Client
+	client *agentClient
+	id     int
+}
+
+// NewAgent creates an agent using the local Docker daemon
+func NewAgent(config AgentConfig) (*Agent, error) {
+	if config.ServerURL == "" {
+		return nil, fmt.Errorf("the server URL is required")
+	}
+	if config.Name == "" {
+		config.Name, _ = os.Hostname()
+	}
+	if err := models.ValidateLabels(config.Labels); err != nil {
+		return nil, err
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	return &Agent{
+		Config: config,
+		Docker: cli,
+		client: newAgentClient(config.ServerURL, config.Token),
+	}, nil
+}
+
+// Run registers the agent and runs leased jobs until ctx is done. A job still
+// running then is stopped and reported as interrupted.
+func (a *Agent) Run(ctx context.Context) error {
+	id, err := a.client.register(ctx, a.Config.Name, a.Config.Labels)
+	if err != nil {
+		return fmt.Errorf("failed to register: %v", err)
+	}
+	a.id = id
+	log.Printf("Registered with %s as agent %d (%s)", a.Config.ServerURL, a.id, a.Config.Name)
+
+	for ctx.Err() == nil {
+		lease, err := a.client.lease(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Failed to lease a job: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(agentRetryDelay):
+			}
+			continue
+		}
+		if lease != nil {
+			a.runLease(ctx, *lease)
+		}
+	}
+	log.Printf("Agent %d stopped", a.id)
+	return nil
+}
+
+// runLease runs a leased job while renewing the lease, and reports its result
+func (a *Agent) runLease(ctx context.Context, lease models.Lease) {
+	job := lease.Job
+	log.Printf("Starting job %d", job.ID)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Renew the lease until the job is done, stopping the job when it was
+	// cancelled or the lease was lost
+	var cancelled, lost atomic.Bool
+	interval := time.Duration(lease.LeaseSeconds) * time.Second / 3
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			wasCancelled, err := a.client.heartbeat(jobCtx, job.ID)
+			if errors.Is(err, ErrLeaseLost) {
+				log.Printf("Job %d: lost the lease, stopping", job.ID)
+				lost.Store(true)
+				cancel()
+				return
+			}
+			if err != nil {
+				log.Printf("Job %d: heartbeat failed: %v", job.ID, err)
+				continue
+			}
+			if wasCancelled {
+				log.Printf("Job %d was cancelled", job.ID)
+				cancelled.Store(true)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	var jobTimeout time.Duration
+	runCtx := jobCtx
+	if job.Timeout != nil {
+		var err error
+		if jobTimeout, err = models.ParseDuration(*job.Timeout); err != nil {
+			a.finish(job.ID, "failed", fmt.Sprintf("invalid job timeout: %v", err), "")
+			return
+		}
+	}
+	if jobTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeout(jobCtx, jobTimeout)
+		defer cancelTimeout()
+	}
+
+	err := a.runJob(runCtx, lease)
+	var failure *stepFailure
+	switch {
+	case lost.Load():
+		// The server re-queued or failed the job already
+	case cancelled.Load():
+		a.finish(job.ID, "cancelled", "", "cancelled")
+	case ctx.Err() != nil:
+		a.finish(job.ID, "interrupted", "agent shut down before the job finished", "interrupted")
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded):
+		a.finish(job.ID, "failed", fmt.Sprintf("job timed out after %s", jobTimeout), "timed_out")
+	case errors.As(err, &failure):
+		a.finish(job.ID, "failed", failure.Reason, "")
+	case err != nil:
+		log.Printf("Error running job %d: %v", job.ID, err)
+		a.finish(job.ID, "failed", err.Error(), "failed")
+	default:
+		a.finish(job.ID, "success", "", "")
+	}
+}
+
+// finish reports the result of a job
+func (a *Agent) finish(jobID int, status, reason, stepStatus string) {
+	result := models.AgentJobResult{Status: status, StepStatus: stepStatus}
+	if reason != "" {
+		result.StatusReason = &reason
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), agentReportTimeout)
+	defer cancel()
+	if err := a.client.finish(ctx, jobID, result); err != nil {
+		log.Printf("Failed to report the result of job %d: %v", jobID, err)
+		return
+	}
+	log.Printf("Job %d finished: %s", jobID, status)
+}
+
+// runJob checks out the project, prepares the executor and runs the steps
+func (a *Agent) runJob(ctx context.Context, lease models.Lease) error {
+	job := lease.Job
+
+	var projectPath string
+	if job.RepoURL != nil && *job.RepoURL != "" {
+		tempDir := repoTempDir(job.ID)
+		os.RemoveAll(tempDir)
+		if err := os.MkdirAll(tempDir, 0755); err != nil {
+			return fmt.Errorf("failed to create temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		branch := "main"
+		if job.Branch != nil && *job.Branch != "" {
+			branch = *job.Branch
+		}
+		if err := cloneRepository(*job.RepoURL, branch, tempDir); err != nil {
+			return fmt.Errorf("failed to clone repository: %v", err)
+		}
+		projectPath = tempDir
+		if job.Folder != nil && *job.Folder != "" {
+			projectPath = filepath.Join(tempDir, *job.Folder)
+		}
+	} else if job.Folder != nil && *job.Folder != "" {
+		// A folder on the agent's machine
+		projectPath = *job.Folder
+	} else {
+		return fmt.Errorf("either repo_url or folder must be specified")
+	}
+
+	if job.Language == nil || *job.Language == "" || job.Version == nil || *job.Version == "" {
+		language, version := "golang", "latest"
+		if info, err := detectLanguageAndVersion(projectPath); err == nil {
+			language, version = info.Language, info.Version
+		}
+		if job.Language == nil || *job.Language == "" {
+			job.Language = &language
+		}
+		if job.Version == nil || *job.Version == "" {
+			job.Version = &version
+		}
+	}
+
+	if commit, err := headCommit(projectPath); err == nil {
+		job.CommitSHA = &commit
+	}
+	scope := jobScope(job, lease.PipelineName, lease.Secrets)
+	envVars, err := expandEnv(lease.Env, scope)
+	if err != nil {
+		return err
+	}
+
+	executor, err := createExecutor(a.Docker, job, a.Config.AllowLocalExecutor)
+	if err != nil {
+		return err
+	}
+	defer executor.Teardown(context.Background())
+
+	spec := executorSpec{Job: job, ProjectPath: projectPath, Env: envVars}
+	if job.ExposePorts != nil && *job.ExposePorts {
+		for _, env := range lease.Env {
+			if env.Key == "PORT" {
+				spec.Ports = append(spec.Ports, env.Value)
+			}
+		}
+	}
+	// Agents have no resource defaults or maximums, requested limits apply as is
+	requested, err := parseResources(job.Resources)
+	if err != nil {
+		return err
+	}
+	if requested != nil {
+		spec.Resources = *requested
+	}
+	if spec.Services, err = parseServices(job.Services); err != nil {
+		return err
+	}
+	if err := expandServices(spec.Services, scope); err != nil {
+		return err
+	}
+
+	if err := executor.Prepare(ctx, spec); err != nil {
+		return err
+	}
+	if job.RepoName != nil {
+		if err := checkoutRepoName(ctx, executor, job); err != nil {
+			return err
+		}
+	}
+	if caches, _ := parseCaches(job.Cache); len(caches) > 0 {
+		log.Printf("Job %d: caches are not restored on agents", job.ID)
+	}
+
+	run := jobRun{
+		Job:       job,
+		Executor:  executor,
+		Resources: spec.Resources,
+		Vars:      scope,
+		Masker:    secrets.NewMasker(lease.Secrets),
+	}
+	run.Env = make(map[string]string, len(lease.Env))
+	for _, env := range lease.Env {
+		run.Env[env.Key] = env.Value
+	}
+	return a.runSteps(ctx, run, lease)
+}
+
+// runSteps runs the steps of a leased job one at a time, each once the steps
+// it depends on have finished, with the same if: rules as the server
+func (a *Agent) runSteps(ctx context.Context, run jobRun, lease models.Lease) error {
+	steps := lease.Steps
+	deps, err := stepDependencies(steps)
+	if err != nil {
+		return err
+	}
+	files := make(map[int][]models.File)
+	for _, f := range lease.Files {
+		files[f.StepID] = append(files[f.StepID], f)
+	}
+
+	status := make([]string, len(steps))
+	stepVars := make(map[string]interface{})
+	condCtx := expr.Context{
+		Vars: map[string]interface{}{
+			"branch":  stringValue(run.Job.Branch),
+			"tag":     stringValue(run.Job.Tag),
+			"trigger": stringValue(run.Job.Trigger),
+			"env":     run.Env,
+			"steps":   stepVars,
+		},
+	}
+	finish := func(i int, s string, outputs map[string]string) {
+		status[i] = s
+		if steps[i].StepKey != nil {
+			stepVars[*steps[i].StepKey] = map[string]interface{}{"status": s, "outputs": outputs}
+			run.Vars.Steps[*steps[i].StepKey] = outputs
+		}
+	}
+	ready := func(i int) bool {
+		for _, dep := range deps[i] {
+			if status[dep] == "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	var firstErr error
+	for {
+		next := -1
+		for i := range steps {
+			if status[i] == "" && ready(i) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		step := steps[next]
+
+		stepConfig, err := parseStepConfig(step)
+		if err != nil {
+			return err
+		}
+		var condition *expr.Expression
+		if stepConfig.If != "" {
+			if condition, err = expr.Parse(stepConfig.If); err != nil {
+				return fmt.Errorf("invalid if for step %d: %v", step.ID, err)
+			}
+		}
+		shouldRun, reason, err := shouldRunAfter(condition, condCtx, steps, deps[next], status)
+		if err != nil {
+			reason = fmt.Sprintf("invalid if: %v", err)
+			a.updateStep(run.Job.ID, step.ID, "failed", &reason, 0)
+			finish(next, "failed", nil)
+			condCtx.Failed = true
+			if firstErr == nil {
+				firstErr = &stepFailure{StepID: step.ID, Status: "failed", Reason: fmt.Sprintf("step %d %s", step.OrderNum, reason)}
+			}
+			continue
+		}
+		if !shouldRun {
+			log.Printf("Skipping step %d: %s", step.ID, reason)
+			a.updateStep(run.Job.ID, step.ID, "skipped", &reason, 0)
+			finish(next, "skipped", nil)
+			continue
+		}
+
+		if docker, ok := run.Executor.(*dockerExecutor); ok {
+			if err := docker.setNetworkPolicy(ctx, stepNetwork(run.Job, stepConfig)); err != nil {
+				message := err.Error()
+				a.updateStep(run.Job.ID, step.ID, "failed", &message, 0)
+				return err
+			}
+		}
+
+		s, outputs, err := a.runStep(ctx, run, step, stepConfig, files[step.ID])
+		if err == nil {
+			finish(next, s, outputs)
+			continue
+		}
+		var failure *stepFailure
+		if !errors.As(err, &failure) {
+			return err
+		}
+		finish(next, failure.Status, outputs)
+		condCtx.Failed = true
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for i, step := range steps {
+		if status[i] == "" {
+			return fmt.Errorf("step %d can never start, its dependencies form a cycle", step.ID)
+		}
+	}
+	return firstErr
+}
+
+// runStep runs a single step like Worker.runStep, streaming its output to
+// the server
+func (a *Agent) runStep(ctx context.Context, run jobRun, step models.Step, stepConfig models.StepConfig, files []models.File) (string, map[string]string, error) {
+	stepTimeout, err := models.ParseDuration(stepConfig.Timeout)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid timeout for step %d: %v", step.ID, err)
+	}
+	maxAttempts := 1
+	var backoff time.Duration
+	if stepConfig.Retry != nil {
+		if stepConfig.Retry.MaxAttempts > 1 {
+			maxAttempts = stepConfig.Retry.MaxAttempts
+		}
+		backoff, err = models.ParseDuration(stepConfig.Retry.Backoff)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid retry backoff for step %d: %v", step.ID, err)
+		}
+	}
+
+	log.Printf("Running step %d", step.ID)
+	a.updateStep(run.Job.ID, step.ID, "running", nil, 0)
+	if err := expandStep(run.Vars, &step, files); err != nil {
+		reason := err.Error()
+		a.updateStep(run.Job.ID, step.ID, "failed", &reason, 0)
+		return "failed", nil, &stepFailure{StepID: step.ID, Status: "failed", Reason: fmt.Sprintf("step %d: %s", step.OrderNum, reason)}
+	}
+	if err := writeStepFiles(ctx, run.Executor, files); err != nil {
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+		reason := err.Error()
+		a.updateStep(run.Job.ID, step.ID, "failed", &reason, 0)
+		return "failed", nil, &stepFailure{StepID: step.ID, Status: "failed", Reason: fmt.Sprintf("step %d: %s", step.OrderNum, reason)}
+	}
+	if step.Type != "bash" {
+		a.updateStep(run.Job.ID, step.ID, "success", nil, 0)
+		return "success", nil, nil
+	}
+
+	var attempt stepAttempt
+	for n := 1; ; n++ {
+		lines := a.stepLog(run.Job.ID, step.ID, n)
+		if n > 1 {
+			lines.add(models.LogStreamSystem, fmt.Sprintf("--- attempt %d of %d ---", n, maxAttempts))
+		}
+		attempt = stepAttempt{Attempt: n}
+		docker, isDocker := run.Executor.(*dockerExecutor)
+		var oomBefore oomState
+		if isDocker {
+			oomBefore = docker.oomState(ctx)
+		}
+		attempt.stepResult, err = execStep(ctx, run.Executor, step, stepTimeout, run.Masker, lines)
+		lines.close()
+		if err != nil {
+			return "", nil, err
+		}
+		attempt.Status = "success"
+		if attempt.TimedOut {
+			attempt.Status = "timed_out"
+			timeoutReason := fmt.Sprintf("timed out after %s", stepTimeout)
+			attempt.Reason = &timeoutReason
+		} else if attempt.ExitCode != 0 {
+			attempt.Status = "failed"
+			if isDocker && docker.oomKilled(ctx, oomBefore, attempt.ExitCode) {
+				oomReason := "killed by the kernel OOM killer"
+				attempt.Reason = &oomReason
+			}
+		}
+		if attempt.Status == "success" || n >= maxAttempts || !shouldRetry(stepConfig.Retry, attempt) {
+			break
+		}
+
+		delay := retryDelay(backoff, n)
+		log.Printf("Step %d attempt %d of %d %s, retrying in %s", step.ID, n, maxAttempts, attempt.Status, delay)
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	reason := attempt.Reason
+	if attempt.Status != "success" && stepConfig.ContinueOnError {
+		continueReason := "continued because continue_on_error is set"
+		if reason != nil {
+			continueReason = *reason + "; " + continueReason
+		}
+		reason = &continueReason
+	}
+	a.reportStep(run.Job.ID, step.ID, models.AgentStepUpdate{Status: attempt.Status, StatusReason: reason, Attempts: attempt.Attempt, Outputs: attempt.Outputs})
+
+	if attempt.Status != "success" && !stepConfig.ContinueOnError {
+		jobReason := fmt.Sprintf("step %d exited with code %d", step.OrderNum, attempt.ExitCode)
+		if attempt.Reason != nil {
+			jobReason = fmt.Sprintf("step %d %s", step.OrderNum, *attempt.Reason)
+		}
+		if attempt.Attempt > 1 {
+			jobReason = fmt.Sprintf("%s after %d attempts", jobReason, attempt.Attempt)
+		}
+		return attempt.Status, attempt.Outputs, &stepFailure{StepID: step.ID, Status: attempt.Status, Reason: jobReason}
+	}
+	return attempt.Status, attempt.Outputs, nil
+}
+
+// updateStep reports the status of a step
+func (a *Agent) updateStep(jobID, stepID int, status string, reason *string, attempts int) {
+	a.reportStep(jobID, stepID, models.AgentStepUpdate{Status: status, StatusReason: reason, Attempts: attempts})
+}
+
+// reportStep sends an update of a step to the server
+func (a *Agent) reportStep(jobID, stepID int, update models.AgentStepUpdate) {
+	ctx, cancel := context.WithTimeout(context.Background(), agentReportTimeout)
+	defer cancel()
+	if err := a.client.updateStep(ctx, jobID, stepID, update); err != nil {
+		log.Printf("Failed to report step %d: %v", stepID, err)
+	}
+}
+
+// stepLog returns the log of an attempt of a step, sent to the server every
+// agentOutputInterval so that the step can be followed while it runs
+func (a *Agent) stepLog(jobID, stepID, attempt int) *stepLog {
+	return newStepLog(attempt, agentOutputInterval, nil, func(lines []models.LogLine) error {
+		ctx, cancel := context.WithTimeout(context.Background(), agentReportTimeout)
+		defer cancel()
+		return a.client.appendLines(ctx, jobID, stepID, lines)
+	})
+}
@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"docker-app/internal/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// agentClient calls the agent endpoints of the server
+type agentClient struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+func newAgentClient(server, token string) *agentClient {
+	return &agentClient{
+		server: strings.TrimRight(server, "/"),
+		token:  token,
+		// Long enough for the server to hold a lease request
+		http: &http.Client{Timeout: agentLeaseWait + 30*time.Second},
+	}
+}
+
+// call sends body, JSON or raw text for a string, and decodes the response
+// into out. Errors returned by the server are turned into Go errors, and a
+// 409 into ErrLeaseLost.
+func (c *agentClient) call(ctx context.Context, method, path string, body, out interface{}) (int, error) {
+	var reader io.Reader
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+		contentType = "text/plain; charset=utf-8"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if reader != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return resp.StatusCode, ErrLeaseLost
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, path, e.Error)
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: invalid response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// register registers the agent with the registration token and switches to
+// the token the server issued for it
+func (c *agentClient) register(ctx context.Context, name string, labels []string) (int, error) {
+	var resp struct {
+		ID    int    `json:"id"`
+		Token string `json:"token"`
+	}
+	req := map[string]interface{}{"name": name, "labels": labels}
+	_, err := c.call(ctx, "POST", "/agent/register", req, &resp)
+	if err != nil {
+		return 0, err
+	}
+	c.token = resp.Token
+	return resp.ID, nil
+}
+
+// lease waits for a job, returning nil when the server has none for a while
+func (c *agentClient) lease(ctx context.Context) (*models.Lease, error) {
+	var lease models.Lease
+	path := "/agent/lease?wait=" + strconv.Itoa(int(agentLeaseWait.Seconds()))
+	status, err := c.call(ctx, "POST", path, nil, &lease)
+	if err != nil || status == http.StatusNoContent {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// heartbeat renews the lease on a job and reports whether it was cancelled
+func (c *agentClient) heartbeat(ctx context.Context, jobID int) (bool, error) {
+	var resp struct {
+		Cancelled bool `json:"cancelled"`
+	}
+	_, err := c.call(ctx, "POST", fmt.Sprintf("/agent/jobs/%d/heartbeat", jobID), nil, &resp)
+	return resp.Cancelled, err
+}
+
+// appendLines adds lines to the output of a step
+func (c *agentClient) appendLines(ctx context.Context, jobID, stepID int, lines []models.LogLine) error {
+	_, err := c.call(ctx, "POST", fmt.Sprintf("/agent/jobs/%d/steps/%d/output", jobID, stepID), models.AgentLogLines{Lines: lines}, nil)
+	return err
+}
+
+// updateStep records the status of a step
+func (c *agentClient) updateStep(ctx context.Context, jobID, stepID int, update models.AgentStepUpdate) error {
+	_, err := c.call(ctx, "PUT", fmt.Sprintf("/agent/jobs/%d/steps/%d", jobID, stepID), update, nil)
+	return err
+}
+
+// finish records the result of a job and ends the lease
+func (c *agentClient) finish(ctx context.Context, jobID int, result models.AgentJobResult) error {
+	_, err := c.call(ctx, "POST", fmt.Sprintf("/agent/jobs/%d/finish", jobID), result, nil)
+	return err
+}
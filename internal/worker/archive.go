@@ -0,0 +1,269 @@
+package worker
+
+import (
+	"archive/tar"
+	"docker-app/internal/models"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// extractTar extracts a tar archive into dst, keeping file modes, symlinks and
+// hard links. Entries that would end up outside dst, directly or through a
+// symlink extracted earlier, are rejected. Everything stays readable and
+// directories writable by the owner, so the tree can be packaged and removed.
+func extractTar(src io.Reader, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := tarEntryPath(dst, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == dst {
+			continue
+		}
+		if err := checkNoSymlinks(dst, target); err != nil {
+			return err
+		}
+		mode := header.FileInfo().Mode().Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := prepareTarget(target); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode|0400); err != nil {
+				return err
+			}
+			os.Chtimes(target, header.ModTime, header.ModTime)
+		case tar.TypeSymlink:
+			if err := prepareTarget(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linked, err := tarEntryPath(dst, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := checkNoSymlinks(dst, linked); err != nil {
+				return err
+			}
+			if err := prepareTarget(target); err != nil {
+				return err
+			}
+			if err := os.Link(linked, target); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping %s: unsupported tar entry type %q", header.Name, header.Typeflag)
+		}
+	}
+	return nil
+}
+
+// tarEntryPath returns where an entry named name is extracted to in dst
+func tarEntryPath(dst, name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+	return filepath.Join(dst, filepath.FromSlash(clean)), nil
+}
+
+// checkNoSymlinks fails when a directory between dst and target is a symlink,
+// which could redirect the write outside dst
+func checkNoSymlinks(dst, target string) error {
+	rel, err := filepath.Rel(dst, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	current := dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("illegal path in archive: %s is below a symlink", target)
+		}
+	}
+	return nil
+}
+
+// prepareTarget creates the parent directory of target and removes a file or
+// symlink already there, so that it isn't written through
+func prepareTarget(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s already exists as a directory", target)
+	}
+	return os.Remove(target)
+}
+
+// tarDirectory writes src, a file or a directory, to dst as a tar archive
+// whose entries are below name. Symlinks are archived as links.
+func tarDirectory(src, name string, dst io.Writer) error {
+	tw := tar.NewWriter(dst)
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// tarStepFiles writes the files of a step to dst as a tar archive, with the
+// content decoded and the modes they set. Directories come before the files
+// they hold.
+func tarStepFiles(files []models.File, dst io.Writer) error {
+	sorted := append([]models.File(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	tw := tar.NewWriter(dst)
+	now := time.Now()
+	for _, f := range sorted {
+		name, err := models.CleanFilePath(f.Name)
+		if err != nil {
+			return fmt.Errorf("file %s: %v", f.Name, err)
+		}
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, ModTime: now}
+		var content []byte
+		def := int64(models.DefaultFileMode)
+		if models.IsStepDir(f.Name) {
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+			def = models.DefaultDirMode
+		} else if content, err = models.DecodeFileContent(f.Content, f.Encoding); err != nil {
+			return fmt.Errorf("file %s: %v", f.Name, err)
+		}
+		if header.Mode, err = models.ParseFileMode(f.Mode, def); err != nil {
+			return fmt.Errorf("file %s: %v", f.Name, err)
+		}
+		header.Size = int64(len(content))
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// filterArtifacts removes the files below dir that the artifacts config
+// doesn't select and returns how many were removed
+func filterArtifacts(dir string, artifacts models.ArtifactsConfig) (int, error) {
+	if len(artifacts.Include) == 0 && len(artifacts.Exclude) == 0 {
+		return 0, nil
+	}
+	var unselected []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if !artifacts.Selects(filepath.ToSlash(rel)) {
+			unselected = append(unselected, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range unselected {
+		if err := os.Remove(file); err != nil {
+			return 0, err
+		}
+	}
+	return len(unselected), nil
+}
@@ -0,0 +1,233 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+}
+
+func buildTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+			if e.typeflag == tar.TypeDir {
+				mode = 0755
+			}
+		}
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: mode}
+		if e.typeflag == tar.TypeReg {
+			header.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestExtractTar(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out")
+	archive := buildTar(t,
+		tarEntry{name: "./", typeflag: tar.TypeDir},
+		tarEntry{name: "bin/", typeflag: tar.TypeDir},
+		tarEntry{name: "bin/run.sh", typeflag: tar.TypeReg, body: "#!/bin/sh\n", mode: 0755},
+		tarEntry{name: "docs/readme.txt", typeflag: tar.TypeReg, body: "hello"},
+		tarEntry{name: "docs/latest", typeflag: tar.TypeSymlink, linkname: "readme.txt"},
+		tarEntry{name: "copy.txt", typeflag: tar.TypeLink, linkname: "docs/readme.txt"},
+		tarEntry{name: "secret.txt", typeflag: tar.TypeReg, body: "s", mode: 0},
+	)
+	if err := extractTar(archive, dst); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	if got := readFile(t, filepath.Join(dst, "docs", "readme.txt")); got != "hello" {
+		t.Errorf("readme.txt = %q", got)
+	}
+	info, err := os.Stat(filepath.Join(dst, "bin", "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("run.sh has mode %v, want 0755", info.Mode().Perm())
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "docs", "latest")); err != nil || link != "readme.txt" {
+		t.Errorf("docs/latest links to %q, %v", link, err)
+	}
+	original, _ := os.Stat(filepath.Join(dst, "docs", "readme.txt"))
+	copied, err := os.Stat(filepath.Join(dst, "copy.txt"))
+	if err != nil || !os.SameFile(original, copied) {
+		t.Errorf("copy.txt is not a hard link of docs/readme.txt: %v", err)
+	}
+}
+
+func TestExtractTarKeepsContentReadable(t *testing.T) {
+	dst := t.TempDir()
+	archive := buildTar(t,
+		tarEntry{name: "locked/", typeflag: tar.TypeDir, mode: 0500},
+		tarEntry{name: "locked/file", typeflag: tar.TypeReg, body: "x", mode: 0200},
+	)
+	if err := extractTar(archive, dst); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+	dir, _ := os.Stat(filepath.Join(dst, "locked"))
+	file, _ := os.Stat(filepath.Join(dst, "locked", "file"))
+	if dir.Mode().Perm()&0700 != 0700 || file.Mode().Perm()&0400 == 0 {
+		t.Errorf("modes %v and %v, want the directory writable and the file readable by the owner", dir.Mode().Perm(), file.Mode().Perm())
+	}
+}
+
+func TestExtractTarRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"parent", []tarEntry{{name: "../escape.txt", typeflag: tar.TypeReg, body: "x"}}},
+		{"parent after a directory", []tarEntry{{name: "a/../../escape.txt", typeflag: tar.TypeReg, body: "x"}}},
+		{"parent itself", []tarEntry{{name: "..", typeflag: tar.TypeDir}}},
+		{"backslashes", []tarEntry{{name: "..\\escape.txt", typeflag: tar.TypeReg, body: "x"}}},
+		{"absolute", []tarEntry{{name: "/tmp/escape.txt", typeflag: tar.TypeReg, body: "x"}}},
+		{"absolute directory", []tarEntry{{name: "/escape/", typeflag: tar.TypeDir}}},
+		{"hard link to a parent", []tarEntry{{name: "link", typeflag: tar.TypeLink, linkname: "../outside/secret"}}},
+		{"hard link to an absolute path", []tarEntry{{name: "link", typeflag: tar.TypeLink, linkname: "/etc/passwd"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dst := filepath.Join(root, "out")
+			err := extractTar(buildTar(t, tt.entries...), dst)
+			if err == nil || !strings.Contains(err.Error(), "illegal path") {
+				t.Fatalf("extractTar error = %v, want an illegal path", err)
+			}
+			assertOnly(t, root, "out")
+		})
+	}
+}
+
+func TestExtractTarRejectsSymlinkedParents(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"file below a symlink", []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "link/planted.txt", typeflag: tar.TypeReg, body: "x"},
+		}},
+		{"file deep below a symlink", []tarEntry{
+			{name: "a/", typeflag: tar.TypeDir},
+			{name: "a/link", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+			{name: "a/link/sub/planted.txt", typeflag: tar.TypeReg, body: "x"},
+		}},
+		{"directory below a symlink", []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "link/sub/", typeflag: tar.TypeDir},
+		}},
+		{"symlink below a symlink", []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "link/planted", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		}},
+		{"hard link below a symlink", []tarEntry{
+			{name: "file.txt", typeflag: tar.TypeReg, body: "x"},
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "link/planted.txt", typeflag: tar.TypeLink, linkname: "file.txt"},
+		}},
+		{"hard link through a symlink", []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "stolen.txt", typeflag: tar.TypeLink, linkname: "link/secret.txt"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			outside := filepath.Join(root, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := extractTar(buildTar(t, tt.entries...), filepath.Join(root, "out"))
+			if err == nil || !strings.Contains(err.Error(), "below a symlink") {
+				t.Fatalf("extractTar error = %v, want an entry below a symlink rejected", err)
+			}
+			assertOnly(t, outside, "secret.txt")
+			if _, err := os.Lstat(filepath.Join(root, "out", "stolen.txt")); err == nil {
+				t.Errorf("a hard link to a file outside was extracted")
+			}
+		})
+	}
+}
+
+func TestExtractTarReplacesSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(root, "outside.txt")
+	if err := os.WriteFile(outside, []byte("untouched"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(root, "out")
+	archive := buildTar(t,
+		tarEntry{name: "file.txt", typeflag: tar.TypeSymlink, linkname: outside},
+		tarEntry{name: "file.txt", typeflag: tar.TypeReg, body: "new"},
+	)
+	if err := extractTar(archive, dst); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+	if got := readFile(t, outside); got != "untouched" {
+		t.Errorf("the file a symlink pointed to was written through: %q", got)
+	}
+	info, err := os.Lstat(filepath.Join(dst, "file.txt"))
+	if err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("file.txt is still a symlink: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dst, "file.txt")); got != "new" {
+		t.Errorf("file.txt = %q", got)
+	}
+}
+
+// assertOnly fails unless dir holds exactly the given names
+func assertOnly(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	if strings.Join(got, ",") != strings.Join(names, ",") {
+		t.Errorf("%s holds %v, want %v", dir, got, names)
+	}
+}
@@ -0,0 +1,153 @@
+package worker
+
+import (
+	"context"
+	"docker-app/internal/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// artifactPruneInterval is how often retention rules are applied besides after
+// every job that built artifacts
+const artifactPruneInterval = time.Hour
+
+// artifactURL is the download URL recorded on the runnable that built an artifact
+func artifactURL(artifactID int) string {
+	return fmt.Sprintf("/artifacts/%d/download", artifactID)
+}
+
+// storeArtifact puts a built file into the artifact store and records it
+func (w *Worker) storeArtifact(ctx context.Context, job models.Job, runnable models.Runnable, file string) (models.Artifact, error) {
+	artifact := models.Artifact{
+		JobID:      job.ID,
+		RunnableID: runnable.ID,
+		PipelineID: job.PipelineID,
+		Name:       filepath.Base(file),
+		Store:      w.Artifacts.GetType(),
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return artifact, err
+	}
+	defer f.Close()
+	w.artifactMutex.RLock()
+	defer w.artifactMutex.RUnlock()
+	artifact.Digest, artifact.Size, err = w.Artifacts.Put(ctx, f)
+	if err != nil {
+		return artifact, err
+	}
+
+	result, err := w.DB.Exec("INSERT INTO artifacts (job_id, runnable_id, pipeline_id, name, digest, size, store) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		artifact.JobID, artifact.RunnableID, artifact.PipelineID, artifact.Name, artifact.Digest, artifact.Size, artifact.Store)
+	if err != nil {
+		return artifact, err
+	}
+	id, _ := result.LastInsertId()
+	artifact.ID = int(id)
+	log.Printf("Stored artifact %s of job %d as %s (%d bytes)", artifact.Name, job.ID, artifact.Digest, artifact.Size)
+	return artifact, nil
+}
+
+// startArtifactPruning applies the retention rules periodically until the
+// worker stops
+func (w *Worker) startArtifactPruning() {
+	go func() {
+		ticker := time.NewTicker(artifactPruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.PruneArtifacts()
+			case <-w.stopping:
+				return
+			}
+		}
+	}()
+}
+
+// PruneArtifacts deletes the artifacts that the retention rules of their
+// pipeline no longer keep
+func (w *Worker) PruneArtifacts() {
+	var pipelines []models.Pipeline
+	err := w.DB.Select(&pipelines, "SELECT * FROM pipelines WHERE retention IS NOT NULL")
+	if err != nil {
+		log.Printf("Failed to load retention rules: %v", err)
+		return
+	}
+
+	for _, pipeline := range pipelines {
+		var retention models.RetentionConfig
+		if err := json.Unmarshal([]byte(*pipeline.Retention), &retention); err != nil {
+			log.Printf("Invalid retention rules for pipeline %d: %v", pipeline.ID, err)
+			continue
+		}
+
+		var expired []models.Artifact
+		maxAge, err := models.ParseDuration(retention.MaxAge)
+		if err != nil {
+			log.Printf("Invalid retention rules for pipeline %d: %v", pipeline.ID, err)
+			continue
+		}
+		if maxAge > 0 {
+			var old []models.Artifact
+			err := w.DB.Select(&old, "SELECT * FROM artifacts WHERE pipeline_id = ? AND created_at < datetime('now', ?)",
+				pipeline.ID, fmt.Sprintf("-%d seconds", int64(maxAge.Seconds())))
+			if err != nil {
+				log.Printf("Failed to find expired artifacts of pipeline %d: %v", pipeline.ID, err)
+				continue
+			}
+			expired = append(expired, old...)
+		}
+		if retention.KeepLast > 0 {
+			var old []models.Artifact
+			err := w.DB.Select(&old, `SELECT * FROM artifacts WHERE pipeline_id = ? AND job_id NOT IN (
+				SELECT DISTINCT job_id FROM artifacts WHERE pipeline_id = ? ORDER BY job_id DESC LIMIT ?)`,
+				pipeline.ID, pipeline.ID, retention.KeepLast)
+			if err != nil {
+				log.Printf("Failed to find expired artifacts of pipeline %d: %v", pipeline.ID, err)
+				continue
+			}
+			expired = append(expired, old...)
+		}
+
+		deleted := make(map[int]bool)
+		for _, artifact := range expired {
+			if deleted[artifact.ID] {
+				continue
+			}
+			deleted[artifact.ID] = true
+			if err := w.DeleteArtifact(artifact); err != nil {
+				log.Printf("Failed to delete artifact %d: %v", artifact.ID, err)
+				continue
+			}
+			log.Printf("Deleted artifact %s of job %d under the retention rules of pipeline %d", artifact.Name, artifact.JobID, pipeline.ID)
+		}
+	}
+}
+
+// DeleteArtifact removes an artifact record, and its content once no other
+// artifact has the same digest. Artifacts are not stored meanwhile, one with
+// the same digest would be recorded with its content gone.
+func (w *Worker) DeleteArtifact(artifact models.Artifact) error {
+	w.artifactMutex.Lock()
+	defer w.artifactMutex.Unlock()
+	_, err := w.DB.Exec("DELETE FROM artifacts WHERE id = ?", artifact.ID)
+	if err != nil {
+		return err
+	}
+	w.DB.Exec("UPDATE runnables SET artifact_url = NULL WHERE id = ? AND artifact_url = ?", artifact.RunnableID, artifactURL(artifact.ID))
+	var count int
+	err = w.DB.Get(&count, "SELECT COUNT(*) FROM artifacts WHERE digest = ? AND store = ?", artifact.Digest, artifact.Store)
+	if err != nil {
+		return err
+	}
+	if count > 0 || artifact.Store != w.Artifacts.GetType() {
+		return nil
+	}
+	return w.Artifacts.Delete(context.Background(), artifact.Digest)
+}
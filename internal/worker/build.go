@@ -0,0 +1,153 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"docker-app/internal/models"
+	"docker-app/internal/providers"
+	"docker-app/internal/secrets"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runnableOutputInterval is how often a runnable's output is written to the
+// database while it is produced
+const runnableOutputInterval = time.Second
+
+// runnableImageName returns the name a docker_image or docker_container
+// runnable tags its image with
+func runnableImageName(runnable models.Runnable, config models.RunnableConfig) string {
+	if config.ImageName != "" {
+		return config.ImageName
+	}
+	return fmt.Sprintf("rapidflow-job-%d-%s", runnable.JobID, runnable.Name)
+}
+
+// buildRunnableImage builds a runnable's image from its Dockerfile with the
+// build context taken from the build container, streams the build log into
+// the runnable's output and records the digest of the image
+func (w *Worker) buildRunnableImage(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, sourceContainerID, imageName string, masker *secrets.Masker) (string, error) {
+	contextPath := config.BuildContextPath()
+	reader, stat, err := w.Docker.CopyFromContainer(ctx, sourceContainerID, contextPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read build context %s: %v", contextPath, err)
+	}
+	defer reader.Close()
+	if !stat.Mode.IsDir() {
+		return "", fmt.Errorf("build context %s is not a directory", contextPath)
+	}
+
+	// The archive holds the context directory itself, the daemon expects its
+	// content at the root
+	buildContext, pw := io.Pipe()
+	defer buildContext.Close()
+	go func() {
+		pw.CloseWithError(rerootTar(reader, pw))
+	}()
+
+	output := &runnableOutput{w: w, runnableID: runnable.ID, masker: masker}
+	defer output.flush()
+	fmt.Fprintf(output, "Building %s from %s in %s\n", imageName, config.Dockerfile, contextPath)
+
+	log.Printf("Building image %s for runnable %s from %s", imageName, runnable.Name, config.Dockerfile)
+	imageID, err := providers.BuildDockerImage(ctx, w.Docker, buildContext, providers.BuildOptions{
+		Dockerfile: path.Clean(config.Dockerfile),
+		Tag:        imageName,
+		BuildArgs:  config.BuildArgs,
+		Target:     config.Target,
+		Labels:     map[string]string{jobContainerLabel: strconv.Itoa(runnable.JobID)},
+	}, output)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(output, "Built image %s (%s)\n", imageName, imageID)
+	log.Printf("Built image %s: %s", imageName, imageID)
+	w.DB.Exec("UPDATE runnables SET image_digest = ? WHERE id = ?", imageID, runnable.ID)
+	return imageID, nil
+}
+
+// rerootTar copies a tar archive of a single directory from src to dst with
+// that directory stripped from the entry names
+func rerootTar(src io.Reader, dst io.Writer) error {
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(dst)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		header.Name = stripTopDir(header.Name)
+		if header.Name == "" {
+			// The directory itself
+			continue
+		}
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = stripTopDir(header.Linkname)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// stripTopDir removes the first element of a slash separated path
+func stripTopDir(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// runnableOutput collects what a runnable prints and writes it to the
+// runnable's output at most every runnableOutputInterval, so that the
+// progress of a long build can be followed. Secret values are masked.
+type runnableOutput struct {
+	w          *Worker
+	runnableID int
+	masker     *secrets.Masker
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	flushed time.Time
+}
+
+func (o *runnableOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.buf.Write(p)
+	if time.Since(o.flushed) >= runnableOutputInterval {
+		o.flushLocked()
+	}
+	return len(p), nil
+}
+
+// flush writes everything collected so far
+func (o *runnableOutput) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flushLocked()
+}
+
+func (o *runnableOutput) flushLocked() {
+	o.flushed = time.Now()
+	if _, err := o.w.DB.Exec("UPDATE runnables SET output = ? WHERE id = ?", o.masker.Mask(o.buf.String()), o.runnableID); err != nil {
+		log.Printf("Failed to update output of runnable %d: %v", o.runnableID, err)
+	}
+}
@@ -0,0 +1,360 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"docker-app/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// cacheUse is a cache restored for a job or step, to be saved once it succeeds
+type cacheUse struct {
+	Config   models.CacheConfig
+	Key      string
+	Paths    []string
+	Hit      bool
+	RecordID int64
+}
+
+// parseCaches decodes the caches stored on a job record
+func parseCaches(caches *string) ([]models.CacheConfig, error) {
+	if caches == nil || *caches == "" {
+		return nil, nil
+	}
+	var c []models.CacheConfig
+	if err := json.Unmarshal([]byte(*caches), &c); err != nil {
+		return nil, fmt.Errorf("invalid cache: %v", err)
+	}
+	return c, nil
+}
+
+// restoreCaches restores the caches of a job, or of one of its steps, where
+// the job runs and records a hit or miss for each. A cache that can't be
+// restored is a miss; it never fails the job.
+func (w *Worker) restoreCaches(ctx context.Context, run jobRun, stepID *int, caches []models.CacheConfig) []cacheUse {
+	var uses []cacheUse
+	for _, config := range caches {
+		use := cacheUse{Config: config}
+		var reason *string
+		key, err := w.cacheKey(ctx, run, config.Key)
+		if err == nil {
+			use.Key = key
+			use.Paths, err = w.resolveCachePaths(ctx, run.Executor, config.Paths)
+		}
+		if err == nil {
+			use.Hit, err = w.restoreCache(ctx, run, use)
+		}
+		if err != nil {
+			log.Printf("Job %d: cache %q not restored: %v", run.Job.ID, config.Key, err)
+			message := err.Error()
+			reason = &message
+		} else if use.Hit {
+			log.Printf("Job %d: cache hit for %s", run.Job.ID, use.Key)
+		} else {
+			log.Printf("Job %d: cache miss for %s", run.Job.ID, use.Key)
+		}
+
+		recordKey := use.Key
+		if recordKey == "" {
+			recordKey = config.Key
+		}
+		result, dbErr := w.DB.Exec("INSERT INTO job_caches (job_id, step_id, key, hit, reason) VALUES (?, ?, ?, ?, ?)", run.Job.ID, stepID, recordKey, use.Hit, reason)
+		if dbErr != nil {
+			log.Printf("Error recording cache %s of job %d: %v", recordKey, run.Job.ID, dbErr)
+		} else {
+			use.RecordID, _ = result.LastInsertId()
+		}
+		// Without a key or paths there is nothing to save later
+		if use.Key != "" && use.Paths != nil {
+			uses = append(uses, use)
+		}
+	}
+	return uses
+}
+
+// saveCaches saves the caches that missed and then evicts the least recently
+// used caches until the store fits its size limit
+func (w *Worker) saveCaches(ctx context.Context, run jobRun, uses []cacheUse) {
+	saved := false
+	for _, use := range uses {
+		if use.Hit {
+			continue
+		}
+		size, err := w.saveCache(ctx, run, use)
+		if err != nil {
+			log.Printf("Job %d: cache %s not saved: %v", run.Job.ID, use.Key, err)
+			w.DB.Exec("UPDATE job_caches SET reason = ? WHERE id = ?", err.Error(), use.RecordID)
+			continue
+		}
+		log.Printf("Job %d: saved cache %s (%s)", run.Job.ID, use.Key, units.BytesSize(float64(size)))
+		w.DB.Exec("UPDATE job_caches SET saved = 1, size = ? WHERE id = ?", size, use.RecordID)
+		saved = true
+	}
+	if saved {
+		w.evictCaches()
+	}
+}
+
+// cacheKey renders a cache key template for a job
+func (w *Worker) cacheKey(ctx context.Context, run jobRun, key string) (string, error) {
+	hashFiles := func(patterns ...string) (string, error) {
+		return w.hashFiles(ctx, run.Executor, patterns)
+	}
+	tmpl, err := models.ParseCacheKey(key, hashFiles)
+	if err != nil {
+		return "", fmt.Errorf("invalid key: %v", err)
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, models.CacheKeyData{
+		Language: stringValue(run.Job.Language),
+		Version:  stringValue(run.Job.Version),
+		Branch:   stringValue(run.Job.Branch),
+		Env:      run.Env,
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid key: %v", err)
+	}
+	rendered := strings.TrimSpace(out.String())
+	if rendered == "" {
+		return "", fmt.Errorf("key %q is empty", key)
+	}
+	return rendered, nil
+}
+
+// hashFiles returns the sha256 of the workspace files matching the shell glob
+// patterns, or "" when no file matches
+func (w *Worker) hashFiles(ctx context.Context, executor Executor, patterns []string) (string, error) {
+	script := `cd "$1" || exit 1; shift; for p in "$@"; do for f in $p; do if [ -f "$f" ]; then sha256sum "$f" || exit 1; fi; done; done`
+	output, exitCode, err := execOutput(ctx, executor, append([]string{"sh", "-c", script, "sh", executor.Workspace()}, patterns...))
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return "", fmt.Errorf("hashFiles failed: %s", strings.TrimSpace(output))
+	}
+	if strings.TrimSpace(output) == "" {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(output))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// resolveCachePaths expands "~/" to the home directory of the user running the
+// job and maps /workspace to the executor's workspace
+func (w *Worker) resolveCachePaths(ctx context.Context, executor Executor, paths []string) ([]string, error) {
+	home := ""
+	resolved := make([]string, len(paths))
+	for i, p := range paths {
+		if strings.HasPrefix(p, "~/") {
+			if home == "" {
+				output, _, err := execOutput(ctx, executor, []string{"sh", "-c", `echo "$HOME"`})
+				if err != nil {
+					return nil, err
+				}
+				home = strings.TrimSpace(output)
+				if home == "" {
+					home = "/root"
+				}
+			}
+			p = path.Join(home, p[2:])
+		}
+		resolved[i] = workspacePath(executor, path.Clean(p))
+	}
+	return resolved, nil
+}
+
+// cacheDir returns the directory holding the tarballs of a saved cache
+func (w *Worker) cacheDir(cacheID int) string {
+	return filepath.Join(w.Config.CacheDir, strconv.Itoa(cacheID))
+}
+
+// restoreCache copies the tarballs of a saved cache to where the job runs. It
+// reports false when the pipeline has no cache with the key.
+func (w *Worker) restoreCache(ctx context.Context, run jobRun, use cacheUse) (bool, error) {
+	var cache models.Cache
+	err := w.DB.Get(&cache, "SELECT * FROM caches WHERE pipeline_id = ? AND key = ?", run.Job.PipelineID, use.Key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	dir := w.cacheDir(cache.ID)
+	if _, err := os.Stat(dir); err != nil {
+		return false, fmt.Errorf("cache %d is missing from the store: %v", cache.ID, err)
+	}
+	// The tarballs are numbered after the paths the cache was saved with,
+	// which the key doesn't have to cover: paths may have been reordered,
+	// added or removed since
+	var saved []string
+	if err := json.Unmarshal([]byte(cache.Paths), &saved); err != nil {
+		return false, fmt.Errorf("cache %d has invalid paths: %v", cache.ID, err)
+	}
+	tarballs := make(map[string]int, len(saved))
+	for i, p := range saved {
+		tarballs[p] = i
+	}
+	for j, p := range use.Paths {
+		i, ok := tarballs[use.Config.Paths[j]]
+		if !ok {
+			log.Printf("Job %d: cache %s was saved without %s", run.Job.ID, use.Key, use.Config.Paths[j])
+			continue
+		}
+		tarball, err := os.Open(filepath.Join(dir, fmt.Sprintf("%d.tar", i)))
+		if os.IsNotExist(err) {
+			// The path didn't exist when the cache was saved
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		err = run.Executor.CopyTo(ctx, path.Dir(p), tarball)
+		tarball.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to restore %s: %v", p, err)
+		}
+	}
+
+	w.DB.Exec("UPDATE caches SET hits = hits + 1, last_used_at = CURRENT_TIMESTAMP WHERE id = ?", cache.ID)
+	return true, nil
+}
+
+// saveCache stores the paths of a cache as tarballs, one per path numbered
+// after its position in the paths recorded with the cache, and returns their
+// total size. Paths that don't exist are left out.
+func (w *Worker) saveCache(ctx context.Context, run jobRun, use cacheUse) (int64, error) {
+	limit := w.Config.CacheSize
+	if use.Config.MaxSize != "" {
+		maxSize, err := units.RAMInBytes(use.Config.MaxSize)
+		if err != nil {
+			return 0, fmt.Errorf("invalid max_size: %v", err)
+		}
+		if limit <= 0 || maxSize < limit {
+			limit = maxSize
+		}
+	}
+
+	if err := os.MkdirAll(w.Config.CacheDir, 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.MkdirTemp(w.Config.CacheDir, "tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var size int64
+	for i, p := range use.Paths {
+		content, err := run.Executor.CopyFrom(ctx, p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %v", p, err)
+		}
+		remaining := int64(-1)
+		if limit > 0 {
+			remaining = limit - size
+		}
+		n, err := writeCacheTarball(filepath.Join(tmp, fmt.Sprintf("%d.tar", i)), content, remaining)
+		content.Close()
+		size += n
+		if err != nil {
+			return 0, fmt.Errorf("failed to save %s: %v (limit %s)", p, err, units.BytesSize(float64(limit)))
+		}
+	}
+
+	pathsJSON, err := json.Marshal(use.Config.Paths)
+	if err != nil {
+		return 0, err
+	}
+	result, err := w.DB.Exec("INSERT OR IGNORE INTO caches (pipeline_id, key, paths, size) VALUES (?, ?, ?, ?)", run.Job.PipelineID, use.Key, string(pathsJSON), size)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, fmt.Errorf("another job saved %s first", use.Key)
+	}
+	id, _ := result.LastInsertId()
+	if err := os.Rename(tmp, w.cacheDir(int(id))); err != nil {
+		w.DB.Exec("DELETE FROM caches WHERE id = ?", id)
+		return 0, err
+	}
+	return size, nil
+}
+
+// writeCacheTarball writes a tar stream to file, failing once it grows beyond
+// limit bytes. A negative limit means no limit.
+func writeCacheTarball(file string, content io.Reader, limit int64) (int64, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if limit < 0 {
+		return io.Copy(f, content)
+	}
+	n, err := io.Copy(f, io.LimitReader(content, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, fmt.Errorf("cache is larger than the size limit")
+	}
+	return n, nil
+}
+
+// evictCaches removes the least recently used caches until the store is
+// within Config.CacheSize
+func (w *Worker) evictCaches() {
+	if w.Config.CacheSize <= 0 {
+		return
+	}
+	w.cacheMutex.Lock()
+	defer w.cacheMutex.Unlock()
+
+	var total int64
+	err := w.DB.Get(&total, "SELECT COALESCE(SUM(size), 0) FROM caches")
+	if err != nil {
+		log.Printf("Failed to compute the cache size: %v", err)
+		return
+	}
+	for total > w.Config.CacheSize {
+		var cache models.Cache
+		err := w.DB.Get(&cache, "SELECT * FROM caches ORDER BY last_used_at, id LIMIT 1")
+		if err != nil {
+			log.Printf("Failed to find a cache to evict: %v", err)
+			return
+		}
+		log.Printf("Evicting cache %s of pipeline %d (%s)", cache.Key, cache.PipelineID, units.BytesSize(float64(cache.Size)))
+		if err := w.DeleteCache(cache.ID); err != nil {
+			log.Printf("Failed to evict cache %d: %v", cache.ID, err)
+			return
+		}
+		total -= cache.Size
+	}
+}
+
+// DeleteCache removes a saved cache and its tarballs
+func (w *Worker) DeleteCache(cacheID int) error {
+	_, err := w.DB.Exec("DELETE FROM caches WHERE id = ?", cacheID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(w.cacheDir(cacheID))
+}
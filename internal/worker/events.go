@@ -0,0 +1,353 @@
+package worker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"docker-app/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// deliveryPollInterval is how often deliveries due for a retry are
+	// looked for; new events are sent right away
+	deliveryPollInterval = 5 * time.Second
+	// deliveryTimeout bounds a request to a subscription
+	deliveryTimeout = 10 * time.Second
+	// deliveryBackoff is the delay before the first retry of a delivery,
+	// doubled for every attempt up to maxRetryDelay
+	deliveryBackoff = 30 * time.Second
+	// maxDeliveryAttempts is how often a delivery is tried before it fails
+	maxDeliveryAttempts = 8
+	// deliveryConcurrency caps the requests sent at the same time
+	deliveryConcurrency = 4
+	// maxResponseBody caps the response body kept in the delivery log, and
+	// read otherwise
+	maxResponseBody = 4096
+	// eventRetention is how long events and their finished deliveries are
+	// kept
+	eventRetention = 30 * 24 * time.Hour
+)
+
+// signatureHeader carries the hex HMAC-SHA256 of the body of a delivery,
+// keyed with the secret of the subscription, as sha256=<hex>
+const signatureHeader = "X-Signature-256"
+
+// newDeliveryClient returns the client deliveries are sent with. It doesn't
+// follow redirects, a 3xx response is a failed attempt. Unless allowPrivate,
+// it refuses to connect to the addresses models.ForbiddenAddress rejects. The
+// address is checked as it is dialed, as a host may resolve elsewhere than
+// when its subscription was validated.
+func newDeliveryClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: deliveryTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || models.ForbiddenAddress(ip) {
+				return fmt.Errorf("refusing to connect to %s, a loopback, link-local or private address", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the subscription
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   deliveryTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// recordJobEvent records the event of the current status of a job
+func (w *Worker) recordJobEvent(job models.Job) {
+	w.recordEvent(models.JobEvent(job.Status), job, 0, 0, models.EventJobData{Job: job})
+}
+
+// recordStepEvent records the event of the current status of a step
+func (w *Worker) recordStepEvent(job models.Job, step models.Step) {
+	step.Output = nil
+	w.recordEvent(models.StepEvent(step.Status), job, step.ID, 0, models.EventStepData{Job: job, Step: step})
+}
+
+// PublishDeployment records the lifecycle event of the current status of a
+// deployment of a job for the subscriptions
+func (w *Worker) PublishDeployment(jobID, deploymentID int) {
+	var job models.Job
+	if err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID); err != nil {
+		return
+	}
+	var deployment models.Deployment
+	if err := w.DB.Get(&deployment, "SELECT * FROM deployments WHERE id = ?", deploymentID); err != nil {
+		return
+	}
+	w.recordEvent(models.DeploymentEvent(deployment.Status), job, 0, deployment.ID,
+		models.EventDeploymentData{Job: job, Deployment: deployment})
+}
+
+// recordEvent records an event of a job, or of its step or deployment when
+// their id is set, and queues its deliveries to the subscriptions that want
+// it. Statuses are published whenever they may have changed, so the event is
+// dropped when it is the last one recorded for the same thing in this run of
+// the job.
+func (w *Worker) recordEvent(eventType string, job models.Job, stepID, deploymentID int, data interface{}) {
+	if eventType == "" {
+		return
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s event of job %d: %v", eventType, job.ID, err)
+		return
+	}
+	var step, deployment *int
+	if stepID != 0 {
+		step = &stepID
+	}
+	if deploymentID != 0 {
+		deployment = &deploymentID
+	}
+
+	w.eventMutex.Lock()
+	defer w.eventMutex.Unlock()
+	tx, err := w.DB.Beginx()
+	if err != nil {
+		log.Printf("Failed to record %s event of job %d: %v", eventType, job.ID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var last string
+	err = tx.Get(&last, "SELECT type FROM events WHERE job_id = ? AND restart = ? AND COALESCE(step_id, 0) = ? AND COALESCE(deployment_id, 0) = ? ORDER BY id DESC LIMIT 1",
+		job.ID, job.RestartCount, stepID, deploymentID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to record %s event of job %d: %v", eventType, job.ID, err)
+		return
+	}
+	if last == eventType {
+		return
+	}
+	result, err := tx.Exec("INSERT INTO events (type, pipeline_id, job_id, step_id, deployment_id, restart, data) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		eventType, job.PipelineID, job.ID, step, deployment, job.RestartCount, string(encoded))
+	if err != nil {
+		log.Printf("Failed to record %s event of job %d: %v", eventType, job.ID, err)
+		return
+	}
+	eventID, _ := result.LastInsertId()
+
+	var subscriptions []models.EventSubscription
+	err = tx.Select(&subscriptions, "SELECT * FROM event_subscriptions WHERE active = 1 AND (pipeline_id IS NULL OR pipeline_id = ?)", job.PipelineID)
+	if err != nil {
+		log.Printf("Failed to look up subscriptions to %s: %v", eventType, err)
+		return
+	}
+	queued := 0
+	for _, subscription := range subscriptions {
+		if !subscription.Wants(eventType) {
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO event_deliveries (subscription_id, event_id, event_type, status, next_attempt_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+			subscription.ID, eventID, eventType, models.DeliveryPending)
+		if err != nil {
+			log.Printf("Failed to queue %s event for subscription %d: %v", eventType, subscription.ID, err)
+			return
+		}
+		queued++
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to record %s event of job %d: %v", eventType, job.ID, err)
+		return
+	}
+	if queued > 0 {
+		w.wakeDeliveries()
+	}
+}
+
+// Redeliver queues an event of a past delivery to be sent again to its
+// subscription, as a new delivery
+func (w *Worker) Redeliver(delivery models.EventDelivery) (models.EventDelivery, error) {
+	var redelivery models.EventDelivery
+	result, err := w.DB.Exec("INSERT INTO event_deliveries (subscription_id, event_id, event_type, status, next_attempt_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		delivery.SubscriptionID, delivery.EventID, delivery.EventType, models.DeliveryPending)
+	if err != nil {
+		return redelivery, err
+	}
+	id, _ := result.LastInsertId()
+	if err := w.DB.Get(&redelivery, "SELECT * FROM event_deliveries WHERE id = ?", id); err != nil {
+		return redelivery, err
+	}
+	w.wakeDeliveries()
+	return redelivery, nil
+}
+
+// wakeDeliveries has the deliveries loop look for due deliveries now
+func (w *Worker) wakeDeliveries() {
+	select {
+	case w.deliveries <- struct{}{}:
+	default:
+	}
+}
+
+// startDeliveries sends the deliveries of events as they are queued, retries
+// the failed ones and drops old events, until the worker stops
+func (w *Worker) startDeliveries() {
+	go func() {
+		ticker := time.NewTicker(deliveryPollInterval)
+		defer ticker.Stop()
+		pruned := time.Time{}
+		for {
+			w.sendDueDeliveries()
+			if time.Since(pruned) > time.Hour {
+				w.pruneEvents()
+				pruned = time.Now()
+			}
+			select {
+			case <-ticker.C:
+			case <-w.deliveries:
+			case <-w.stopping:
+				return
+			}
+		}
+	}()
+}
+
+// sendDueDeliveries sends the pending deliveries whose next attempt is due
+func (w *Worker) sendDueDeliveries() {
+	var deliveries []models.EventDelivery
+	err := w.DB.Select(&deliveries, "SELECT * FROM event_deliveries WHERE status = ? AND next_attempt_at <= CURRENT_TIMESTAMP ORDER BY id LIMIT 100", models.DeliveryPending)
+	if err != nil {
+		log.Printf("Failed to look for due deliveries: %v", err)
+		return
+	}
+	slots := make(chan struct{}, deliveryConcurrency)
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(delivery models.EventDelivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			w.deliver(delivery)
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+// deliver POSTs the event of a delivery to its subscription and records the
+// outcome: success on a 2xx response, otherwise another attempt after a
+// backoff until maxDeliveryAttempts were made
+func (w *Worker) deliver(delivery models.EventDelivery) {
+	var subscription models.EventSubscription
+	err := w.DB.Get(&subscription, "SELECT * FROM event_subscriptions WHERE id = ?", delivery.SubscriptionID)
+	if err == nil && !subscription.Active {
+		err = fmt.Errorf("subscription %d is inactive", subscription.ID)
+	}
+	var event models.Event
+	if err == nil {
+		err = w.DB.Get(&event, "SELECT * FROM events WHERE id = ?", delivery.EventID)
+	}
+	if err != nil {
+		message := err.Error()
+		w.DB.Exec("UPDATE event_deliveries SET status = ?, error = ?, next_attempt_at = NULL WHERE id = ?", models.DeliveryFailed, message, delivery.ID)
+		return
+	}
+
+	body, err := json.Marshal(event.Payload())
+	if err != nil {
+		log.Printf("Failed to encode event %d: %v", event.ID, err)
+		return
+	}
+	start := time.Now()
+	status, response, err := w.postEvent(subscription, delivery, event, body)
+	duration := time.Since(start).Milliseconds()
+	attempts := delivery.Attempts + 1
+
+	var responseStatus *int
+	if status != 0 {
+		responseStatus = &status
+	}
+	if err == nil && status >= 200 && status < 300 {
+		w.DB.Exec("UPDATE event_deliveries SET status = ?, attempts = ?, response_status = ?, response_body = ?, error = NULL, duration_ms = ?, next_attempt_at = NULL, last_attempt_at = CURRENT_TIMESTAMP WHERE id = ?",
+			models.DeliverySuccess, attempts, responseStatus, response, duration, delivery.ID)
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("subscription responded %d", status)
+	}
+	message := err.Error()
+	if attempts >= maxDeliveryAttempts {
+		log.Printf("Delivery %d of %s event %d to %s failed after %d attempts: %s", delivery.ID, event.Type, event.ID, subscription.URL, attempts, message)
+		w.DB.Exec("UPDATE event_deliveries SET status = ?, attempts = ?, response_status = ?, response_body = ?, error = ?, duration_ms = ?, next_attempt_at = NULL, last_attempt_at = CURRENT_TIMESTAMP WHERE id = ?",
+			models.DeliveryFailed, attempts, responseStatus, response, message, duration, delivery.ID)
+		return
+	}
+	delay := retryDelay(deliveryBackoff, attempts)
+	w.DB.Exec("UPDATE event_deliveries SET attempts = ?, response_status = ?, response_body = ?, error = ?, duration_ms = ?, next_attempt_at = datetime('now', ?), last_attempt_at = CURRENT_TIMESTAMP WHERE id = ?",
+		attempts, responseStatus, response, message, duration, fmt.Sprintf("+%d seconds", int64(delay.Seconds())), delivery.ID)
+}
+
+// postEvent sends the body of an event to a subscription and returns the
+// status of the response, and the start of its body when responses are stored
+func (w *Worker) postEvent(subscription models.EventSubscription, delivery models.EventDelivery, event models.Event, body []byte) (int, *string, error) {
+	req, err := http.NewRequest("POST", subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "docker-app-events")
+	req.Header.Set("X-Event-Type", event.Type)
+	req.Header.Set("X-Event-ID", strconv.Itoa(event.ID))
+	req.Header.Set("X-Delivery-ID", strconv.Itoa(delivery.ID))
+	req.Header.Set(signatureHeader, signPayload(subscription.Secret, body))
+
+	resp, err := w.deliveryClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if !w.Config.StoreDeliveryResponses {
+		return resp.StatusCode, nil, nil
+	}
+	response := string(data)
+	return resp.StatusCode, &response, nil
+}
+
+// signPayload returns the value of signatureHeader for a body signed with
+// secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// pruneEvents deletes the deliveries and events older than eventRetention,
+// keeping the deliveries still pending and their events
+func (w *Worker) pruneEvents() {
+	modifier := fmt.Sprintf("-%d seconds", int64(eventRetention.Seconds()))
+	_, err := w.DB.Exec("DELETE FROM event_deliveries WHERE status != ? AND created_at < datetime('now', ?)", models.DeliveryPending, modifier)
+	if err != nil {
+		log.Printf("Failed to prune event deliveries: %v", err)
+		return
+	}
+	_, err = w.DB.Exec("DELETE FROM events WHERE created_at < datetime('now', ?) AND id NOT IN (SELECT event_id FROM event_deliveries)", modifier)
+	if err != nil {
+		log.Printf("Failed to prune events: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"docker-app/internal/models"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// containerWorkspace is where container executors put the project
+const containerWorkspace = "/workspace"
+
+// Executor runs a job somewhere: it prepares a workspace holding the project,
+// runs commands in it, copies files in and out and removes what it created
+// once the job is done. newExecutor creates one for every job.
+//
+// Paths are paths where the job runs. Container executors keep the project at
+// /workspace, the local executor at Workspace().
+type Executor interface {
+	// GetType returns the name pipelines choose the executor by
+	GetType() string
+
+	// Prepare creates the workspace of a job
+	Prepare(ctx context.Context, spec executorSpec) error
+
+	// Workspace returns the path of the project
+	Workspace() string
+
+	// Exec runs cmd where the job runs and returns its exit code. The local
+	// executor starts it in the workspace. When ctx is done the command is
+	// killed and ctx.Err() returned.
+	Exec(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error)
+
+	// CopyTo extracts a tar stream into dir, creating dir first
+	CopyTo(ctx context.Context, dir string, content io.Reader) error
+
+	// CopyFrom returns a tar stream of path whose entries start with the last
+	// element of path, like docker cp. A missing path is reported with an
+	// error matching os.ErrNotExist.
+	CopyFrom(ctx context.Context, path string) (io.ReadCloser, error)
+
+	// Teardown removes everything Prepare created
+	Teardown(ctx context.Context) error
+}
+
+// executorSpec describes the job an executor prepares a workspace for
+type executorSpec struct {
+	Job models.Job
+	// ProjectPath is the project on the worker, cloned or a local folder
+	ProjectPath string
+	// Env holds the job's environment as KEY=value
+	Env []string
+	// Ports are published on the host when the job exposes ports
+	Ports []string
+	// Resources are the effective resource limits of the job container
+	Resources models.ResourceConfig
+	// Services are started next to the job container, with their effective
+	// resource limits
+	Services []models.ServiceConfig
+}
+
+// newExecutor creates the executor the pipeline of a job chose
+func (w *Worker) newExecutor(job models.Job) (Executor, error) {
+	return createExecutor(w.Docker, job, w.Config.AllowLocalExecutor)
+}
+
+// createExecutor creates the executor of a job, running docker jobs with the
+// given daemon
+func createExecutor(docker *client.Client, job models.Job, allowLocal bool) (Executor, error) {
+	config, err := models.ParseExecutor(job.Executor)
+	if err != nil {
+		return nil, err
+	}
+	switch models.ExecutorType(config) {
+	case models.ExecutorDocker:
+		return newDockerExecutor(docker, job.ID), nil
+	case models.ExecutorLocal:
+		if !allowLocal {
+			return nil, fmt.Errorf("the local executor is disabled on this worker")
+		}
+		return newLocalExecutor(job.ID), nil
+	case models.ExecutorSSH:
+		return newSSHExecutor(config, job.ID)
+	}
+	return nil, fmt.Errorf("unknown executor %q", config.Type)
+}
+
+// workspacePath maps a path under /workspace, as pipelines write them, to the
+// workspace of the executor
+func workspacePath(executor Executor, p string) string {
+	workspace := executor.Workspace()
+	if workspace == containerWorkspace {
+		return p
+	}
+	if p == containerWorkspace {
+		return workspace
+	}
+	if strings.HasPrefix(p, containerWorkspace+"/") {
+		return path.Join(workspace, strings.TrimPrefix(p, containerWorkspace+"/"))
+	}
+	return p
+}
+
+// execOutput runs a command in the workspace and returns its combined output
+// and exit code
+func execOutput(ctx context.Context, executor Executor, cmd []string) (string, int, error) {
+	var output bytes.Buffer
+	exitCode, err := executor.Exec(ctx, cmd, &output, &output)
+	return output.String(), exitCode, err
+}
+
+// checkoutRepoName clones the repo_name of a job into the workspace and checks
+// out its branch
+func checkoutRepoName(ctx context.Context, executor Executor, job models.Job) error {
+	log.Printf("Cloning repo %s", *job.RepoName)
+	workspace := executor.Workspace()
+	_, exitCode, err := execOutput(ctx, executor, []string{"git", "clone", *job.RepoName, workspace})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("failed to clone repo")
+	}
+	log.Printf("Repo cloned")
+	// Checkout branch if specified
+	if job.Branch != nil && *job.Branch != "" {
+		log.Printf("Checking out branch %s", *job.Branch)
+		_, exitCode, err := execOutput(ctx, executor, []string{"git", "-C", workspace, "checkout", *job.Branch})
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("failed to checkout branch")
+		}
+		log.Printf("Branch checked out")
+	}
+	return nil
+}
+
+// writeStepFiles creates the files of a step in the workspace. They are
+// copied in as a tar archive, so their content never goes through a shell,
+// and then handed to their owners.
+func writeStepFiles(ctx context.Context, executor Executor, files []models.File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	var archive bytes.Buffer
+	if err := tarStepFiles(files, &archive); err != nil {
+		return err
+	}
+	workspace := executor.Workspace()
+	if err := executor.CopyTo(ctx, workspace, &archive); err != nil {
+		return fmt.Errorf("failed to write files: %v", err)
+	}
+	for _, f := range files {
+		if f.Owner == "" {
+			continue
+		}
+		name, _ := models.CleanFilePath(f.Name)
+		output, exitCode, err := execOutput(ctx, executor, []string{"chown", f.Owner, path.Join(workspace, name)})
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("failed to change the owner of %s: %s", f.Name, strings.TrimSpace(output))
+		}
+	}
+	return nil
+}
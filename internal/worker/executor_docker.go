@@ -0,0 +1,377 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"docker-app/internal/models"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+// dockerExecutor runs a job in a container next to its services, on the
+// worker's Docker daemon or, for the ssh executor, on a remote one
+type dockerExecutor struct {
+	docker      *client.Client
+	jobID       int
+	containerID string
+	network     *jobNetwork
+	// remote daemons can't bind mount the project, it is copied into the
+	// container instead
+	remote bool
+	// closeConn closes the connection to a remote daemon, later calls do
+	// nothing
+	closeConn func() error
+	// execs numbers the PID files of commands
+	execs int64
+}
+
+func newDockerExecutor(docker *client.Client, jobID int) *dockerExecutor {
+	return &dockerExecutor{docker: docker, jobID: jobID}
+}
+
+func (e *dockerExecutor) GetType() string {
+	if e.remote {
+		return models.ExecutorSSH
+	}
+	return models.ExecutorDocker
+}
+
+func (e *dockerExecutor) Workspace() string {
+	return containerWorkspace
+}
+
+// Prepare pulls the base image of the job, falling back to ubuntu with an
+// install script, starts the services on the job network and starts the build
+// container with the project at /workspace
+func (e *dockerExecutor) Prepare(ctx context.Context, spec executorSpec) error {
+	job := spec.Job
+	versionStr := stringValue(job.Version)
+	baseImage := getBaseImage(*job.Language, versionStr)
+	fallback := false
+	log.Printf("Pulling image %s", baseImage)
+	if err := e.pullImage(ctx, baseImage); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("Failed to pull image %s: %v, falling back to ubuntu", baseImage, err)
+		fallback = true
+		baseImage = "ubuntu:latest"
+		if err := e.pullImage(ctx, baseImage); err != nil {
+			return err
+		}
+	}
+	log.Printf("Image pulled successfully")
+
+	// Setup ports
+	exposedPorts := nat.PortSet{}
+	portBindings := nat.PortMap{}
+	for _, p := range spec.Ports {
+		port := nat.Port(p + "/tcp")
+		exposedPorts[port] = struct{}{}
+		portBindings[port] = []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: p}}
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: portBindings,
+	}
+	if err := applyResources(hostConfig, spec.Resources); err != nil {
+		return err
+	}
+
+	// Every job gets its own network, shared with its services
+	networkName := jobNetworkName(e.jobID)
+	if err := e.createJobNetwork(ctx, networkName, e.jobID, false); err != nil {
+		return err
+	}
+	hostConfig.NetworkMode = container.NetworkMode(networkName)
+	if len(spec.Services) > 0 {
+		if err := e.startServices(ctx, e.jobID, networkName, spec.Services); err != nil {
+			return err
+		}
+	}
+
+	if !e.remote {
+		absPath, err := filepath.Abs(spec.ProjectPath)
+		if err != nil {
+			return err
+		}
+		hostConfig.Binds = []string{fmt.Sprintf("%s:%s", absPath, containerWorkspace)}
+	}
+
+	resp, err := e.docker.ContainerCreate(ctx, &container.Config{
+		Image:        baseImage,
+		Env:          append(spec.Env, "WORKSPACE="+containerWorkspace),
+		Cmd:          []string{"sleep", "infinity"},
+		ExposedPorts: exposedPorts,
+		Labels:       map[string]string{jobContainerLabel: strconv.Itoa(e.jobID)},
+	}, hostConfig, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	e.containerID = resp.ID
+	e.network = &jobNetwork{
+		jobID:       e.jobID,
+		containerID: resp.ID,
+		services:    spec.Services,
+		policy:      models.NetworkDefault,
+	}
+
+	if e.remote {
+		log.Printf("Copying %s to the container", spec.ProjectPath)
+		if err := e.copyProject(ctx, spec.ProjectPath); err != nil {
+			return fmt.Errorf("failed to copy the project: %v", err)
+		}
+	}
+
+	err = e.docker.ContainerStart(ctx, e.containerID, types.ContainerStartOptions{})
+	if err != nil {
+		return err
+	}
+	log.Printf("Container started: %s", e.containerID)
+
+	if fallback {
+		return e.runInstallScript(ctx, *job.Language, versionStr)
+	}
+	return nil
+}
+
+// pullImage pulls an image and waits until the pull is done
+func (e *dockerExecutor) pullImage(ctx context.Context, image string) error {
+	out, err := e.docker.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(io.Discard, out)
+	return err
+}
+
+// copyProject copies the project into the created container at /workspace
+func (e *dockerExecutor) copyProject(ctx context.Context, projectPath string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarDirectory(projectPath, strings.TrimPrefix(containerWorkspace, "/"), pw))
+	}()
+	defer pr.Close()
+	return e.docker.CopyToContainer(ctx, e.containerID, "/", pr, types.CopyToContainerOptions{})
+}
+
+// runInstallScript installs the language of a job in a container running the
+// fallback image, using scripts/<language>-<version>.sh when there is one
+func (e *dockerExecutor) runInstallScript(ctx context.Context, language, version string) error {
+	scriptPath := fmt.Sprintf("scripts/%s-%s.sh", language, version)
+	script, err := os.ReadFile(scriptPath)
+	if os.IsNotExist(err) {
+		log.Printf("No install script found for %s-%s", language, version)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Running install script %s", scriptPath)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "install.sh", Mode: 0755, Size: int64(len(script)), ModTime: time.Now()})
+	tw.Write(script)
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := e.CopyTo(ctx, "/tmp", &buf); err != nil {
+		return fmt.Errorf("failed to create install script: %v", err)
+	}
+
+	output := logWriter{}
+	exitCode, err := e.Exec(ctx, []string{"/tmp/install.sh"}, output, output)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("install script failed")
+	}
+	return nil
+}
+
+// Exec runs cmd in the build container. A wrapper records the PID of the
+// command so that its process tree can be killed once ctx is done.
+func (e *dockerExecutor) Exec(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error) {
+	pidFile := fmt.Sprintf("/tmp/rapidflow-exec-%d.pid", atomic.AddInt64(&e.execs, 1))
+	execResp, err := e.docker.ContainerExecCreate(ctx, e.containerID, types.ExecConfig{
+		Cmd:          append([]string{"sh", "-c", `echo $$ > "$1"; shift; exec "$@"`, "sh", pidFile}, cmd...),
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	hijacked, err := e.docker.ContainerExecAttach(ctx, execResp.ID, types.ExecStartCheck{})
+	if err != nil {
+		return 0, err
+	}
+	defer hijacked.Close()
+
+	// Kill the process and unblock the reader below once the command has to stop
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			e.killProcess(pidFile)
+			hijacked.Close()
+		case <-done:
+		}
+	}()
+
+	_, err = stdcopy.StdCopy(stdout, stderr, hijacked.Reader)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	inspect, err := e.docker.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+// killProcess kills the process tree of a command inside the container using
+// the PID file written by Exec
+func (e *dockerExecutor) killProcess(pidFile string) {
+	script := `kill_tree() { for child in $(cat /proc/$1/task/*/children 2>/dev/null); do kill_tree "$child"; done; kill -KILL "$1" 2>/dev/null; }; [ -f "$1" ] && kill_tree "$(cat "$1")"; rm -f "$1"`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	execResp, err := e.docker.ContainerExecCreate(ctx, e.containerID, types.ExecConfig{
+		Cmd: []string{"sh", "-c", script, "sh", pidFile},
+	})
+	if err != nil {
+		log.Printf("Failed to kill process in container %s: %v", e.containerID, err)
+		return
+	}
+	err = e.docker.ContainerExecStart(ctx, execResp.ID, types.ExecStartCheck{Detach: true})
+	if err != nil {
+		log.Printf("Failed to kill process in container %s: %v", e.containerID, err)
+	}
+}
+
+func (e *dockerExecutor) CopyTo(ctx context.Context, dir string, content io.Reader) error {
+	output, exitCode, err := execOutput(ctx, e, []string{"mkdir", "-p", dir})
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("failed to create %s: %s", dir, strings.TrimSpace(output))
+	}
+	return e.docker.CopyToContainer(ctx, e.containerID, dir, content, types.CopyToContainerOptions{})
+}
+
+func (e *dockerExecutor) CopyFrom(ctx context.Context, path string) (io.ReadCloser, error) {
+	content, _, err := e.docker.CopyFromContainer(ctx, e.containerID, path)
+	if client.IsErrNotFound(err) {
+		return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	return content, err
+}
+
+// Teardown removes the build container, the services and the job networks,
+// then closes the connection to a remote daemon. The error tells first that
+// the build container could not be removed.
+func (e *dockerExecutor) Teardown(ctx context.Context) error {
+	var removeErr error
+	if e.containerID != "" {
+		err := e.docker.ContainerRemove(ctx, e.containerID, types.ContainerRemoveOptions{Force: true})
+		if err != nil && !client.IsErrNotFound(err) {
+			log.Printf("Failed to remove container %s: %v", e.containerID, err)
+			removeErr = err
+		}
+	}
+	e.removeJobServices(e.jobID)
+	closeErr := e.close()
+	if removeErr != nil {
+		return removeErr
+	}
+	return closeErr
+}
+
+// close closes the connection to a remote daemon
+func (e *dockerExecutor) close() error {
+	if e.closeConn == nil {
+		return nil
+	}
+	return e.closeConn()
+}
+
+// oomKilledExitCode is the exit code of a command killed with SIGKILL, which
+// is how the OOM killer ends processes
+const oomKilledExitCode = 137
+
+// oomState tells whether the kernel OOM killer fired inside the build
+// container: the oom_kill counter of the container's memory cgroup, when the
+// container shows it, and the OOMKilled flag Docker sets on the first kill and
+// keeps for the lifetime of the container
+type oomState struct {
+	kills   int64
+	counted bool
+	flagged bool
+}
+
+// oomState reads the OOM state of the build container
+func (e *dockerExecutor) oomState(ctx context.Context) oomState {
+	var state oomState
+	// memory.events is cgroup v2, memory.oom_control cgroup v1
+	output, _, err := execOutput(ctx, e, []string{"sh", "-c", "cat /sys/fs/cgroup/memory.events /sys/fs/cgroup/memory/memory.oom_control 2>/dev/null"})
+	if err == nil {
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != "oom_kill" {
+				continue
+			}
+			if kills, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				state.kills, state.counted = kills, true
+				break
+			}
+		}
+	}
+	info, err := e.docker.ContainerInspect(ctx, e.containerID)
+	if err == nil && info.State != nil {
+		state.flagged = info.State.OOMKilled
+	}
+	return state
+}
+
+// oomKilled reports whether the OOM killer ended a command that exited with
+// exitCode, given the OOM state of the container before the command ran. Only
+// a kill during the command counts: the counter went up or, without one, the
+// flag got set and the command was killed.
+func (e *dockerExecutor) oomKilled(ctx context.Context, before oomState, exitCode int) bool {
+	after := e.oomState(ctx)
+	if before.counted && after.counted {
+		return after.kills > before.kills
+	}
+	return exitCode == oomKilledExitCode && after.flagged && !before.flagged
+}
+
+// logWriter writes what it is given to the log
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
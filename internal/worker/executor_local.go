@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"context"
+	"docker-app/internal/models"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// localExecutor runs the steps of trusted jobs as shell commands on the worker
+// itself, in the project directory. Nothing isolates them from the worker or
+// from each other, which is why workers only run them with
+// Config.AllowLocalExecutor.
+type localExecutor struct {
+	jobID     int
+	workspace string
+	env       []string
+}
+
+func newLocalExecutor(jobID int) *localExecutor {
+	return &localExecutor{jobID: jobID}
+}
+
+func (e *localExecutor) GetType() string {
+	return models.ExecutorLocal
+}
+
+func (e *localExecutor) Workspace() string {
+	return e.workspace
+}
+
+// Prepare uses the project directory as the workspace, so a local folder is
+// built in place
+func (e *localExecutor) Prepare(ctx context.Context, spec executorSpec) error {
+	workspace, err := filepath.Abs(spec.ProjectPath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(workspace); err != nil || !info.IsDir() {
+		return fmt.Errorf("project directory %s does not exist", workspace)
+	}
+	e.workspace = workspace
+	e.env = append(os.Environ(), spec.Env...)
+	e.env = append(e.env, "WORKSPACE="+workspace)
+	log.Printf("Job %d runs locally in %s", e.jobID, workspace)
+	return nil
+}
+
+// Exec runs cmd in the workspace. Commands run in their own process group,
+// which is killed as a whole once ctx is done.
+func (e *localExecutor) Exec(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error) {
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Dir = e.workspace
+	c.Env = e.env
+	c.Stdout = stdout
+	c.Stderr = stderr
+	setProcessGroup(c)
+	if err := c.Start(); err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(c)
+		case <-done:
+		}
+	}()
+
+	err := c.Wait()
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+func (e *localExecutor) CopyTo(ctx context.Context, dir string, content io.Reader) error {
+	return extractTar(content, dir)
+}
+
+func (e *localExecutor) CopyFrom(ctx context.Context, path string) (io.ReadCloser, error) {
+	if _, err := os.Lstat(path); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarDirectory(path, filepath.Base(path), pw))
+	}()
+	return pr, nil
+}
+
+// Teardown leaves the workspace alone, it is the project itself
+func (e *localExecutor) Teardown(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package worker
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd; processes it started keep running on Windows
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"context"
+	"docker-app/internal/models"
+	"docker-app/internal/providers"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/docker/docker/client"
+)
+
+// defaultRemoteDockerHost is the daemon the ssh executor uses on the remote
+// host when the pipeline doesn't set docker_host
+const defaultRemoteDockerHost = "unix:///var/run/docker.sock"
+
+// newSSHExecutor connects to a remote host over SSH and returns an executor
+// that runs the job like the docker executor, on the Docker daemon of that
+// host. The daemon is reached through the SSH connection, so it doesn't have
+// to listen on the network. The project is copied into the build container
+// instead of being mounted.
+func newSSHExecutor(executor *models.ExecutorConfig, jobID int) (*dockerExecutor, error) {
+	var config providers.VPSConfig
+	if err := executor.DecodeConfig(&config); err != nil {
+		return nil, fmt.Errorf("invalid ssh executor config: %v", err)
+	}
+	docker, closeConn, err := remoteDocker(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Job %d runs on the Docker daemon of %s", jobID, config.Host)
+
+	e := newDockerExecutor(docker, jobID)
+	e.remote = true
+	e.closeConn = closeConn
+	return e, nil
+}
+
+// remoteDocker connects to the Docker daemon of a remote host through SSH.
+// closeConn closes the client and the connection, later calls do nothing.
+func remoteDocker(config providers.VPSConfig) (docker *client.Client, closeConn func() error, err error) {
+	dockerHost := config.DockerHost
+	if dockerHost == "" {
+		dockerHost = defaultRemoteDockerHost
+	}
+	hostURL, err := client.ParseHostURL(dockerHost)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid docker_host: %v", err)
+	}
+
+	conn, err := providers.ConnectSSH(config.Host, config.SSHUser, config.SSHKeyPath, config.SSHPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	docker, err = client.NewClientWithOpts(
+		client.WithHost(dockerHost),
+		client.WithDialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+			return conn.Dial(hostURL.Scheme, hostURL.Host)
+		}),
+		client.WithAPIVersionNegotiation(),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	var closeOnce sync.Once
+	var closeErr error
+	closeConn = func() error {
+		closeOnce.Do(func() {
+			docker.Close()
+			closeErr = conn.Close()
+		})
+		return closeErr
+	}
+	return docker, closeConn, nil
+}
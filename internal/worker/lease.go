@@ -0,0 +1,148 @@
+package worker
+
+import (
+	"database/sql"
+	"docker-app/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrLeaseLost is returned to an agent reporting on a job it no longer holds,
+// because its lease expired or the job was cancelled
+var ErrLeaseLost = errors.New("the job is no longer leased to this agent")
+
+// agentLeasable is the SQL condition on jobs that agents may lease: temporary
+// jobs and jobs with runnables stay with the server's own pool
+const agentLeasable = `(temporary IS NULL OR temporary = 0)
+	AND NOT EXISTS (SELECT 1 FROM runnables WHERE runnables.job_id = jobs.id)`
+
+// LeaseJob hands the oldest pending job the agent has the labels for to it
+// and starts it. Temporary jobs and jobs with runnables stay with the server's
+// own pool, as their containers and images have to live on the server. It
+// returns nil when no job can be leased.
+func (w *Worker) LeaseJob(agent models.Agent) (*models.Lease, error) {
+	if w.isStopping() {
+		return nil, nil
+	}
+
+	tx, err := w.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	labels, err := models.ParseLabels(agent.Labels)
+	if err != nil {
+		return nil, err
+	}
+	jobID, err := nextPendingJob(tx, "AND "+agentLeasable, labels)
+	if err != nil || jobID == 0 {
+		return nil, err
+	}
+
+	result, err := tx.Exec("UPDATE jobs SET status = 'running', agent_id = ?, lease_expires_at = datetime('now', ?), started_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'pending'",
+		agent.ID, leaseModifier(w.Config.LeaseTimeout), jobID)
+	if err != nil {
+		return nil, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// Someone else claimed the job between the select and the update
+		return nil, nil
+	}
+
+	lease := models.Lease{LeaseSeconds: int(w.Config.LeaseTimeout.Seconds())}
+	if err := tx.Get(&lease.Job, "SELECT * FROM jobs WHERE id = ?", jobID); err != nil {
+		return nil, err
+	}
+	if err := tx.Get(&lease.PipelineName, "SELECT name FROM pipelines WHERE id = ?", lease.Job.PipelineID); err != nil {
+		return nil, err
+	}
+	if err := tx.Select(&lease.Steps, "SELECT * FROM steps WHERE job_id = ? ORDER BY order_num", jobID); err != nil {
+		return nil, err
+	}
+	if err := tx.Select(&lease.Files, "SELECT * FROM files WHERE step_id IN (SELECT id FROM steps WHERE job_id = ?)", jobID); err != nil {
+		return nil, err
+	}
+	if err := tx.Select(&lease.Env, "SELECT * FROM environments WHERE job_id = ?", jobID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if lease.Job.LeaseExpires != nil {
+		lease.ExpiresAt = *lease.Job.LeaseExpires
+	}
+	w.PublishJob(jobID)
+	if lease.Secrets, err = w.leaseSecrets(lease); err != nil {
+		log.Printf("Job %d: %v", jobID, err)
+		w.DB.Exec("UPDATE jobs SET status = 'failed', status_reason = ?, lease_expires_at = NULL, finished_at = CURRENT_TIMESTAMP WHERE id = ?", err.Error(), jobID)
+		w.PublishJob(jobID)
+		return nil, nil
+	}
+
+	log.Printf("Leased job %d to agent %d", jobID, agent.ID)
+	return &lease, nil
+}
+
+// RenewLease extends an agent's lease on a job. It reports whether the job
+// was cancelled, in which case the agent should stop it.
+func (w *Worker) RenewLease(agentID, jobID int) (bool, error) {
+	var job models.Job
+	err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID)
+	if err == sql.ErrNoRows {
+		return false, ErrLeaseLost
+	}
+	if err != nil {
+		return false, err
+	}
+	if job.AgentID == nil || *job.AgentID != agentID {
+		return false, ErrLeaseLost
+	}
+	if job.Cancelled {
+		return true, nil
+	}
+
+	result, err := w.DB.Exec("UPDATE jobs SET lease_expires_at = datetime('now', ?) WHERE id = ? AND agent_id = ? AND status = 'running'",
+		leaseModifier(w.Config.LeaseTimeout), jobID, agentID)
+	if err != nil {
+		return false, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return false, ErrLeaseLost
+	}
+	return false, nil
+}
+
+// requeueExpiredLeases re-queues the jobs of agents that stopped renewing
+// their lease, or fails them once they were re-queued MaxRestarts times
+func (w *Worker) requeueExpiredLeases() {
+	var jobs []models.Job
+	err := w.DB.Select(&jobs, "SELECT * FROM jobs WHERE status = 'running' AND agent_id IS NOT NULL AND lease_expires_at < CURRENT_TIMESTAMP")
+	if err != nil {
+		log.Printf("Failed to look for expired leases: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		log.Printf("Job %d: the lease of agent %d expired", job.ID, *job.AgentID)
+		if job.RestartCount < w.Config.MaxRestarts {
+			err = w.requeueJob(job, fmt.Sprintf("requeued after the lease of agent %d expired", *job.AgentID))
+		} else {
+			reason := fmt.Sprintf("the lease of agent %d expired (gave up after %d restarts)", *job.AgentID, job.RestartCount)
+			_, err = w.DB.Exec("UPDATE jobs SET status = 'failed', status_reason = ?, lease_expires_at = NULL, finished_at = CURRENT_TIMESTAMP WHERE id = ?", reason, job.ID)
+			w.DB.Exec("UPDATE steps SET status = 'failed' WHERE job_id = ? AND status = 'running'", job.ID)
+		}
+		if err != nil {
+			log.Printf("Failed to recover job %d from an expired lease: %v", job.ID, err)
+		}
+		w.PublishSteps(job.ID)
+		w.PublishJob(job.ID)
+	}
+}
+
+// leaseModifier returns the SQLite datetime modifier for a lease of timeout
+func leaseModifier(timeout time.Duration) string {
+	return fmt.Sprintf("+%d seconds", int64(timeout.Seconds()))
+}
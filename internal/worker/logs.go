@@ -0,0 +1,155 @@
+package worker
+
+import (
+	"docker-app/internal/models"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// logFlushInterval is how often the lines of a running step are stored
+const logFlushInterval = time.Second
+
+// AppendLogLines stores lines of a step after those stored so far, setting
+// their job, step and seq in place
+func AppendLogLines(db *sqlx.DB, jobID, stepID int, lines []models.LogLine) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var seq int
+	if err := tx.Get(&seq, "SELECT COALESCE(MAX(seq), 0) FROM log_lines WHERE step_id = ?", stepID); err != nil {
+		return err
+	}
+	for i := range lines {
+		seq++
+		lines[i].JobID = jobID
+		lines[i].StepID = stepID
+		lines[i].Seq = seq
+	}
+	if err := insertLogLines(tx, lines); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// storeLogLines stores lines that are already numbered
+func storeLogLines(db *sqlx.DB, lines []models.LogLine) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertLogLines(tx, lines); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertLogLines(tx *sqlx.Tx, lines []models.LogLine) error {
+	for _, line := range lines {
+		_, err := tx.Exec("INSERT INTO log_lines (job_id, step_id, attempt, seq, stream, line, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			line.JobID, line.StepID, line.Attempt, line.Seq, line.Stream, line.Line, line.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastLogSeq returns the seq of the last line stored for a step, 0 when it
+// has none
+func lastLogSeq(db *sqlx.DB, stepID int) (int, error) {
+	var seq int
+	err := db.Get(&seq, "SELECT COALESCE(MAX(seq), 0) FROM log_lines WHERE step_id = ?", stepID)
+	return seq, err
+}
+
+// stepLog collects the lines of a step attempt and hands them to store every
+// interval, so that they can be read while the step runs without a write
+// for every line. Lines that couldn't be stored are kept for the next time.
+// prepare, when set, sees every line as it is added, to number and publish
+// it.
+type stepLog struct {
+	attempt int
+	prepare func(*models.LogLine)
+	store   func([]models.LogLine) error
+
+	mutex   sync.Mutex
+	pending []models.LogLine
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newStepLog starts collecting the lines of attempt of a step
+func newStepLog(attempt int, interval time.Duration, prepare func(*models.LogLine), store func([]models.LogLine) error) *stepLog {
+	l := &stepLog{
+		attempt: attempt,
+		prepare: prepare,
+		store:   store,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.flush()
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// add records a line printed on stream
+func (l *stepLog) add(stream, text string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	line := models.LogLine{
+		Attempt:   l.attempt,
+		Stream:    stream,
+		Line:      text,
+		Timestamp: time.Now().UTC(),
+	}
+	if l.prepare != nil {
+		l.prepare(&line)
+	}
+	l.pending = append(l.pending, line)
+}
+
+// flush stores the lines added since the last flush. The step keeps adding
+// lines while they are stored.
+func (l *stepLog) flush() {
+	l.mutex.Lock()
+	lines := l.pending
+	l.pending = nil
+	l.mutex.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+	if err := l.store(lines); err != nil {
+		log.Printf("Failed to store %d log lines: %v", len(lines), err)
+		l.mutex.Lock()
+		l.pending = append(lines, l.pending...)
+		l.mutex.Unlock()
+	}
+}
+
+// close stops the periodic flushes and stores the remaining lines
+func (l *stepLog) close() {
+	close(l.stop)
+	<-l.done
+	l.flush()
+}
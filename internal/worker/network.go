@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"context"
+	"docker-app/internal/models"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// jobNetworkName returns the name of the Docker network created for a job
+func jobNetworkName(jobID int) string {
+	return fmt.Sprintf("rapidflow-job-%d", jobID)
+}
+
+// internalNetworkName returns the name of a job's network without outbound
+// access, used by restricted steps to reach the services
+func internalNetworkName(jobID int) string {
+	return fmt.Sprintf("rapidflow-job-%d-internal", jobID)
+}
+
+// createJobNetwork creates the network a job's containers share. Internal
+// networks have no route to anything outside them.
+func (e *dockerExecutor) createJobNetwork(ctx context.Context, name string, jobID int, internal bool) error {
+	_, err := e.docker.NetworkCreate(ctx, name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Internal:       internal,
+		Labels:         map[string]string{jobContainerLabel: strconv.Itoa(jobID)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create network %s: %v", name, err)
+	}
+	log.Printf("Created network %s for job %d", name, jobID)
+	return nil
+}
+
+// removeJobNetworks removes the networks of a job, if it has any
+func (e *dockerExecutor) removeJobNetworks(jobID int) {
+	for _, name := range []string{jobNetworkName(jobID), internalNetworkName(jobID)} {
+		err := e.docker.NetworkRemove(context.Background(), name)
+		if err != nil && !client.IsErrNotFound(err) {
+			log.Printf("Failed to remove network %s: %v", name, err)
+		}
+	}
+}
+
+// stepNetwork returns the network policy of a step, which defaults to the
+// policy of its job
+func stepNetwork(job models.Job, config models.StepConfig) string {
+	if config.Network != "" {
+		return config.Network
+	}
+	if job.Network != nil && *job.Network != "" {
+		return *job.Network
+	}
+	return models.NetworkDefault
+}
+
+// jobNetwork tracks which networks the build container of a job is on
+type jobNetwork struct {
+	jobID       int
+	containerID string
+	services    []models.ServiceConfig
+	policy      string
+	internal    bool
+}
+
+// networks returns the networks a container following policy is connected to
+func (n *jobNetwork) networks(policy string) []string {
+	switch policy {
+	case models.NetworkRestricted:
+		return []string{internalNetworkName(n.jobID)}
+	case models.NetworkNone:
+		return nil
+	}
+	return []string{jobNetworkName(n.jobID)}
+}
+
+// setNetworkPolicy connects the build container to the networks policy allows
+// and disconnects it from the others. The internal network is created the
+// first time a restricted step needs it, and the services join it under the
+// same names they have on the job network.
+func (e *dockerExecutor) setNetworkPolicy(ctx context.Context, policy string) error {
+	n := e.network
+	if policy == n.policy {
+		return nil
+	}
+	if policy == models.NetworkRestricted && !n.internal {
+		name := internalNetworkName(n.jobID)
+		if err := e.createJobNetwork(ctx, name, n.jobID, true); err != nil {
+			return err
+		}
+		n.internal = true
+		for _, service := range n.services {
+			containerID, err := e.serviceContainerID(ctx, n.jobID, service.Name)
+			if err != nil {
+				return fmt.Errorf("service %s: %v", service.Name, err)
+			}
+			err = e.docker.NetworkConnect(ctx, name, containerID, &network.EndpointSettings{Aliases: serviceAliases(service)})
+			if err != nil {
+				return fmt.Errorf("service %s: failed to join network %s: %v", service.Name, name, err)
+			}
+		}
+	}
+
+	current := n.networks(n.policy)
+	wanted := n.networks(policy)
+	for _, name := range wanted {
+		if !containsString(current, name) {
+			if err := e.docker.NetworkConnect(ctx, name, n.containerID, nil); err != nil {
+				return fmt.Errorf("failed to connect to network %s: %v", name, err)
+			}
+		}
+	}
+	for _, name := range current {
+		if !containsString(wanted, name) {
+			if err := e.docker.NetworkDisconnect(ctx, name, n.containerID, true); err != nil {
+				return fmt.Errorf("failed to disconnect from network %s: %v", name, err)
+			}
+		}
+	}
+	log.Printf("Job %d: network policy is now %s", n.jobID, policy)
+	n.policy = policy
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
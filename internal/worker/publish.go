@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"docker-app/internal/models"
+	"docker-app/internal/pubsub"
+)
+
+// PublishJob sends the status of a job to the clients following it and
+// records its lifecycle event for the subscriptions
+func (w *Worker) PublishJob(jobID int) {
+	var job models.Job
+	if err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID); err != nil {
+		return
+	}
+	w.Events.Publish(job.ID, pubsub.TypeJob, pubsub.JobStatus{JobID: job.ID, Status: job.Status, StatusReason: job.StatusReason})
+	w.recordJobEvent(job)
+}
+
+// PublishStep sends the status of a step to the clients following its job
+// and records its lifecycle event for the subscriptions
+func (w *Worker) PublishStep(stepID int) {
+	var step models.Step
+	if err := w.DB.Get(&step, "SELECT * FROM steps WHERE id = ?", stepID); err != nil {
+		return
+	}
+	w.Events.Publish(step.JobID, pubsub.TypeStep, stepStatus(step))
+	var job models.Job
+	if err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", step.JobID); err != nil {
+		return
+	}
+	w.recordStepEvent(job, step)
+}
+
+// PublishSteps sends the statuses of all the steps of a job, after they were
+// changed together
+func (w *Worker) PublishSteps(jobID int) {
+	var job models.Job
+	if err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID); err != nil {
+		return
+	}
+	var steps []models.Step
+	if err := w.DB.Select(&steps, "SELECT * FROM steps WHERE job_id = ? ORDER BY order_num", jobID); err != nil {
+		return
+	}
+	for _, step := range steps {
+		w.Events.Publish(jobID, pubsub.TypeStep, stepStatus(step))
+		w.recordStepEvent(job, step)
+	}
+}
+
+func stepStatus(step models.Step) pubsub.StepStatus {
+	return pubsub.StepStatus{
+		JobID:        step.JobID,
+		StepID:       step.ID,
+		OrderNum:     step.OrderNum,
+		Status:       step.Status,
+		StatusReason: step.StatusReason,
+	}
+}
@@ -0,0 +1,318 @@
+package worker
+
+import (
+	"context"
+	"docker-app/internal/models"
+	"docker-app/internal/providers"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// RecoverJobs reconciles the database with the Docker daemon after a server
+// restart. Jobs that were queued or running when the previous process died are
+// either failed or re-queued according to their restart policy, and containers
+// and temp directories that no live job owns are removed, on the remote hosts
+// of the ssh executor too.
+//
+// It must be called before StartQueue, while no job is running in this process.
+func (w *Worker) RecoverJobs() error {
+	var jobs []models.Job
+	// Jobs leased by agents keep running there, their leases tell when not
+	err := w.DB.Select(&jobs, "SELECT * FROM jobs WHERE status IN ('queued', 'running') AND agent_id IS NULL")
+	if err != nil {
+		return err
+	}
+
+	if len(jobs) > 0 {
+		log.Printf("Recovering %d jobs interrupted by a worker restart", len(jobs))
+	}
+
+	for _, job := range jobs {
+		if err := w.recoverJob(job); err != nil {
+			log.Printf("Failed to recover job %d: %v", job.ID, err)
+		}
+	}
+
+	w.removeOrphanedContainers(w.Docker)
+	w.removeOrphanedNetworks(w.Docker)
+	w.removeOrphanedTempDirs()
+	// Remote hosts may be slow to reach or down, they don't hold the queue up
+	go w.removeRemoteOrphans()
+
+	return nil
+}
+
+// recoverJob fails or re-queues a single interrupted job. Nothing drives its
+// container anymore, but the steps it was running may still be going, so a
+// job is only re-queued once its container is known to be gone.
+func (w *Worker) recoverJob(job models.Job) error {
+	ctx := context.Background()
+
+	// The containers of the job are on the daemon it ran on, which may be
+	// that of a remote host
+	executor, connectErr := w.jobDockerExecutor(job)
+	if connectErr != nil {
+		log.Printf("Job %d: failed to reach its Docker daemon: %v", job.ID, connectErr)
+	} else {
+		defer executor.close()
+	}
+
+	var containerID string
+	// running tells that the container may still be running steps
+	running := false
+	if job.ContainerID != nil {
+		containerID = *job.ContainerID
+		if executor == nil {
+			running = true
+		} else {
+			info, err := executor.docker.ContainerInspect(ctx, containerID)
+			if client.IsErrNotFound(err) {
+				log.Printf("Job %d: container %s no longer exists", job.ID, containerID)
+				containerID = ""
+			} else if err != nil {
+				log.Printf("Job %d: failed to inspect container %s: %v", job.ID, containerID, err)
+				running = true
+			} else if info.State != nil {
+				log.Printf("Job %d: container %s is %s, nothing is driving it anymore", job.ID, containerID, info.State.Status)
+				running = info.State.Running || info.State.Paused || info.State.Restarting
+			}
+		}
+	}
+	// cleanup removes what the job created, the error tells that its
+	// container may still run
+	cleanup := func() error {
+		if executor == nil {
+			removeTempDir(ownedTempDir(job))
+			return connectErr
+		}
+		return cleanupJobResources(executor, containerID, ownedTempDir(job))
+	}
+
+	policy := models.RestartPolicyFail
+	if job.RestartPolicy != nil && *job.RestartPolicy != "" {
+		policy = *job.RestartPolicy
+	}
+
+	reason := "worker restarted"
+	cleaned := false
+	if policy == models.RestartPolicyRequeue && job.RestartCount < w.Config.MaxRestarts {
+		// A re-queued job starts from scratch, so everything it created goes.
+		// Its old steps must not keep running next to the new ones.
+		err := cleanup()
+		if err == nil || !running {
+			return w.requeueJob(job, "requeued after worker restart")
+		}
+		log.Printf("Job %d: not re-queuing, container %s may still be running: %v", job.ID, containerID, err)
+		reason = "worker restarted (container could not be removed)"
+		cleaned = true
+	} else if policy == models.RestartPolicyRequeue {
+		reason = fmt.Sprintf("worker restarted (gave up after %d restarts)", job.RestartCount)
+	}
+
+	// Temporary jobs keep their resources until the pipeline is stopped
+	if !cleaned && (job.Temporary == nil || !*job.Temporary) {
+		cleanup()
+	}
+
+	log.Printf("Job %d: marking as failed (%s)", job.ID, reason)
+	_, err := w.DB.Exec("UPDATE jobs SET status = 'failed', status_reason = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?", reason, job.ID)
+	if err != nil {
+		return err
+	}
+	_, err = w.DB.Exec("UPDATE steps SET status = 'failed' WHERE job_id = ? AND status = 'running'", job.ID)
+	if err != nil {
+		return err
+	}
+	w.stopRunningAttempts(job.ID, "failed")
+	w.PublishSteps(job.ID)
+	w.PublishJob(job.ID)
+	return nil
+}
+
+// requeueJob resets a job and all of its children so that it runs again from
+// the start, with reason as its status reason
+func (w *Worker) requeueJob(job models.Job, reason string) error {
+	log.Printf("Job %d: re-queuing (restart %d of %d)", job.ID, job.RestartCount+1, w.Config.MaxRestarts)
+
+	tx, err := w.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE jobs SET status = 'pending', status_reason = ?, restart_count = restart_count + 1, container_id = NULL, temp_dir = NULL, agent_id = NULL, lease_expires_at = NULL, started_at = NULL, finished_at = NULL WHERE id = ?", reason, job.ID)
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		"DELETE FROM step_attempts WHERE step_id IN (SELECT id FROM steps WHERE job_id = ?)",
+		"DELETE FROM log_lines WHERE job_id = ?",
+		"UPDATE steps SET status = 'pending', output = NULL, status_reason = NULL, attempts = 0 WHERE job_id = ?",
+		"UPDATE runnables SET status = 'pending', output = NULL, artifact_url = NULL, image_digest = NULL WHERE job_id = ?",
+		"UPDATE deployments SET status = 'pending', output = NULL, url = NULL WHERE runnable_id IN (SELECT id FROM runnables WHERE job_id = ?)",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, job.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// The job starts over, clients following it start over too
+	w.Events.Forget(job.ID)
+	w.PublishJob(job.ID)
+	return nil
+}
+
+// ownedTempDir returns the clone directory created for a job, if any. Local
+// folders are never returned since they belong to the user.
+func ownedTempDir(job models.Job) string {
+	if job.TempDir != nil && *job.TempDir != "" {
+		return *job.TempDir
+	}
+	if job.RepoURL != nil && *job.RepoURL != "" {
+		return repoTempDir(job.ID)
+	}
+	return ""
+}
+
+// jobOwnsResources reports whether a job still needs its container and temp
+// directory. Only temporary jobs keep them after finishing, until they are stopped.
+func (w *Worker) jobOwnsResources(jobID int) bool {
+	var job models.Job
+	err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID)
+	if err != nil {
+		return false
+	}
+
+	switch job.Status {
+	case "pending", "waiting", "queued", "running":
+		return true
+	case "stopped":
+		return false
+	}
+	return job.Temporary != nil && *job.Temporary
+}
+
+// removeOrphanedContainers removes the build and service containers of a
+// daemon whose job no longer owns them
+func (w *Worker) removeOrphanedContainers(docker *client.Client) {
+	ctx := context.Background()
+
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", jobContainerLabel)),
+	})
+	if err != nil {
+		log.Printf("Failed to list job containers: %v", err)
+		return
+	}
+
+	for _, c := range containers {
+		jobID, err := strconv.Atoi(c.Labels[jobContainerLabel])
+		if err == nil && w.jobOwnsResources(jobID) {
+			continue
+		}
+		log.Printf("Removing orphaned container %s (job %s)", c.ID, c.Labels[jobContainerLabel])
+		err = docker.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			log.Printf("Failed to remove orphaned container %s: %v", c.ID, err)
+		}
+	}
+}
+
+// removeOrphanedNetworks removes the job networks of a daemon whose job no
+// longer owns them
+func (w *Worker) removeOrphanedNetworks(docker *client.Client) {
+	ctx := context.Background()
+
+	networks, err := docker.NetworkList(ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", jobContainerLabel)),
+	})
+	if err != nil {
+		log.Printf("Failed to list job networks: %v", err)
+		return
+	}
+
+	for _, n := range networks {
+		jobID, err := strconv.Atoi(n.Labels[jobContainerLabel])
+		if err == nil && w.jobOwnsResources(jobID) {
+			continue
+		}
+		log.Printf("Removing orphaned network %s (job %s)", n.Name, n.Labels[jobContainerLabel])
+		if err := docker.NetworkRemove(ctx, n.ID); err != nil {
+			log.Printf("Failed to remove orphaned network %s: %v", n.Name, err)
+		}
+	}
+}
+
+// removeRemoteOrphans removes the orphaned containers and networks on every
+// remote host jobs of the ssh executor ran on, connecting once per daemon
+func (w *Worker) removeRemoteOrphans() {
+	var executors []string
+	err := w.DB.Select(&executors, "SELECT DISTINCT executor FROM jobs WHERE executor IS NOT NULL AND executor != ''")
+	if err != nil {
+		log.Printf("Failed to list job executors: %v", err)
+		return
+	}
+
+	swept := make(map[providers.VPSConfig]bool)
+	for i := range executors {
+		executor, err := models.ParseExecutor(&executors[i])
+		if err != nil || models.ExecutorType(executor) != models.ExecutorSSH {
+			continue
+		}
+		var config providers.VPSConfig
+		if err := executor.DecodeConfig(&config); err != nil {
+			continue
+		}
+		daemon := providers.VPSConfig{Host: config.Host, SSHUser: config.SSHUser, SSHKeyPath: config.SSHKeyPath, SSHPort: config.SSHPort, DockerHost: config.DockerHost}
+		if swept[daemon] {
+			continue
+		}
+		swept[daemon] = true
+
+		docker, closeConn, err := remoteDocker(daemon)
+		if err != nil {
+			log.Printf("Failed to reach the Docker daemon of %s to remove orphaned containers: %v", config.Host, err)
+			continue
+		}
+		w.removeOrphanedContainers(docker)
+		w.removeOrphanedNetworks(docker)
+		closeConn()
+	}
+}
+
+// removeOrphanedTempDirs removes repository clones and artifact directories
+// whose job no longer owns them
+func (w *Worker) removeOrphanedTempDirs() {
+	for _, prefix := range []string{"rapidflow-repo-", "rapidflow-job-"} {
+		matches, err := filepath.Glob(filepath.Join(os.TempDir(), prefix+"*"))
+		if err != nil {
+			continue
+		}
+		for _, dir := range matches {
+			jobID, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), prefix))
+			if err != nil {
+				continue
+			}
+			if w.jobOwnsResources(jobID) {
+				continue
+			}
+			log.Printf("Removing orphaned temporary directory: %s", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("Failed to remove temporary directory %s: %v", dir, err)
+			}
+		}
+	}
+}
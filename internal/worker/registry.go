@@ -0,0 +1,38 @@
+package worker
+
+import (
+	"database/sql"
+	"docker-app/internal/models"
+	"docker-app/internal/secrets"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// registryCredentials looks up the registry logins stored through the API for
+// the registry provider. Passwords are encrypted with the master key, the
+// registry host authenticated with them.
+type registryCredentials struct {
+	db     *sqlx.DB
+	cipher *secrets.Cipher
+}
+
+func (c registryCredentials) Lookup(registry string) (string, string, error) {
+	var credential models.RegistryCredential
+	err := c.db.Get(&credential, "SELECT * FROM registry_credentials WHERE registry = ?", registry)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if c.cipher == nil {
+		return "", "", fmt.Errorf("the login for %s can't be decrypted, the server has no master key", registry)
+	}
+	password, err := c.cipher.Decrypt(credential.Registry, credential.Password)
+	if err != nil {
+		return "", "", fmt.Errorf("registry credential: %v", err)
+	}
+	return credential.Username, password, nil
+}
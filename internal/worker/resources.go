@@ -0,0 +1,247 @@
+package worker
+
+import (
+	"docker-app/internal/models"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// effectiveResources fills the limits a job or runnable didn't request with the
+// server defaults and caps every limit at the server maximums
+func (w *Worker) effectiveResources(requested *models.ResourceConfig) (models.ResourceConfig, error) {
+	defaults := w.Config.DefaultResources
+	max := w.Config.MaxResources
+
+	var r models.ResourceConfig
+	if requested != nil {
+		r = *requested
+	}
+
+	if r.CPUs <= 0 {
+		r.CPUs = defaults.CPUs
+	}
+	if max.CPUs > 0 && (r.CPUs <= 0 || r.CPUs > max.CPUs) {
+		r.CPUs = max.CPUs
+	}
+
+	if r.PidsLimit <= 0 {
+		r.PidsLimit = defaults.PidsLimit
+	}
+	if max.PidsLimit > 0 && (r.PidsLimit <= 0 || r.PidsLimit > max.PidsLimit) {
+		r.PidsLimit = max.PidsLimit
+	}
+
+	// Memory plus swap includes the memory, so its maximum caps memory too
+	maxMemory, err := smallerSize(max.Memory, max.MemorySwap)
+	if err != nil {
+		return r, fmt.Errorf("invalid maximum memory: %v", err)
+	}
+	if r.Memory, err = capSize(r.Memory, defaults.Memory, maxMemory); err != nil {
+		return r, fmt.Errorf("invalid memory limit: %v", err)
+	}
+	if r.MemorySwap, err = capMemorySwap(r.MemorySwap, defaults.MemorySwap, r.Memory, max); err != nil {
+		return r, fmt.Errorf("invalid memory_swap: %v", err)
+	}
+	if r.ShmSize, err = capSize(r.ShmSize, defaults.ShmSize, max.ShmSize); err != nil {
+		return r, fmt.Errorf("invalid shm_size: %v", err)
+	}
+	if r.Disk, err = capSize(r.Disk, defaults.Disk, max.Disk); err != nil {
+		return r, fmt.Errorf("invalid disk limit: %v", err)
+	}
+
+	ulimits := make(map[string]models.UlimitConfig)
+	for name, limit := range defaults.Ulimits {
+		ulimits[name] = limit
+	}
+	for name, limit := range r.Ulimits {
+		ulimits[name] = limit
+	}
+	for name, limit := range max.Ulimits {
+		current, ok := ulimits[name]
+		if !ok || current.Hard > limit.Hard || current.Hard < 0 {
+			current.Hard = limit.Hard
+		}
+		if !ok || current.Soft > current.Hard || current.Soft < 0 {
+			current.Soft = current.Hard
+		}
+		ulimits[name] = current
+	}
+	r.Ulimits = nil
+	if len(ulimits) > 0 {
+		r.Ulimits = ulimits
+	}
+
+	return r, nil
+}
+
+// capSize returns value (or fallback when empty) limited to max. Sizes are
+// compared in bytes but returned in their original notation.
+func capSize(value, fallback, max string) (string, error) {
+	if value == "" {
+		value = fallback
+	}
+	if max == "" {
+		if value != "" {
+			if _, err := units.RAMInBytes(value); err != nil {
+				return "", err
+			}
+		}
+		return value, nil
+	}
+
+	maxBytes, err := units.RAMInBytes(max)
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return max, nil
+	}
+	valueBytes, err := units.RAMInBytes(value)
+	if err != nil {
+		return "", err
+	}
+	if valueBytes > maxBytes {
+		return max, nil
+	}
+	return value, nil
+}
+
+// smallerSize returns the smaller of two sizes, ignoring empty ones
+func smallerSize(a, b string) (string, error) {
+	if a == "" || b == "" {
+		return a + b, nil
+	}
+	aBytes, err := units.RAMInBytes(a)
+	if err != nil {
+		return "", err
+	}
+	bBytes, err := units.RAMInBytes(b)
+	if err != nil {
+		return "", err
+	}
+	if bBytes < aBytes {
+		return b, nil
+	}
+	return a, nil
+}
+
+// capMemorySwap returns the memory plus swap limit (or fallback when empty)
+// of a container limited to memory. It is at least memory and at most the
+// maximum memory_swap or, when only memory has a maximum, twice the maximum
+// memory, which is what Docker gives containers that don't set it. Unlimited
+// swap (-1) is refused when either maximum is set.
+func capMemorySwap(swap, fallback, memory string, max models.ResourceConfig) (string, error) {
+	if swap == "" {
+		swap = fallback
+	}
+	limit := max.MemorySwap
+	if limit == "" && max.Memory != "" {
+		maxMemory, err := units.RAMInBytes(max.Memory)
+		if err != nil {
+			return "", err
+		}
+		limit = strconv.FormatInt(2*maxMemory, 10)
+	}
+	if swap == "-1" {
+		if limit != "" {
+			return "", fmt.Errorf("unlimited swap (-1) is not allowed on this server")
+		}
+		return swap, nil
+	}
+	if memory == "" {
+		// Without a memory limit there is no maximum either, and Docker
+		// only limits swap together with memory
+		if swap != "" {
+			return "", fmt.Errorf("memory_swap needs a memory limit")
+		}
+		return "", nil
+	}
+
+	memoryBytes, err := units.RAMInBytes(memory)
+	if err != nil {
+		return "", err
+	}
+	if swap == "" {
+		if limit == "" {
+			return "", nil
+		}
+		swap = strconv.FormatInt(2*memoryBytes, 10)
+	}
+	if swap, err = capSize(swap, "", limit); err != nil {
+		return "", err
+	}
+	swapBytes, err := units.RAMInBytes(swap)
+	if err != nil {
+		return "", err
+	}
+	if swapBytes < memoryBytes {
+		return memory, nil
+	}
+	return swap, nil
+}
+
+// applyResources sets the Docker resource limits on a host config
+func applyResources(hostConfig *container.HostConfig, r models.ResourceConfig) error {
+	if r.CPUs > 0 {
+		hostConfig.NanoCPUs = int64(r.CPUs * 1e9)
+	}
+	if r.Memory != "" {
+		memory, err := units.RAMInBytes(r.Memory)
+		if err != nil {
+			return fmt.Errorf("invalid memory limit: %v", err)
+		}
+		hostConfig.Memory = memory
+	}
+	if r.MemorySwap != "" {
+		if r.MemorySwap == "-1" {
+			hostConfig.MemorySwap = -1
+		} else {
+			swap, err := units.RAMInBytes(r.MemorySwap)
+			if err != nil {
+				return fmt.Errorf("invalid memory_swap: %v", err)
+			}
+			hostConfig.MemorySwap = swap
+		}
+	}
+	if r.PidsLimit > 0 {
+		pidsLimit := r.PidsLimit
+		hostConfig.PidsLimit = &pidsLimit
+	}
+	if r.ShmSize != "" {
+		shmSize, err := units.RAMInBytes(r.ShmSize)
+		if err != nil {
+			return fmt.Errorf("invalid shm_size: %v", err)
+		}
+		hostConfig.ShmSize = shmSize
+	}
+	if r.Disk != "" {
+		if _, err := units.RAMInBytes(r.Disk); err != nil {
+			return fmt.Errorf("invalid disk limit: %v", err)
+		}
+		hostConfig.StorageOpt = map[string]string{"size": r.Disk}
+	}
+	for name, limit := range r.Ulimits {
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &units.Ulimit{
+			Name: name,
+			Soft: limit.Soft,
+			Hard: limit.Hard,
+		})
+	}
+	return nil
+}
+
+// parseResources decodes the resources stored on a job record
+func parseResources(resources *string) (*models.ResourceConfig, error) {
+	if resources == nil || *resources == "" {
+		return nil, nil
+	}
+	var r models.ResourceConfig
+	if err := json.Unmarshal([]byte(*resources), &r); err != nil {
+		return nil, fmt.Errorf("invalid resources: %v", err)
+	}
+	return &r, nil
+}
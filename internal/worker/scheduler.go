@@ -0,0 +1,263 @@
+package worker
+
+import (
+	"docker-app/internal/models"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// agentOnlineWindow is how recently an agent must have asked for a job to
+// count as a runner for waiting jobs
+const agentOnlineWindow = 2 * time.Minute
+
+// PoolStatus describes the current utilisation of the worker pool
+type PoolStatus struct {
+	Size        int   `json:"size"`
+	Busy        int   `json:"busy"`
+	Available   int   `json:"available"`
+	RunningJobs []int `json:"running_jobs"`
+	PendingJobs int   `json:"pending_jobs"`
+	WaitingJobs int   `json:"waiting_jobs"`
+}
+
+// PoolStatus returns how many pool slots are in use and which jobs occupy them
+func (w *Worker) PoolStatus() (PoolStatus, error) {
+	busy := len(w.slots)
+	status := PoolStatus{
+		Size:        w.Config.PoolSize,
+		Busy:        busy,
+		Available:   w.Config.PoolSize - busy,
+		RunningJobs: make([]int, 0),
+	}
+
+	w.mutex.RLock()
+	for jobID := range w.runningJobs {
+		status.RunningJobs = append(status.RunningJobs, jobID)
+	}
+	w.mutex.RUnlock()
+	sort.Ints(status.RunningJobs)
+
+	err := w.DB.Get(&status.PendingJobs, "SELECT COUNT(*) FROM jobs WHERE status = 'pending'")
+	if err != nil {
+		return status, err
+	}
+	err = w.DB.Get(&status.WaitingJobs, "SELECT COUNT(*) FROM jobs WHERE status = 'waiting'")
+	if err != nil {
+		return status, err
+	}
+
+	return status, nil
+}
+
+// claimNextJob atomically moves the oldest pending job the pool has the labels
+// for to the queued state so that it can only ever be picked up once. It
+// returns 0 when no such job is pending.
+func (w *Worker) claimNextJob() (int, error) {
+	tx, err := w.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	jobID, err := nextPendingJob(tx, "", w.Config.Labels)
+	if err != nil || jobID == 0 {
+		return 0, err
+	}
+
+	result, err := tx.Exec("UPDATE jobs SET status = 'queued' WHERE id = ? AND status = 'pending'", jobID)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if affected == 0 {
+		// Someone else claimed the job between the select and the update
+		return 0, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return jobID, nil
+}
+
+// nextPendingJob returns the oldest pending job, restricted by the extra SQL
+// condition where, that a runner with labels may run. It returns 0 when there
+// is none.
+func nextPendingJob(tx *sqlx.Tx, where string, labels []string) (int, error) {
+	var jobs []struct {
+		ID     int     `db:"id"`
+		RunsOn *string `db:"runs_on"`
+	}
+	err := tx.Select(&jobs, "SELECT id, runs_on FROM jobs WHERE status = 'pending' AND cancelled = 0 "+where+" ORDER BY created_at ASC, id ASC")
+	if err != nil {
+		return 0, err
+	}
+	for _, job := range jobs {
+		runsOn, err := models.ParseLabels(job.RunsOn)
+		if err != nil {
+			log.Printf("Job %d: %v", job.ID, err)
+			continue
+		}
+		if models.HasLabels(labels, runsOn) {
+			return job.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// updateWaitingJobs moves pending jobs that no runner has the labels for to
+// waiting, and waiting jobs back to pending once a runner with their labels
+// shows up. The runners are the worker's pool and the agents that asked for a
+// job within agentOnlineWindow, the latter only for jobs agents may lease.
+func (w *Worker) updateWaitingJobs() {
+	var jobs []models.Job
+	err := w.DB.Select(&jobs, "SELECT * FROM jobs WHERE status IN ('pending', 'waiting') AND runs_on IS NOT NULL")
+	if err != nil || len(jobs) == 0 {
+		return
+	}
+	var serverOnly []int
+	err = w.DB.Select(&serverOnly, "SELECT id FROM jobs WHERE status IN ('pending', 'waiting') AND runs_on IS NOT NULL AND NOT ("+agentLeasable+")")
+	if err != nil {
+		log.Printf("Failed to look up jobs agents can't lease: %v", err)
+		return
+	}
+	agentsExcluded := make(map[int]bool)
+	for _, id := range serverOnly {
+		agentsExcluded[id] = true
+	}
+
+	var agents [][]string
+	var agentLabels []*string
+	err = w.DB.Select(&agentLabels, "SELECT labels FROM agents WHERE last_seen_at > datetime('now', ?)",
+		fmt.Sprintf("-%d seconds", int64(agentOnlineWindow.Seconds())))
+	if err != nil {
+		log.Printf("Failed to look up agents: %v", err)
+		return
+	}
+	for _, encoded := range agentLabels {
+		labels, err := models.ParseLabels(encoded)
+		if err == nil {
+			agents = append(agents, labels)
+		}
+	}
+
+	for _, job := range jobs {
+		runsOn, err := models.ParseLabels(job.RunsOn)
+		if err != nil {
+			continue
+		}
+		placeable := models.HasLabels(w.Config.Labels, runsOn)
+		if !agentsExcluded[job.ID] {
+			for _, labels := range agents {
+				if models.HasLabels(labels, runsOn) {
+					placeable = true
+					break
+				}
+			}
+		}
+		switch {
+		case !placeable && job.Status == "pending":
+			reason := fmt.Sprintf("waiting for a runner with the labels %s", strings.Join(runsOn, ", "))
+			if agentsExcluded[job.ID] {
+				reason = fmt.Sprintf("waiting for a server with the labels %s, agents don't run temporary jobs or jobs with runnables", strings.Join(runsOn, ", "))
+			}
+			log.Printf("Job %d is %s", job.ID, reason)
+			w.DB.Exec("UPDATE jobs SET status = 'waiting', status_reason = ? WHERE id = ? AND status = 'pending'", reason, job.ID)
+			w.PublishJob(job.ID)
+		case placeable && job.Status == "waiting":
+			log.Printf("Job %d found a runner", job.ID)
+			w.DB.Exec("UPDATE jobs SET status = 'pending', status_reason = NULL WHERE id = ? AND status = 'waiting'", job.ID)
+			w.PublishJob(job.ID)
+		}
+	}
+}
+
+// cancelFlaggedJobs cancels running jobs that were flagged as cancelled in the database
+func (w *Worker) cancelFlaggedJobs() {
+	var jobIDs []int
+	err := w.DB.Select(&jobIDs, "SELECT id FROM jobs WHERE status = 'running' AND cancelled = 1")
+	if err != nil {
+		return
+	}
+	for _, jobID := range jobIDs {
+		w.CancelJob(jobID)
+	}
+}
+
+// StartQueue starts the background scheduler. At most Config.PoolSize jobs run
+// at the same time; a job is only started after it has been claimed.
+func (w *Worker) StartQueue() {
+	w.startArtifactPruning()
+	w.startDeliveries()
+	go func() {
+		for {
+			if w.isStopping() {
+				log.Printf("Job queue stopped, no new jobs will be claimed")
+				return
+			}
+
+			// Check for cancelled jobs and clean them up
+			w.cancelFlaggedJobs()
+			w.requeueExpiredLeases()
+			w.updateWaitingJobs()
+
+			// Wait for a free slot in the pool
+			select {
+			case w.slots <- struct{}{}:
+			case <-w.stopping:
+				continue
+			case <-time.After(w.Config.PollInterval):
+				continue
+			}
+
+			jobID, err := w.claimNextJob()
+			if err != nil {
+				<-w.slots
+				log.Printf("Error claiming job: %v", err)
+				time.Sleep(2 * w.Config.PollInterval) // Wait before retrying
+				continue
+			}
+			if jobID == 0 {
+				<-w.slots
+				time.Sleep(w.Config.PollInterval) // Wait before checking again
+				continue
+			}
+
+			// Shutdown may have started while the job was being claimed
+			w.mutex.Lock()
+			if w.isStopping() {
+				w.mutex.Unlock()
+				w.DB.Exec("UPDATE jobs SET status = 'pending' WHERE id = ? AND status = 'queued'", jobID)
+				w.PublishJob(jobID)
+				<-w.slots
+				continue
+			}
+			w.activeJobs.Add(1)
+			w.mutex.Unlock()
+
+			log.Printf("Claimed job %d (%d/%d slots in use)", jobID, len(w.slots), w.Config.PoolSize)
+			w.PublishJob(jobID)
+
+			// Run job asynchronously, releasing the slot when it finishes
+			go func(id int) {
+				defer w.activeJobs.Done()
+				defer func() { <-w.slots }()
+				err := w.RunJob(id)
+				if err != nil {
+					log.Printf("Error running job %d: %v", id, err)
+					// Don't overwrite a cancelled or interrupted status
+					w.DB.Exec("UPDATE jobs SET status = 'failed', status_reason = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ? AND status IN ('queued', 'running')", err.Error(), id)
+					w.PublishJob(id)
+				}
+			}(jobID)
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"docker-app/internal/models"
+	"docker-app/internal/secrets"
+	"docker-app/internal/vars"
+	"fmt"
+)
+
+// jobSecrets decrypts the secrets a job can refer to: the global ones, with
+// those of its pipeline taking precedence
+func (w *Worker) jobSecrets(job models.Job) (map[string]string, error) {
+	return w.decryptSecrets(job, nil)
+}
+
+// JobMasker returns a masker for the secrets a job can refer to, which hides
+// them in the output agents send whatever the agent masked itself. Without a
+// master key no secret reached the job and nothing is masked.
+func (w *Worker) JobMasker(jobID int) (*secrets.Masker, error) {
+	if w.Config.Secrets == nil {
+		return nil, nil
+	}
+	var job models.Job
+	if err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID); err != nil {
+		return nil, err
+	}
+	values, err := w.jobSecrets(job)
+	if err != nil {
+		return nil, err
+	}
+	return secrets.NewMasker(values), nil
+}
+
+// leaseSecrets decrypts the secrets the env, services, steps and files of a
+// leased job refer to, the only ones the agent gets. ${NAME} is only expanded
+// in runnables, which agents don't run.
+func (w *Worker) leaseSecrets(lease models.Lease) (map[string]string, error) {
+	services, err := parseServices(lease.Job.Services)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, env := range lease.Env {
+		values = append(values, env.Value)
+	}
+	for _, service := range services {
+		for _, value := range service.Env {
+			values = append(values, value)
+		}
+	}
+	for _, step := range lease.Steps {
+		values = append(values, step.Content)
+	}
+	for _, f := range lease.Files {
+		values = append(values, f.Content)
+	}
+
+	names := make(map[string]bool)
+	for _, value := range values {
+		refs, err := vars.References(value, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			if ref.Namespace() == vars.Secrets && len(ref.Path) == 2 {
+				names[ref.Path[1]] = true
+			}
+		}
+	}
+	return w.decryptSecrets(lease.Job, names)
+}
+
+// decryptSecrets decrypts the secrets of a job, only those named in names
+// unless it is nil
+func (w *Worker) decryptSecrets(job models.Job, names map[string]bool) (map[string]string, error) {
+	var stored []models.Secret
+	err := w.DB.Select(&stored, "SELECT * FROM secrets WHERE pipeline_id IS NULL OR pipeline_id = ? ORDER BY pipeline_id IS NOT NULL", job.PipelineID)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(stored))
+	if names != nil {
+		referenced := stored[:0]
+		for _, secret := range stored {
+			if names[secret.Name] {
+				referenced = append(referenced, secret)
+			}
+		}
+		stored = referenced
+	}
+	if len(stored) == 0 {
+		return values, nil
+	}
+	if w.Config.Secrets == nil {
+		return nil, fmt.Errorf("secrets can't be decrypted without a master key")
+	}
+	for _, secret := range stored {
+		value, err := w.Config.Secrets.Decrypt(secret.Name, secret.Value)
+		if err != nil {
+			return nil, err
+		}
+		values[secret.Name] = value
+	}
+	return values, nil
+}
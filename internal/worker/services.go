@@ -0,0 +1,234 @@
+package worker
+
+import (
+	"context"
+	"docker-app/internal/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+)
+
+// serviceLabel marks service containers with the name of their service. They
+// also carry jobContainerLabel so that they are cleaned up with the job.
+const serviceLabel = "rapidflow.service"
+
+// serviceStartTimeout bounds how long a service may take to become healthy
+const serviceStartTimeout = 5 * time.Minute
+
+// parseServices decodes the services stored on a job record
+func parseServices(services *string) ([]models.ServiceConfig, error) {
+	if services == nil || *services == "" {
+		return nil, nil
+	}
+	var s []models.ServiceConfig
+	if err := json.Unmarshal([]byte(*services), &s); err != nil {
+		return nil, fmt.Errorf("invalid services: %v", err)
+	}
+	return s, nil
+}
+
+// startServices starts the services of a job on its network and waits until
+// every one of them is healthy
+func (e *dockerExecutor) startServices(ctx context.Context, jobID int, networkName string, services []models.ServiceConfig) error {
+	for _, service := range services {
+		if err := e.startService(ctx, jobID, networkName, service); err != nil {
+			return fmt.Errorf("service %s: %v", service.Name, err)
+		}
+	}
+	for _, service := range services {
+		if err := e.waitForService(ctx, jobID, service); err != nil {
+			return fmt.Errorf("service %s: %v", service.Name, err)
+		}
+	}
+	return nil
+}
+
+// startService pulls and starts a single service container
+func (e *dockerExecutor) startService(ctx context.Context, jobID int, networkName string, service models.ServiceConfig) error {
+	log.Printf("Pulling service image %s", service.Image)
+	out, err := e.docker.ImagePull(ctx, service.Image, types.ImagePullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %v", service.Image, err)
+	}
+	defer out.Close()
+	_, err = io.Copy(io.Discard, out)
+	if err != nil {
+		return err
+	}
+
+	var env []string
+	for k, v := range service.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	config := &container.Config{
+		Image: service.Image,
+		Env:   env,
+		Labels: map[string]string{
+			jobContainerLabel: strconv.Itoa(jobID),
+			serviceLabel:      service.Name,
+		},
+	}
+	if len(service.Command) > 0 {
+		config.Cmd = service.Command
+	}
+	if service.HealthCheck != nil {
+		config.Healthcheck, err = healthConfig(*service.HealthCheck)
+		if err != nil {
+			return err
+		}
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(networkName),
+	}
+	if service.Resources != nil {
+		if err := applyResources(hostConfig, *service.Resources); err != nil {
+			return err
+		}
+	}
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkName: {Aliases: serviceAliases(service)},
+		},
+	}
+
+	resp, err := e.docker.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, "")
+	if err != nil {
+		return err
+	}
+	err = e.docker.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return err
+	}
+	log.Printf("Started service %s for job %d: %s", service.Name, jobID, resp.ID)
+	return nil
+}
+
+// serviceAliases returns the host names a service is reachable by
+func serviceAliases(service models.ServiceConfig) []string {
+	return append([]string{service.Name}, service.Aliases...)
+}
+
+// healthConfig converts a service health check to its Docker form
+func healthConfig(h models.HealthCheckConfig) (*container.HealthConfig, error) {
+	interval, err := models.ParseDuration(h.Interval)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := models.ParseDuration(h.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	startPeriod, err := models.ParseDuration(h.StartPeriod)
+	if err != nil {
+		return nil, err
+	}
+	return &container.HealthConfig{
+		Test:        []string{"CMD-SHELL", h.Test},
+		Interval:    interval,
+		Timeout:     timeout,
+		StartPeriod: startPeriod,
+		Retries:     h.Retries,
+	}, nil
+}
+
+// waitForService waits until a service is healthy. Services without a health
+// check only have to be running.
+func (e *dockerExecutor) waitForService(ctx context.Context, jobID int, service models.ServiceConfig) error {
+	containerID, err := e.serviceContainerID(ctx, jobID, service.Name)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(serviceStartTimeout)
+	for {
+		info, err := e.docker.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return err
+		}
+		if info.State == nil {
+			return fmt.Errorf("container state unavailable")
+		}
+		if !info.State.Running {
+			return fmt.Errorf("exited with code %d", info.State.ExitCode)
+		}
+		if info.State.Health == nil || info.State.Health.Status == types.Healthy {
+			log.Printf("Service %s for job %d is ready", service.Name, jobID)
+			return nil
+		}
+		if info.State.Health.Status == types.Unhealthy {
+			return fmt.Errorf("health check failed: %s", lastHealthOutput(info.State.Health))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not healthy after %s", serviceStartTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// lastHealthOutput returns the output of the most recent health check
+func lastHealthOutput(health *types.Health) string {
+	if len(health.Log) == 0 {
+		return "no health check output"
+	}
+	return strings.TrimSpace(health.Log[len(health.Log)-1].Output)
+}
+
+// serviceContainerID finds the container of a job's service
+func (e *dockerExecutor) serviceContainerID(ctx context.Context, jobID int, name string) (string, error) {
+	containers, err := e.docker.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", fmt.Sprintf("%s=%d", jobContainerLabel, jobID)),
+			filters.Arg("label", fmt.Sprintf("%s=%s", serviceLabel, name)),
+		),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(containers) == 0 {
+		return "", fmt.Errorf("container not found")
+	}
+	return containers[0].ID, nil
+}
+
+// removeJobServices removes a job's service containers and its networks
+func (e *dockerExecutor) removeJobServices(jobID int) {
+	ctx := context.Background()
+
+	containers, err := e.docker.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", fmt.Sprintf("%s=%d", jobContainerLabel, jobID)),
+			filters.Arg("label", serviceLabel),
+		),
+	})
+	if err != nil {
+		log.Printf("Failed to list services of job %d: %v", jobID, err)
+	}
+	for _, c := range containers {
+		log.Printf("Removing service %s: %s", c.Labels[serviceLabel], c.ID)
+		err := e.docker.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			log.Printf("Failed to remove service container %s: %v", c.ID, err)
+		}
+	}
+
+	e.removeJobNetworks(jobID)
+}
@@ -0,0 +1,128 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// interruptGracePeriod is how long Shutdown waits for cancelled jobs to record
+// their own status before it marks them as interrupted itself
+const interruptGracePeriod = 15 * time.Second
+
+// Shutdown stops the queue from claiming new jobs and waits up to timeout for
+// running jobs to finish. Jobs still running after the timeout are cancelled
+// and marked as interrupted.
+func (w *Worker) Shutdown(timeout time.Duration) {
+	w.mutex.Lock()
+	w.stopOnce.Do(func() { close(w.stopping) })
+	w.mutex.Unlock()
+
+	w.mutex.RLock()
+	running := len(w.runningJobs)
+	w.mutex.RUnlock()
+	log.Printf("Shutting down worker, waiting up to %s for %d running jobs", timeout, running)
+
+	done := make(chan struct{})
+	go func() {
+		w.activeJobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("All jobs finished, worker stopped")
+		return
+	case <-time.After(timeout):
+	}
+
+	// Cancel whatever is still running
+	w.mutex.Lock()
+	var jobIDs []int
+	for jobID, cancel := range w.runningJobs {
+		w.interrupted[jobID] = true
+		jobIDs = append(jobIDs, jobID)
+		cancel()
+	}
+	w.mutex.Unlock()
+	log.Printf("Shutdown timeout reached, interrupting jobs %v", jobIDs)
+
+	select {
+	case <-done:
+	case <-time.After(interruptGracePeriod):
+		log.Printf("Jobs did not stop within %s", interruptGracePeriod)
+	}
+
+	// Make sure nothing is left looking like it is still running
+	for _, jobID := range jobIDs {
+		w.markJobInterrupted(jobID)
+	}
+	log.Printf("Worker stopped")
+}
+
+// isStopping reports whether Shutdown has been called
+func (w *Worker) isStopping() bool {
+	select {
+	case <-w.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// markJobStopped records why a job's context ended - a job timeout, a user
+// cancellation or a shutdown - and returns the error to end the job with
+func (w *Worker) markJobStopped(ctx context.Context, jobID int, timeout time.Duration) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		reason := fmt.Sprintf("job timed out after %s", timeout)
+		w.DB.Exec("UPDATE steps SET status = 'timed_out', status_reason = ? WHERE job_id = ? AND status = 'running'", reason, jobID)
+		w.stopRunningAttempts(jobID, "timed_out")
+		w.SkipPendingSteps(jobID, reason)
+		w.DB.Exec("UPDATE jobs SET status = 'failed', status_reason = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?", reason, jobID)
+		w.PublishSteps(jobID)
+		w.PublishJob(jobID)
+		return fmt.Errorf("job %d %s", jobID, reason)
+	}
+
+	w.markJobCancelled(jobID)
+	return fmt.Errorf("job %d was cancelled", jobID)
+}
+
+// markJobCancelled records that a job stopped because its context was
+// cancelled, either by the user or by Shutdown
+func (w *Worker) markJobCancelled(jobID int) {
+	w.mutex.RLock()
+	interrupted := w.interrupted[jobID]
+	w.mutex.RUnlock()
+
+	if interrupted {
+		w.markJobInterrupted(jobID)
+		return
+	}
+
+	w.DB.Exec("UPDATE jobs SET status = 'cancelled', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
+	w.DB.Exec("UPDATE steps SET status = 'cancelled' WHERE job_id = ? AND status IN ('pending', 'running')", jobID)
+	w.stopRunningAttempts(jobID, "cancelled")
+	w.PublishSteps(jobID)
+	w.PublishJob(jobID)
+}
+
+// markJobInterrupted records that a job was stopped by a server shutdown
+func (w *Worker) markJobInterrupted(jobID int) {
+	reason := "server shut down before the job finished"
+	w.DB.Exec("UPDATE jobs SET status = 'interrupted', status_reason = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ? AND status IN ('queued', 'running')", reason, jobID)
+	w.DB.Exec("UPDATE steps SET status = 'interrupted' WHERE job_id = ? AND status IN ('pending', 'running')", jobID)
+	w.stopRunningAttempts(jobID, "interrupted")
+	w.DB.Exec("UPDATE runnables SET status = 'interrupted' WHERE job_id = ? AND status IN ('pending', 'running')", jobID)
+	w.DB.Exec("UPDATE deployments SET status = 'interrupted' WHERE status IN ('pending', 'running') AND runnable_id IN (SELECT id FROM runnables WHERE job_id = ?)", jobID)
+	w.PublishSteps(jobID)
+	w.PublishJob(jobID)
+}
+
+// SkipPendingSteps marks the steps of a job that never started as skipped,
+// once the job ended for reason before getting to them
+func (w *Worker) SkipPendingSteps(jobID int, reason string) {
+	w.DB.Exec("UPDATE steps SET status = 'skipped', status_reason = ? WHERE job_id = ? AND status = 'pending'", "not run: "+reason, jobID)
+}
@@ -0,0 +1,638 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"docker-app/internal/expr"
+	"docker-app/internal/models"
+	"docker-app/internal/pubsub"
+	"docker-app/internal/secrets"
+	"docker-app/internal/vars"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// jobRun is the state shared by the steps of a running job
+type jobRun struct {
+	Job       models.Job
+	Executor  Executor
+	Resources models.ResourceConfig
+	Env       map[string]string
+	// Vars expands the references of steps and gathers the outputs steps
+	// set. Masker hides the values of secrets in what is stored.
+	Vars   *vars.Scope
+	Masker *secrets.Masker
+}
+
+// stepFailure is returned when a step doesn't succeed. Status is the status
+// recorded on the step and Reason becomes the status reason of the job.
+type stepFailure struct {
+	StepID int
+	Status string
+	Reason string
+}
+
+func (e *stepFailure) Error() string {
+	return fmt.Sprintf("step %d failed", e.StepID)
+}
+
+// stepResult is the outcome of running a step command
+type stepResult struct {
+	Output   string
+	Outputs  map[string]string
+	ExitCode int
+	TimedOut bool
+}
+
+// parseStepConfig decodes the options stored with a step. Steps created before
+// options were stored have none.
+func parseStepConfig(step models.Step) (models.StepConfig, error) {
+	var config models.StepConfig
+	if step.Config == nil || *step.Config == "" {
+		return config, nil
+	}
+	if err := json.Unmarshal([]byte(*step.Config), &config); err != nil {
+		return config, fmt.Errorf("invalid config for step %d: %v", step.ID, err)
+	}
+	return config, nil
+}
+
+// maxParallelSteps returns how many steps of a job may run at the same time.
+// A pipeline may lower the server limit with max_parallel but not raise it.
+func (w *Worker) maxParallelSteps(job models.Job) int {
+	limit := w.Config.MaxParallelSteps
+	if job.MaxParallel != nil && *job.MaxParallel > 0 && *job.MaxParallel < limit {
+		limit = *job.MaxParallel
+	}
+	return limit
+}
+
+// stepDependencies returns, for every step, the indexes of the steps it waits
+// for. Steps created before the graph was stored depend on the previous step.
+func stepDependencies(steps []models.Step) ([][]int, error) {
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if step.StepKey != nil && *step.StepKey != "" {
+			index[*step.StepKey] = i
+		}
+	}
+
+	deps := make([][]int, len(steps))
+	for i, step := range steps {
+		if step.DependsOn == nil || *step.DependsOn == "" {
+			if i > 0 {
+				deps[i] = []int{i - 1}
+			}
+			continue
+		}
+		var keys []string
+		if err := json.Unmarshal([]byte(*step.DependsOn), &keys); err != nil {
+			return nil, fmt.Errorf("invalid depends_on for step %d: %v", step.ID, err)
+		}
+		for _, key := range keys {
+			j, ok := index[key]
+			if !ok {
+				return nil, fmt.Errorf("step %d depends on unknown step %q", step.ID, key)
+			}
+			deps[i] = append(deps[i], j)
+		}
+	}
+	return deps, nil
+}
+
+// runSteps starts every step once the steps it depends on have finished,
+// running at most maxParallel at a time. A step runs when its if: condition
+// holds; without one it runs only while no step has failed. Steps that don't
+// run are marked skipped. The first error is returned.
+func (w *Worker) runSteps(ctx context.Context, run jobRun, steps []models.Step, maxParallel int) error {
+	deps, err := stepDependencies(steps)
+	if err != nil {
+		return err
+	}
+	if maxParallel <= 0 {
+		maxParallel = 1
+	}
+
+	conditions := make([]*expr.Expression, len(steps))
+	networks := make([]string, len(steps))
+	for i, step := range steps {
+		stepConfig, err := parseStepConfig(step)
+		if err != nil {
+			return err
+		}
+		networks[i] = stepNetwork(run.Job, stepConfig)
+		if stepConfig.If == "" {
+			continue
+		}
+		conditions[i], err = expr.Parse(stepConfig.If)
+		if err != nil {
+			return fmt.Errorf("invalid if for step %d: %v", step.ID, err)
+		}
+	}
+
+	type stepDone struct {
+		index   int
+		status  string
+		outputs map[string]string
+		err     error
+	}
+	done := make(chan stepDone)
+	// status is empty until a step has started and holds its final status after
+	status := make([]string, len(steps))
+	stepVars := make(map[string]interface{})
+	condCtx := expr.Context{
+		Vars: map[string]interface{}{
+			"branch":  stringValue(run.Job.Branch),
+			"tag":     stringValue(run.Job.Tag),
+			"trigger": stringValue(run.Job.Trigger),
+			"env":     run.Env,
+			"steps":   stepVars,
+		},
+	}
+	running := 0
+	var firstErr error
+	fatal := false
+
+	finish := func(i int, s string, outputs map[string]string) {
+		status[i] = s
+		if steps[i].StepKey != nil {
+			stepVars[*steps[i].StepKey] = map[string]interface{}{"status": s, "outputs": outputs}
+			run.Vars.Steps[*steps[i].StepKey] = outputs
+		}
+	}
+	ready := func(i int) bool {
+		for _, dep := range deps[i] {
+			if status[dep] == "" || status[dep] == "running" {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		// Start or skip every step whose dependencies have finished. Skipping a
+		// step can make others ready, so repeat until nothing changes.
+		for progress := !fatal && ctx.Err() == nil; progress; {
+			progress = false
+			for i, step := range steps {
+				if status[i] != "" || !ready(i) {
+					continue
+				}
+				shouldRun, reason, err := shouldRunAfter(conditions[i], condCtx, steps, deps[i], status)
+				if err != nil {
+					reason = fmt.Sprintf("invalid if: %v", err)
+					w.DB.Exec("UPDATE steps SET status = 'failed', status_reason = ? WHERE id = ?", reason, step.ID)
+					w.PublishStep(step.ID)
+					finish(i, "failed", nil)
+					condCtx.Failed = true
+					if firstErr == nil {
+						firstErr = &stepFailure{StepID: step.ID, Status: "failed", Reason: fmt.Sprintf("step %d %s", step.OrderNum, reason)}
+					}
+					progress = true
+					continue
+				}
+				if !shouldRun {
+					log.Printf("Skipping step %d: %s", step.ID, reason)
+					w.DB.Exec("UPDATE steps SET status = 'skipped', status_reason = ? WHERE id = ?", reason, step.ID)
+					w.PublishStep(step.ID)
+					finish(i, "skipped", nil)
+					progress = true
+					continue
+				}
+				if running >= maxParallel {
+					continue
+				}
+				// Steps that run together share the container's network, so a
+				// step with another policy waits until the running ones finish
+				if docker, ok := run.Executor.(*dockerExecutor); ok && networks[i] != docker.network.policy {
+					if running > 0 {
+						continue
+					}
+					if err := docker.setNetworkPolicy(ctx, networks[i]); err != nil {
+						w.DB.Exec("UPDATE steps SET status = 'failed', status_reason = ? WHERE id = ?", err.Error(), step.ID)
+						w.PublishStep(step.ID)
+						finish(i, "failed", nil)
+						fatal = true
+						if firstErr == nil {
+							firstErr = err
+						}
+						progress = false
+						break
+					}
+				}
+				status[i] = "running"
+				running++
+				// The step sees the outputs of the steps that finished so far
+				stepRun := run
+				stepRun.Vars = run.Vars.Snapshot()
+				go func(i int) {
+					status, outputs, err := w.runStep(ctx, stepRun, steps[i])
+					done <- stepDone{index: i, status: status, outputs: outputs, err: err}
+				}(i)
+			}
+		}
+		if running == 0 {
+			break
+		}
+
+		result := <-done
+		running--
+		if result.err == nil {
+			finish(result.index, result.status, result.outputs)
+			continue
+		}
+		var failure *stepFailure
+		if errors.As(result.err, &failure) {
+			finish(result.index, failure.Status, result.outputs)
+			condCtx.Failed = true
+		} else {
+			// Docker or database errors stop the job, as does a stopped ctx
+			finish(result.index, "failed", nil)
+			fatal = true
+		}
+		if firstErr == nil {
+			firstErr = result.err
+		}
+	}
+
+	if fatal || ctx.Err() != nil {
+		return firstErr
+	}
+	for i, step := range steps {
+		if status[i] == "" {
+			return fmt.Errorf("step %d can never start, its dependencies form a cycle", step.ID)
+		}
+	}
+	return firstErr
+}
+
+// shouldRunStep evaluates a step condition. Steps without a condition, or with
+// one that doesn't call success(), failure() or always(), only run while no
+// step has failed. The reason explains why a step is skipped.
+func shouldRunStep(condition *expr.Expression, ctx expr.Context) (bool, string, error) {
+	if condition == nil || !condition.UsesStatus() {
+		if ctx.Failed {
+			return false, "an earlier step failed", nil
+		}
+		if condition == nil {
+			return true, "", nil
+		}
+	}
+	ok, err := condition.Eval(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	if !ok {
+		return false, fmt.Sprintf("condition %q is false", condition), nil
+	}
+	return true, "", nil
+}
+
+// shouldRunAfter is shouldRunStep for a step whose dependencies finished with
+// the given statuses. Like needs: in GitHub Actions, a step is skipped with a
+// dependency that was skipped, whose outputs it can't use, unless its
+// condition calls success(), failure() or always().
+func shouldRunAfter(condition *expr.Expression, ctx expr.Context, steps []models.Step, deps []int, status []string) (bool, string, error) {
+	if condition == nil || !condition.UsesStatus() {
+		for _, dep := range deps {
+			if status[dep] == "skipped" {
+				return false, fmt.Sprintf("step %d it depends on was skipped", steps[dep].OrderNum), nil
+			}
+		}
+	}
+	return shouldRunStep(condition, ctx)
+}
+
+// stringValue dereferences an optional string
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// runStep runs a single step, retrying it according to its retry policy, and
+// returns the status recorded on it with the outputs it set. A *stepFailure
+// is returned when the step didn't succeed and may not continue_on_error;
+// when ctx is done the partial output is kept and the job is left for the
+// caller to stop.
+func (w *Worker) runStep(ctx context.Context, run jobRun, step models.Step) (string, map[string]string, error) {
+	stepConfig, err := parseStepConfig(step)
+	if err != nil {
+		return "", nil, err
+	}
+	stepTimeout, err := models.ParseDuration(stepConfig.Timeout)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid timeout for step %d: %v", step.ID, err)
+	}
+	maxAttempts := 1
+	var backoff time.Duration
+	if stepConfig.Retry != nil {
+		if stepConfig.Retry.MaxAttempts > 1 {
+			maxAttempts = stepConfig.Retry.MaxAttempts
+		}
+		backoff, err = models.ParseDuration(stepConfig.Retry.Backoff)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid retry backoff for step %d: %v", step.ID, err)
+		}
+	}
+
+	log.Printf("Running step %d", step.ID)
+	// Update step status
+	_, err = w.DB.Exec("UPDATE steps SET status = 'running' WHERE id = ?", step.ID)
+	if err != nil {
+		log.Printf("Error updating step status: %v", err)
+	}
+	w.PublishStep(step.ID)
+	// Get files for step
+	var files []models.File
+	err = w.DB.Select(&files, "SELECT * FROM files WHERE step_id = ?", step.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	// Expand the variables the step refers to, a reference to one that isn't
+	// defined fails the step
+	if err := expandStep(run.Vars, &step, files); err != nil {
+		reason := err.Error()
+		w.DB.Exec("UPDATE steps SET status = 'failed', status_reason = ? WHERE id = ?", reason, step.ID)
+		w.PublishStep(step.ID)
+		return "failed", nil, &stepFailure{StepID: step.ID, Status: "failed", Reason: fmt.Sprintf("step %d: %s", step.OrderNum, reason)}
+	}
+	// Create files, the step fails when one can't be written
+	if err := writeStepFiles(ctx, run.Executor, files); err != nil {
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+		reason := err.Error()
+		w.DB.Exec("UPDATE steps SET status = 'failed', status_reason = ? WHERE id = ?", reason, step.ID)
+		w.PublishStep(step.ID)
+		return "failed", nil, &stepFailure{StepID: step.ID, Status: "failed", Reason: fmt.Sprintf("step %d: %s", step.OrderNum, reason)}
+	}
+	if step.Type != "bash" {
+		return "success", nil, nil
+	}
+	stepCaches := w.restoreCaches(ctx, run, &step.ID, stepConfig.Cache)
+
+	// Run the step content as bash, retrying failed attempts
+	var attempt stepAttempt
+	for n := 1; ; n++ {
+		attempt, err = w.runStepAttempt(ctx, run, step, n, stepTimeout)
+		if err != nil {
+			return "", nil, err
+		}
+		if attempt.Status == "success" || n >= maxAttempts || !shouldRetry(stepConfig.Retry, attempt) {
+			break
+		}
+
+		delay := retryDelay(backoff, n)
+		log.Printf("Step %d attempt %d of %d %s, retrying in %s", step.ID, n, maxAttempts, attempt.Status, delay)
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	reason := attempt.Reason
+	if attempt.Status != "success" && stepConfig.ContinueOnError {
+		continueReason := "continued because continue_on_error is set"
+		if reason != nil {
+			continueReason = *reason + "; " + continueReason
+		}
+		reason = &continueReason
+	}
+	if attempt.Status == "success" {
+		w.saveCaches(ctx, run, stepCaches)
+	}
+	outputs, err := outputsJSON(attempt.Outputs)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = w.DB.Exec("UPDATE steps SET status = ?, output = ?, outputs = ?, status_reason = ? WHERE id = ?", attempt.Status, attempt.Output, outputs, reason, step.ID)
+	if err != nil {
+		log.Printf("Error updating step: %v", err)
+	}
+	w.PublishStep(step.ID)
+
+	if attempt.Status != "success" && !stepConfig.ContinueOnError {
+		jobReason := fmt.Sprintf("step %d exited with code %d", step.OrderNum, attempt.ExitCode)
+		if attempt.Reason != nil {
+			jobReason = fmt.Sprintf("step %d %s", step.OrderNum, *attempt.Reason)
+		}
+		if attempt.Attempt > 1 {
+			jobReason = fmt.Sprintf("%s after %d attempts", jobReason, attempt.Attempt)
+		}
+		return attempt.Status, attempt.Outputs, &stepFailure{StepID: step.ID, Status: attempt.Status, Reason: jobReason}
+	}
+	return attempt.Status, attempt.Outputs, nil
+}
+
+// stepAttempt is the outcome of one run of a step's command
+type stepAttempt struct {
+	stepResult
+	Attempt int
+	Status  string
+	Reason  *string
+}
+
+// runStepAttempt runs a step's command once and records the attempt with its
+// own output and exit code in step_attempts
+func (w *Worker) runStepAttempt(ctx context.Context, run jobRun, step models.Step, n int, timeout time.Duration) (stepAttempt, error) {
+	attempt := stepAttempt{Attempt: n}
+
+	result, err := w.DB.Exec("INSERT INTO step_attempts (step_id, attempt, status) VALUES (?, ?, 'running')", step.ID, n)
+	if err != nil {
+		return attempt, err
+	}
+	attemptID, _ := result.LastInsertId()
+	w.DB.Exec("UPDATE steps SET attempts = ? WHERE id = ?", n, step.ID)
+
+	// Lines are numbered and published as they are read, and stored in
+	// batches
+	seq, err := lastLogSeq(w.DB, step.ID)
+	if err != nil {
+		return attempt, err
+	}
+	lines := newStepLog(n, logFlushInterval, func(line *models.LogLine) {
+		seq++
+		line.JobID = step.JobID
+		line.StepID = step.ID
+		line.Seq = seq
+		w.Events.Publish(step.JobID, pubsub.TypeLine, *line)
+	}, func(batch []models.LogLine) error {
+		return storeLogLines(w.DB, batch)
+	})
+	docker, isDocker := run.Executor.(*dockerExecutor)
+	var oomBefore oomState
+	if isDocker {
+		oomBefore = docker.oomState(ctx)
+	}
+	attempt.stepResult, err = execStep(ctx, run.Executor, step, timeout, run.Masker, lines)
+	lines.close()
+	if ctx.Err() != nil {
+		// Keep what the step printed before it was stopped
+		w.DB.Exec("UPDATE step_attempts SET output = ? WHERE id = ?", attempt.Output, attemptID)
+		w.DB.Exec("UPDATE steps SET output = ? WHERE id = ?", attempt.Output, step.ID)
+		return attempt, ctx.Err()
+	}
+	if err != nil {
+		w.DB.Exec("UPDATE step_attempts SET status = 'failed', status_reason = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?", err.Error(), attemptID)
+		return attempt, err
+	}
+
+	attempt.Status = "success"
+	exitCode := &attempt.ExitCode
+	if attempt.TimedOut {
+		attempt.Status = "timed_out"
+		timeoutReason := fmt.Sprintf("timed out after %s", timeout)
+		attempt.Reason = &timeoutReason
+		exitCode = nil
+	} else if attempt.ExitCode != 0 {
+		attempt.Status = "failed"
+		if isDocker && docker.oomKilled(ctx, oomBefore, attempt.ExitCode) {
+			oomReason := fmt.Sprintf("killed by the kernel OOM killer (memory limit %s)", run.Resources.Memory)
+			if run.Resources.Memory == "" {
+				oomReason = "killed by the kernel OOM killer"
+			}
+			attempt.Reason = &oomReason
+		}
+	}
+
+	_, err = w.DB.Exec("UPDATE step_attempts SET status = ?, exit_code = ?, output = ?, status_reason = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?",
+		attempt.Status, exitCode, attempt.Output, attempt.Reason, attemptID)
+	if err != nil {
+		log.Printf("Error updating attempt %d of step %d: %v", n, step.ID, err)
+	}
+	return attempt, nil
+}
+
+// shouldRetry reports whether a failed attempt may be retried under policy.
+// Without on_exit_codes any failure is retried, otherwise only those exit codes.
+func shouldRetry(policy *models.RetryConfig, attempt stepAttempt) bool {
+	if policy == nil {
+		return false
+	}
+	if len(policy.OnExitCodes) == 0 {
+		return true
+	}
+	if attempt.TimedOut {
+		return false
+	}
+	for _, code := range policy.OnExitCodes {
+		if code == attempt.ExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRetryDelay caps the exponential backoff between attempts
+const maxRetryDelay = 10 * time.Minute
+
+// retryDelay returns how long to wait after attempt n failed: backoff doubled
+// for every attempt before it
+func retryDelay(backoff time.Duration, n int) time.Duration {
+	delay := backoff
+	for i := 1; i < n && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// stopRunningAttempts closes the attempts of a job's steps that were still
+// running when the job was stopped
+func (w *Worker) stopRunningAttempts(jobID int, status string) {
+	w.DB.Exec("UPDATE step_attempts SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE status = 'running' AND step_id IN (SELECT id FROM steps WHERE job_id = ?)", status, jobID)
+}
+
+// execStep runs a step's command with the executor and collects its output
+// with the values of secrets masked, and the outputs it sets, also adding
+// every line to lines when it isn't nil. The command is killed when timeout
+// elapses or ctx is done; a timeout is reported through stepResult.TimedOut,
+// while a done ctx is left to the caller.
+func execStep(ctx context.Context, executor Executor, step models.Step, timeout time.Duration, masker *secrets.Masker, lines *stepLog) (stepResult, error) {
+	var result stepResult
+
+	stepCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type execDone struct {
+		exitCode int
+		err      error
+	}
+	stdout, stdoutWriter := io.Pipe()
+	stderr, stderrWriter := io.Pipe()
+	done := make(chan execDone, 1)
+	go func() {
+		exitCode, err := executor.Exec(stepCtx, []string{"sh", "-c", step.Content}, stdoutWriter, stderrWriter)
+		stdoutWriter.Close()
+		stderrWriter.Close()
+		done <- execDone{exitCode, err}
+	}()
+
+	// Both streams are read at the same time, output keeps their lines in
+	// the order they were read
+	var mutex sync.Mutex
+	var output bytes.Buffer
+	read := func(pr *io.PipeReader, stream string) error {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			line := masker.Mask(scanner.Text())
+			mutex.Lock()
+			log.Println(line)
+			output.WriteString(line + "\n")
+			if name, value, ok := parseSetOutput(line); ok {
+				if result.Outputs == nil {
+					result.Outputs = make(map[string]string)
+				}
+				result.Outputs[name] = value
+			}
+			if lines != nil {
+				lines.add(stream, line)
+			}
+			mutex.Unlock()
+		}
+		// Unblock the command if the output couldn't be read to the end
+		pr.CloseWithError(scanner.Err())
+		return scanner.Err()
+	}
+	stderrRead := make(chan error, 1)
+	go func() {
+		stderrRead <- read(stderr, models.LogStreamStderr)
+	}()
+	readErr := read(stdout, models.LogStreamStdout)
+	if err := <-stderrRead; readErr == nil {
+		readErr = err
+	}
+	finished := <-done
+	result.Output = output.String()
+
+	if stepCtx.Err() != nil {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		result.TimedOut = true
+		return result, nil
+	}
+	if readErr != nil {
+		return result, readErr
+	}
+	if finished.err != nil {
+		return result, finished.err
+	}
+	result.ExitCode = finished.exitCode
+	return result, nil
+}
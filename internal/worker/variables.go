@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"docker-app/internal/models"
+	"docker-app/internal/vars"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// setOutputPrefix starts the lines a step prints to set an output, as in
+// echo "::set-output name=version::1.4.2"
+const setOutputPrefix = "::set-output name="
+
+// jobScope returns the variables the references of a job expand to. Its env
+// is added by expandEnv and step outputs as the steps finish.
+func jobScope(job models.Job, pipelineName string, secretValues map[string]string) *vars.Scope {
+	commit := stringValue(job.CommitSHA)
+	shortCommit := commit
+	if len(shortCommit) > 7 {
+		shortCommit = shortCommit[:7]
+	}
+	jobID := strconv.Itoa(job.ID)
+	scope := &vars.Scope{
+		Secrets: secretValues,
+		Job: map[string]string{
+			"id":         jobID,
+			"branch":     stringValue(job.Branch),
+			"tag":        stringValue(job.Tag),
+			"trigger":    stringValue(job.Trigger),
+			"commit_sha": commit,
+			"short_sha":  shortCommit,
+		},
+		Pipeline: map[string]string{
+			"id":   strconv.Itoa(job.PipelineID),
+			"name": pipelineName,
+		},
+		Exported: map[string]string{
+			"JOB_ID":        jobID,
+			"PIPELINE_NAME": pipelineName,
+		},
+		Steps: make(map[string]map[string]string),
+	}
+	if job.Branch != nil {
+		scope.Exported["BRANCH"] = *job.Branch
+	}
+	if commit != "" {
+		scope.Exported["COMMIT_SHA"] = commit
+	}
+	return scope
+}
+
+// expandEnv expands the references of a job's env and records the values in
+// scope. It returns the environment of the job's containers as KEY=value: the
+// env followed by the variables the job exports, such as JOB_ID.
+func expandEnv(envs []models.Environment, scope *vars.Scope) ([]string, error) {
+	values := make(map[string]string, len(envs))
+	var envVars []string
+	for _, env := range envs {
+		value, err := scope.Expand(env.Value)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %v", env.Key, err)
+		}
+		values[env.Key] = value
+		envVars = append(envVars, fmt.Sprintf("%s=%s", env.Key, value))
+	}
+	scope.Env = values
+
+	exported := make([]string, 0, len(scope.Exported))
+	for key := range scope.Exported {
+		exported = append(exported, key)
+	}
+	sort.Strings(exported)
+	for _, key := range exported {
+		envVars = append(envVars, fmt.Sprintf("%s=%s", key, scope.Exported[key]))
+	}
+	return envVars, nil
+}
+
+// expandServices expands the references of the environment of services, such
+// as the password of a database
+func expandServices(services []models.ServiceConfig, scope *vars.Scope) error {
+	for _, service := range services {
+		for key, value := range service.Env {
+			expanded, err := scope.Expand(value)
+			if err != nil {
+				return fmt.Errorf("service %s: env %s: %v", service.Name, key, err)
+			}
+			service.Env[key] = expanded
+		}
+	}
+	return nil
+}
+
+// expandStep expands the references of a step's command and of its files
+func expandStep(scope *vars.Scope, step *models.Step, files []models.File) error {
+	content, err := scope.Expand(step.Content)
+	if err != nil {
+		return err
+	}
+	step.Content = content
+	for i, f := range files {
+		content, err := scope.Expand(f.Content)
+		if err != nil {
+			return fmt.Errorf("file %s: %v", f.Name, err)
+		}
+		files[i].Content = content
+	}
+	return nil
+}
+
+// parseSetOutput returns the output a line of a step sets, if any
+func parseSetOutput(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, setOutputPrefix) {
+		return "", "", false
+	}
+	name, value, found := strings.Cut(strings.TrimPrefix(line, setOutputPrefix), "::")
+	if !found || !vars.IsOutputName(name) {
+		return "", "", false
+	}
+	return name, value, true
+}
+
+// outputsJSON encodes the outputs stored with a step, nil when it set none
+func outputsJSON(outputs map[string]string) (*string, error) {
+	if len(outputs) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(outputs)
+	if err != nil {
+		return nil, err
+	}
+	encoded := string(data)
+	return &encoded, nil
+}
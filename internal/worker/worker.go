@@ -4,14 +4,19 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"docker-app/internal/artifacts"
 	"docker-app/internal/models"
 	"docker-app/internal/providers"
+	"docker-app/internal/pubsub"
+	"docker-app/internal/secrets"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -26,14 +31,125 @@ import (
 )
 
 type Worker struct {
-	DB              *sqlx.DB
-	Docker          *client.Client
+	DB        *sqlx.DB
+	Docker    *client.Client
+	Config    Config
+	Artifacts artifacts.Store
+	// Events passes the lines and statuses of running jobs to the clients
+	// following them
+	Events          *pubsub.Broker
 	runningJobs     map[int]context.CancelFunc
 	mutex           sync.RWMutex
 	providerManager *providers.ProviderManager
+	slots           chan struct{}
+	activeJobs      sync.WaitGroup
+	stopping        chan struct{}
+	stopOnce        sync.Once
+	interrupted     map[int]bool
+	cacheMutex      sync.Mutex
+	eventMutex      sync.Mutex
+	// artifactMutex is read-locked while an artifact is put and recorded,
+	// and locked while one is deleted, so that content is never removed
+	// between a Put finding it stored and its record being inserted
+	artifactMutex  sync.RWMutex
+	deliveries     chan struct{}
+	deliveryClient *http.Client
+}
+
+// Config holds the tunable settings of a worker
+type Config struct {
+	// PoolSize is the maximum number of jobs executed concurrently by StartQueue
+	PoolSize int
+	// PollInterval is how long the queue waits before looking for new jobs when idle
+	PollInterval time.Duration
+	// MaxRestarts caps how often a job is re-queued by RecoverJobs
+	MaxRestarts int
+	// DefaultResources applies to containers that don't request a limit
+	DefaultResources models.ResourceConfig
+	// MaxResources caps the limits any container may request
+	MaxResources models.ResourceConfig
+	// MaxParallelSteps caps how many steps of one job run at the same time
+	MaxParallelSteps int
+	// CacheDir is where saved caches are stored
+	CacheDir string
+	// CacheSize caps the total size of saved caches in bytes; the least
+	// recently used caches are evicted beyond it
+	CacheSize int64
+	// ArtifactDir is where the local artifact store keeps artifacts
+	ArtifactDir string
+	// ArtifactStore replaces the local artifact store when set
+	ArtifactStore artifacts.Store
+	// AllowLocalExecutor lets jobs run with the local executor, as shell
+	// commands on the worker's machine without any isolation
+	AllowLocalExecutor bool
+	// LeaseTimeout is how long a job leased to an agent is kept without a
+	// heartbeat before it is re-queued
+	LeaseTimeout time.Duration
+	// Labels are what the worker's pool offers to runs_on; it only claims
+	// jobs whose runs_on labels it all has
+	Labels []string
+	// Secrets decrypts the stored secrets jobs refer to
+	Secrets *secrets.Cipher
+	// AllowPrivateSubscriptions lets deliveries connect to loopback,
+	// link-local and private addresses
+	AllowPrivateSubscriptions bool
+	// StoreDeliveryResponses keeps the start of the body of the responses
+	// to deliveries in the delivery log
+	StoreDeliveryResponses bool
+}
+
+// DefaultConfig returns the configuration used by NewWorker
+func DefaultConfig() Config {
+	return Config{
+		PoolSize:         4,
+		PollInterval:     1 * time.Second,
+		MaxRestarts:      3,
+		MaxParallelSteps: 4,
+		CacheDir:         "./testdata/data/cache",
+		CacheSize:        10 << 30,
+		ArtifactDir:      "./testdata/data/artifacts",
+		LeaseTimeout:     time.Minute,
+	}
 }
 
 func NewWorker(db *sqlx.DB) (*Worker, error) {
+	return NewWorkerWithConfig(db, DefaultConfig())
+}
+
+// NewWorkerWithConfig creates a worker using the given configuration, falling
+// back to the defaults for any zero values
+func NewWorkerWithConfig(db *sqlx.DB, config Config) (*Worker, error) {
+	defaults := DefaultConfig()
+	if config.PoolSize <= 0 {
+		config.PoolSize = defaults.PoolSize
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaults.PollInterval
+	}
+	if config.MaxRestarts < 0 {
+		config.MaxRestarts = defaults.MaxRestarts
+	}
+	if config.MaxParallelSteps <= 0 {
+		config.MaxParallelSteps = defaults.MaxParallelSteps
+	}
+	if config.CacheDir == "" {
+		config.CacheDir = defaults.CacheDir
+	}
+	if config.ArtifactDir == "" {
+		config.ArtifactDir = defaults.ArtifactDir
+	}
+	if config.LeaseTimeout <= 0 {
+		config.LeaseTimeout = defaults.LeaseTimeout
+	}
+	store := config.ArtifactStore
+	if store == nil {
+		local, err := artifacts.NewLocalStore(config.ArtifactDir)
+		if err != nil {
+			return nil, err
+		}
+		store = local
+	}
+
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
@@ -41,8 +157,16 @@ func NewWorker(db *sqlx.DB) (*Worker, error) {
 	return &Worker{
 		DB:              db,
 		Docker:          cli,
+		Config:          config,
+		Artifacts:       store,
+		Events:          pubsub.NewBroker(),
 		runningJobs:     make(map[int]context.CancelFunc),
-		providerManager: providers.NewProviderManager(),
+		providerManager: providers.NewProviderManager(cli, registryCredentials{db: db, cipher: config.Secrets}),
+		slots:           make(chan struct{}, config.PoolSize),
+		stopping:        make(chan struct{}),
+		interrupted:     make(map[int]bool),
+		deliveries:      make(chan struct{}, 1),
+		deliveryClient:  newDeliveryClient(config.AllowPrivateSubscriptions),
 	}, nil
 }
 
@@ -285,6 +409,23 @@ func cloneRepository(repoURL, branch, targetDir string) error {
 	return nil
 }
 
+// headCommit returns the commit checked out in dir
+func headCommit(dir string) (string, error) {
+	output, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// jobContainerLabel marks build containers with the ID of the job that owns them
+const jobContainerLabel = "rapidflow.job_id"
+
+// repoTempDir returns the directory a job's repository is cloned into
+func repoTempDir(jobID int) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("rapidflow-repo-%d", jobID))
+}
+
 // cleanupTemporaryResources cleans up temporary containers, images, and directories
 func (w *Worker) cleanupTemporaryResources(jobID int, containerID, tempDir string) {
 	log.Printf("Cleaning up temporary resources for job %d", jobID)
@@ -340,28 +481,54 @@ func (w *Worker) RemoveContainerByName(containerName string) error {
 	return nil
 }
 
-// CleanupJobResources cleans up all resources associated with a job
-func (w *Worker) CleanupJobResources(jobID int, containerID, tempDir string) {
-	log.Printf("Cleaning up job %d resources", jobID)
+// CleanupJobResources cleans up all resources associated with a job, on the
+// Docker daemon it ran on. The error tells that the job container could not
+// be removed, so it may still run.
+func (w *Worker) CleanupJobResources(job models.Job, containerID, tempDir string) error {
+	executor, err := w.jobDockerExecutor(job)
+	if err != nil {
+		log.Printf("Failed to reach the Docker daemon of job %d: %v", job.ID, err)
+		removeTempDir(tempDir)
+		return err
+	}
+	return cleanupJobResources(executor, containerID, tempDir)
+}
 
-	ctx := context.Background()
+// jobDockerExecutor returns a docker executor on the daemon the containers of
+// a job run on, that of its remote host for the ssh executor. Jobs of the
+// local executor only have containers for their services, on the local daemon.
+func (w *Worker) jobDockerExecutor(job models.Job) (*dockerExecutor, error) {
+	executor, err := createExecutor(w.Docker, job, true)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := executor.(*dockerExecutor); ok {
+		return e, nil
+	}
+	return newDockerExecutor(w.Docker, job.ID), nil
+}
 
-	// Remove main container if it exists
+// cleanupJobResources removes the job container, services and networks with
+// executor, which is closed afterwards, and the temporary directory
+func cleanupJobResources(executor *dockerExecutor, containerID, tempDir string) error {
+	log.Printf("Cleaning up job %d resources", executor.jobID)
 	if containerID != "" {
 		log.Printf("Removing job container: %s", containerID)
-		err := w.Docker.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: true})
-		if err != nil {
-			log.Printf("Failed to remove job container %s: %v", containerID, err)
-		}
 	}
+	executor.containerID = containerID
+	err := executor.Teardown(context.Background())
+	removeTempDir(tempDir)
+	return err
+}
 
-	// Remove temporary directory
-	if tempDir != "" {
-		log.Printf("Removing temporary directory: %s", tempDir)
-		err := os.RemoveAll(tempDir)
-		if err != nil {
-			log.Printf("Failed to remove temporary directory %s: %v", tempDir, err)
-		}
+// removeTempDir removes the temporary directory of a job, if any
+func removeTempDir(tempDir string) {
+	if tempDir == "" {
+		return
+	}
+	log.Printf("Removing temporary directory: %s", tempDir)
+	if err := os.RemoveAll(tempDir); err != nil {
+		log.Printf("Failed to remove temporary directory %s: %v", tempDir, err)
 	}
 }
 
@@ -369,7 +536,7 @@ func (w *Worker) RunJob(jobID int) error {
 	return w.RunJobWithContext(context.Background(), jobID)
 }
 
-func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
+func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) (err error) {
 	// Create a cancellable context for this job
 	jobCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -380,9 +547,17 @@ func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
 
 	log.Printf("Starting job %d", jobID)
 
+	// A job that fails leaves no step pending
+	defer func() {
+		if err != nil {
+			w.SkipPendingSteps(jobID, err.Error())
+			w.PublishSteps(jobID)
+		}
+	}()
+
 	// Check if job was cancelled before we start
 	var job models.Job
-	err := w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID)
+	err = w.DB.Get(&job, "SELECT * FROM jobs WHERE id = ?", jobID)
 	if err != nil {
 		return err
 	}
@@ -392,11 +567,26 @@ func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
 		return nil
 	}
 
+	// Enforce the job-level timeout on everything the job does from here on
+	var jobTimeout time.Duration
+	if job.Timeout != nil {
+		jobTimeout, err = models.ParseDuration(*job.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid job timeout: %v", err)
+		}
+	}
+	if jobTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		jobCtx, cancelTimeout = context.WithTimeout(jobCtx, jobTimeout)
+		defer cancelTimeout()
+	}
+
 	// Update status to running
 	_, err = w.DB.Exec("UPDATE jobs SET status = 'running', started_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
 	if err != nil {
 		return err
 	}
+	w.PublishJob(jobID)
 
 	// Handle repository cloning and language detection
 	var projectPath string
@@ -410,7 +600,7 @@ func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
 	// If repo URL is provided, clone the repository
 	if job.RepoURL != nil && *job.RepoURL != "" {
 		// Create temporary directory for cloning
-		tempDir = filepath.Join(os.TempDir(), fmt.Sprintf("rapidflow-repo-%d", jobID))
+		tempDir = repoTempDir(jobID)
 		err = os.MkdirAll(tempDir, 0755)
 		if err != nil {
 			return fmt.Errorf("failed to create temp directory: %v", err)
@@ -448,6 +638,12 @@ func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
 		return fmt.Errorf("either repo_url or folder must be specified")
 	}
 
+	// Record the commit being built, registry tags can refer to it
+	if commit, err := headCommit(projectPath); err == nil {
+		w.DB.Exec("UPDATE jobs SET commit_sha = ? WHERE id = ?", commit, jobID)
+		job.CommitSHA = &commit
+	}
+
 	// Auto-detect language and version if not specified
 	var detectedLanguage, detectedVersion string
 	if job.Language == nil || *job.Language == "" || job.Version == nil || *job.Version == "" {
@@ -487,240 +683,113 @@ func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
 	if err != nil {
 		return err
 	}
-	var envVars []string
-	for _, env := range envs {
-		envVars = append(envVars, fmt.Sprintf("%s=%s", env.Key, env.Value))
+	// Variables are expanded here, only the job's containers and providers
+	// see the values of secrets and they are masked in everything stored
+	secretValues, err := w.jobSecrets(job)
+	if err != nil {
+		return err
+	}
+	var pipelineName string
+	if err := w.DB.Get(&pipelineName, "SELECT name FROM pipelines WHERE id = ?", job.PipelineID); err != nil {
+		return err
 	}
-	// Add branch if set
-	if job.Branch != nil {
-		envVars = append(envVars, fmt.Sprintf("BRANCH=%s", *job.Branch))
+	scope := jobScope(job, pipelineName, secretValues)
+	envVars, err := expandEnv(envs, scope)
+	if err != nil {
+		return err
 	}
 
 	// Check for cancellation
-	select {
-	case <-jobCtx.Done():
-		w.DB.Exec("UPDATE jobs SET status = 'cancelled', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
-		return fmt.Errorf("job %d was cancelled", jobID)
-	default:
+	if jobCtx.Err() != nil {
+		return w.markJobStopped(jobCtx, jobID, jobTimeout)
 	}
 
+	executor, err := w.newExecutor(job)
+	if err != nil {
+		return err
+	}
+	// Note: For temporary jobs, cleanup will be handled by stop-pipeline command
+	// This allows users to access the server before manually stopping it
+	if isTemporary {
+		log.Printf("Job %d marked as temporary - resources will remain until pipeline is stopped", jobID)
+	} else {
+		// Only auto-cleanup non-temporary jobs
+		defer executor.Teardown(context.Background())
+	}
+
+	spec := executorSpec{
+		Job:         job,
+		ProjectPath: projectPath,
+		Env:         envVars,
+	}
 	// Setup ports
-	exposedPorts := nat.PortSet{}
-	portBindings := nat.PortMap{}
 	if job.ExposePorts != nil && *job.ExposePorts {
 		for _, env := range envs {
 			if env.Key == "PORT" {
-				port := nat.Port(env.Value + "/tcp")
-				exposedPorts[port] = struct{}{}
-				portBindings[port] = []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: env.Value}}
+				spec.Ports = append(spec.Ports, env.Value)
 			}
 		}
 	}
-	// Setup base image
-	versionStr := ""
-	if job.Version != nil {
-		versionStr = *job.Version
-	}
-	baseImage := getBaseImage(*job.Language, versionStr)
-	fallback := false
-	// Pull image
-	log.Printf("Pulling image %s", baseImage)
-	out, err := w.Docker.ImagePull(jobCtx, baseImage, types.ImagePullOptions{})
-	if err != nil {
-		log.Printf("Failed to pull image %s: %v, falling back to ubuntu", baseImage, err)
-		fallback = true
-		baseImage = "ubuntu:latest"
-		out, err = w.Docker.ImagePull(jobCtx, baseImage, types.ImagePullOptions{})
+
+	// Apply resource limits and record the effective values on the job. The
+	// local executor has no container to limit.
+	var resources models.ResourceConfig
+	if executor.GetType() != models.ExecutorLocal {
+		requested, err := parseResources(job.Resources)
 		if err != nil {
 			return err
 		}
-		defer out.Close()
-		_, err = io.Copy(io.Discard, out)
+		resources, err = w.effectiveResources(requested)
 		if err != nil {
 			return err
 		}
-	} else {
-		defer out.Close()
-		_, err = io.Copy(io.Discard, out)
+		resourcesJSON, err := json.Marshal(resources)
 		if err != nil {
 			return err
 		}
-	}
-	log.Printf("Image pulled successfully")
-
-	// Check for cancellation again
-	select {
-	case <-jobCtx.Done():
-		w.DB.Exec("UPDATE jobs SET status = 'cancelled', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
-		return fmt.Errorf("job %d was cancelled", jobID)
-	default:
-	}
-
-	hostConfig := &container.HostConfig{
-		PortBindings: portBindings,
-	}
-
-	// Use the determined project path for volume binding
-	if projectPath != "" {
-		absPath, err := filepath.Abs(projectPath)
+		_, err = w.DB.Exec("UPDATE jobs SET resources = ? WHERE id = ?", string(resourcesJSON), jobID)
 		if err != nil {
-			return err
+			log.Printf("Warning: failed to store effective resources: %v", err)
 		}
-		hostConfig.Binds = []string{fmt.Sprintf("%s:/workspace", absPath)}
 	}
+	spec.Resources = resources
 
-	resp, err := w.Docker.ContainerCreate(jobCtx, &container.Config{
-		Image:        baseImage,
-		Env:          envVars,
-		Cmd:          []string{"sleep", "infinity"},
-		Tty:          true,
-		ExposedPorts: exposedPorts,
-	}, hostConfig, nil, nil, "")
+	services, err := parseServices(job.Services)
 	if err != nil {
 		return err
 	}
-	containerID := resp.ID
-
-	// Store container ID in database for potential cleanup
-	_, err = w.DB.Exec("UPDATE jobs SET container_id = ? WHERE id = ?", containerID, jobID)
-	if err != nil {
+	if err := expandServices(services, scope); err != nil {
 		return err
 	}
-
-	// Note: For temporary jobs, cleanup will be handled by stop-pipeline command
-	// This allows users to access the server before manually stopping it
-	if isTemporary {
-		log.Printf("Job %d marked as temporary - resources will remain until pipeline is stopped", jobID)
-	} else {
-		// Only auto-cleanup non-temporary jobs
-		defer w.Docker.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true})
+	for i, service := range services {
+		serviceResources, err := w.effectiveResources(service.Resources)
+		if err != nil {
+			return fmt.Errorf("service %s: %v", service.Name, err)
+		}
+		services[i].Resources = &serviceResources
 	}
+	spec.Services = services
 
-	// Start container
-	err = w.Docker.ContainerStart(jobCtx, containerID, types.ContainerStartOptions{})
+	err = executor.Prepare(jobCtx, spec)
+	if jobCtx.Err() != nil {
+		return w.markJobStopped(jobCtx, jobID, jobTimeout)
+	}
 	if err != nil {
 		return err
 	}
-	log.Printf("Container started: %s", containerID)
-	// Install language if fallback
-	if fallback {
-		scriptPath := fmt.Sprintf("scripts/%s-%s.sh", *job.Language, versionStr)
-		if _, err := os.Stat(scriptPath); err == nil {
-			log.Printf("Running install script %s", scriptPath)
-			scriptContent, err := os.ReadFile(scriptPath)
-			if err != nil {
-				return err
-			}
-			// Create script in container
-			execResp, err := w.Docker.ContainerExecCreate(jobCtx, containerID, types.ExecConfig{
-				Cmd:          []string{"sh", "-c", fmt.Sprintf("echo '%s' > /tmp/install.sh && chmod +x /tmp/install.sh", string(scriptContent))},
-				AttachStdout: true,
-				AttachStderr: true,
-			})
-			if err != nil {
-				return err
-			}
-			err = w.Docker.ContainerExecStart(jobCtx, execResp.ID, types.ExecStartCheck{})
-			if err != nil {
-				return err
-			}
-			inspect, err := w.Docker.ContainerExecInspect(jobCtx, execResp.ID)
-			if err != nil {
-				return err
-			}
-			if inspect.ExitCode != 0 {
-				return fmt.Errorf("failed to create install script")
-			}
-			// Run script
-			execResp, err = w.Docker.ContainerExecCreate(jobCtx, containerID, types.ExecConfig{
-				Cmd:          []string{"/tmp/install.sh"},
-				AttachStdout: true,
-				AttachStderr: true,
-			})
-			if err != nil {
-				return err
-			}
-			hijacked, err := w.Docker.ContainerExecAttach(jobCtx, execResp.ID, types.ExecStartCheck{})
-			if err != nil {
-				return err
-			}
-			defer hijacked.Close()
-			var output bytes.Buffer
-			scanner := bufio.NewScanner(hijacked.Reader)
-			for scanner.Scan() {
-				line := scanner.Text()
-				log.Println(line)
-				output.WriteString(line + "\n")
-
-				// Check for cancellation while reading output
-				select {
-				case <-jobCtx.Done():
-					w.DB.Exec("UPDATE jobs SET status = 'cancelled', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
-					return fmt.Errorf("job %d was cancelled", jobID)
-				default:
-				}
-			}
-			if err := scanner.Err(); err != nil {
-				return err
-			}
-			inspect, err = w.Docker.ContainerExecInspect(jobCtx, execResp.ID)
-			if err != nil {
-				return err
-			}
-			if inspect.ExitCode != 0 {
-				return fmt.Errorf("install script failed")
-			}
-		} else {
-			log.Printf("No install script found for %s-%s", *job.Language, versionStr)
-		}
-	}
-	if job.RepoName != nil {
-		// Clone repo
-		log.Printf("Cloning repo %s", *job.RepoName)
-		execResp, err := w.Docker.ContainerExecCreate(jobCtx, containerID, types.ExecConfig{
-			Cmd:          []string{"sh", "-c", fmt.Sprintf("git clone %s /workspace", *job.RepoName)},
-			AttachStdout: true,
-			AttachStderr: true,
-		})
-		if err != nil {
-			return err
-		}
-		err = w.Docker.ContainerExecStart(jobCtx, execResp.ID, types.ExecStartCheck{})
+
+	// Store container ID in database for potential cleanup
+	if docker, ok := executor.(*dockerExecutor); ok {
+		_, err = w.DB.Exec("UPDATE jobs SET container_id = ? WHERE id = ?", docker.containerID, jobID)
 		if err != nil {
 			return err
 		}
-		inspect, err := w.Docker.ContainerExecInspect(jobCtx, execResp.ID)
-		if err != nil {
+	}
+
+	if job.RepoName != nil {
+		if err := checkoutRepoName(jobCtx, executor, job); err != nil {
 			return err
 		}
-		if inspect.ExitCode != 0 {
-			return fmt.Errorf("failed to clone repo")
-		}
-		log.Printf("Repo cloned")
-		// Checkout branch if specified
-		if job.Branch != nil && *job.Branch != "" {
-			log.Printf("Checking out branch %s", *job.Branch)
-			execResp, err := w.Docker.ContainerExecCreate(jobCtx, containerID, types.ExecConfig{
-				Cmd:          []string{"sh", "-c", fmt.Sprintf("cd /workspace && git checkout %s", *job.Branch)},
-				AttachStdout: true,
-				AttachStderr: true,
-			})
-			if err != nil {
-				return err
-			}
-			err = w.Docker.ContainerExecStart(jobCtx, execResp.ID, types.ExecStartCheck{})
-			if err != nil {
-				return err
-			}
-			inspect, err := w.Docker.ContainerExecInspect(jobCtx, execResp.ID)
-			if err != nil {
-				return err
-			}
-			if inspect.ExitCode != 0 {
-				return fmt.Errorf("failed to checkout branch")
-			}
-			log.Printf("Branch checked out")
-		}
 	} else {
 		log.Printf("Using local folder")
 	}
@@ -733,118 +802,54 @@ func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
 		return err
 	}
 	log.Printf("Running %d steps", len(steps))
-	for _, step := range steps {
-		// Check for cancellation before each step
-		select {
-		case <-jobCtx.Done():
-			w.DB.Exec("UPDATE jobs SET status = 'cancelled', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
-			w.DB.Exec("UPDATE steps SET status = 'cancelled' WHERE job_id = ? AND status IN ('pending', 'running')", jobID)
-			return fmt.Errorf("job %d was cancelled", jobID)
-		default:
-		}
-
-		log.Printf("Running step %d", step.ID)
-		// Update step status
-		_, err = w.DB.Exec("UPDATE steps SET status = 'running' WHERE id = ?", step.ID)
-		if err != nil {
-			log.Printf("Error updating step status: %v", err)
-		}
-		// Get files for step
-		var files []models.File
-		err = w.DB.Select(&files, "SELECT * FROM files WHERE step_id = ?", step.ID)
-		if err != nil {
-			return err
-		}
-		// Create files
-		for _, f := range files {
-			content := f.Content
-			// Exec to create file
-			execResp, err := w.Docker.ContainerExecCreate(jobCtx, containerID, types.ExecConfig{
-				Cmd:          []string{"sh", "-c", fmt.Sprintf("echo '%s' > %s", content, f.Name)},
-				AttachStdout: true,
-				AttachStderr: true,
-			})
-			if err != nil {
-				return err
-			}
-			err = w.Docker.ContainerExecStart(jobCtx, execResp.ID, types.ExecStartCheck{})
-			if err != nil {
-				return err
-			}
-			// Wait for exec
-			inspect, err := w.Docker.ContainerExecInspect(jobCtx, execResp.ID)
-			if err != nil {
-				return err
-			}
-			if inspect.ExitCode != 0 {
-				output := "Failed to create file"
-				w.DB.Exec("UPDATE steps SET status = 'failed', output = ? WHERE id = ?", output, step.ID)
-				continue
-			}
-		}
-		// Run the step content as bash
-		if step.Type == "bash" {
-			execResp, err := w.Docker.ContainerExecCreate(jobCtx, containerID, types.ExecConfig{
-				Cmd:          []string{"sh", "-c", step.Content},
-				AttachStdout: true,
-				AttachStderr: true,
-			})
-			if err != nil {
-				return err
-			}
-			hijacked, err := w.Docker.ContainerExecAttach(jobCtx, execResp.ID, types.ExecStartCheck{})
-			if err != nil {
-				return err
-			}
-			defer hijacked.Close()
-			var output bytes.Buffer
-			scanner := bufio.NewScanner(hijacked.Reader)
-			for scanner.Scan() {
-				line := scanner.Text()
-				log.Println(line)
-				output.WriteString(line + "\n")
-
-				// Check for cancellation while reading step output
-				select {
-				case <-jobCtx.Done():
-					w.DB.Exec("UPDATE jobs SET status = 'cancelled', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
-					w.DB.Exec("UPDATE steps SET status = 'cancelled' WHERE job_id = ? AND status IN ('pending', 'running')", jobID)
-					return fmt.Errorf("job %d was cancelled", jobID)
-				default:
-				}
-			}
-			if err := scanner.Err(); err != nil {
-				return err
-			}
-			// Wait for exec
-			inspect, err := w.Docker.ContainerExecInspect(jobCtx, execResp.ID)
-			if err != nil {
-				return err
-			}
-			status := "success"
-			if inspect.ExitCode != 0 {
-				status = "failed"
-			}
-			_, err = w.DB.Exec("UPDATE steps SET status = ?, output = ? WHERE id = ?", status, output.String(), step.ID)
-			if err != nil {
-				log.Printf("Error updating step: %v", err)
-			}
-
-			// If step failed, mark job as failed and stop
-			if status == "failed" {
-				w.DB.Exec("UPDATE jobs SET status = 'failed', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
-				return fmt.Errorf("step %d failed", step.ID)
-			}
+	env := make(map[string]string, len(envs))
+	for _, e := range envs {
+		env[e.Key] = e.Value
+	}
+	run := jobRun{
+		Job:       job,
+		Executor:  executor,
+		Resources: resources,
+		Env:       env,
+		Vars:      scope,
+		Masker:    secrets.NewMasker(secretValues),
+	}
+	caches, err := parseCaches(job.Cache)
+	if err != nil {
+		return err
+	}
+	jobCaches := w.restoreCaches(jobCtx, run, nil, caches)
+	err = w.runSteps(jobCtx, run, steps, w.maxParallelSteps(job))
+	// Network policies only apply to steps, temporary jobs keep serving
+	// through the job network afterwards
+	if docker, ok := executor.(*dockerExecutor); ok {
+		if err := docker.setNetworkPolicy(context.Background(), models.NetworkDefault); err != nil {
+			log.Printf("Warning: failed to restore the network of job %d: %v", jobID, err)
 		}
 	}
+	if jobCtx.Err() != nil {
+		return w.markJobStopped(jobCtx, jobID, jobTimeout)
+	}
+	var failure *stepFailure
+	if errors.As(err, &failure) {
+		// If a step failed, mark the job as failed and stop
+		w.DB.Exec("UPDATE jobs SET status = 'failed', status_reason = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?", failure.Reason, jobID)
+		w.PublishJob(jobID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	w.saveCaches(jobCtx, run, jobCaches)
 	// Update job status to success
 	_, err = w.DB.Exec("UPDATE jobs SET status = 'success', finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobID)
 	if err != nil {
 		return err
 	}
+	w.PublishJob(jobID)
 
 	// Process runnables after successful build
-	err = w.processRunnables(jobCtx, jobID, containerID, job)
+	err = w.processRunnables(jobCtx, run)
 	if err != nil {
 		log.Printf("Error processing runnables for job %d: %v", jobID, err)
 		// Don't fail the job if runnables fail, just log the error
@@ -854,7 +859,8 @@ func (w *Worker) RunJobWithContext(ctx context.Context, jobID int) error {
 }
 
 // processRunnables handles the deployment/packaging phase after successful build
-func (w *Worker) processRunnables(ctx context.Context, jobID int, containerID string, job models.Job) error {
+func (w *Worker) processRunnables(ctx context.Context, run jobRun) error {
+	jobID := run.Job.ID
 	// Get runnables for this job
 	var runnables []models.Runnable
 	err := w.DB.Select(&runnables, "SELECT * FROM runnables WHERE job_id = ? AND status = 'pending'", jobID)
@@ -878,20 +884,24 @@ func (w *Worker) processRunnables(ctx context.Context, jobID int, containerID st
 
 	// Process each runnable
 	for _, runnable := range runnables {
-		err = w.processRunnable(ctx, runnable, containerID, tempDir, job)
+		err = w.processRunnable(ctx, runnable, run, tempDir)
 		if err != nil {
-			log.Printf("Failed to process runnable %s: %v", runnable.Name, err)
-			w.DB.Exec("UPDATE runnables SET status = 'failed', output = ? WHERE id = ?", err.Error(), runnable.ID)
+			message := run.Masker.Mask(err.Error())
+			log.Printf("Failed to process runnable %s: %s", runnable.Name, message)
+			// Keep the build log the runnable wrote before it failed
+			w.DB.Exec("UPDATE runnables SET status = 'failed', output = COALESCE(output || char(10), '') || ? WHERE id = ?", message, runnable.ID)
 			continue
 		}
 	}
 
+	w.PruneArtifacts()
 	return nil
 }
 
 // processRunnable processes a single runnable
-func (w *Worker) processRunnable(ctx context.Context, runnable models.Runnable, containerID, tempDir string, job models.Job) error {
+func (w *Worker) processRunnable(ctx context.Context, runnable models.Runnable, run jobRun, tempDir string) error {
 	log.Printf("Processing runnable: %s (type: %s)", runnable.Name, runnable.Type)
+	job := run.Job
 
 	// Update runnable status to running
 	_, err := w.DB.Exec("UPDATE runnables SET status = 'running' WHERE id = ?", runnable.ID)
@@ -901,21 +911,33 @@ func (w *Worker) processRunnable(ctx context.Context, runnable models.Runnable,
 
 	var artifactPath string
 
-	// Parse runnable config
+	// Parse runnable config, with the variables it refers to expanded
+	expandedConfig, err := run.Vars.ExpandJSON(runnable.Config)
+	if err != nil {
+		return fmt.Errorf("runnable config: %v", err)
+	}
+	runnable.Config = expandedConfig
 	var config models.RunnableConfig
 	if err := json.Unmarshal([]byte(runnable.Config), &config); err != nil {
 		return fmt.Errorf("failed to parse runnable config: %v", err)
 	}
 
 	switch runnable.Type {
-	case "docker_container":
-		artifactPath, err = w.handleDockerContainer(ctx, runnable, config, containerID, tempDir, job)
-	case "docker_image":
-		artifactPath, err = w.handleDockerImage(ctx, runnable, config, containerID, tempDir)
+	case "docker_container", "docker_image":
+		// Images are built from the build container on the worker's daemon
+		if run.Executor.GetType() != models.ExecutorDocker {
+			return fmt.Errorf("%s runnables need the %s executor", runnable.Type, models.ExecutorDocker)
+		}
+		containerID := run.Executor.(*dockerExecutor).containerID
+		if runnable.Type == "docker_container" {
+			artifactPath, err = w.handleDockerContainer(ctx, runnable, config, containerID, tempDir, job, run.Masker)
+		} else {
+			artifactPath, err = w.handleDockerImage(ctx, runnable, config, containerID, tempDir, run.Masker)
+		}
 	case "artifacts":
-		artifactPath, err = w.handleArtifacts(ctx, runnable, config, containerID, tempDir)
+		artifactPath, err = w.handleArtifacts(ctx, runnable, config, run.Executor, tempDir)
 	case "serverless":
-		artifactPath, err = w.handleServerless(ctx, runnable, config, containerID, tempDir)
+		artifactPath, err = w.handleServerless(ctx, runnable, config, run.Executor, tempDir)
 	default:
 		return fmt.Errorf("unsupported runnable type: %s", runnable.Type)
 	}
@@ -924,15 +946,33 @@ func (w *Worker) processRunnable(ctx context.Context, runnable models.Runnable,
 		return err
 	}
 
-	// Update runnable with artifact path
+	// Keep built files in the artifact store, the temp directory is removed
+	// once the deployments are done
+	url := artifactPath
+	if info, err := os.Stat(artifactPath); err == nil && info.Mode().IsRegular() {
+		artifact, err := w.storeArtifact(ctx, job, runnable, artifactPath)
+		if err != nil {
+			return fmt.Errorf("failed to store artifact: %v", err)
+		}
+		url = artifactURL(artifact.ID)
+	}
+
+	// Update runnable with artifact URL
 	_, err = w.DB.Exec("UPDATE runnables SET artifact_url = ?, status = 'success' WHERE id = ?",
-		artifactPath, runnable.ID)
+		url, runnable.ID)
 	if err != nil {
 		return err
 	}
 
+	// Reload the runnable, deployments use what it recorded such as the image
+	// digest
+	if err := w.DB.Get(&runnable, "SELECT * FROM runnables WHERE id = ?", runnable.ID); err != nil {
+		return err
+	}
+	runnable.Config = expandedConfig
+
 	// Process deployments for this runnable
-	err = w.processDeployments(ctx, runnable, artifactPath)
+	err = w.processDeployments(ctx, run, runnable, artifactPath)
 	if err != nil {
 		log.Printf("Failed to process deployments for runnable %s: %v", runnable.Name, err)
 		// Don't fail the runnable if deployments fail
@@ -942,7 +982,16 @@ func (w *Worker) processRunnable(ctx context.Context, runnable models.Runnable,
 }
 
 // handleDockerContainer creates and runs a Docker container
-func (w *Worker) handleDockerContainer(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, sourceContainerID, tempDir string, job models.Job) (string, error) {
+func (w *Worker) handleDockerContainer(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, sourceContainerID, tempDir string, job models.Job, masker *secrets.Masker) (string, error) {
+	if config.Dockerfile != "" {
+		imageName := runnableImageName(runnable, config)
+		imageID, err := w.buildRunnableImage(ctx, runnable, config, sourceContainerID, imageName, masker)
+		if err != nil {
+			return "", err
+		}
+		return w.startRunnableContainer(ctx, runnable, config, job, imageID, config.WorkingDir, config.Entrypoint)
+	}
+
 	// Get working directory from config (defaults to /workspace)
 	workingDir := config.WorkingDir
 	if workingDir == "" {
@@ -986,29 +1035,6 @@ func (w *Worker) handleDockerContainer(ctx context.Context, runnable models.Runn
 	// Now update the working directory to /app and entrypoint accordingly
 	actualWorkingDir := "/app"
 
-	// Handle default port exposure if expose_ports is true and no ports specified
-	if len(config.Ports) == 0 && job.ExposePorts != nil && *job.ExposePorts {
-		// Get environment variables to find PORT setting
-		var envs []models.Environment
-		err := w.DB.Select(&envs, "SELECT * FROM environments WHERE job_id = ?", job.ID)
-		if err == nil {
-			for _, env := range envs {
-				if env.Key == "PORT" {
-					// Use the PORT environment variable as default
-					config.Ports = []string{env.Value}
-					log.Printf("Using default port from environment: %s", env.Value)
-					break
-				}
-			}
-		}
-
-		// If still no port found, use common defaults
-		if len(config.Ports) == 0 {
-			config.Ports = []string{"3000"} // Default fallback port
-			log.Printf("Using fallback default port: 3000")
-		}
-	}
-
 	// Get entrypoint from config and adjust path if it references /workspace
 	var actualEntrypoint []string
 	if len(config.Entrypoint) > 0 {
@@ -1093,10 +1119,7 @@ func (w *Worker) handleDockerContainer(ctx context.Context, runnable models.Runn
 	}
 
 	// Determine image name
-	imageName := config.ImageName
-	if imageName == "" {
-		imageName = fmt.Sprintf("rapidflow-job-%d-%s", runnable.JobID, runnable.Name)
-	}
+	imageName := runnableImageName(runnable, config)
 
 	// Create image from current container state
 	commitResp, err := w.Docker.ContainerCommit(ctx, sourceContainerID, types.ContainerCommitOptions{
@@ -1108,6 +1131,36 @@ func (w *Worker) handleDockerContainer(ctx context.Context, runnable models.Runn
 
 	imageID := commitResp.ID
 	log.Printf("Created Docker image: %s with name: %s", imageID, imageName)
+	w.DB.Exec("UPDATE runnables SET image_digest = ? WHERE id = ?", imageID, runnable.ID)
+
+	return w.startRunnableContainer(ctx, runnable, config, job, imageID, actualWorkingDir, actualEntrypoint)
+}
+
+// startRunnableContainer runs the image of a docker_container runnable with
+// its ports, environment and resources
+func (w *Worker) startRunnableContainer(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, job models.Job, imageID, workingDir string, entrypoint []string) (string, error) {
+	// Handle default port exposure if expose_ports is true and no ports specified
+	if len(config.Ports) == 0 && job.ExposePorts != nil && *job.ExposePorts {
+		// Get environment variables to find PORT setting
+		var envs []models.Environment
+		err := w.DB.Select(&envs, "SELECT * FROM environments WHERE job_id = ?", job.ID)
+		if err == nil {
+			for _, env := range envs {
+				if env.Key == "PORT" {
+					// Use the PORT environment variable as default
+					config.Ports = []string{env.Value}
+					log.Printf("Using default port from environment: %s", env.Value)
+					break
+				}
+			}
+		}
+
+		// If still no port found, use common defaults
+		if len(config.Ports) == 0 {
+			config.Ports = []string{"3000"} // Default fallback port
+			log.Printf("Using fallback default port: 3000")
+		}
+	}
 
 	// Create and start new container from committed image
 	containerConfig := &container.Config{
@@ -1115,17 +1168,17 @@ func (w *Worker) handleDockerContainer(ctx context.Context, runnable models.Runn
 		Env:   make([]string, 0),
 	}
 
-	// Set working directory to /app (where we copied the artifacts)
-	containerConfig.WorkingDir = actualWorkingDir
+	// Without a working directory the image's own is used
+	containerConfig.WorkingDir = workingDir
 
 	// Add environment variables from config
 	for key, value := range config.Environment {
 		containerConfig.Env = append(containerConfig.Env, fmt.Sprintf("%s=%s", key, value))
 	}
 
-	// Set entrypoint from config (adjusted for /app directory)
-	if len(actualEntrypoint) > 0 {
-		containerConfig.Entrypoint = actualEntrypoint
+	// Set entrypoint from config
+	if len(entrypoint) > 0 {
+		containerConfig.Entrypoint = entrypoint
 	}
 
 	// Set exposed ports with Docker-style port mapping support
@@ -1158,16 +1211,25 @@ func (w *Worker) handleDockerContainer(ctx context.Context, runnable models.Runn
 	}
 
 	// Handle existing container with same name by removing it
-	err = w.handleExistingContainer(ctx, containerName)
+	err := w.handleExistingContainer(ctx, containerName)
 	if err != nil {
 		log.Printf("Warning: failed to handle existing container '%s': %v", containerName, err)
 		// Don't fail the deployment, just warn
 	}
 
-	newContainer, err := w.Docker.ContainerCreate(ctx, containerConfig, &container.HostConfig{
+	hostConfig := &container.HostConfig{
 		AutoRemove:   false, // Don't auto-remove so we can track it
 		PortBindings: portBindings,
-	}, nil, nil, containerName)
+	}
+	resources, err := w.effectiveResources(config.Resources)
+	if err != nil {
+		return "", err
+	}
+	if err := applyResources(hostConfig, resources); err != nil {
+		return "", err
+	}
+
+	newContainer, err := w.Docker.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, containerName)
 	if err != nil {
 		return "", fmt.Errorf("failed to create container: %v", err)
 	}
@@ -1245,26 +1307,33 @@ func (w *Worker) handleExistingContainer(ctx context.Context, containerName stri
 }
 
 // handleDockerImage exports Docker image as tar file
-func (w *Worker) handleDockerImage(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, sourceContainerID, tempDir string) (string, error) {
+func (w *Worker) handleDockerImage(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, sourceContainerID, tempDir string, masker *secrets.Masker) (string, error) {
 	// Determine image name
-	imageName := config.ImageName
-	if imageName == "" {
-		imageName = fmt.Sprintf("rapidflow-job-%d-%s", runnable.JobID, runnable.Name)
-	}
+	imageName := runnableImageName(runnable, config)
 
-	// Create image from current container state
-	commitResp, err := w.Docker.ContainerCommit(ctx, sourceContainerID, types.ContainerCommitOptions{
-		Reference: imageName,
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to commit container: %v", err)
+	var imageID string
+	if config.Dockerfile != "" {
+		var err error
+		imageID, err = w.buildRunnableImage(ctx, runnable, config, sourceContainerID, imageName, masker)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		// Create image from current container state
+		commitResp, err := w.Docker.ContainerCommit(ctx, sourceContainerID, types.ContainerCommitOptions{
+			Reference: imageName,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to commit container: %v", err)
+		}
+		imageID = commitResp.ID
+		w.DB.Exec("UPDATE runnables SET image_digest = ? WHERE id = ?", imageID, runnable.ID)
 	}
 
-	imageID := commitResp.ID
 	imagePath := filepath.Join(tempDir, fmt.Sprintf("%s-image.tar", runnable.Name))
 
 	// Save image to tar file
-	err = providers.SaveDockerImage(w.Docker, imageID, imagePath)
+	err := providers.SaveDockerImage(w.Docker, imageID, imagePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to save Docker image: %v", err)
 	}
@@ -1273,18 +1342,38 @@ func (w *Worker) handleDockerImage(ctx context.Context, runnable models.Runnable
 	return imagePath, nil
 }
 
-// handleArtifacts creates zip archive of workspace
-func (w *Worker) handleArtifacts(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, sourceContainerID, tempDir string) (string, error) {
-	// Copy workspace from container to local temp directory
+// handleArtifacts creates a zip archive of the files selected from the
+// artifacts source, /workspace by default
+func (w *Worker) handleArtifacts(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, executor Executor, tempDir string) (string, error) {
+	selection, err := config.Artifacts()
+	if err != nil {
+		return "", err
+	}
+	source := workspacePath(executor, selection.SourcePath())
+
+	// Copy the source from where the job ran to local temp directory
 	workspaceDir := filepath.Join(tempDir, "workspace")
-	err := w.copyFromContainer(ctx, sourceContainerID, "/workspace", workspaceDir)
+	err = copyFromExecutor(ctx, executor, source, workspaceDir)
 	if err != nil {
-		return "", fmt.Errorf("failed to copy workspace: %v", err)
+		return "", fmt.Errorf("failed to copy %s: %v", source, err)
+	}
+
+	// The copy is rooted at the source's name; a single file is zipped as is
+	sourceDir := filepath.Join(workspaceDir, path.Base(source))
+	if info, err := os.Lstat(sourceDir); err != nil || !info.IsDir() {
+		sourceDir = workspaceDir
+	}
+	removed, err := filterArtifacts(sourceDir, selection)
+	if err != nil {
+		return "", fmt.Errorf("failed to select artifacts: %v", err)
+	}
+	if removed > 0 {
+		log.Printf("Left %d files out of the artifacts", removed)
 	}
 
 	// Create zip archive
 	zipPath := filepath.Join(tempDir, fmt.Sprintf("%s-artifacts.zip", runnable.Name))
-	err = providers.CreateZipArchive(workspaceDir, zipPath)
+	err = providers.CreateZipArchive(sourceDir, zipPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to create zip archive: %v", err)
 	}
@@ -1294,14 +1383,14 @@ func (w *Worker) handleArtifacts(ctx context.Context, runnable models.Runnable,
 }
 
 // handleServerless packages for serverless deployment
-func (w *Worker) handleServerless(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, sourceContainerID, tempDir string) (string, error) {
+func (w *Worker) handleServerless(ctx context.Context, runnable models.Runnable, config models.RunnableConfig, executor Executor, tempDir string) (string, error) {
 	// For serverless, we typically want a zip of the built application
-	return w.handleArtifacts(ctx, runnable, config, sourceContainerID, tempDir)
+	return w.handleArtifacts(ctx, runnable, config, executor, tempDir)
 }
 
-// copyFromContainer copies files from container to local filesystem
-func (w *Worker) copyFromContainer(ctx context.Context, containerID, srcPath, dstPath string) error {
-	reader, _, err := w.Docker.CopyFromContainer(ctx, containerID, srcPath)
+// copyFromExecutor copies files from where a job ran to local filesystem
+func copyFromExecutor(ctx context.Context, executor Executor, srcPath, dstPath string) error {
+	reader, err := executor.CopyFrom(ctx, srcPath)
 	if err != nil {
 		return err
 	}
@@ -1311,36 +1400,8 @@ func (w *Worker) copyFromContainer(ctx context.Context, containerID, srcPath, ds
 	return extractTar(reader, dstPath)
 }
 
-// extractTar extracts tar archive to destination directory
-func extractTar(src io.Reader, dst string) error {
-	// Create destination directory
-	if err := os.MkdirAll(dst, 0755); err != nil {
-		return err
-	}
-
-	// For simplicity, we'll use a basic approach
-	// In production, you'd want proper tar extraction
-	tempFile := filepath.Join(dst, "temp.tar")
-	outFile, err := os.Create(tempFile)
-	if err != nil {
-		return err
-	}
-
-	_, err = io.Copy(outFile, src)
-	outFile.Close()
-
-	if err != nil {
-		return err
-	}
-
-	// Remove temp file
-	defer os.Remove(tempFile)
-
-	return nil
-}
-
 // processDeployments handles all deployments for a runnable
-func (w *Worker) processDeployments(ctx context.Context, runnable models.Runnable, artifactPath string) error {
+func (w *Worker) processDeployments(ctx context.Context, run jobRun, runnable models.Runnable, artifactPath string) error {
 	// Get deployments for this runnable
 	var deployments []models.Deployment
 	err := w.DB.Select(&deployments, "SELECT * FROM deployments WHERE runnable_id = ? AND status = 'pending'", runnable.ID)
@@ -1351,73 +1412,55 @@ func (w *Worker) processDeployments(ctx context.Context, runnable models.Runnabl
 	log.Printf("Processing %d deployments for runnable %s", len(deployments), runnable.Name)
 
 	for _, deployment := range deployments {
-		err = w.processDeployment(ctx, runnable, deployment, artifactPath)
+		url, err := w.processDeployment(ctx, run, runnable, deployment, artifactPath)
 		if err != nil {
-			log.Printf("Failed to process deployment %d: %v", deployment.ID, err)
+			message := run.Masker.Mask(err.Error())
+			log.Printf("Failed to process deployment %d: %s", deployment.ID, message)
 			w.DB.Exec("UPDATE deployments SET status = 'failed', output = ? WHERE id = ?",
-				err.Error(), deployment.ID)
+				message, deployment.ID)
+			w.PublishDeployment(run.Job.ID, deployment.ID)
 			continue
 		}
 
-		w.DB.Exec("UPDATE deployments SET status = 'success' WHERE id = ?", deployment.ID)
+		if url != "" {
+			w.DB.Exec("UPDATE deployments SET status = 'success', url = ? WHERE id = ?", url, deployment.ID)
+		} else {
+			w.DB.Exec("UPDATE deployments SET status = 'success' WHERE id = ?", deployment.ID)
+		}
+		w.PublishDeployment(run.Job.ID, deployment.ID)
 	}
 
 	return nil
 }
 
 // processDeployment handles a single deployment
-func (w *Worker) processDeployment(ctx context.Context, runnable models.Runnable, deployment models.Deployment, artifactPath string) error {
+func (w *Worker) processDeployment(ctx context.Context, run jobRun, runnable models.Runnable, deployment models.Deployment, artifactPath string) (string, error) {
 	log.Printf("Processing deployment: %s", deployment.OutputType)
 
+	// Providers get the config with the variables it refers to expanded,
+	// deployments.config keeps the references
+	config, err := run.Vars.ExpandJSON(deployment.Config)
+	if err != nil {
+		return "", err
+	}
+	deployment.Config = config
+
 	// Get provider
 	provider, err := w.providerManager.GetProvider(deployment.OutputType)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	// Providers that know where they published return it
+	if deployer, ok := provider.(providers.JobDeployer); ok {
+		return deployer.DeployJob(ctx, run.Job, runnable, deployment, artifactPath)
 	}
 
 	// Deploy
 	err = provider.Deploy(ctx, runnable, deployment, artifactPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
-}
-
-func (w *Worker) StartQueue() {
-	go func() {
-		for {
-			// Check for cancelled jobs and clean them up
-			var cancelledJobs []models.Job
-			err := w.DB.Select(&cancelledJobs, "SELECT * FROM jobs WHERE status = 'running' AND cancelled = 1")
-			if err == nil {
-				for _, job := range cancelledJobs {
-					w.CancelJob(job.ID)
-				}
-			}
-
-			var jobs []models.Job
-			err = w.DB.Select(&jobs, "SELECT id FROM jobs WHERE status = 'pending' ORDER BY created_at ASC LIMIT 1")
-			if err != nil {
-				log.Printf("Error selecting jobs: %v", err)
-				time.Sleep(2 * time.Second) // Wait before retrying
-				continue
-			}
-			if len(jobs) == 0 {
-				time.Sleep(1 * time.Second) // Wait before checking again
-				continue
-			}
-
-			jobID := jobs[0].ID
-
-			// Run job asynchronously (non-blocking)
-			go func(id int) {
-				err := w.RunJob(id)
-				if err != nil {
-					log.Printf("Error running job %d: %v", id, err)
-					w.DB.Exec("UPDATE jobs SET status = 'failed', finished_at = CURRENT_TIMESTAMP WHERE id = ?", id)
-				}
-			}(jobID)
-		}
-	}()
+	return "", nil
 }
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"docker-app/internal/api"
 	"docker-app/internal/models"
+	"docker-app/internal/secrets"
 	"docker-app/internal/worker"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/docker/go-units"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/jmoiron/sqlx"
@@ -27,8 +33,169 @@ func main() {
 			{
 				Name:  "server",
 				Usage: "Start the HTTP server",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:    "workers",
+						Aliases: []string{"w"},
+						Usage:   "Maximum number of jobs to run concurrently",
+						Value:   worker.DefaultConfig().PoolSize,
+					},
+					&cli.IntFlag{
+						Name:  "max-parallel-steps",
+						Usage: "Maximum number of steps of one job to run concurrently",
+						Value: worker.DefaultConfig().MaxParallelSteps,
+					},
+					&cli.DurationFlag{
+						Name:  "shutdown-timeout",
+						Usage: "How long to wait for running jobs on SIGTERM before interrupting them",
+						Value: 5 * time.Minute,
+					},
+					&cli.Float64Flag{
+						Name:  "default-cpus",
+						Usage: "CPU limit for containers that don't set resources.cpus",
+					},
+					&cli.StringFlag{
+						Name:  "default-memory",
+						Usage: "Memory limit (e.g. 2g) for containers that don't set resources.memory",
+					},
+					&cli.StringFlag{
+						Name:  "default-memory-swap",
+						Usage: "Memory plus swap limit (e.g. 4g) for containers that don't set resources.memory_swap",
+					},
+					&cli.Int64Flag{
+						Name:  "default-pids-limit",
+						Usage: "Process limit for containers that don't set resources.pids_limit",
+					},
+					&cli.StringFlag{
+						Name:  "default-shm-size",
+						Usage: "Size of /dev/shm (e.g. 64m) for containers that don't set resources.shm_size",
+					},
+					&cli.StringFlag{
+						Name:  "default-disk",
+						Usage: "Writable layer size (e.g. 20g) for containers that don't set resources.disk",
+					},
+					&cli.StringSliceFlag{
+						Name:  "default-ulimit",
+						Usage: "Ulimit as name=soft:hard (e.g. nofile=1024:4096) for containers that don't set it",
+					},
+					&cli.Float64Flag{
+						Name:  "max-cpus",
+						Usage: "Maximum CPU limit a pipeline may request",
+					},
+					&cli.StringFlag{
+						Name:  "max-memory",
+						Usage: "Maximum memory limit a pipeline may request",
+					},
+					&cli.StringFlag{
+						Name:  "max-memory-swap",
+						Usage: "Maximum memory plus swap limit a pipeline may request",
+					},
+					&cli.Int64Flag{
+						Name:  "max-pids-limit",
+						Usage: "Maximum process limit a pipeline may request",
+					},
+					&cli.StringFlag{
+						Name:  "max-shm-size",
+						Usage: "Maximum size of /dev/shm a pipeline may request",
+					},
+					&cli.StringFlag{
+						Name:  "max-disk",
+						Usage: "Maximum writable layer size a pipeline may request",
+					},
+					&cli.StringSliceFlag{
+						Name:  "max-ulimit",
+						Usage: "Maximum ulimit as name=soft:hard a pipeline may request",
+					},
+					&cli.StringFlag{
+						Name:  "cache-dir",
+						Usage: "Directory where dependency caches are stored",
+						Value: worker.DefaultConfig().CacheDir,
+					},
+					&cli.StringFlag{
+						Name:  "artifact-dir",
+						Usage: "Directory where the local artifact store keeps artifacts",
+						Value: worker.DefaultConfig().ArtifactDir,
+					},
+					&cli.StringFlag{
+						Name:  "cache-size",
+						Usage: "Total size (e.g. 10g) of stored caches before the least recently used are evicted",
+						Value: "10g",
+					},
+					&cli.BoolFlag{
+						Name:  "allow-local-executor",
+						Usage: "Run jobs of pipelines with the local executor directly on this machine, without isolation",
+					},
+					&cli.StringFlag{
+						Name:    "agent-token",
+						Usage:   "Token agents register with; agents are disabled without one",
+						EnvVars: []string{"RAPIDFLOW_AGENT_TOKEN"},
+					},
+					&cli.BoolFlag{
+						Name:  "allow-private-subscriptions",
+						Usage: "Let event subscriptions point at loopback, link-local and private addresses",
+					},
+					&cli.BoolFlag{
+						Name:  "store-delivery-responses",
+						Usage: "Keep the start of the body of the responses to event deliveries in the delivery log",
+					},
+					&cli.StringSliceFlag{
+						Name:  "allowed-origins",
+						Usage: "Origins of web pages besides the server's own that may follow jobs over WebSockets, e.g. https://ci.example.com, or * for any",
+					},
+					&cli.StringSliceFlag{
+						Name:  "labels",
+						Usage: "Labels the worker pool offers to runs_on, e.g. amd64,docker",
+					},
+					&cli.StringFlag{
+						Name:    "secret-key",
+						Usage:   "Base64 master key secrets are encrypted with, instead of the key file",
+						EnvVars: []string{"RAPIDFLOW_SECRET_KEY"},
+					},
+					&cli.StringFlag{
+						Name:  "secret-key-file",
+						Usage: "File holding the master key, generated when it doesn't exist",
+						Value: defaultSecretKeyFile,
+					},
+					&cli.DurationFlag{
+						Name:  "agent-lease",
+						Usage: "How long a job leased to an agent is kept without a heartbeat before it is re-queued",
+						Value: worker.DefaultConfig().LeaseTimeout,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return startServer(c)
+				},
+			},
+			{
+				Name:  "agent",
+				Usage: "Run jobs leased from a server on this machine",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "server",
+						Aliases:  []string{"s"},
+						Usage:    "Address of the server, e.g. http://ci.internal:3000",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "token",
+						Usage:   "Agent token the server was started with",
+						EnvVars: []string{"RAPIDFLOW_AGENT_TOKEN"},
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Name of the agent (defaults to the hostname)",
+					},
+					&cli.BoolFlag{
+						Name:  "allow-local-executor",
+						Usage: "Run jobs of pipelines with the local executor directly on this machine, without isolation",
+					},
+					&cli.StringSliceFlag{
+						Name:  "labels",
+						Usage: "Labels the agent offers to runs_on, e.g. arm64,docker",
+					},
+				},
 				Action: func(c *cli.Context) error {
-					return startServer()
+					return runAgent(c)
 				},
 			},
 			{
@@ -41,9 +208,23 @@ func main() {
 						Usage:    "Path to pipeline YAML file",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:    "secret-key",
+						Usage:   "Base64 master key secrets are encrypted with, instead of the key file",
+						EnvVars: []string{"RAPIDFLOW_SECRET_KEY"},
+					},
+					&cli.StringFlag{
+						Name:  "secret-key-file",
+						Usage: "File holding the master key, generated when it doesn't exist",
+						Value: defaultSecretKeyFile,
+					},
 				},
 				Action: func(c *cli.Context) error {
-					return runPipeline(c.String("file"))
+					cipher, err := secretCipher(c)
+					if err != nil {
+						return err
+					}
+					return runPipeline(c.String("file"), cipher)
 				},
 			},
 			{
@@ -77,7 +258,7 @@ func main() {
 	}
 }
 
-func startServer() error {
+func startServer(c *cli.Context) error {
 	dir := "./testdata/data"
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		err = os.MkdirAll(dir, 0755)
@@ -99,33 +280,143 @@ func startServer() error {
 	}
 
 	// Start worker
-	w, err := worker.NewWorker(db)
+	config := worker.DefaultConfig()
+	config.PoolSize = c.Int("workers")
+	config.MaxParallelSteps = c.Int("max-parallel-steps")
+	defaultUlimits, err := parseUlimits(c.StringSlice("default-ulimit"))
+	if err != nil {
+		return fmt.Errorf("invalid default ulimit: %v", err)
+	}
+	maxUlimits, err := parseUlimits(c.StringSlice("max-ulimit"))
+	if err != nil {
+		return fmt.Errorf("invalid maximum ulimit: %v", err)
+	}
+	config.DefaultResources = models.ResourceConfig{
+		CPUs:       c.Float64("default-cpus"),
+		Memory:     c.String("default-memory"),
+		MemorySwap: c.String("default-memory-swap"),
+		PidsLimit:  c.Int64("default-pids-limit"),
+		ShmSize:    c.String("default-shm-size"),
+		Disk:       c.String("default-disk"),
+		Ulimits:    defaultUlimits,
+	}
+	config.MaxResources = models.ResourceConfig{
+		CPUs:       c.Float64("max-cpus"),
+		Memory:     c.String("max-memory"),
+		MemorySwap: c.String("max-memory-swap"),
+		PidsLimit:  c.Int64("max-pids-limit"),
+		ShmSize:    c.String("max-shm-size"),
+		Disk:       c.String("max-disk"),
+		Ulimits:    maxUlimits,
+	}
+	if config.MaxResources.MemorySwap == "-1" {
+		return fmt.Errorf("invalid maximum memory swap: it can't be unlimited")
+	}
+	config.CacheDir = c.String("cache-dir")
+	config.ArtifactDir = c.String("artifact-dir")
+	config.AllowLocalExecutor = c.Bool("allow-local-executor")
+	config.LeaseTimeout = c.Duration("agent-lease")
+	config.Labels = c.StringSlice("labels")
+	if err := models.ValidateLabels(config.Labels); err != nil {
+		return fmt.Errorf("invalid labels: %v", err)
+	}
+	config.AllowPrivateSubscriptions = c.Bool("allow-private-subscriptions")
+	config.StoreDeliveryResponses = c.Bool("store-delivery-responses")
+	config.Secrets, err = secretCipher(c)
+	if err != nil {
+		return err
+	}
+	config.CacheSize, err = units.RAMInBytes(c.String("cache-size"))
+	if err != nil {
+		return fmt.Errorf("invalid cache size: %v", err)
+	}
+	w, err := worker.NewWorkerWithConfig(db, config)
 	if err != nil {
 		return err
 	}
+
+	// Reconcile jobs left behind by a previous server process
+	err = w.RecoverJobs()
+	if err != nil {
+		log.Printf("Warning: job recovery failed: %v", err)
+	}
 	w.StartQueue()
 
 	// Setup API
 	handler := api.NewHandler(db, w)
+	handler.AgentToken = c.String("agent-token")
+	handler.Secrets = config.Secrets
+	handler.AllowedOrigins = c.StringSlice("allowed-origins")
+	handler.AllowPrivateSubscriptions = config.AllowPrivateSubscriptions
 	app := fiber.New()
 	app.Use(cors.New())
 	app.Post("/pipelines", handler.CreatePipeline)
 	app.Get("/pipelines", handler.GetPipelines)
 	app.Get("/pipelines/:id", handler.GetPipeline)
 	app.Get("/pipelines/:id/jobs", handler.GetPipelineJobs)
+	app.Get("/pipelines/:id/matrix-runs", handler.GetPipelineMatrixRuns)
+	app.Get("/matrix-runs/:id", handler.GetMatrixRun)
 	app.Get("/jobs", handler.GetJobs)
 	app.Post("/pipelines/:pipelineID/jobs", handler.CreateJob)
 	app.Get("/jobs/:id", handler.GetJob)
 	app.Get("/jobs/:id/details", handler.GetJobDetails)
 	app.Get("/jobs/:id/logs", handler.GetJobLogs)
 	app.Get("/jobs/:id/logs/stream", handler.StreamJobLogs)
+	app.Get("/jobs/:id/lines", handler.GetJobLines)
+	app.Get("/jobs/:id/events", handler.StreamJobEvents)
+	app.Get("/jobs/:id/ws", handler.JobEventsSocket)
 	app.Post("/jobs/:id/cancel", handler.CancelJob)
 	app.Post("/jobs/:id/retry", handler.RetryJob)
 	app.Get("/jobs/:id/steps", handler.GetJobSteps)
 	app.Get("/steps/:id", handler.GetStep)
 	app.Get("/steps/:id/logs", handler.GetStepLogs)
+	app.Get("/steps/:id/lines", handler.GetStepLines)
+	app.Get("/steps/:id/attempts", handler.GetStepAttempts)
+	app.Get("/jobs/:id/caches", handler.GetJobCaches)
+	app.Get("/pipelines/:id/caches", handler.GetPipelineCaches)
+	app.Delete("/caches/:id", handler.DeleteCache)
+	app.Get("/jobs/:id/artifacts", handler.GetJobArtifacts)
+	app.Get("/artifacts/:id/download", handler.DownloadArtifact)
+	app.Post("/registry-credentials", handler.CreateRegistryCredential)
+	app.Get("/registry-credentials", handler.GetRegistryCredentials)
+	app.Delete("/registry-credentials/:id", handler.DeleteRegistryCredential)
+	app.Post("/secrets", handler.CreateSecret)
+	app.Get("/secrets", handler.GetSecrets)
+	app.Put("/secrets/:id", handler.UpdateSecret)
+	app.Delete("/secrets/:id", handler.DeleteSecret)
+	app.Post("/subscriptions", handler.CreateSubscription)
+	app.Get("/subscriptions", handler.GetSubscriptions)
+	app.Get("/subscriptions/:id", handler.GetSubscription)
+	app.Put("/subscriptions/:id", handler.UpdateSubscription)
+	app.Delete("/subscriptions/:id", handler.DeleteSubscription)
+	app.Get("/subscriptions/:id/deliveries", handler.GetSubscriptionDeliveries)
+	app.Get("/deliveries/:id", handler.GetDelivery)
+	app.Post("/deliveries/:id/redeliver", handler.RedeliverDelivery)
+	app.Get("/events", handler.GetEvents)
+	app.Get("/workers/status", handler.GetWorkerStatus)
+	app.Get("/agents", handler.GetAgents)
+	app.Post("/agent/register", handler.RegisterAgent)
+	agent := app.Group("/agent", handler.AgentAuth)
+	agent.Post("/lease", handler.LeaseAgentJob)
+	agent.Post("/jobs/:id/heartbeat", handler.AgentHeartbeat)
+	agent.Post("/jobs/:id/steps/:step_id/output", handler.AgentStepOutput)
+	agent.Put("/jobs/:id/steps/:step_id", handler.AgentUpdateStep)
+	agent.Post("/jobs/:id/finish", handler.AgentFinishJob)
 	app.Get("/health", func(c *fiber.Ctx) error { return c.SendString("OK") })
 
+	// Drain running jobs before exiting on SIGINT/SIGTERM
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+
+		w.Shutdown(c.Duration("shutdown-timeout"))
+		if err := app.Shutdown(); err != nil {
+			log.Printf("Error shutting down HTTP server: %v", err)
+		}
+	}()
+
 	log.Println("Server starting on :3000")
 	return app.Listen(":3000")
 }
@@ -136,6 +427,7 @@ CREATE TABLE IF NOT EXISTS pipelines (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     name TEXT NOT NULL,
     config TEXT NOT NULL,
+    retention TEXT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -154,12 +446,37 @@ CREATE TABLE IF NOT EXISTS jobs (
     temp_dir TEXT,
     cancelled BOOLEAN DEFAULT 0,
     container_id TEXT,
+    restart_policy TEXT,
+    resources TEXT,
+    timeout TEXT,
+    max_parallel INTEGER,
+    trigger TEXT,
+    tag TEXT,
+    matrix_run_id INTEGER,
+    matrix_values TEXT,
+    services TEXT,
+    network TEXT,
+    cache TEXT,
+    commit_sha TEXT,
+    executor TEXT,
+    runs_on TEXT,
+    agent_id INTEGER,
+    lease_expires_at DATETIME,
+    restart_count INTEGER DEFAULT 0,
+    status_reason TEXT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     started_at DATETIME,
     finished_at DATETIME,
     FOREIGN KEY (pipeline_id) REFERENCES pipelines(id)
 );
 
+CREATE TABLE IF NOT EXISTS matrix_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pipeline_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (pipeline_id) REFERENCES pipelines(id)
+);
+
 CREATE TABLE IF NOT EXISTS steps (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     job_id INTEGER NOT NULL,
@@ -168,6 +485,12 @@ CREATE TABLE IF NOT EXISTS steps (
     content TEXT NOT NULL,
     status TEXT DEFAULT 'pending',
     output TEXT,
+    outputs TEXT,
+    status_reason TEXT,
+    config TEXT,
+    step_key TEXT,
+    depends_on TEXT,
+    attempts INTEGER DEFAULT 0,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (job_id) REFERENCES jobs(id)
 );
@@ -185,6 +508,38 @@ CREATE TABLE IF NOT EXISTS files (
     step_id INTEGER NOT NULL,
     name TEXT NOT NULL,
     content TEXT NOT NULL,
+    encoding TEXT NOT NULL DEFAULT '',
+    mode TEXT NOT NULL DEFAULT '',
+    owner TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY (step_id) REFERENCES steps(id)
+);
+
+CREATE TABLE IF NOT EXISTS log_lines (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id INTEGER NOT NULL,
+    step_id INTEGER NOT NULL,
+    attempt INTEGER NOT NULL DEFAULT 1,
+    seq INTEGER NOT NULL,
+    stream TEXT NOT NULL,
+    line TEXT NOT NULL,
+    timestamp DATETIME NOT NULL,
+    FOREIGN KEY (job_id) REFERENCES jobs(id),
+    FOREIGN KEY (step_id) REFERENCES steps(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS log_lines_step_seq ON log_lines (step_id, seq);
+CREATE INDEX IF NOT EXISTS log_lines_job ON log_lines (job_id, id);
+
+CREATE TABLE IF NOT EXISTS step_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    step_id INTEGER NOT NULL,
+    attempt INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'running',
+    exit_code INTEGER,
+    output TEXT,
+    status_reason TEXT,
+    started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    finished_at DATETIME,
     FOREIGN KEY (step_id) REFERENCES steps(id)
 );
 
@@ -197,6 +552,7 @@ CREATE TABLE IF NOT EXISTS runnables (
     status TEXT DEFAULT 'pending',
     output TEXT,
     artifact_url TEXT,
+    image_digest TEXT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (job_id) REFERENCES jobs(id)
 );
@@ -212,12 +568,226 @@ CREATE TABLE IF NOT EXISTS deployments (
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (runnable_id) REFERENCES runnables(id)
 );
+
+CREATE TABLE IF NOT EXISTS artifacts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id INTEGER NOT NULL,
+    runnable_id INTEGER NOT NULL,
+    pipeline_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    digest TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    store TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (job_id) REFERENCES jobs(id),
+    FOREIGN KEY (runnable_id) REFERENCES runnables(id)
+);
+
+CREATE TABLE IF NOT EXISTS caches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pipeline_id INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    paths TEXT NOT NULL,
+    size INTEGER DEFAULT 0,
+    hits INTEGER DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (pipeline_id, key),
+    FOREIGN KEY (pipeline_id) REFERENCES pipelines(id)
+);
+
+CREATE TABLE IF NOT EXISTS job_caches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id INTEGER NOT NULL,
+    step_id INTEGER,
+    key TEXT NOT NULL,
+    hit BOOLEAN DEFAULT 0,
+    saved BOOLEAN DEFAULT 0,
+    size INTEGER DEFAULT 0,
+    reason TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (job_id) REFERENCES jobs(id)
+);
+
+CREATE TABLE IF NOT EXISTS registry_credentials (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    registry TEXT NOT NULL UNIQUE,
+    username TEXT NOT NULL,
+    password TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS secrets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pipeline_id INTEGER,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (pipeline_id) REFERENCES pipelines(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS secrets_scope_name ON secrets (COALESCE(pipeline_id, 0), name);
+
+CREATE TABLE IF NOT EXISTS agents (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    labels TEXT,
+    last_seen_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    type TEXT NOT NULL,
+    pipeline_id INTEGER NOT NULL,
+    job_id INTEGER NOT NULL,
+    step_id INTEGER,
+    deployment_id INTEGER,
+    restart INTEGER NOT NULL DEFAULT 0,
+    data TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (job_id) REFERENCES jobs(id)
+);
+
+CREATE INDEX IF NOT EXISTS events_job ON events (job_id, id);
+
+CREATE TABLE IF NOT EXISTS event_subscriptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL,
+    pipeline_id INTEGER,
+    secret TEXT NOT NULL,
+    active BOOLEAN DEFAULT 1,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (pipeline_id) REFERENCES pipelines(id)
+);
+
+CREATE TABLE IF NOT EXISTS event_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    subscription_id INTEGER NOT NULL,
+    event_id INTEGER NOT NULL,
+    event_type TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER DEFAULT 0,
+    next_attempt_at DATETIME,
+    response_status INTEGER,
+    response_body TEXT,
+    error TEXT,
+    duration_ms INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_attempt_at DATETIME,
+    FOREIGN KEY (subscription_id) REFERENCES event_subscriptions(id),
+    FOREIGN KEY (event_id) REFERENCES events(id)
+);
+
+CREATE INDEX IF NOT EXISTS event_deliveries_due ON event_deliveries (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS event_deliveries_subscription ON event_deliveries (subscription_id, id);
 	`
 	_, err := db.Exec(schema)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return addMissingColumns(db)
+}
+
+// columnMigrations lists columns added after their table was first created,
+// so that databases created by older versions are upgraded in place
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"jobs", "restart_policy", "TEXT"},
+	{"jobs", "restart_count", "INTEGER DEFAULT 0"},
+	{"jobs", "status_reason", "TEXT"},
+	{"jobs", "resources", "TEXT"},
+	{"steps", "status_reason", "TEXT"},
+	{"jobs", "timeout", "TEXT"},
+	{"steps", "config", "TEXT"},
+	{"jobs", "max_parallel", "INTEGER"},
+	{"steps", "step_key", "TEXT"},
+	{"steps", "depends_on", "TEXT"},
+	{"jobs", "trigger", "TEXT"},
+	{"jobs", "tag", "TEXT"},
+	{"steps", "attempts", "INTEGER DEFAULT 0"},
+	{"jobs", "matrix_run_id", "INTEGER"},
+	{"jobs", "matrix_values", "TEXT"},
+	{"jobs", "services", "TEXT"},
+	{"jobs", "network", "TEXT"},
+	{"jobs", "cache", "TEXT"},
+	{"pipelines", "retention", "TEXT"},
+	{"runnables", "image_digest", "TEXT"},
+	{"jobs", "commit_sha", "TEXT"},
+	{"jobs", "executor", "TEXT"},
+	{"jobs", "agent_id", "INTEGER"},
+	{"jobs", "lease_expires_at", "DATETIME"},
+	{"jobs", "runs_on", "TEXT"},
+	{"agents", "labels", "TEXT"},
+	{"steps", "outputs", "TEXT"},
+	{"files", "encoding", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "mode", "TEXT NOT NULL DEFAULT ''"},
+	{"files", "owner", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// addMissingColumns applies columnMigrations for columns that don't exist yet
+func addMissingColumns(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", m.table, m.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition))
+		if err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %v", m.table, m.column, err)
+		}
+	}
+	return nil
 }
 
-func runPipeline(filePath string) error {
+// defaultSecretKeyFile is where the master key is kept unless given otherwise
+const defaultSecretKeyFile = "./testdata/data/secret.key"
+
+// secretCipher returns the cipher for the master key of --secret-key, or of
+// the key file
+func secretCipher(c *cli.Context) (*secrets.Cipher, error) {
+	var key []byte
+	var err error
+	if encoded := c.String("secret-key"); encoded != "" {
+		key, err = secrets.ParseKey(encoded)
+	} else {
+		key, err = secrets.LoadKey(c.String("secret-key-file"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the master key: %v", err)
+	}
+	return secrets.NewCipher(key)
+}
+
+// parseUlimits decodes ulimits given as name=soft:hard, or name=limit for the
+// same soft and hard limit
+func parseUlimits(values []string) (map[string]models.UlimitConfig, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	ulimits := make(map[string]models.UlimitConfig, len(values))
+	for _, value := range values {
+		ulimit, err := units.ParseUlimit(value)
+		if err != nil {
+			return nil, err
+		}
+		ulimits[ulimit.Name] = models.UlimitConfig{Soft: ulimit.Soft, Hard: ulimit.Hard}
+	}
+	return ulimits, nil
+}
+
+func runPipeline(filePath string, cipher *secrets.Cipher) error {
 	// Connect DB
 	db, err := sqlx.Connect("sqlite3", "./testdata/data/ci.db")
 	if err != nil {
@@ -243,125 +813,74 @@ func runPipeline(filePath string) error {
 	if err != nil {
 		return err
 	}
+	err = config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid pipeline config: %v", err)
+	}
 
 	// Create pipeline
 	pipeline := models.Pipeline{
 		Name:   config.Name,
 		Config: string(data),
 	}
-	query := `INSERT INTO pipelines (name, config) VALUES (?, ?)`
-	result, err := db.Exec(query, pipeline.Name, pipeline.Config)
+	pipeline.Retention, err = config.RetentionJSON()
 	if err != nil {
 		return err
 	}
-	pipelineID, _ := result.LastInsertId()
-
-	// Create job
-	job := models.Job{
-		PipelineID: int(pipelineID),
-		Status:     "pending",
-	}
-	if config.Branch != "" {
-		job.Branch = &config.Branch
-	}
-	if config.RepoName != "" {
-		job.RepoName = &config.RepoName
-	}
-	if config.RepoURL != "" {
-		job.RepoURL = &config.RepoURL
-	}
-	if config.Language != "" {
-		job.Language = &config.Language
-	}
-	if config.Version != "" {
-		job.Version = &config.Version
-	}
-	if config.Folder != "" {
-		job.Folder = &config.Folder
+	query := `INSERT INTO pipelines (name, config, retention) VALUES (?, ?, ?)`
+	result, err := db.Exec(query, pipeline.Name, pipeline.Config, pipeline.Retention)
+	if err != nil {
+		return err
 	}
-	if config.ExposePorts {
-		job.ExposePorts = &config.ExposePorts
+	pipelineID, _ := result.LastInsertId()
+	secretNames, err := api.SecretNames(db, int(pipelineID))
+	if err != nil {
+		return err
 	}
-	if config.Temporary {
-		job.Temporary = &config.Temporary
+	if err := config.ValidateSecrets(secretNames); err != nil {
+		return fmt.Errorf("invalid pipeline config: %v", err)
 	}
-	query = `INSERT INTO jobs (pipeline_id, status, branch, repo_name, repo_url, language, version, folder, expose_ports, temporary) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-	result, err = db.Exec(query, job.PipelineID, job.Status, job.Branch, job.RepoName, job.RepoURL, job.Language, job.Version, job.Folder, job.ExposePorts, job.Temporary)
+
+	// Create jobs, one per matrix combination if the pipeline has a matrix
+	run, jobs, err := api.CreateJobs(db, int(pipelineID), config, models.TriggerCLI, "")
 	if err != nil {
 		return err
 	}
-	jobID, _ := result.LastInsertId()
-
-	// Create steps
-	for i, step := range config.Steps {
-		result, err := db.Exec(`INSERT INTO steps (job_id, order_num, type, content, status) VALUES (?, ?, ?, ?, ?)`, jobID, i+1, step.Type, step.Content, "pending")
-		if err != nil {
-			return err
-		}
-		stepID, _ := result.LastInsertId()
-		// Insert files
-		for name, content := range step.Files {
-			_, err = db.Exec(`INSERT INTO files (step_id, name, content) VALUES (?, ?, ?)`, stepID, name, content)
-			if err != nil {
-				return err
-			}
-		}
+	if run != nil {
+		log.Printf("Pipeline created and matrix run %d queued with %d jobs", run.ID, len(jobs))
+	} else {
+		log.Printf("Pipeline created and job %d queued", jobs[0].ID)
 	}
 
-	// Create env
-	for k, v := range config.Env {
-		_, err = db.Exec(`INSERT INTO environments (job_id, key, value) VALUES (?, ?, ?)`, jobID, k, v)
-		if err != nil {
-			return err
-		}
+	// Start worker and run the jobs synchronously. The pipeline file comes
+	// from whoever runs the command, so its jobs may run locally.
+	workerConfig := worker.DefaultConfig()
+	workerConfig.AllowLocalExecutor = true
+	workerConfig.Secrets = cipher
+	w, err := worker.NewWorkerWithConfig(db, workerConfig)
+	if err != nil {
+		return err
 	}
-
-	// Create runnables
-	for _, runnable := range config.Runnables {
-		if !runnable.Enabled {
-			continue // Skip disabled runnables
-		}
-
-		configJSON, err := json.Marshal(runnable)
-		if err != nil {
-			return err
-		}
-
-		result, err := db.Exec(`INSERT INTO runnables (job_id, name, type, config, status) VALUES (?, ?, ?, ?, ?)`,
-			jobID, runnable.Name, runnable.Type, string(configJSON), "pending")
+	// Events are delivered by the server, once one runs on this database
+	for _, job := range jobs {
+		w.PublishJob(job.ID)
+	}
+	var failed []int
+	for _, job := range jobs {
+		log.Printf("Running job %d", job.ID)
+		err = w.RunJob(job.ID)
 		if err != nil {
-			return err
-		}
-
-		runnableID, _ := result.LastInsertId()
-
-		// Create deployments for this runnable
-		for _, output := range runnable.Outputs {
-			outputConfigJSON, err := json.Marshal(output.Config)
-			if err != nil {
-				return err
-			}
-
-			_, err = db.Exec(`INSERT INTO deployments (runnable_id, output_type, config, status) VALUES (?, ?, ?, ?)`,
-				runnableID, output.Type, string(outputConfigJSON), "pending")
-			if err != nil {
+			log.Printf("Error running job %d: %v", job.ID, err)
+			db.Exec("UPDATE jobs SET status = 'failed' WHERE id = ?", job.ID)
+			w.PublishJob(job.ID)
+			if run == nil {
 				return err
 			}
+			failed = append(failed, job.ID)
 		}
 	}
-
-	log.Printf("Pipeline created and job %d queued", jobID)
-
-	// Start worker and run job synchronously
-	w, err := worker.NewWorker(db)
-	if err != nil {
-		return err
-	}
-	err = w.RunJob(int(jobID))
-	if err != nil {
-		log.Printf("Error running job %d: %v", jobID, err)
-		db.Exec("UPDATE jobs SET status = 'failed' WHERE id = ?", jobID)
-		return err
+	if len(failed) > 0 {
+		return fmt.Errorf("matrix run %d: jobs %v failed", run.ID, failed)
 	}
 
 	return nil
@@ -429,7 +948,7 @@ func stopPipeline(pipelineID int) error {
 		}
 
 		// Clean up main job container and temp directory
-		w.CleanupJobResources(job.ID, containerID, tempDir)
+		w.CleanupJobResources(job, containerID, tempDir)
 
 		// Update job status
 		db.Exec("UPDATE jobs SET status = 'stopped', finished_at = CURRENT_TIMESTAMP WHERE id = ?", job.ID)
@@ -496,3 +1015,21 @@ func listPipelines() error {
 
 	return nil
 }
+
+func runAgent(c *cli.Context) error {
+	agent, err := worker.NewAgent(worker.AgentConfig{
+		ServerURL:          c.String("server"),
+		Token:              c.String("token"),
+		Name:               c.String("name"),
+		AllowLocalExecutor: c.Bool("allow-local-executor"),
+		Labels:             c.StringSlice("labels"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stop on SIGINT/SIGTERM, reporting a running job as interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return agent.Run(ctx)
+}